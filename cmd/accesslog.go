@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A log file that starts over when it gets too big or too old. The full one
+// is kept next to it, with the time it was rotated in its name, e.g.,
+// access-20261014T191500.log, until it is older than the retention.
+type RotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	keep     time.Duration
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, keep time.Duration) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return f, f.open()
+}
+
+// Opens the file to append to it. A file left by a previous run is
+// continued, and counts as opened when it was last written to.
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.openedAt = file, info.Size(), time.Now()
+	if info.Size() > 0 {
+		f.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tooBig := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	tooOld := f.maxAge > 0 && time.Since(f.openedAt) >= f.maxAge
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// The file of a rotated log, e.g., access-20261014T191500.log for
+// access.log
+func (f *RotatingFile) rotatedName(t time.Time) string {
+	ext := filepath.Ext(f.path)
+	return strings.TrimSuffix(f.path, ext) + "-" + t.UTC().Format("20060102T150405") + ext
+}
+
+// The pattern matching all the rotated logs
+func (f *RotatingFile) rotatedPattern() string {
+	ext := filepath.Ext(f.path)
+	return strings.TrimSuffix(f.path, ext) + "-*" + ext
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, f.rotatedName(time.Now())); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	// Removing the old ones may fail, the log goes on anyway
+	if f.keep > 0 {
+		paths, _ := filepath.Glob(f.rotatedPattern())
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > f.keep {
+				os.Remove(path)
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	accessOnce   sync.Once
+	accessShared *slog.Logger
+	accessErr    error
+)
+
+// The access log of the deployment, shared by the libraries of all tenants:
+// a line of JSON per request, in the file of ACCESS_LOG_FILE, which is
+// rotated once it has ACCESS_LOG_MAX_MB megabytes or ACCESS_LOG_ROTATE_HOURS
+// hours, and whose rotated files are removed after ACCESS_LOG_KEEP_DAYS days.
+// Without a file there is none, and the requests are only in the log (see
+// requestLogger).
+func accessLogFor(cfg Config) (*slog.Logger, error) {
+	accessOnce.Do(func() {
+		if cfg.AccessLogFile == "" {
+			return
+		}
+		file, err := openRotatingFile(cfg.AccessLogFile,
+			int64(cfg.AccessLogMaxMB)<<20,
+			time.Duration(cfg.AccessLogRotateHours)*time.Hour,
+			time.Duration(cfg.AccessLogKeepDays)*24*time.Hour)
+		if err != nil {
+			accessErr = err
+			return
+		}
+		accessShared = slog.New(slog.NewJSONHandler(file, nil))
+	})
+	return accessShared, accessErr
+}
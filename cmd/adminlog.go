@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Next to the audit log, which records every change to the books and
+// everything around them, the admin log records the few changes that grant
+// or take access, or can't be undone: who changed the role of a user,
+// created or revoked an API key, turned off the second factor or ended the
+// sessions of somebody,
+// merged books, changed the settings of the library or the level of the
+// logs. It is kept apart, so it stays short enough to actually read, and
+// only the admins see it.
+type AdminAction struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	ActionName    string             `bson:"actionname"`
+	ActionActor   string             `bson:"actionactor"`
+	ActionIP      string             `bson:"actionip"`
+	ActionTarget  string             `bson:"actiontarget"`
+	ActionDetails bson.M             `bson:"actiondetails,omitempty"`
+	ActionTime    time.Time          `bson:"actiontime"`
+}
+
+const (
+	AdminRoleChange     = "role-change"
+	AdminKeyCreate      = "key-create"
+	AdminKeyRevoke      = "key-revoke"
+	AdminTOTPReset      = "2fa-reset"
+	AdminSessionsRevoke = "sessions-revoke"
+	AdminBooksMerge     = "books-merge"
+	AdminTenantCreate   = "tenant-create"
+	AdminTenantUpdate   = "tenant-update"
+	AdminTenantToken    = "tenant-token"
+	AdminLogLevel       = "log-level"
+)
+
+type AdminLog struct {
+	coll *Repository
+}
+
+func adminActionToMap(a AdminAction) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      a.ID.Hex(),
+		"action":  a.ActionName,
+		"actor":   a.ActionActor,
+		"ip":      a.ActionIP,
+		"target":  a.ActionTarget,
+		"details": a.ActionDetails,
+		"time":    formatTimestamp(a.ActionTime),
+	}
+}
+
+// Records an action of the request. The action already happened, so failing
+// to record it is only logged.
+func (l *AdminLog) Record(c echo.Context, action string, target string, details bson.M) {
+	entry := AdminAction{
+		ID:            primitive.NewObjectID(),
+		ActionName:    action,
+		ActionActor:   actorFrom(c.Request().Context()),
+		ActionIP:      c.RealIP(),
+		ActionTarget:  target,
+		ActionDetails: details,
+		ActionTime:    time.Now().UTC(),
+	}
+	if _, err := l.coll.InsertOne(context.TODO(), entry); err != nil {
+		loggerFrom(c.Request().Context()).Error("failed to record admin action", "action", action, "target", target, "err", err)
+	}
+}
+
+// Registers the endpoint for the admins to read the admin log, newest first.
+// Like the audit log, it can be narrowed down to an action and a date range,
+// e.g., /api/admin/log?action=role-change&from=2024-05-01.
+func registerAdminLogRoutes(e *echo.Echo, l *AdminLog) {
+	e.GET("/api/admin/log", func(c echo.Context) error {
+		query := newQuery("actionname")
+		if value := c.QueryParam("action"); value != "" {
+			query.Eq("actionname", value)
+		}
+		filter, err := query.Filter()
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		period, msg := dateRangeFilter(c, "actiontime")
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+		for k, v := range period {
+			filter[k] = v
+		}
+
+		limit := int64(100)
+		if value := c.QueryParam("limit"); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 1 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+			}
+			limit = n
+		}
+
+		opts := options.Find().SetSort(bson.D{{Key: "actiontime", Value: -1}}).SetLimit(limit)
+		cursor, err := l.coll.Find(context.TODO(), filter, opts)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list admin log"})
+		}
+		var results []AdminAction
+		if err = cursor.All(context.TODO(), &results); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list admin log"})
+		}
+
+		ret := []map[string]interface{}{}
+		for _, a := range results {
+			ret = append(ret, adminActionToMap(a))
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+}
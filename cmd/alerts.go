@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// How often the watchdog looks at the errors
+const alertTick = 10 * time.Second
+
+// Watches the answers with a 5xx status and the failures of the database
+// (commands that failed, or no connection to be had) over the last minutes,
+// and posts an alert to ALERT_WEBHOOK_URL when there are too many of either.
+// The message is the {"text": "..."} of the incoming webhooks of Slack,
+// which Mattermost, Rocket.Chat and Discord (at its /slack URL) take too.
+// After an alert, the watchdog keeps quiet for a while, so a long outage
+// gives a message now and then rather than one every few seconds.
+type Watchdog struct {
+	url           string
+	service       string
+	profile       string
+	serverErrors  int64
+	mongoFailures int64
+	window        time.Duration
+	cooldown      time.Duration
+	client        *http.Client
+
+	// What was counted at every tick of the window, the oldest being
+	// overwritten by the newest, and the totals at the last one
+	ticks      [][2]int64
+	next       int
+	lastServer int64
+	lastMongo  int64
+	quietUntil time.Time
+}
+
+// The watchdog, or nil without ALERT_WEBHOOK_URL
+func newWatchdog(cfg Config) *Watchdog {
+	if cfg.AlertWebhookURL == "" {
+		return nil
+	}
+	window := time.Duration(max(cfg.AlertWindowMinutes, 1)) * time.Minute
+	return &Watchdog{
+		url:           cfg.AlertWebhookURL,
+		service:       cfg.ServiceName,
+		profile:       cfg.Profile,
+		serverErrors:  int64(cfg.AlertServerErrors),
+		mongoFailures: int64(cfg.AlertMongoFailures),
+		window:        window,
+		cooldown:      time.Duration(cfg.AlertCooldownMinutes) * time.Minute,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		ticks:         make([][2]int64, window/alertTick),
+		lastServer:    routeMetrics.ServerErrors(),
+		lastMongo:     mongoStats.commandFailures.Load() + mongoStats.checkoutFailures.Load(),
+	}
+}
+
+// Counts the errors since the last tick, and alerts if the window has more
+// than the thresholds allow, 0 meaning no limit. It runs every alertTick
+// (see main).
+func (w *Watchdog) Check() error {
+	server := routeMetrics.ServerErrors()
+	mongo := mongoStats.commandFailures.Load() + mongoStats.checkoutFailures.Load()
+	w.ticks[w.next] = [2]int64{server - w.lastServer, mongo - w.lastMongo}
+	w.next = (w.next + 1) % len(w.ticks)
+	w.lastServer, w.lastMongo = server, mongo
+
+	var inWindow [2]int64
+	for _, t := range w.ticks {
+		inWindow[0] += t[0]
+		inWindow[1] += t[1]
+	}
+	var reasons []string
+	if w.serverErrors > 0 && inWindow[0] >= w.serverErrors {
+		reasons = append(reasons, fmt.Sprintf("%d requests answered with a server error", inWindow[0]))
+	}
+	if w.mongoFailures > 0 && inWindow[1] >= w.mongoFailures {
+		reasons = append(reasons, fmt.Sprintf("%d failures of the database", inWindow[1]))
+	}
+	if len(reasons) == 0 || time.Now().Before(w.quietUntil) {
+		return nil
+	}
+	w.quietUntil = time.Now().Add(w.cooldown)
+	return w.alert(reasons)
+}
+
+func (w *Watchdog) alert(reasons []string) error {
+	hostname, _ := os.Hostname()
+	text := fmt.Sprintf(":rotating_light: *%s* (%s, on %s): in the last %s,", w.service, w.profile, hostname, w.window)
+	for i, reason := range reasons {
+		if i > 0 {
+			text += " and"
+		}
+		text += " " + reason
+	}
+	slog.Warn("sending alert", "text", text)
+
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	res, err := w.client.Post(w.url, echo.MIMEApplicationJSON, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("the webhook answered %s", res.Status)
+	}
+	return nil
+}
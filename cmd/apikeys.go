@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A key for a service using the API, e.g., the catalogue of a school or a
+// script importing books, sent along as the X-API-Key header. Like with the
+// passwords, we only store a hash of the key, plus its first characters so
+// people can tell the keys apart.
+type APIKey struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	KeyName     string             `json:"name" form:"name"`
+	KeyPrefix   string             `json:"-" form:"-"`
+	KeyHash     string             `json:"-" form:"-"`
+	KeyCreator  string             `json:"-" form:"-"`
+	KeyUses     int64              `json:"-" form:"-"`
+	KeyLastUsed *time.Time         `json:"-" form:"-" bson:",omitempty"`
+	KeyRevoked  *time.Time         `json:"-" form:"-" bson:",omitempty"`
+	CreatedAt   time.Time          `json:"-" form:"-" bson:"createdat,omitempty"`
+	UpdatedAt   time.Time          `json:"-" form:"-" bson:"updatedat,omitempty"`
+}
+
+const (
+	apiKeyHeader = "X-API-Key"
+	// Every key starts like this, which makes them easy to spot, e.g., when
+	// somebody pushes one to a repository by accident
+	apiKeyStart = "lib_"
+)
+
+func apiKeyToMap(k APIKey) map[string]interface{} {
+	ret := map[string]interface{}{
+		"id":        k.ID.Hex(),
+		"name":      k.KeyName,
+		"prefix":    k.KeyPrefix,
+		"creator":   k.KeyCreator,
+		"uses":      k.KeyUses,
+		"lastUsed":  "",
+		"revoked":   "",
+		"createdAt": formatTimestamp(k.CreatedAt),
+		"updatedAt": formatTimestamp(k.UpdatedAt),
+	}
+	if k.KeyLastUsed != nil {
+		ret["lastUsed"] = k.KeyLastUsed.Format(time.RFC3339)
+	}
+	if k.KeyRevoked != nil {
+		ret["revoked"] = k.KeyRevoked.Format(time.RFC3339)
+	}
+	return ret
+}
+
+func newAPIKey() (string, error) {
+	data := make([]byte, 24)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return apiKeyStart + hex.EncodeToString(data), nil
+}
+
+// Middleware letting the requests with a valid key through, as if they came
+// from a member of the staff: the key itself, with its name and prefix showing up in the
+// audit log. Every use is counted.
+func apiKeyAuth(coll *Repository) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			value := c.Request().Header.Get(apiKeyHeader)
+			if value == "" {
+				return next(c)
+			}
+
+			var key APIKey
+			filter := bson.M{"keyhash": hashToken(value), "keyrevoked": bson.M{"$exists": false}}
+			if err := coll.FindOne(context.TODO(), filter).Decode(&key); err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid api key"})
+			}
+			update := bson.M{"$inc": bson.M{"keyuses": 1}, "$set": bson.M{"keylastused": time.Now().UTC()}}
+			if _, err := coll.UpdateOne(context.TODO(), bson.M{"_id": key.ID}, update); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to check api key"})
+			}
+
+			setUser(c, User{ID: key.ID, UserName: key.KeyName, UserEmail: "key:" + key.KeyPrefix, UserRole: RoleStaff})
+			return next(c)
+		}
+	}
+}
+
+// Registers the endpoints for the admins to manage the keys.
+func registerAPIKeyRoutes(e *echo.Echo, admin *AdminLog, coll *Repository) {
+	e.GET("/api/keys", func(c echo.Context) error {
+		opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}})
+		cursor, err := coll.Find(context.TODO(), bson.D{}, opts)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list api keys"})
+		}
+		var results []APIKey
+		if err = cursor.All(context.TODO(), &results); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list api keys"})
+		}
+
+		ret := []map[string]interface{}{}
+		for _, k := range results {
+			ret = append(ret, apiKeyToMap(k))
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	// The response holds the key, which is the only time it is shown
+	e.POST("/api/keys", func(c echo.Context) error {
+		key := new(APIKey)
+		if err := c.Bind(key); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		key.KeyName = strings.TrimSpace(key.KeyName)
+		if key.KeyName == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "name is required"})
+		}
+
+		value, err := newAPIKey()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create api key"})
+		}
+		user, _ := currentUser(c)
+		key.ID = primitive.NewObjectID()
+		key.KeyPrefix = value[:len(apiKeyStart)+6]
+		key.KeyHash = hashToken(value)
+		key.KeyCreator = user.UserEmail
+		if _, err = coll.InsertOne(c.Request().Context(), key); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert api key"})
+		}
+
+		admin.Record(c, AdminKeyCreate, key.KeyPrefix, bson.M{"name": key.KeyName})
+		ret := apiKeyToMap(*key)
+		ret["key"] = value
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	// Revoked keys stop working right away, but we keep them around with
+	// their counters
+	e.DELETE("/api/keys/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		filter := bson.M{"_id": id, "keyrevoked": bson.M{"$exists": false}}
+		result, err := coll.UpdateOne(c.Request().Context(), filter, bson.M{"$set": bson.M{"keyrevoked": time.Now().UTC()}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to revoke api key"})
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "api key not found"})
+		}
+		admin.Record(c, AdminKeyRevoke, id.Hex(), nil)
+		return c.JSON(http.StatusOK, result)
+	})
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+)
+
+// Who a book is written for. Books without an audience are for anybody.
+const (
+	AudienceChildren = "children"
+	AudienceYA       = "ya"
+	AudienceAdult    = "adult"
+)
+
+var audiences = []string{AudienceChildren, AudienceYA, AudienceAdult}
+
+// Lowercases the audience and checks it is one we know. An empty audience
+// is fine, it is optional.
+func normalizeAudience(value string) (string, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return "", true
+	}
+	for _, a := range audiences {
+		if value == a {
+			return value, true
+		}
+	}
+	return value, false
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// An entry of the audit log, i.e., a record of a single write to the
+// database: who did it, when, and how the document looked before and after.
+// Creations have no "before" and deletions no "after".
+type AuditEntry struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty"`
+	AuditCollection string             `bson:"auditcollection"`
+	AuditAction     string             `bson:"auditaction"`
+	AuditRecord     interface{}        `bson:"auditrecord"`
+	AuditBook       primitive.ObjectID `bson:"auditbook,omitempty"`
+	AuditActor      string             `bson:"auditactor"`
+	AuditTime       time.Time          `bson:"audittime"`
+	AuditChanges    []string           `bson:"auditchanges"`
+	AuditBefore     bson.M             `bson:"auditbefore,omitempty"`
+	AuditAfter      bson.M             `bson:"auditafter,omitempty"`
+}
+
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// The key under which the request context carries who is making the request.
+type actorKey struct{}
+
+// Remembers who is making the request, so the audit log can tell. That is
+// why the handlers pass the request context to their writes, instead of
+// context.TODO(). Writes done outside of a request, e.g., by the background
+// jobs, show up as "system".
+func auditActor(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := context.WithValue(c.Request().Context(), actorKey{}, c.RealIP())
+		c.SetRequest(c.Request().WithContext(ctx))
+		return next(c)
+	}
+}
+
+func actorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return "system"
+}
+
+// Returns the fields that differ between the two versions of a document.
+// The update timestamp changes every time, so it is not worth listing.
+func changedFields(before bson.M, after bson.M) []string {
+	changes := []string{}
+	for k, v := range after {
+		if k != "updatedat" && !reflect.DeepEqual(before[k], v) {
+			changes = append(changes, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			changes = append(changes, k)
+		}
+	}
+	return changes
+}
+
+// Reads the documents matching the filter as they are right now, so we can
+// compare them once the write went through.
+func (r *Repository) snapshot(ctx context.Context, filter interface{}, one bool) []bson.M {
+	if r.audit == nil {
+		return nil
+	}
+	opts := options.Find()
+	if one {
+		opts.SetLimit(1)
+	}
+	cursor, err := r.Collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil
+	}
+	var docs []bson.M
+	cursor.All(ctx, &docs)
+	return docs
+}
+
+func (r *Repository) findByID(ctx context.Context, id interface{}) bson.M {
+	if r.audit == nil {
+		return nil
+	}
+	var doc bson.M
+	if err := r.Collection.FindOne(ctx, bson.M{"_id": id}).Decode(&doc); err != nil {
+		return nil
+	}
+	return doc
+}
+
+// Records a write in the audit log. Failing to do so is logged, but does not
+// fail the write itself, which already happened anyway.
+func (r *Repository) record(ctx context.Context, action string, before bson.M, after bson.M) {
+	if r.audit == nil {
+		return
+	}
+	doc := after
+	if doc == nil {
+		doc = before
+	}
+	if doc == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		AuditCollection: r.Name(),
+		AuditAction:     action,
+		AuditRecord:     doc["_id"],
+		AuditActor:      actorFrom(ctx),
+		AuditTime:       time.Now().UTC(),
+		AuditChanges:    changedFields(before, after),
+		AuditBefore:     before,
+		AuditAfter:      after,
+	}
+	// Most records belong to a book, which is what people usually look for
+	if book, ok := doc["bookid"].(primitive.ObjectID); ok {
+		entry.AuditBook = book
+	}
+	if r.Name() == booksCollection {
+		entry.AuditBook, _ = doc["_id"].(primitive.ObjectID)
+	}
+	if _, err := r.audit.InsertOne(context.TODO(), entry); err != nil {
+		loggerFrom(ctx).Error("failed to record write", "action", action, "collection", r.Name(), "err", err)
+	}
+}
+
+// Records the writes to all the documents the filter matched before. The
+// ones that are gone when we look again were deleted.
+func (r *Repository) recordAll(ctx context.Context, action string, before []bson.M) {
+	for _, b := range before {
+		var after bson.M
+		if action != AuditDelete {
+			if after = r.findByID(ctx, b["_id"]); after == nil {
+				continue
+			}
+			if len(changedFields(b, after)) == 0 {
+				continue
+			}
+		}
+		r.record(ctx, action, b, after)
+	}
+}
+
+// The filter of the audit log from the query, which may narrow it down to
+// a book, a collection or a single record of one, an action, who did it
+// (regardless of case) and a date range (both ends included), e.g.,
+// ?book=<id>&actor=jane@example.com&from=2024-05-01&to=2024-05-31. The
+// failed logins (the "logins" collection, see lockout.go) are only shown to
+// the admins. If the query doesn't make sense, the message says why.
+func auditFilter(c echo.Context) (bson.M, int, string) {
+	query := newQuery("auditcollection", "auditbook", "auditaction", "auditrecord", "auditactor")
+	user, _ := currentUser(c)
+	if !can(user, PermUsersManage) {
+		if c.QueryParam("collection") == loginsCollection {
+			return nil, http.StatusForbidden, "admin only"
+		}
+		query.Where("auditcollection", "$ne", loginsCollection)
+	}
+	if value := c.QueryParam("book"); value != "" {
+		book, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			return nil, http.StatusBadRequest, "invalid book id"
+		}
+		query.Eq("auditbook", book)
+	}
+	if value := c.QueryParam("collection"); value != "" {
+		query.Eq("auditcollection", value)
+	}
+	// Most records have an ObjectID, the others, e.g., the logins, a string
+	if value := c.QueryParam("record"); value != "" {
+		if id, err := primitive.ObjectIDFromHex(value); err == nil {
+			query.Eq("auditrecord", id)
+		} else {
+			query.Eq("auditrecord", value)
+		}
+	}
+	if value := c.QueryParam("action"); value != "" {
+		query.Eq("auditaction", value)
+	}
+	if value := c.QueryParam("actor"); value != "" {
+		query.Match("auditactor", value)
+	}
+	filter, err := query.Filter()
+	if err != nil {
+		return nil, http.StatusBadRequest, err.Error()
+	}
+
+	period, msg := dateRangeFilter(c, "audittime")
+	if msg != "" {
+		return nil, http.StatusBadRequest, msg
+	}
+	for k, v := range period {
+		filter[k] = v
+	}
+	return filter, 0, ""
+}
+
+// The entries of the audit log matching the filter, newest first, on the
+// page if there is one
+func findAudit(ctx context.Context, coll *Repository, filter bson.M, page *Page) ([]AuditEntry, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "audittime", Value: -1}, {Key: "_id", Value: -1}})
+	if page != nil {
+		page.Apply(opts)
+	}
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []AuditEntry
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func auditToMap(a AuditEntry) map[string]interface{} {
+	book := ""
+	if !a.AuditBook.IsZero() {
+		book = a.AuditBook.Hex()
+	}
+	record := a.AuditRecord
+	if id, ok := record.(primitive.ObjectID); ok {
+		record = id.Hex()
+	}
+	return map[string]interface{}{
+		"id":         a.ID.Hex(),
+		"collection": a.AuditCollection,
+		"action":     a.AuditAction,
+		"record":     record,
+		"book":       book,
+		"actor":      a.AuditActor,
+		"time":       a.AuditTime.Format(time.RFC3339),
+		"changes":    a.AuditChanges,
+		"before":     a.AuditBefore,
+		"after":      a.AuditAfter,
+	}
+}
+
+// The filters of the audit log, as the query has them
+var auditParams = []string{"book", "collection", "record", "action", "actor", "from", "to"}
+
+// Registers the endpoint to browse the audit log, with the filters of
+// auditFilter, a page at a time: /api/audit?page=2&size=50, 100 entries by
+// default. X-Total-Count tells how many match on all the pages together.
+// The entries hold whole records, e.g., the emails and addresses of the
+// members, so only the admins read them (see policies.go). They also have a
+// page to browse it at /admin/audit, and can download
+// what they see at /admin/audit/export?format=csv (or xlsx), all the pages
+// of it.
+func registerAuditRoutes(e *echo.Echo, coll *Repository) {
+	e.GET("/api/audit", func(c echo.Context) error {
+		filter, status, msg := auditFilter(c)
+		if msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		page := Page{Number: 1, Size: 100}
+		if n, err := strconv.Atoi(c.QueryParam("page")); err == nil && n > 0 {
+			page.Number = n
+		}
+		// limit is what the size was called before there were pages
+		for _, name := range []string{"limit", "size"} {
+			if value := c.QueryParam(name); value != "" {
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid " + name})
+				}
+				page.Size = n
+			}
+		}
+		total, err := coll.CountDocuments(c.Request().Context(), filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list audit log"})
+		}
+
+		results, err := findAudit(c.Request().Context(), coll, filter, &page)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list audit log"})
+		}
+		ret := []map[string]interface{}{}
+		for _, a := range results {
+			ret = append(ret, auditToMap(a))
+		}
+		c.Response().Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	e.GET("/admin/audit", func(c echo.Context) error {
+		filter, status, msg := auditFilter(c)
+		if msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+		page, err := paginate(coll, filter, pageFrom(c))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list audit log"})
+		}
+		results, err := findAudit(c.Request().Context(), coll, filter, &page)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list audit log"})
+		}
+		collections, err := coll.Distinct(c.Request().Context(), "auditcollection", bson.M{})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list audit log"})
+		}
+
+		entries := []map[string]interface{}{}
+		for _, a := range results {
+			entry := auditToMap(a)
+			entry["time"] = a.AuditTime.Format(time.DateTime)
+			entries = append(entries, entry)
+		}
+		query := url.Values{}
+		data := map[string]interface{}{}
+		for _, name := range auditParams {
+			if value := c.QueryParam(name); value != "" {
+				query.Set(name, value)
+			}
+			data[name] = c.QueryParam(name)
+		}
+		data["entries"] = entries
+		data["collections"] = collections
+		data["actions"] = []string{AuditCreate, AuditUpdate, AuditDelete}
+		data["page"] = page.toMap("/admin/audit", "#audit-filters")
+		data["exports"] = exportLinks("/admin/audit/export", query)
+		return c.Render(http.StatusOK, "admin-audit", data)
+	})
+
+	e.GET("/admin/audit/export", func(c echo.Context) error {
+		filter, status, msg := auditFilter(c)
+		if msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+		results, err := findAudit(c.Request().Context(), coll, filter, nil)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list audit log"})
+		}
+		t := exportTable{name: "audit", header: []string{"Time", "Actor", "Action", "Collection", "Record", "Book", "Changes"}}
+		for _, a := range results {
+			m := auditToMap(a)
+			t.rows = append(t.rows, []interface{}{m["time"], a.AuditActor, a.AuditAction, a.AuditCollection, fmt.Sprint(m["record"]), m["book"], strings.Join(a.AuditChanges, ", ")})
+		}
+		return sendExport(c, t)
+	})
+}
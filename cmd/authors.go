@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How long the details fetched from Wikidata are kept before we ask again.
+const authorRefresh = 30 * 24 * time.Hour
+
+// What we know about the life of an author. Years are 0 when unknown.
+type AuthorInfo struct {
+	Bio      string `json:"bio" form:"bio" bson:"bio,omitempty"`
+	Born     int    `json:"born" form:"born" bson:"born,omitempty"`
+	Died     int    `json:"died" form:"died" bson:"died,omitempty"`
+	Portrait string `json:"portrait" form:"portrait" bson:"portrait,omitempty"`
+}
+
+// An author of the books in the catalogue, matched to the books by name.
+// The details are fetched from Wikidata, but anything set in the override
+// wins, for when Wikidata picked the wrong person or we know better.
+type Author struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty"`
+	AuthorName     string             `bson:"authorname"`
+	AuthorWikidata string             `bson:"authorwikidata,omitempty"`
+	AuthorFetched  time.Time          `bson:"authorfetched,omitempty"`
+	AuthorInfo     AuthorInfo         `bson:"authorinfo,omitempty"`
+	AuthorOverride AuthorInfo         `bson:"authoroverride,omitempty"`
+	CreatedAt      time.Time          `bson:"createdat,omitempty"`
+	UpdatedAt      time.Time          `bson:"updatedat,omitempty"`
+}
+
+// The details to show, the fetched ones filled in with the overrides.
+func (a Author) Info() AuthorInfo {
+	info := a.AuthorInfo
+	if a.AuthorOverride.Bio != "" {
+		info.Bio = a.AuthorOverride.Bio
+	}
+	if a.AuthorOverride.Born != 0 {
+		info.Born = a.AuthorOverride.Born
+	}
+	if a.AuthorOverride.Died != 0 {
+		info.Died = a.AuthorOverride.Died
+	}
+	if a.AuthorOverride.Portrait != "" {
+		info.Portrait = a.AuthorOverride.Portrait
+	}
+	return info
+}
+
+func authorToMap(a Author) map[string]interface{} {
+	info := a.Info()
+	wikidata := ""
+	if a.AuthorWikidata != "" {
+		wikidata = "https://www.wikidata.org/wiki/" + a.AuthorWikidata
+	}
+	id := ""
+	if !a.ID.IsZero() {
+		id = a.ID.Hex()
+	}
+	return map[string]interface{}{
+		"id":       id,
+		"name":     a.AuthorName,
+		"bio":      info.Bio,
+		"born":     info.Born,
+		"died":     info.Died,
+		"portrait": info.Portrait,
+		"wikidata": wikidata,
+		"override": a.AuthorOverride,
+		"fetched":  formatTimestamp(a.AuthorFetched),
+	}
+}
+
+// Looks the author up by name, adding them the first time they are asked for.
+// Only syncAuthors does, for the authors of the books; visitors looking an
+// author up must not add anybody.
+func findOrCreateAuthor(ctx context.Context, coll *Repository, name string) (Author, error) {
+	var author Author
+	err := coll.FindOneAndUpdate(ctx,
+		bson.M{"authorname": name},
+		bson.M{"$setOnInsert": bson.M{"authorname": name}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&author)
+	return author, err
+}
+
+// Asks Wikidata (and Wikipedia, for the bio) about the authors. Wikidata has
+// many people sharing a name, so only those described as writers of some
+// sort are taken.
+type Wikidata struct {
+	client       *http.Client
+	wikidataURL  string
+	wikipediaURL string
+}
+
+func newWikidata(cfg Config) *Wikidata {
+	return &Wikidata{
+		client:       tracedClient(time.Duration(cfg.LookupTimeout) * time.Second),
+		wikidataURL:  cfg.WikidataURL,
+		wikipediaURL: cfg.WikipediaURL,
+	}
+}
+
+var writerPattern = regexp.MustCompile(`(?i)writer|author|novelist|poet|playwright|essayist|journalist|historian|philosopher`)
+
+func (w *Wikidata) get(ctx context.Context, from string, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, from, nil)
+	if err != nil {
+		return err
+	}
+	// Wikimedia asks clients to say who they are
+	req.Header.Set("User-Agent", "CAPS-Cloud-exercises/1.0 (library catalogue)")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(into)
+}
+
+// Returns the Wikidata id of the author, or "" when none matches.
+func (w *Wikidata) search(ctx context.Context, name string) (string, error) {
+	query := url.Values{"action": {"wbsearchentities"}, "search": {name}, "language": {"en"}, "type": {"item"}, "limit": {"10"}, "format": {"json"}}
+	var body struct {
+		Search []struct {
+			ID          string `json:"id"`
+			Description string `json:"description"`
+		} `json:"search"`
+	}
+	if err := w.get(ctx, w.wikidataURL+"/w/api.php?"+query.Encode(), &body); err != nil {
+		return "", err
+	}
+	for _, s := range body.Search {
+		if writerPattern.MatchString(s.Description) {
+			return s.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// Reads the year out of a Wikidata time, e.g., "+1952-03-11T00:00:00Z".
+func wikidataYear(value string) int {
+	sign := 1
+	if strings.HasPrefix(value, "-") {
+		sign = -1
+	}
+	year, _, _ := strings.Cut(strings.TrimLeft(value, "+-"), "-")
+	n, _ := strconv.Atoi(year)
+	return sign * n
+}
+
+// Fetches the details of the author with the given Wikidata id.
+func (w *Wikidata) details(ctx context.Context, id string) (AuthorInfo, error) {
+	type claim struct {
+		Mainsnak struct {
+			Datavalue struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"datavalue"`
+		} `json:"mainsnak"`
+	}
+	var body struct {
+		Entities map[string]struct {
+			Descriptions map[string]struct {
+				Value string `json:"value"`
+			} `json:"descriptions"`
+			Claims    map[string][]claim `json:"claims"`
+			Sitelinks map[string]struct {
+				Title string `json:"title"`
+			} `json:"sitelinks"`
+		} `json:"entities"`
+	}
+	if err := w.get(ctx, w.wikidataURL+"/wiki/Special:EntityData/"+url.PathEscape(id)+".json", &body); err != nil {
+		return AuthorInfo{}, err
+	}
+	entity, ok := body.Entities[id]
+	if !ok {
+		return AuthorInfo{}, fmt.Errorf("wikidata has no entity %s", id)
+	}
+
+	info := AuthorInfo{Bio: entity.Descriptions["en"].Value}
+	// P569 is the date of birth, P570 the date of death and P18 the image
+	year := func(property string) int {
+		var value struct {
+			Time string `json:"time"`
+		}
+		if claims := entity.Claims[property]; len(claims) > 0 && json.Unmarshal(claims[0].Mainsnak.Datavalue.Value, &value) == nil {
+			return wikidataYear(value.Time)
+		}
+		return 0
+	}
+	info.Born, info.Died = year("P569"), year("P570")
+	if claims := entity.Claims["P18"]; len(claims) > 0 {
+		var file string
+		if json.Unmarshal(claims[0].Mainsnak.Datavalue.Value, &file) == nil && file != "" {
+			info.Portrait = "https://commons.wikimedia.org/wiki/Special:FilePath/" + url.PathEscape(file) + "?width=300"
+		}
+	}
+
+	// The first paragraph of the Wikipedia article makes a better bio than
+	// the one-liner of Wikidata, when there is one
+	if link, ok := entity.Sitelinks["enwiki"]; ok {
+		var summary struct {
+			Extract string `json:"extract"`
+		}
+		title := url.PathEscape(strings.ReplaceAll(link.Title, " ", "_"))
+		if err := w.get(ctx, w.wikipediaURL+"/api/rest_v1/page/summary/"+title, &summary); err != nil {
+			loggerFrom(ctx).Warn("failed to fetch Wikipedia summary", "wikidata", id, "err", err)
+		} else if summary.Extract != "" {
+			info.Bio = summary.Extract
+		}
+	}
+	return info, nil
+}
+
+// Fetches the details of the author from Wikidata when we have none yet or
+// they are getting old, and stores them. On errors the author is returned
+// as it was, we can show what we have and try again later.
+func (w *Wikidata) Refresh(ctx context.Context, coll *Repository, author Author, force bool) Author {
+	if !force && !author.AuthorFetched.IsZero() && time.Since(author.AuthorFetched) < authorRefresh {
+		return author
+	}
+
+	id := author.AuthorWikidata
+	var err error
+	if id == "" {
+		id, err = w.search(ctx, author.AuthorName)
+	}
+	info := AuthorInfo{}
+	if err == nil && id != "" {
+		info, err = w.details(ctx, id)
+	}
+	if err != nil {
+		loggerFrom(ctx).Warn("failed to fetch author details", "author", author.AuthorName, "err", err)
+		return author
+	}
+
+	// An author Wikidata does not know is remembered too, so we don't ask
+	// for it on every visit
+	author.AuthorWikidata, author.AuthorInfo, author.AuthorFetched = id, info, time.Now().UTC()
+	set := bson.M{"authorwikidata": id, "authorinfo": info, "authorfetched": author.AuthorFetched}
+	if _, err = coll.UpdateOne(context.TODO(), bson.M{"_id": author.ID}, bson.M{"$set": set}); err != nil {
+		loggerFrom(ctx).Error("failed to store author details", "author", author.AuthorName, "err", err)
+	}
+	return author
+}
+
+// The authors of the books in circulation, by name, with how many books
+// they wrote. The database finds them with the "author" index (see
+// indexes.go). Those syncAuthors hasn't added yet have no id; their page
+// is found by name.
+func listAuthors(ctx context.Context, coll *Repository, books *Repository) ([]map[string]interface{}, error) {
+	results, err := countByAuthor(ctx, books)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(results))
+	for i, r := range results {
+		names[i] = r.Name
+	}
+	cursor, err := coll.Find(ctx, bson.M{"authorname": bson.M{"$in": names}})
+	if err != nil {
+		return nil, err
+	}
+	var known []Author
+	if err = cursor.All(ctx, &known); err != nil {
+		return nil, err
+	}
+	ids := map[string]string{}
+	for _, a := range known {
+		ids[a.AuthorName] = a.ID.Hex()
+	}
+
+	ret := []map[string]interface{}{}
+	for _, r := range results {
+		ret = append(ret, map[string]interface{}{"id": ids[r.Name], "author": r.Name, "books": r.Books})
+	}
+	return ret, nil
+}
+
+// How many books of each author are in circulation, by name
+type authorCount struct {
+	Name  string `bson:"_id"`
+	Books int    `bson:"books"`
+}
+
+func countByAuthor(ctx context.Context, books *Repository) ([]authorCount, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: statusFilter(bson.M{"bookauthor": bson.M{"$nin": bson.A{"", nil}}}, "")}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$bookauthor"},
+			{Key: "books", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	cursor, err := books.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []authorCount
+	err = cursor.All(ctx, &results)
+	return results, err
+}
+
+// How many authors a run of syncAuthors asks Wikidata about at most, so it
+// goes easy on Wikidata, and on us
+const authorSyncBatch = 20
+
+// Adds the authors of the books written since the last run, and fetches the
+// details of the authors we have none of yet, or old ones, from Wikidata.
+// It runs in the background (see Library.startJobs), so the pages never
+// wait for Wikidata, and only the books bring new authors in.
+func syncAuthors(ctx context.Context, wikidata *Wikidata, coll *Repository, books *Repository) error {
+	results, err := countByAuthor(ctx, books)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(results))
+	for i, r := range results {
+		names[i] = r.Name
+	}
+	known, err := coll.Distinct(ctx, "authorname", bson.M{"authorname": bson.M{"$in": names}})
+	if err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for _, name := range known {
+		if name, ok := name.(string); ok {
+			have[name] = true
+		}
+	}
+	for _, name := range names {
+		if !have[name] {
+			if _, err = findOrCreateAuthor(ctx, coll, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	stale := bson.M{"$or": bson.A{
+		bson.M{"authorfetched": bson.M{"$exists": false}},
+		bson.M{"authorfetched": bson.M{"$lt": time.Now().Add(-authorRefresh)}},
+	}}
+	cursor, err := coll.Find(ctx, stale, options.Find().SetLimit(authorSyncBatch))
+	if err != nil {
+		return err
+	}
+	var authors []Author
+	if err = cursor.All(ctx, &authors); err != nil {
+		return err
+	}
+	for _, a := range authors {
+		wikidata.Refresh(ctx, coll, a, false)
+	}
+	return nil
+}
+
+// Sums up the books of the author: how many there are, how many pages they
+// have together, and the years of the first and the latest one. Unknown
+// years (0) are left out of those.
+func authorStats(ctx context.Context, books *Repository, name string) (map[string]interface{}, error) {
+	knownYear := bson.D{{Key: "$cond", Value: bson.A{bson.D{{Key: "$gt", Value: bson.A{"$bookyear", 0}}}, "$bookyear", nil}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: statusFilter(bson.M{"bookauthor": name}, "")}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "books", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "pages", Value: bson.D{{Key: "$sum", Value: "$bookpages"}}},
+			{Key: "first", Value: bson.D{{Key: "$min", Value: knownYear}}},
+			{Key: "latest", Value: bson.D{{Key: "$max", Value: knownYear}}},
+		}}},
+	}
+	cursor, err := books.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Books  int `bson:"books"`
+		Pages  int `bson:"pages"`
+		First  int `bson:"first"`
+		Latest int `bson:"latest"`
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	stats := map[string]interface{}{"books": 0, "pages": 0, "first": 0, "latest": 0}
+	if len(results) > 0 {
+		r := results[0]
+		stats = map[string]interface{}{"books": r.Books, "pages": r.Pages, "first": r.First, "latest": r.Latest}
+	}
+	return stats, nil
+}
+
+// The average rating of the reviewed books of the author, and how many
+// reviews there are, once addRatings filled them in.
+func authorRating(books []map[string]interface{}) (float64, int) {
+	sum, reviews := 0.0, 0
+	for _, b := range books {
+		count := b["reviews"].(int)
+		sum += b["rating"].(float64) * float64(count)
+		reviews += count
+	}
+	if reviews == 0 {
+		return 0, 0
+	}
+	return math.Round(sum/float64(reviews)*10) / 10, reviews
+}
+
+// Registers the endpoints with the details of the authors, the list of the
+// authors and the page of each of them.
+func registerAuthorRoutes(e *echo.Echo, wikidata *Wikidata, coll *Repository, books *Repository, reviews *Repository) {
+	// Finds the author of the request, by id or by name (?name=...)
+	find := func(c echo.Context) (Author, bool, error) {
+		var author Author
+		if c.Param("id") == "" {
+			name := strings.TrimSpace(c.QueryParam("name"))
+			if name == "" {
+				return author, false, c.JSON(http.StatusBadRequest, map[string]string{"error": "name is required"})
+			}
+			// Looking up doesn't add the author: one with books who
+			// isn't added yet (see syncAuthors) is shown without an id
+			err := coll.FindOne(c.Request().Context(), bson.M{"authorname": name}).Decode(&author)
+			if err == mongo.ErrNoDocuments {
+				count, err := books.CountDocuments(c.Request().Context(), bson.M{"bookauthor": name}, options.Count().SetLimit(1))
+				if err != nil {
+					return author, false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to find author"})
+				}
+				if count == 0 {
+					return author, false, echo.NewHTTPError(http.StatusNotFound, "author not found")
+				}
+				return Author{AuthorName: name}, true, nil
+			}
+			if err != nil {
+				return author, false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to find author"})
+			}
+			return author, true, nil
+		}
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return author, false, echo.NewHTTPError(http.StatusBadRequest, "invalid id")
+		}
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&author); err != nil {
+			return author, false, echo.NewHTTPError(http.StatusNotFound, "author not found")
+		}
+		return author, true, nil
+	}
+
+	e.GET("/authors", func(c echo.Context) error {
+		authors, err := listAuthors(c.Request().Context(), coll, books)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list authors"})
+		}
+		return c.Render(http.StatusOK, "author-table", map[string]interface{}{
+			"authors": authors,
+			"exports": exportLinks("/authors/export", nil),
+		})
+	})
+
+	// The page of the author, with the bio, the books and what they add up to
+	page := func(c echo.Context) error {
+		author, ok, err := find(c)
+		if !ok {
+			return err
+		}
+
+		opts := options.Find().SetSort(bson.D{{Key: "bookyear", Value: 1}, {Key: "bookname", Value: 1}})
+		list := findAllBooks(books, statusFilter(bson.M{"bookauthor": author.AuthorName}, ""), opts)
+		if err = addRatings(reviews, list); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to compute ratings"})
+		}
+		stats, err := authorStats(c.Request().Context(), books, author.AuthorName)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to sum up the books"})
+		}
+		stats["rating"], stats["reviews"] = authorRating(list)
+
+		return c.Render(http.StatusOK, "author-page", map[string]interface{}{
+			"author": authorToMap(author),
+			"books":  list,
+			"stats":  stats,
+			"title":  author.AuthorName,
+		})
+	}
+	// By name too, to link the page from a book, e.g.,
+	// /authors/lookup?name=Douglas+Adams
+	e.GET("/authors/lookup", page)
+	e.GET("/authors/:id", page)
+
+	e.GET("/authors/bio", func(c echo.Context) error {
+		author, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		return c.Render(200, "author-bio", authorToMap(author))
+	})
+
+	show := func(c echo.Context) error {
+		author, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		return c.JSON(http.StatusOK, authorToMap(author))
+	}
+	// By name, e.g., /api/authors/lookup?name=Douglas+Adams
+	e.GET("/api/authors/lookup", show)
+	e.GET("/api/authors/:id", show)
+
+	// Asks Wikidata again right away, e.g., after fixing it there
+	e.POST("/api/authors/:id/refresh", func(c echo.Context) error {
+		author, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		return c.JSON(http.StatusOK, authorToMap(wikidata.Refresh(c.Request().Context(), coll, author, true)))
+	})
+
+	// Sets what is shown instead of the details from Wikidata. Empty fields
+	// fall back to those, so sending {} removes the override.
+	e.PUT("/api/authors/:id/override", func(c echo.Context) error {
+		author, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		var override AuthorInfo
+		if err := c.Bind(&override); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		override.Bio = strings.TrimSpace(override.Bio)
+		override.Portrait = strings.TrimSpace(override.Portrait)
+		if override.Portrait != "" && !strings.HasPrefix(override.Portrait, "https://") && !strings.HasPrefix(override.Portrait, "http://") {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "portrait must be a web link"})
+		}
+
+		author.AuthorOverride = override
+		if _, err = coll.UpdateOne(c.Request().Context(), bson.M{"_id": author.ID}, bson.M{"$set": bson.M{"authoroverride": override}}); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update author"})
+		}
+		return c.JSON(http.StatusOK, authorToMap(author))
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/ean"
+	"github.com/boombuler/barcode/qr"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Size of the barcode images: the width of the thinnest bar and the
+	// height of the bars, in pixels
+	barcodeModule = 2
+	barcodeHeight = 80
+	// Blank space around the bars scanners need to find the barcode, in bars
+	barcodeQuiet = 10
+	// Size of the QR code images, in pixels, and of the blank space around
+	// them, in squares
+	qrSize  = 200
+	qrQuiet = 4
+)
+
+// The identifier printed on the label of a copy. Copies without a barcode of
+// their own get their id, so every copy can be labelled.
+func copyIdentifier(cp Copy) string {
+	if cp.CopyBarcode != "" {
+		return cp.CopyBarcode
+	}
+	return cp.ID.Hex()
+}
+
+// Encodes the identifier. Code 128 can hold any text, EAN-13 only 12 digits
+// (the 13th is the check digit, which we compute or verify).
+func encodeBarcode(symbology string, value string) (barcode.Barcode, error) {
+	switch symbology {
+	case "", "code128":
+		return code128.Encode(value)
+	case "ean13":
+		return ean.Encode(value)
+	}
+	return nil, fmt.Errorf("unknown symbology %q", symbology)
+}
+
+func isBar(bc barcode.Barcode, x int) bool {
+	r, _, _, _ := bc.At(x, 0).RGBA()
+	return r == 0
+}
+
+// Surrounds the image with a white margin of the given size.
+func withQuietZone(img image.Image, margin int) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx()+2*margin, b.Dy()+2*margin))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(margin, margin, margin+b.Dx(), margin+b.Dy()), img, b.Min, draw.Src)
+	return dst
+}
+
+// Writes the barcode as an SVG, one rectangle per bar, with the identifier
+// underneath so it can be typed in when the scanner gives up.
+func barcodeSVG(bc barcode.Barcode, text string) string {
+	width := bc.Bounds().Dx()
+	total := (width + 2*barcodeQuiet) * barcodeModule
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`,
+		total, barcodeHeight+20, total, barcodeHeight+20)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/>`, total, barcodeHeight+20)
+	for x := 0; x < width; {
+		if !isBar(bc, x) {
+			x++
+			continue
+		}
+		// Consecutive black modules make a single, wider bar
+		start := x
+		for x < width && isBar(bc, x) {
+			x++
+		}
+		fmt.Fprintf(&b, `<rect x="%d" width="%d" height="%d"/>`,
+			(start+barcodeQuiet)*barcodeModule, (x-start)*barcodeModule, barcodeHeight)
+	}
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="monospace" font-size="14" text-anchor="middle">%s</text>`,
+		total/2, barcodeHeight+16, html.EscapeString(text))
+	b.WriteString("</svg>")
+	return b.String()
+}
+
+// What the QR code of a book holds: the address of its page, with the ISBN
+// along, so a scanner app finds the page and a labelling program the ISBN,
+// e.g., https://library.example.com/books/<id>?isbn=9780141036144.
+func bookQRContent(c echo.Context, book BookStore) string {
+	link := absoluteURL(c, "/books/"+book.ID.Hex())
+	if book.BookISBN != "" {
+		link += "?isbn=" + url.QueryEscape(book.BookISBN)
+	}
+	return link
+}
+
+// Writes the QR code as an SVG, one square per dark module, which prints
+// sharp at any size.
+func qrSVG(code barcode.Barcode) string {
+	size := code.Bounds().Dx()
+	total := size + 2*qrQuiet
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		qrSize, qrSize, total, total)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/>`, total, total)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if r, _, _, _ := code.At(x, y).RGBA(); r == 0 {
+				fmt.Fprintf(&b, `<rect x="%d" y="%d" width="1" height="1"/>`, x+qrQuiet, y+qrQuiet)
+			}
+		}
+	}
+	b.WriteString("</svg>")
+	return b.String()
+}
+
+// Registers the endpoints generating the barcode label of a copy, e.g.,
+// /api/copies/<id>/barcode?format=svg&symbology=ean13, and the QR code of a
+// book, e.g., /books/<id>/qr?format=svg.
+func registerBarcodeRoutes(e *echo.Echo, copies *Repository, books *Repository) {
+	e.GET("/api/copies/:id/barcode", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var cp Copy
+		if err = copies.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&cp); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "copy not found"})
+		}
+
+		text := copyIdentifier(cp)
+		bc, err := encodeBarcode(c.QueryParam("symbology"), text)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "cannot encode " + text + ": " + err.Error()})
+		}
+
+		switch c.QueryParam("format") {
+		case "svg":
+			return c.Blob(http.StatusOK, "image/svg+xml", []byte(barcodeSVG(bc, bc.Content())))
+		case "", "png":
+			scaled, err := barcode.Scale(bc, bc.Bounds().Dx()*barcodeModule, barcodeHeight)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to draw barcode"})
+			}
+			c.Response().Header().Set(echo.HeaderContentType, "image/png")
+			c.Response().WriteHeader(http.StatusOK)
+			return png.Encode(c.Response(), withQuietZone(scaled, barcodeQuiet*barcodeModule))
+		}
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "format must be png or svg"})
+	})
+
+	e.GET("/books/:id/qr", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var book BookStore
+		if err = books.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&book); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+
+		code, err := qr.Encode(bookQRContent(c, book), qr.M, qr.Auto)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to draw QR code"})
+		}
+		switch c.QueryParam("format") {
+		case "svg":
+			return c.Blob(http.StatusOK, "image/svg+xml", []byte(qrSVG(code)))
+		case "", "png":
+			module := max(qrSize/(code.Bounds().Dx()+2*qrQuiet), 1)
+			scaled, err := barcode.Scale(code, code.Bounds().Dx()*module, code.Bounds().Dy()*module)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to draw QR code"})
+			}
+			c.Response().Header().Set(echo.HeaderContentType, "image/png")
+			c.Response().WriteHeader(http.StatusOK)
+			return png.Encode(c.Response(), withQuietZone(scaled, qrQuiet*module))
+		}
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "format must be png or svg"})
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A branch of the library, i.e., a building with its own shelves. Copies
+// belong to a branch, and are lent from there. Copies without a branch are
+// from before there were any, and count for all of them.
+type Branch struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	BranchName    string             `json:"name" form:"name"`
+	BranchAddress string             `json:"address" form:"address"`
+	CreatedAt     time.Time          `json:"-" form:"-" bson:"createdat,omitempty"`
+	UpdatedAt     time.Time          `json:"-" form:"-" bson:"updatedat,omitempty"`
+}
+
+// The cookie the branch switcher stores the chosen branch in.
+const branchCookie = "branch"
+
+func branchToMap(b Branch) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        b.ID.Hex(),
+		"name":      b.BranchName,
+		"address":   b.BranchAddress,
+		"createdAt": formatTimestamp(b.CreatedAt),
+		"updatedAt": formatTimestamp(b.UpdatedAt),
+	}
+}
+
+func findAllBranches(coll *Repository) ([]Branch, error) {
+	cursor, err := coll.Find(context.TODO(), bson.M{}, options.Find().SetSort(bson.D{{Key: "branchname", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var results []Branch
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Returns the branch asked for with ?branch=<id>, or otherwise the one picked
+// in the branch switcher. The zero id means all branches.
+func selectedBranch(c echo.Context) (primitive.ObjectID, bool) {
+	value := c.QueryParam("branch")
+	if value == "" {
+		if cookie, err := c.Cookie(branchCookie); err == nil {
+			value = cookie.Value
+		}
+	}
+	if value == "" || value == "all" {
+		return primitive.NilObjectID, true
+	}
+	id, err := primitive.ObjectIDFromHex(value)
+	return id, err == nil
+}
+
+// Narrows the filter down to the selected branch, if there is one. It
+// reports false when the branch is not a valid id.
+func branchFilter(c echo.Context, filter bson.M, field string) (bson.M, bool) {
+	id, ok := selectedBranch(c)
+	if ok && !id.IsZero() {
+		filter[field] = id
+	}
+	return filter, ok
+}
+
+// Counts the copies of a book per branch, and how many of them can be lent.
+func availabilityByBranch(copies *Repository, branches *Repository, book primitive.ObjectID) ([]map[string]interface{}, error) {
+	all, err := findCopies(copies, bson.M{"bookid": book, "copystatus": bson.M{"$nin": outOfCirculation}})
+	if err != nil {
+		return nil, err
+	}
+	counts := map[primitive.ObjectID][2]int{}
+	for _, cp := range all {
+		n := counts[cp.CopyBranch]
+		n[0]++
+		if cp.CopyStatus == StatusAvailable {
+			n[1]++
+		}
+		counts[cp.CopyBranch] = n
+	}
+
+	found, err := findAllBranches(branches)
+	if err != nil {
+		return nil, err
+	}
+	ret := []map[string]interface{}{}
+	for _, b := range found {
+		if n, ok := counts[b.ID]; ok {
+			ret = append(ret, map[string]interface{}{"id": b.ID.Hex(), "name": b.BranchName, "copies": n[0], "available": n[1]})
+		}
+	}
+	if n, ok := counts[primitive.NilObjectID]; ok {
+		ret = append(ret, map[string]interface{}{"id": "", "name": "", "copies": n[0], "available": n[1]})
+	}
+	return ret, nil
+}
+
+// Registers the endpoints to manage the branches, and the branch switcher.
+func registerBranchRoutes(e *echo.Echo, copies *Repository, coll *Repository) {
+	e.GET("/branches/switcher", func(c echo.Context) error {
+		branches, err := findAllBranches(coll)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list branches"})
+		}
+		selected, _ := selectedBranch(c)
+		list := []map[string]interface{}{}
+		for _, b := range branches {
+			m := branchToMap(b)
+			m["selected"] = b.ID == selected
+			list = append(list, m)
+		}
+		return c.Render(200, "branch-switcher", list)
+	})
+
+	// Remembers the branch and reloads the page, so everything on it is
+	// shown for that branch
+	e.POST("/branch", func(c echo.Context) error {
+		value := c.FormValue("branch")
+		if value != "" && value != "all" {
+			if _, err := primitive.ObjectIDFromHex(value); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid branch"})
+			}
+		}
+		c.SetCookie(&http.Cookie{Name: branchCookie, Value: value, Path: "/", MaxAge: 365 * 24 * 3600, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		c.Response().Header().Set("HX-Refresh", "true")
+		return c.NoContent(http.StatusOK)
+	})
+
+	e.GET("/api/branches", func(c echo.Context) error {
+		branches, err := findAllBranches(coll)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list branches"})
+		}
+		ret := []map[string]interface{}{}
+		for _, b := range branches {
+			ret = append(ret, branchToMap(b))
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	e.GET("/api/branches/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var branch Branch
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&branch); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "branch not found"})
+		}
+		return c.JSON(http.StatusOK, branchToMap(branch))
+	})
+
+	// Creates the branch, or updates it when an id is given
+	save := func(c echo.Context, id primitive.ObjectID) error {
+		branch := new(Branch)
+		if err := c.Bind(branch); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		branch.BranchName = strings.TrimSpace(branch.BranchName)
+		branch.BranchAddress = strings.TrimSpace(branch.BranchAddress)
+		if branch.BranchName == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "name is required"})
+		}
+		count, err := coll.CountDocuments(context.TODO(), bson.M{
+			"branchname": bson.M{"$regex": "^" + regexp.QuoteMeta(branch.BranchName) + "$", "$options": "i"},
+			"_id":        bson.M{"$ne": id},
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to check branch"})
+		}
+		if count > 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "branch already exists"})
+		}
+
+		if id.IsZero() {
+			branch.ID = primitive.NewObjectID()
+			_, err = coll.InsertOne(c.Request().Context(), branch)
+		} else {
+			branch.ID = id
+			var result *mongo.UpdateResult
+			result, err = coll.UpdateOne(c.Request().Context(), bson.M{"_id": id}, bson.M{"$set": bson.M{"branchname": branch.BranchName, "branchaddress": branch.BranchAddress}})
+			if err == nil && result.MatchedCount == 0 {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "branch not found"})
+			}
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to save branch"})
+		}
+		return c.JSON(http.StatusOK, branchToMap(*branch))
+	}
+
+	e.POST("/api/branches", func(c echo.Context) error {
+		return save(c, primitive.NilObjectID)
+	})
+
+	e.PUT("/api/branches/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		return save(c, id)
+	})
+
+	// Branches still holding copies cannot go, the copies have to be moved
+	// somewhere else first
+	e.DELETE("/api/branches/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		count, err := copies.CountDocuments(context.TODO(), bson.M{"copybranch": id})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete branch"})
+		}
+		if count > 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "branch still has copies"})
+		}
+
+		result, err := coll.DeleteOne(c.Request().Context(), bson.M{"_id": id})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete branch"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// How many books a batch can change at once, which is more than a page of
+// the book table holds
+const batchLimit = 500
+
+// The books a batch is about, with what to do with them, e.g., the author to
+// give them. The ids are the ones ticked in the book table.
+type batchRequest struct {
+	IDs    []string `json:"ids" form:"ids"`
+	Author string   `json:"author" form:"author"`
+	Tag    string   `json:"tag" form:"tag"`
+}
+
+// Reads the batch of the request, and returns what is wrong with it, if
+// anything.
+func bindBatch(c echo.Context) (batchRequest, []primitive.ObjectID, string) {
+	var req batchRequest
+	if err := c.Bind(&req); err != nil {
+		return req, nil, "invalid request"
+	}
+	ids, ok := parseObjectIDs(req.IDs)
+	if !ok {
+		return req, nil, "invalid id"
+	}
+	if len(ids) == 0 {
+		return req, nil, "no books selected"
+	}
+	if len(ids) > batchLimit {
+		return req, nil, "too many books selected"
+	}
+	return req, ids, ""
+}
+
+// The books among ids with a copy that is loaned or held, which can't be
+// deleted until the copy is back on the shelf: deleting them would delete the
+// copy the member has, or the one waiting for them.
+func busyBooks(ctx context.Context, copies *Repository, ids []primitive.ObjectID) ([]primitive.ObjectID, error) {
+	values, err := copies.Distinct(ctx, "bookid", bson.M{
+		"bookid":     bson.M{"$in": ids},
+		"copystatus": bson.M{"$in": []string{StatusLoaned, StatusHeld}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	busy := make([]primitive.ObjectID, 0, len(values))
+	for _, value := range values {
+		if id, ok := value.(primitive.ObjectID); ok {
+			busy = append(busy, id)
+		}
+	}
+	return busy, nil
+}
+
+// Deletes the books with what belongs to them: their genres, copies, reviews
+// and covers, and their places in the favorites and the lists. When a step
+// fails, what failed is returned with the error.
+func deleteBooks(ctx context.Context, cfg Config, ids []primitive.ObjectID, books *Repository, bookGenres *Repository, copies *Repository, reviews *Repository, favorites *Repository, lists *Repository) (*mongo.DeleteResult, string, error) {
+	result, err := books.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, "failed to delete book", err
+	}
+	belonging := bson.M{"bookid": bson.M{"$in": ids}}
+	if _, err = bookGenres.DeleteMany(ctx, belonging); err != nil {
+		return nil, "failed to delete book genres", err
+	}
+	if _, err = copies.DeleteMany(ctx, belonging); err != nil {
+		return nil, "failed to delete book copies", err
+	}
+	if _, err = reviews.DeleteMany(ctx, belonging); err != nil {
+		return nil, "failed to delete book reviews", err
+	}
+	if _, err = favorites.DeleteMany(ctx, belonging); err != nil {
+		return nil, "failed to delete book favorites", err
+	}
+	if _, err = lists.UpdateMany(ctx, bson.M{}, bson.M{"$pull": bson.M{"listbooks": bson.M{"$in": ids}}}); err != nil {
+		return nil, "failed to remove book from lists", err
+	}
+	for _, id := range ids {
+		removeCover(cfg.CoversPath, id)
+	}
+	return result, "", nil
+}
+
+// Registers the changes of many books at once, for the bar above the book
+// table: giving them an author, adding a tag to them, and deleting them.
+// They all take the ids of the books, e.g.,
+//
+//	POST /api/books/batch/author  {"ids": ["<id>", "<id>"], "author": "Ursula K. Le Guin"}
+//	POST /api/books/batch/tags    {"ids": ["<id>"], "tag": "classics"}
+//	POST /api/books/batch/delete  {"ids": ["<id>"]}
+//
+// htmx gets the changed rows back, each to take the place of the one it had
+// in the table; the table reloads itself after books were deleted.
+func registerBulkRoutes(e *echo.Echo, cfg Config, coll *Repository, bookGenres *Repository, copies *Repository, reviews *Repository, favorites *Repository, lists *Repository) {
+	// Answers a change with the rows of the books, or how many of them
+	// changed for the other clients
+	changed := func(c echo.Context, ids []primitive.ObjectID, result *mongo.UpdateResult) error {
+		if c.Request().Header.Get("HX-Request") == "" {
+			return c.JSON(http.StatusOK, result)
+		}
+		rows := findAllBooks(coll, bson.M{"_id": bson.M{"$in": ids}})
+		scope, _ := branchFilter(c, bson.M{}, "copybranch")
+		if err := addAvailability(copies, rows, scope); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count copies"})
+		}
+		for _, row := range rows {
+			row["oob"], row["selected"] = true, true
+		}
+		return c.Render(http.StatusOK, "book-rows-changed", rows)
+	}
+
+	e.POST("/api/books/batch/author", func(c echo.Context) error {
+		req, ids, msg := bindBatch(c)
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+		author := strings.TrimSpace(req.Author)
+		if author == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "author is required"})
+		}
+		result, err := coll.UpdateMany(c.Request().Context(), bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"bookauthor": author}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update books"})
+		}
+		return changed(c, ids, result)
+	})
+
+	e.POST("/api/books/batch/tags", func(c echo.Context) error {
+		req, ids, msg := bindBatch(c)
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+		tag := normalizeTag(req.Tag)
+		if tag == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "tag is required"})
+		}
+		result, err := coll.UpdateMany(c.Request().Context(), bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$addToSet": bson.M{"booktags": tag}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to add tag"})
+		}
+		return changed(c, ids, result)
+	})
+
+	e.POST("/api/books/batch/delete", func(c echo.Context) error {
+		_, ids, msg := bindBatch(c)
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+		// The books with a copy out are left as they are, and listed
+		busy, err := busyBooks(c.Request().Context(), copies, ids)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to find book copies"})
+		}
+		isBusy := make(map[primitive.ObjectID]bool, len(busy))
+		for _, id := range busy {
+			isBusy[id] = true
+		}
+		free := make([]primitive.ObjectID, 0, len(ids))
+		for _, id := range ids {
+			if !isBusy[id] {
+				free = append(free, id)
+			}
+		}
+		result := &mongo.DeleteResult{}
+		if len(free) > 0 {
+			if result, msg, err = deleteBooks(c.Request().Context(), cfg, free, coll, bookGenres, copies, reviews, favorites, lists); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": msg})
+			}
+		}
+		skipped := []map[string]interface{}{}
+		if len(busy) > 0 {
+			skipped = findAllBooks(coll, bson.M{"_id": bson.M{"$in": busy}})
+		}
+		if c.Request().Header.Get("HX-Request") != "" {
+			// The table reloads itself on the event, see "book-table"
+			flash := "Books deleted"
+			if len(skipped) > 0 {
+				names := make([]string, 0, len(skipped))
+				for _, book := range skipped {
+					names = append(names, book["name"].(string))
+				}
+				flash = fmt.Sprintf("%d books deleted; kept %s, as copies are loaned or held", result.DeletedCount, strings.Join(names, ", "))
+			}
+			setFlash(c, flash)
+			c.Response().Header().Set("HX-Trigger", "booksChanged")
+			return c.NoContent(http.StatusOK)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"DeletedCount": result.DeletedCount, "skipped": skipped})
+	})
+}
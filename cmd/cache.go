@@ -0,0 +1,183 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// How often the books were answered from the cache, see expvars.go
+var bookCacheStats = newCacheStats("books")
+
+// Keeps answers that take long to make, e.g., the lists of books, for a
+// while. The repositories forget all of them as soon as anything is written
+// (see Repository.invalidate), as we can't tell which ones the write
+// changed.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool)
+	Set(ctx context.Context, key string, value []byte)
+	Clear(ctx context.Context)
+}
+
+// Picks the cache of a library with CACHE_STORE: "memory", the default, or
+// "redis", which all the replicas share. It is nil with CACHE_SIZE=0.
+func newCache(cfg Config, tenant string) (Cache, error) {
+	if cfg.CacheSize <= 0 {
+		return nil, nil
+	}
+	ttl := time.Duration(cfg.CacheTTLSeconds) * time.Second
+	switch cfg.CacheStore {
+	case "", "memory":
+		return newMemoryCache(cfg.CacheSize, ttl, bookCacheStats), nil
+	case "redis":
+		client, err := redisClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &RedisCache{client: client, prefix: "library:" + tenant + ":cache:", ttl: ttl, stats: bookCacheStats}, nil
+	}
+	return nil, errors.New("CACHE_STORE must be memory or redis")
+}
+
+type cacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// A cache in the memory of the server, keeping up to size answers for ttl.
+// When full, the one used the longest ago makes room.
+type memoryCache struct {
+	size  int
+	ttl   time.Duration
+	stats *CacheStats
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// The entries, the most recently used first
+	order *list.List
+}
+
+func newMemoryCache(size int, ttl time.Duration, stats *CacheStats) *memoryCache {
+	return &memoryCache{size: size, ttl: ttl, stats: stats, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+func (m *memoryCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if ok && time.Now().After(el.Value.(*cacheEntry).expires) {
+		m.order.Remove(el)
+		delete(m.entries, key)
+		ok = false
+	}
+	if !ok {
+		m.stats.Miss()
+		return nil, false
+	}
+	m.stats.Hit()
+	m.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+func (m *memoryCache) Set(ctx context.Context, key string, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := &cacheEntry{key: key, value: value, expires: time.Now().Add(m.ttl)}
+	if el, ok := m.entries[key]; ok {
+		el.Value = entry
+		m.order.MoveToFront(el)
+		return
+	}
+	m.entries[key] = m.order.PushFront(entry)
+	for m.order.Len() > m.size {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (m *memoryCache) Clear(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = map[string]*list.Element{}
+	m.order.Init()
+}
+
+// In Redis, every answer is a key of its own, which Redis drops after the
+// ttl, or when it runs out of memory, so CACHE_SIZE doesn't apply. The keys
+// start with the tenant, as the libraries share the Redis server, and with
+// the generation of the cache: clearing it starts the next one, so the
+// replicas stop finding what was cached before, without looking for the
+// keys to delete. Redis failing only makes us ask the database.
+type RedisCache struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+	stats  *CacheStats
+}
+
+func (r *RedisCache) key(ctx context.Context, key string) (string, error) {
+	generation, err := r.client.Get(ctx, r.prefix+"generation").Result()
+	if err == redis.Nil {
+		generation, err = "0", nil
+	}
+	return r.prefix + generation + ":" + key, err
+}
+
+func (r *RedisCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	key, err := r.key(ctx, key)
+	var value []byte
+	if err == nil {
+		value, err = r.client.Get(ctx, key).Bytes()
+	}
+	if err != nil {
+		if err != redis.Nil {
+			loggerFrom(ctx).Warn("failed to read the cache", "err", err)
+		}
+		r.stats.Miss()
+		return nil, false
+	}
+	r.stats.Hit()
+	return value, true
+}
+
+func (r *RedisCache) Set(ctx context.Context, key string, value []byte) {
+	key, err := r.key(ctx, key)
+	if err == nil {
+		err = r.client.Set(ctx, key, value, r.ttl).Err()
+	}
+	if err != nil {
+		loggerFrom(ctx).Warn("failed to write the cache", "err", err)
+	}
+}
+
+func (r *RedisCache) Clear(ctx context.Context) {
+	if err := r.client.Incr(ctx, r.prefix+"generation").Err(); err != nil {
+		loggerFrom(ctx).Warn("failed to clear the cache", "err", err)
+	}
+}
+
+// The key of what the request asks for, e.g., "api" for the list of books
+// of the API or "book/<id>" for a book: its query, in a fixed order, and
+// what else the books depend on, i.e., the branch picked in the switcher,
+// the preferences of the user and, for the pages, their language.
+func bookCacheKey(c echo.Context, kind string, locale string) string {
+	query := c.QueryParams()
+	branch, _ := selectedBranch(c)
+	prefs, _ := json.Marshal(preferencesOf(c))
+	key := url.Values{
+		"q":      {query.Encode()},
+		"branch": {branch.Hex()},
+		"locale": {locale},
+		"prefs":  {string(prefs)},
+	}
+	return kind + "?" + key.Encode()
+}
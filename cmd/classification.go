@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// A Dewey Decimal call number: three digits, maybe decimals, and maybe a
+	// cutter for the author, e.g., "823.914 ADA"
+	ddcPattern = regexp.MustCompile(`^\d{3}(\.\d+)?( [A-Z0-9.]+)*$`)
+	// A Library of Congress call number: one to three letters, a number, and
+	// the cutters and year, e.g., "PR6051.D3352 H5 1979"
+	lccPattern = regexp.MustCompile(`^([A-Z]{1,3}) ?(\d{1,4})(\.\d+)?(( ?\.?[A-Z]\d+)*( \d{4})?)$`)
+)
+
+// The ten main classes of the Dewey Decimal Classification.
+var ddcClasses = map[string]string{
+	"0": "000 Computer science, information and general works",
+	"1": "100 Philosophy and psychology",
+	"2": "200 Religion",
+	"3": "300 Social sciences",
+	"4": "400 Language",
+	"5": "500 Science",
+	"6": "600 Technology",
+	"7": "700 Arts and recreation",
+	"8": "800 Literature",
+	"9": "900 History and geography",
+}
+
+// The main classes of the Library of Congress Classification.
+var lccClasses = map[string]string{
+	"A": "A General works",
+	"B": "B Philosophy, psychology and religion",
+	"C": "C Auxiliary sciences of history",
+	"D": "D World history",
+	"E": "E History of the Americas",
+	"F": "F History of the Americas",
+	"G": "G Geography, anthropology and recreation",
+	"H": "H Social sciences",
+	"J": "J Political science",
+	"K": "K Law",
+	"L": "L Education",
+	"M": "M Music",
+	"N": "N Fine arts",
+	"P": "P Language and literature",
+	"Q": "Q Science",
+	"R": "R Medicine",
+	"S": "S Agriculture",
+	"T": "T Technology",
+	"U": "U Military science",
+	"V": "V Naval science",
+	"Z": "Z Bibliography and library science",
+}
+
+func normalizeCallNumber(value string) string {
+	return strings.Join(strings.Fields(strings.ToUpper(value)), " ")
+}
+
+// Turns an LCC call number into something that sorts right as a string: the
+// class number is padded, so "PR951" comes before "PR6051".
+func lccSortKey(lcc string) string {
+	m := lccPattern.FindStringSubmatch(lcc)
+	if m == nil {
+		return lcc
+	}
+	return fmt.Sprintf("%-3s%s%s%s%s", m[1], strings.Repeat("0", 4-len(m[2])), m[2], m[3], m[4])
+}
+
+// Validates and normalizes the call numbers of the book. Both are optional.
+func validateClassification(book *BookStore) string {
+	book.BookDDC = normalizeCallNumber(book.BookDDC)
+	book.BookLCC = normalizeCallNumber(book.BookLCC)
+	if book.BookDDC != "" && !ddcPattern.MatchString(book.BookDDC) {
+		return "ddc must be a Dewey call number, e.g. 823.914"
+	}
+	book.BookLCCSort = ""
+	if book.BookLCC != "" {
+		if !lccPattern.MatchString(book.BookLCC) {
+			return "lcc must be a Library of Congress call number, e.g. PR6051.D3352"
+		}
+		book.BookLCCSort = lccSortKey(book.BookLCC)
+	}
+	return ""
+}
+
+// Groups the classified books by the main class of the scheme, in the
+// order of the classes, and the books by call number within them.
+func browseClassification(books *Repository, scheme string) ([]map[string]interface{}, error) {
+	field, sortField, classes := "bookddc", "bookddc", ddcClasses
+	if scheme == "lcc" {
+		field, sortField, classes = "booklcc", "booklccsort", lccClasses
+	}
+	opts := options.Find().SetSort(bson.D{{Key: sortField, Value: 1}})
+	cursor, err := books.Find(context.TODO(), statusFilter(bson.M{field: bson.M{"$nin": bson.A{"", nil}}}, ""), opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []BookStore
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	groups := map[string][]map[string]interface{}{}
+	for _, b := range results {
+		number := b.BookDDC
+		if scheme == "lcc" {
+			number = b.BookLCC
+		}
+		class := number[:1]
+		groups[class] = append(groups[class], map[string]interface{}{
+			"id":     b.ID.Hex(),
+			"name":   b.BookName,
+			"author": b.BookAuthor,
+			"number": number,
+		})
+	}
+
+	keys := []string{}
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := []map[string]interface{}{}
+	for _, k := range keys {
+		name, ok := classes[k]
+		if !ok {
+			name = k
+		}
+		ret = append(ret, map[string]interface{}{"class": k, "name": name, "books": groups[k]})
+	}
+	return ret, nil
+}
+
+// Registers the page and endpoint to browse the books by classification,
+// e.g., /classification?scheme=lcc. Dewey is the default.
+func registerClassificationRoutes(e *echo.Echo, books *Repository) {
+	scheme := func(c echo.Context) (string, bool) {
+		value := c.QueryParam("scheme")
+		if value == "" {
+			value = "ddc"
+		}
+		return value, value == "ddc" || value == "lcc"
+	}
+
+	e.GET("/classification", func(c echo.Context) error {
+		s, ok := scheme(c)
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "scheme must be ddc or lcc"})
+		}
+		groups, err := browseClassification(books, s)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list books"})
+		}
+		return c.Render(200, "classification-browse", map[string]interface{}{"scheme": s, "groups": groups})
+	})
+
+	e.GET("/api/classification", func(c echo.Context) error {
+		s, ok := scheme(c)
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "scheme must be ddc or lcc"})
+		}
+		groups, err := browseClassification(books, s)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list books"})
+		}
+		return c.JSON(http.StatusOK, groups)
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A change in the condition of a copy. Most of them are noticed when the copy
+// comes back from a loan, in which case the loan is kept along.
+type ConditionChange struct {
+	From      string             `bson:"from"`
+	Condition string             `bson:"condition"`
+	Date      time.Time          `bson:"date"`
+	Loan      primitive.ObjectID `bson:"loan,omitempty"`
+	Note      string             `bson:"note,omitempty"`
+}
+
+// The grade given to a copy when it is checked back in. Both are optional.
+type checkInRequest struct {
+	Condition string `json:"condition" form:"condition"`
+	Note      string `json:"note" form:"note"`
+}
+
+func conditionChangeToMap(ch ConditionChange) map[string]interface{} {
+	loan := ""
+	if !ch.Loan.IsZero() {
+		loan = ch.Loan.Hex()
+	}
+	return map[string]interface{}{
+		"from":      ch.From,
+		"condition": ch.Condition,
+		"date":      ch.Date.Format(time.RFC3339),
+		"loan":      loan,
+		"note":      ch.Note,
+	}
+}
+
+// Changes the condition of the copy, keeping track of what it was before.
+// Grading a copy with the condition it already has changes nothing.
+func gradeCopy(cp *Copy, condition string, loan primitive.ObjectID, note string) {
+	if condition == cp.CopyCondition {
+		return
+	}
+	cp.CopyConditions = append(cp.CopyConditions, ConditionChange{
+		From:      cp.CopyCondition,
+		Condition: condition,
+		Date:      time.Now().UTC(),
+		Loan:      loan,
+		Note:      strings.TrimSpace(note),
+	})
+	cp.CopyCondition = condition
+}
+
+// Grades the copy of a loan that was just returned. A copy coming back
+// damaged is put aside for repair instead of going back to the shelf, which
+// is reported back so the caller does not release it.
+func checkInCopy(ctx context.Context, copies *Repository, loan Loan, req checkInRequest) (bool, error) {
+	if req.Condition == "" {
+		return false, nil
+	}
+	var cp Copy
+	if err := copies.FindOne(context.TODO(), bson.M{"_id": loan.CopyID}).Decode(&cp); err != nil {
+		return false, err
+	}
+	gradeCopy(&cp, req.Condition, loan.ID, req.Note)
+	set := bson.M{"copycondition": cp.CopyCondition, "copyconditions": cp.CopyConditions}
+	damaged := cp.CopyCondition == "damaged"
+	if damaged {
+		set["copystatus"] = StatusDamaged
+	}
+	_, err := copies.UpdateOne(ctx, bson.M{"_id": cp.ID}, bson.M{"$set": set})
+	return damaged, err
+}
+
+// Registers the endpoints for the condition history of the copies and the
+// report of those in need of repair.
+func registerConditionRoutes(e *echo.Echo, books *Repository, copies *Repository) {
+	e.GET("/api/copies/:id/conditions", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var cp Copy
+		if err = copies.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&cp); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "copy not found"})
+		}
+
+		history := []map[string]interface{}{}
+		for _, ch := range cp.CopyConditions {
+			history = append(history, conditionChangeToMap(ch))
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"condition": cp.CopyCondition,
+			"history":   history,
+		})
+	})
+
+	// Damaged copies, in whatever status they are, except for those that are
+	// not part of the collection anymore. The ones damaged the longest ago
+	// come first.
+	e.GET("/api/reports/repairs", func(c echo.Context) error {
+		found, err := findCopies(copies, bson.M{
+			"$or":        bson.A{bson.M{"copycondition": "damaged"}, bson.M{"copystatus": StatusDamaged}},
+			"copystatus": bson.M{"$nin": outOfCirculation},
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list copies"})
+		}
+
+		names := map[string]string{}
+		for _, b := range findAllBooks(books, bson.M{}) {
+			names[b["id"].(string)] = b["name"].(string)
+		}
+		since := func(cp Copy) time.Time {
+			for i := len(cp.CopyConditions) - 1; i >= 0; i-- {
+				if cp.CopyConditions[i].Condition == "damaged" {
+					return cp.CopyConditions[i].Date
+				}
+			}
+			return cp.UpdatedAt
+		}
+		slices.SortFunc(found, func(a, b Copy) int { return since(a).Compare(since(b)) })
+
+		ret := []map[string]interface{}{}
+		for _, cp := range found {
+			m := copyToMap(cp)
+			m["bookName"] = names[cp.BookID.Hex()]
+			m["since"] = formatTimestamp(since(cp))
+			ret = append(ret, m)
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Holds the settings that may change between deployments. They are read from
+// environment variables, so the same binary can run on your machine, inside
+// Docker or in the cloud without touching the code.
+type Config struct {
+	// Where the database is, with the username and password
+	MongoURI string
+	// The addresses the server listens on for HTTP, and for HTTPS when it
+	// serves it itself, either with its own certificate or with the ones
+	// Let's Encrypt issues for the domains (see tls.go)
+	HTTPAddr    string
+	HTTPSAddr   string
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSDomains  []string
+	TLSCacheDir string
+	// Folder where the uploaded book covers and their thumbnails are stored
+	CoversPath string
+	// Days a member has to pick up a reserved copy before the hold expires
+	HoldPickupDays int
+	// Days a book can be kept before the loan is overdue
+	LoanDays int
+	// Fine charged per day late, and the most charged for a single loan, in cents
+	FinePerDay int
+	FineCap    int
+	// Currency the collection value is reported in, and what one unit of
+	// each other currency is worth in it
+	BaseCurrency  string
+	ExchangeRates map[string]float64
+	// Where ISBNs are looked up to fill in new books, and how many seconds
+	// we wait for an answer
+	OpenLibraryURL string
+	LookupTimeout  int
+	// Where covers are fetched from for the books without one, with {isbn}
+	// standing for their ISBN. Empty to only use placeholders.
+	CoverProvider string
+	// Google Books, which fills in what is missing from existing books, and
+	// how many milliseconds the enrichment job waits between two requests
+	GoogleBooksURL string
+	GoogleBooksKey string
+	EnrichInterval int
+	// Where the details of the authors are looked up
+	WikidataURL  string
+	WikipediaURL string
+	// The domain whose subdomains are the libraries of the tenants, empty for
+	// a single library, and the token of the admin creating them
+	TenantDomain string
+	AdminToken   string
+	// The secret the cookies of the second step of logging in are signed
+	// with, how many days a login lasts at most, and how many minutes it
+	// lasts without being used
+	SessionSecret      string
+	SessionDays        int
+	SessionIdleMinutes int
+	// Where the sessions are kept, "mongo" or "redis", and where Redis is
+	SessionStore string
+	RedisURL     string
+	// The secret the API tokens are signed with, how many minutes an access
+	// token lasts, and how many days a refresh token
+	JWTSecret          string
+	AccessTokenMinutes int
+	RefreshTokenDays   int
+	// The OAuth2 clients to log in with Google and GitHub. Providers without
+	// a client id are not offered.
+	GoogleClientID     string
+	GoogleClientSecret string
+	GitHubClientID     string
+	GitHubClientSecret string
+	// Any OpenID Connect provider, e.g., the single sign-on of a university,
+	// the name of its button, and which values of which claim make an admin
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCTitle        string
+	OIDCScopes       string
+	OIDCRoleClaim    string
+	OIDCAdminValues  []string
+	// The security headers of the responses, see headers.go. The
+	// Content-Security-Policy can be sent as report-only while trying it,
+	// and Strict-Transport-Security is off with a max age of 0.
+	ContentSecurityPolicy string
+	CSPReportOnly         bool
+	FrameOptions          string
+	ReferrerPolicy        string
+	HSTSMaxAge            int
+	// Whether only logged in users get the covers, unless the URL is signed,
+	// the secret signing them, and how many minutes a signed URL works by
+	// default and at most (see signedurls.go)
+	PrivateFiles        bool
+	URLSigningSecret    string
+	SignedURLMinutes    int
+	SignedURLMaxMinutes int
+	// How many kilobytes the body of a request may have, and of an upload
+	BodyLimitKB   int
+	UploadLimitKB int
+	// How many failed logins lock an account, and for how many minutes the
+	// first time (it doubles with every further failure)
+	LoginMaxFailures    int
+	LoginLockoutMinutes int
+	// The SMTP server the emails are sent through, e.g., the links to set a
+	// new password, and how many minutes these links work
+	SMTPHost          string
+	SMTPPort          int
+	SMTPUsername      string
+	SMTPPassword      string
+	SMTPFrom          string
+	ResetTokenMinutes int
+	// The key the secrets of the second factor are encrypted with, and the
+	// name the authenticator apps show next to the codes
+	EncryptionKey string
+	TOTPIssuer    string
+	// Whether search engines may find the catalog, with a sitemap, and
+	// whether the shared reading lists are in it (see sitemap.go). A
+	// robots.txt file of one's own can be served instead of the one made up.
+	PublicCatalog bool
+	SitemapLists  bool
+	RobotsFile    string
+	// How the logs are written, "text" or "json", and from which level on
+	// (see logging.go)
+	LogFormat string
+	LogLevel  string
+	// One in how many debug lines of the same message are written
+	LogDebugSample int
+	// The OpenTelemetry collector the traces are sent to, the name of the
+	// service they are from, and the share of the requests traced (see
+	// tracing.go)
+	OTLPEndpoint     string
+	ServiceName      string
+	TraceSampleRatio float64
+	// Whether the admins can profile the server at /debug/pprof (see pprof.go)
+	Pprof bool
+	// Milliseconds after which a database operation is logged as slow, 0 to
+	// never (see slowqueries.go)
+	SlowQueryMS int
+	// The file the requests are logged to as well, the megabytes and hours
+	// after which it starts over, and the days the full ones are kept (see
+	// accesslog.go)
+	AccessLogFile        string
+	AccessLogMaxMB       int
+	AccessLogRotateHours int
+	AccessLogKeepDays    int
+	// Where the errors are reported, the environment and the release they
+	// are reported from, and the share of them that is (see sentry.go)
+	SentryDSN         string
+	SentryEnvironment string
+	SentryRelease     string
+	SentrySampleRate  float64
+	// The share of the requests of every route that should succeed, which
+	// sets its error budget (see metrics.go)
+	SLOObjective float64
+	// The profile of the configuration, e.g., "production" or "staging",
+	// told at /api/version (see version.go)
+	Profile string
+	// The webhook the alerts are posted to, the minutes the errors are
+	// counted over, how many 5xx answers and failures of the database are
+	// too many, and the minutes to keep quiet after an alert (see alerts.go)
+	AlertWebhookURL      string
+	AlertWindowMinutes   int
+	AlertServerErrors    int
+	AlertMongoFailures   int
+	AlertCooldownMinutes int
+	// Whether the server creates the indexes as it starts, rather than
+	// leaving it to "migrate" (see indexes.go)
+	AutoMigrate bool
+	// Where the books are cached, "memory" or "redis", how many answers
+	// are, and for how many seconds at most (see cache.go)
+	CacheStore      string
+	CacheSize       int
+	CacheTTLSeconds int
+}
+
+func loadConfig() Config {
+	secrets := loadSecrets()
+	profile := getEnv("APP_PROFILE", "development")
+	return Config{
+		MongoURI:              mongoURI(secrets.get("MONGO_URI", "mongodb://localhost:27017"), secrets.get("MONGO_PASSWORD", "")),
+		HTTPAddr:              getEnv("HTTP_ADDR", ":3030"),
+		HTTPSAddr:             getEnv("HTTPS_ADDR", ":443"),
+		TLSCertFile:           os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:            os.Getenv("TLS_KEY_FILE"),
+		TLSDomains:            getEnvList("TLS_DOMAINS"),
+		TLSCacheDir:           getEnv("TLS_CACHE_DIR", "certs"),
+		CoversPath:            getEnv("COVERS_PATH", "covers"),
+		HoldPickupDays:        getEnvInt("HOLD_PICKUP_DAYS", 3),
+		LoanDays:              getEnvInt("LOAN_DAYS", 14),
+		FinePerDay:            getEnvInt("FINE_PER_DAY", 25),
+		FineCap:               getEnvInt("FINE_CAP", 1000),
+		BaseCurrency:          strings.ToUpper(getEnv("BASE_CURRENCY", "EUR")),
+		ExchangeRates:         getEnvRates("EXCHANGE_RATES"),
+		OpenLibraryURL:        strings.TrimSuffix(getEnv("OPENLIBRARY_URL", "https://openlibrary.org"), "/"),
+		LookupTimeout:         getEnvInt("LOOKUP_TIMEOUT", 5),
+		CoverProvider:         getEnv("COVER_PROVIDER", "https://covers.openlibrary.org/b/isbn/{isbn}-L.jpg?default=false"),
+		GoogleBooksURL:        strings.TrimSuffix(getEnv("GOOGLE_BOOKS_URL", "https://www.googleapis.com/books/v1"), "/"),
+		GoogleBooksKey:        secrets.get("GOOGLE_BOOKS_KEY", ""),
+		EnrichInterval:        getEnvInt("ENRICH_INTERVAL", 1000),
+		WikidataURL:           strings.TrimSuffix(getEnv("WIKIDATA_URL", "https://www.wikidata.org"), "/"),
+		WikipediaURL:          strings.TrimSuffix(getEnv("WIKIPEDIA_URL", "https://en.wikipedia.org"), "/"),
+		TenantDomain:          strings.ToLower(os.Getenv("TENANT_DOMAIN")),
+		AdminToken:            secrets.get("ADMIN_TOKEN", ""),
+		SessionSecret:         secrets.get("SESSION_SECRET", ""),
+		SessionDays:           getEnvInt("SESSION_DAYS", 7),
+		SessionIdleMinutes:    getEnvInt("SESSION_IDLE_MINUTES", 120),
+		SessionStore:          getEnv("SESSION_STORE", "mongo"),
+		RedisURL:              secrets.get("REDIS_URL", "redis://localhost:6379/0"),
+		JWTSecret:             secrets.get("JWT_SECRET", ""),
+		AccessTokenMinutes:    getEnvInt("ACCESS_TOKEN_MINUTES", 15),
+		RefreshTokenDays:      getEnvInt("REFRESH_TOKEN_DAYS", 30),
+		GoogleClientID:        os.Getenv("GOOGLE_CLIENT_ID"),
+		GoogleClientSecret:    secrets.get("GOOGLE_CLIENT_SECRET", ""),
+		GitHubClientID:        os.Getenv("GITHUB_CLIENT_ID"),
+		GitHubClientSecret:    secrets.get("GITHUB_CLIENT_SECRET", ""),
+		OIDCIssuer:            os.Getenv("OIDC_ISSUER"),
+		OIDCClientID:          os.Getenv("OIDC_CLIENT_ID"),
+		OIDCClientSecret:      secrets.get("OIDC_CLIENT_SECRET", ""),
+		OIDCTitle:             getEnv("OIDC_TITLE", "Single sign-on"),
+		OIDCScopes:            getEnv("OIDC_SCOPES", "openid email profile"),
+		OIDCRoleClaim:         getEnv("OIDC_ROLE_CLAIM", "groups"),
+		OIDCAdminValues:       getEnvList("OIDC_ADMIN_VALUES"),
+		ContentSecurityPolicy: getEnv("CONTENT_SECURITY_POLICY", defaultCSP),
+		CSPReportOnly:         getEnvBool("CSP_REPORT_ONLY", false),
+		FrameOptions:          getEnv("FRAME_OPTIONS", "DENY"),
+		ReferrerPolicy:        getEnv("REFERRER_POLICY", "strict-origin-when-cross-origin"),
+		HSTSMaxAge:            getEnvInt("HSTS_MAX_AGE", 31536000),
+		PrivateFiles:          getEnvBool("PRIVATE_FILES", false),
+		URLSigningSecret:      secrets.get("URL_SIGNING_SECRET", ""),
+		SignedURLMinutes:      getEnvInt("SIGNED_URL_MINUTES", 60),
+		SignedURLMaxMinutes:   getEnvInt("SIGNED_URL_MAX_MINUTES", 10080),
+		BodyLimitKB:           getEnvInt("BODY_LIMIT_KB", 1024),
+		UploadLimitKB:         getEnvInt("UPLOAD_LIMIT_KB", 10240),
+		LoginMaxFailures:      getEnvInt("LOGIN_MAX_FAILURES", 5),
+		LoginLockoutMinutes:   getEnvInt("LOGIN_LOCKOUT_MINUTES", 15),
+		SMTPHost:              os.Getenv("SMTP_HOST"),
+		SMTPPort:              getEnvInt("SMTP_PORT", 587),
+		SMTPUsername:          os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:          secrets.get("SMTP_PASSWORD", ""),
+		SMTPFrom:              getEnv("SMTP_FROM", "library@localhost"),
+		ResetTokenMinutes:     getEnvInt("RESET_TOKEN_MINUTES", 60),
+		EncryptionKey:         secrets.get("ENCRYPTION_KEY", ""),
+		TOTPIssuer:            getEnv("TOTP_ISSUER", "Library"),
+		PublicCatalog:         getEnvBool("PUBLIC_CATALOG", false),
+		SitemapLists:          getEnvBool("SITEMAP_LISTS", false),
+		RobotsFile:            os.Getenv("ROBOTS_FILE"),
+		LogFormat:             getEnv("LOG_FORMAT", "text"),
+		LogLevel:              getEnv("LOG_LEVEL", "info"),
+		LogDebugSample:        getEnvInt("LOG_DEBUG_SAMPLE", 1),
+		OTLPEndpoint:          os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		ServiceName:           getEnv("OTEL_SERVICE_NAME", "library"),
+		TraceSampleRatio:      getEnvFloat("OTEL_TRACES_SAMPLER_ARG", 1),
+		Pprof:                 getEnvBool("PPROF", false),
+		SlowQueryMS:           getEnvInt("SLOW_QUERY_MS", 200),
+		AccessLogFile:         os.Getenv("ACCESS_LOG_FILE"),
+		AccessLogMaxMB:        getEnvInt("ACCESS_LOG_MAX_MB", 100),
+		AccessLogRotateHours:  getEnvInt("ACCESS_LOG_ROTATE_HOURS", 24),
+		AccessLogKeepDays:     getEnvInt("ACCESS_LOG_KEEP_DAYS", 14),
+		SentryDSN:             secrets.get("SENTRY_DSN", ""),
+		SentryEnvironment:     getEnv("SENTRY_ENVIRONMENT", profile),
+		SentryRelease:         os.Getenv("SENTRY_RELEASE"),
+		SentrySampleRate:      getEnvFloat("SENTRY_SAMPLE_RATE", 1),
+		SLOObjective:          getEnvFloat("SLO_OBJECTIVE", 0.999),
+		Profile:               profile,
+		AlertWebhookURL:       secrets.get("ALERT_WEBHOOK_URL", ""),
+		AlertWindowMinutes:    getEnvInt("ALERT_WINDOW_MINUTES", 5),
+		AlertServerErrors:     getEnvInt("ALERT_SERVER_ERRORS", 50),
+		AlertMongoFailures:    getEnvInt("ALERT_MONGO_FAILURES", 10),
+		AlertCooldownMinutes:  getEnvInt("ALERT_COOLDOWN_MINUTES", 15),
+		AutoMigrate:           getEnvBool("AUTO_MIGRATE", true),
+		CacheStore:            getEnv("CACHE_STORE", "memory"),
+		CacheSize:             getEnvInt("CACHE_SIZE", 1000),
+		CacheTTLSeconds:       getEnvInt("CACHE_TTL_SECONDS", 60),
+	}
+}
+
+// Returns the value of the environment variable, or the fallback when it is
+// not set.
+func getEnv(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Same as getEnv, but for settings that are on or off, e.g., "true" or "1".
+func getEnvBool(key string, fallback bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// Same as getEnv, but for numeric settings. Values that are not numbers are
+// ignored in favor of the fallback.
+func getEnvInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// Same as getEnvInt, but for fractions, e.g., "0.25"
+func getEnvFloat(key string, fallback float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// Reads a list written as "a,b,c", in lowercase
+func getEnvList(key string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// Reads exchange rates written as "USD=0.92,GBP=1.17". Malformed entries are
+// logged and skipped.
+func getEnvRates(key string) map[string]float64 {
+	rates := map[string]float64{}
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		code, value, _ := strings.Cut(entry, "=")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate <= 0 {
+			slog.Warn("ignoring exchange rate", "entry", entry, "variable", key)
+			continue
+		}
+		rates[strings.ToUpper(strings.TrimSpace(code))] = rate
+	}
+	return rates
+}
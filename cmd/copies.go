@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A title (BookStore) can have several physical copies on the shelves. Each
+// copy has its own barcode, so we can tell them apart when lending them.
+type Copy struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	BookID        primitive.ObjectID `bson:"bookid"`
+	CopyBarcode   string             `bson:"copybarcode"`
+	CopyAcquired  time.Time          `bson:"copyacquired"`
+	CopyCondition string             `bson:"copycondition"`
+	CopyStatus    string             `bson:"copystatus"`
+	// How the condition changed over time, see conditions.go
+	CopyConditions []ConditionChange `bson:"copyconditions,omitempty"`
+	// What we paid for the copy, in cents
+	CopyPrice    int      `bson:"copyprice,omitempty"`
+	CopyCurrency string   `bson:"copycurrency,omitempty"`
+	CopyLocation Location `bson:"copylocation,omitempty"`
+	// The branch the copy is lent from, see branches.go
+	CopyBranch primitive.ObjectID `bson:"copybranch,omitempty"`
+	// Whether the copy was bought or donated, and the order or donation
+	CopyProvenance string             `bson:"copyprovenance,omitempty"`
+	CopySource     primitive.ObjectID `bson:"copysource,omitempty"`
+	CreatedAt      time.Time          `bson:"createdat,omitempty"`
+	UpdatedAt      time.Time          `bson:"updatedat,omitempty"`
+}
+
+const (
+	StatusAvailable = "available"
+	StatusLoaned    = "loaned"
+	// Set aside for a member who placed a hold on the book
+	StatusHeld = "held"
+	// See lifecycle.go for how these can be reached
+	StatusLost      = "lost"
+	StatusDamaged   = "damaged"
+	StatusWithdrawn = "withdrawn"
+)
+
+var (
+	copyConditions = []string{"new", "good", "worn", "damaged"}
+	copyStatuses   = []string{StatusAvailable, StatusLoaned, StatusHeld, StatusLost, StatusDamaged, StatusWithdrawn}
+)
+
+// The body we accept when adding or updating a copy. The acquisition date is
+// written as YYYY-MM-DD, the same format the HTML date inputs use.
+type copyRequest struct {
+	ID        string `json:"id" form:"id"`
+	Barcode   string `json:"barcode" form:"barcode"`
+	Acquired  string `json:"acquired" form:"acquired"`
+	Condition string `json:"condition" form:"condition"`
+	Status    string `json:"status" form:"status"`
+	// In cents, e.g. "1250" for 12.50
+	Price    string `json:"price" form:"price"`
+	Currency string `json:"currency" form:"currency"`
+	// The id of the branch, or "none" to take the copy out of its branch
+	Branch string `json:"branch" form:"branch"`
+}
+
+func copyToMap(cp Copy) map[string]interface{} {
+	branch := ""
+	if !cp.CopyBranch.IsZero() {
+		branch = cp.CopyBranch.Hex()
+	}
+	return map[string]interface{}{
+		"id":         cp.ID.Hex(),
+		"book":       cp.BookID.Hex(),
+		"barcode":    cp.CopyBarcode,
+		"acquired":   cp.CopyAcquired.Format(time.DateOnly),
+		"condition":  cp.CopyCondition,
+		"status":     cp.CopyStatus,
+		"price":      cp.CopyPrice,
+		"currency":   cp.CopyCurrency,
+		"location":   locationToMap(cp.CopyLocation),
+		"provenance": cp.CopyProvenance,
+		"branch":     branch,
+		"createdAt":  formatTimestamp(cp.CreatedAt),
+		"updatedAt":  formatTimestamp(cp.UpdatedAt),
+	}
+}
+
+func findCopies(coll *Repository, filter bson.M) ([]Copy, error) {
+	cursor, err := coll.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+	var results []Copy
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Counts the copies of every book, and how many of them can be lent right
+// now, with a single aggregation instead of one query per book. Lost and
+// withdrawn copies are not on the shelves anymore, so they don't count. The
+// scope narrows the copies further down, e.g., to a branch.
+func availabilityByBook(coll *Repository, scope bson.M) (map[primitive.ObjectID][2]int, error) {
+	match := bson.M{"copystatus": bson.M{"$nin": outOfCirculation}}
+	for k, v := range scope {
+		match[k] = v
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$bookid"},
+			{Key: "total", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "available", Value: bson.D{{Key: "$sum", Value: bson.D{
+				{Key: "$cond", Value: bson.A{bson.D{{Key: "$eq", Value: bson.A{"$copystatus", StatusAvailable}}}, 1, 0}},
+			}}}},
+		}}},
+	}
+	cursor, err := coll.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		BookID    primitive.ObjectID `bson:"_id"`
+		Total     int                `bson:"total"`
+		Available int                `bson:"available"`
+	}
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	ret := map[primitive.ObjectID][2]int{}
+	for _, r := range results {
+		ret[r.BookID] = [2]int{r.Total, r.Available}
+	}
+	return ret, nil
+}
+
+// Adds the "copies" and "available" counts to the books we are about to
+// return or render, counting only the copies in the scope.
+func addAvailability(coll *Repository, books []map[string]interface{}, scope bson.M) error {
+	counts, err := availabilityByBook(coll, scope)
+	if err != nil {
+		return err
+	}
+	fillAvailability(books, counts)
+	return nil
+}
+
+// Adds the counts of availabilityByBook to the books, e.g., to one batch
+// after the other when streaming them (see stream.go).
+func fillAvailability(books []map[string]interface{}, counts map[primitive.ObjectID][2]int) {
+	for _, b := range books {
+		id, _ := primitive.ObjectIDFromHex(b["id"].(string))
+		b["copies"] = counts[id][0]
+		b["available"] = counts[id][1]
+	}
+}
+
+// Validates the request and applies it over the given copy.
+func applyCopyRequest(coll *Repository, branches *Repository, cp *Copy, req copyRequest) string {
+	if req.Barcode = strings.TrimSpace(req.Barcode); req.Barcode != "" {
+		count, err := coll.CountDocuments(context.TODO(), bson.M{"copybarcode": req.Barcode, "_id": bson.M{"$ne": cp.ID}})
+		if err != nil {
+			return "failed to check barcode"
+		}
+		if count > 0 {
+			return "barcode already in use"
+		}
+		cp.CopyBarcode = req.Barcode
+	}
+	if req.Acquired != "" {
+		acquired, err := time.Parse(time.DateOnly, req.Acquired)
+		if err != nil {
+			return "acquired must be a date like 2024-05-14"
+		}
+		cp.CopyAcquired = acquired
+	}
+	if req.Condition != "" {
+		if !slices.Contains(copyConditions, req.Condition) {
+			return "condition must be one of " + strings.Join(copyConditions, ", ")
+		}
+		gradeCopy(cp, req.Condition, primitive.NilObjectID, "")
+	}
+	if req.Status != "" {
+		if !slices.Contains(copyStatuses, req.Status) {
+			return "status must be one of " + strings.Join(copyStatuses, ", ")
+		}
+		if !canTransition(copyTransitions, cp.CopyStatus, req.Status) {
+			return "cannot change status from " + cp.CopyStatus + " to " + req.Status
+		}
+		cp.CopyStatus = req.Status
+	}
+	if req.Branch == "none" {
+		cp.CopyBranch = primitive.NilObjectID
+	} else if req.Branch != "" {
+		branch, err := primitive.ObjectIDFromHex(req.Branch)
+		if err != nil {
+			return "invalid branch"
+		}
+		if err = branches.FindOne(context.TODO(), bson.M{"_id": branch}).Err(); err != nil {
+			return "branch not found"
+		}
+		cp.CopyBranch = branch
+	}
+	if req.Price != "" || req.Currency != "" {
+		price := cp.CopyPrice
+		if req.Price != "" {
+			var err error
+			if price, err = strconv.Atoi(req.Price); err != nil {
+				return "price must be a whole number of cents"
+			}
+		}
+		currency := cp.CopyCurrency
+		if req.Currency != "" {
+			currency = req.Currency
+		}
+		var msg string
+		if currency, msg = validatePrice(price, currency); msg != "" {
+			return msg
+		}
+		cp.CopyPrice, cp.CopyCurrency = price, currency
+	}
+	return ""
+}
+
+// A new copy is available and in good shape unless told otherwise. When no
+// barcode is given, we use the id so every copy has a unique one.
+func newCopy(bookID primitive.ObjectID) Copy {
+	cp := Copy{
+		ID:            primitive.NewObjectID(),
+		BookID:        bookID,
+		CopyAcquired:  time.Now().UTC().Truncate(24 * time.Hour),
+		CopyCondition: "good",
+		CopyStatus:    StatusAvailable,
+	}
+	cp.CopyBarcode = strings.ToUpper(cp.ID.Hex())
+	return cp
+}
+
+// Registers the endpoints to manage the physical copies of the books.
+func registerCopyRoutes(e *echo.Echo, books *Repository, branches *Repository, coll *Repository) {
+	e.GET("/api/books/:id/copies", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		filter, ok := branchFilter(c, bson.M{"bookid": id}, "copybranch")
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid branch"})
+		}
+		copies, err := findCopies(coll, filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list copies"})
+		}
+
+		list := []map[string]interface{}{}
+		available := 0
+		for _, cp := range copies {
+			list = append(list, copyToMap(cp))
+			if cp.CopyStatus == StatusAvailable {
+				available++
+			}
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"total":     len(copies),
+			"available": available,
+			"copies":    list,
+		})
+	})
+
+	e.POST("/api/books/:id/copies", func(c echo.Context) error {
+		bookID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var req copyRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if err = books.FindOne(context.TODO(), bson.M{"_id": bookID}).Err(); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+
+		cp := newCopy(bookID)
+		if msg := applyCopyRequest(coll, branches, &cp, req); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		if _, err = coll.InsertOne(c.Request().Context(), cp); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert copy"})
+		}
+		return c.JSON(http.StatusOK, copyToMap(cp))
+	})
+
+	e.GET("/api/copies/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		var cp Copy
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&cp); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "copy not found"})
+		}
+		return c.JSON(http.StatusOK, copyToMap(cp))
+	})
+
+	e.PUT("/api/copies", func(c echo.Context) error {
+		var req copyRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		id, err := primitive.ObjectIDFromHex(req.ID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		var cp Copy
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&cp); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "copy not found"})
+		}
+		if msg := applyCopyRequest(coll, branches, &cp, req); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		if _, err = coll.ReplaceOne(c.Request().Context(), bson.M{"_id": id}, cp); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update copy"})
+		}
+		return c.JSON(http.StatusOK, copyToMap(cp))
+	})
+
+	e.DELETE("/api/copies/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		// A loaned copy is still out there, so it has to be returned first
+		result, err := coll.DeleteOne(c.Request().Context(), bson.M{"_id": id, "copystatus": bson.M{"$ne": StatusLoaned}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete copy"})
+		}
+		if result.DeletedCount == 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "copy not found or currently loaned"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
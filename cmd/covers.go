@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	// These imports register the decoders for the formats we accept, so that
+	// image.Decode and image.DecodeConfig know how to read them.
+	_ "image/gif"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Largest cover we accept, in bytes
+	maxCoverSize = 5 << 20
+	// Largest cover we decode, in pixels. A few kilobytes of PNG can claim to
+	// be huge, and decoding it would take gigabytes of memory.
+	maxCoverPixels = 25_000_000
+	// Bounding box of the generated thumbnails, in pixels
+	thumbWidth  = 120
+	thumbHeight = 180
+	// Width of the thumbnails in the tables; twice as wide ones are used on
+	// high density screens
+	tableThumbWidth = 60
+)
+
+// The widths the thumbnails can be asked for, e.g., /covers/<id>/thumb?w=60.
+// They are kept to a few, as every one of them is stored once generated.
+// The height is always one and a half times the width.
+var thumbWidths = []int{tableThumbWidth, thumbWidth, 2 * thumbWidth}
+
+var errInvalidCover = errors.New("cover must be a PNG, JPEG or GIF image of at most 5MB and 25 megapixels")
+
+// Decodes a cover, once its header told us it isn't too large to.
+func decodeCover(data []byte) (image.Image, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errInvalidCover
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxCoverPixels {
+		return nil, "", errInvalidCover
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errInvalidCover
+	}
+	return img, format, nil
+}
+
+// Stores the uploaded cover under the given folder, named after the book id,
+// and generates its thumbnail next to it. It returns the name of the stored
+// file, which we keep in the book document.
+func saveCover(dir string, id primitive.ObjectID, header *multipart.FileHeader) (string, error) {
+	data, err := readCover(header)
+	if err != nil {
+		return "", err
+	}
+	return writeCover(dir, id, data)
+}
+
+func readCover(header *multipart.FileHeader) ([]byte, error) {
+	if header.Size > maxCoverSize {
+		return nil, errInvalidCover
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, maxCoverSize+1))
+}
+
+// Reads the cover sent along a multipart form and checks it is one we can
+// store, before the book it is for is created. Without a "cover" field, it
+// returns nothing.
+func uploadedCover(c echo.Context) ([]byte, error) {
+	header, err := c.FormFile("cover")
+	if err != nil {
+		return nil, nil
+	}
+	data, err := readCover(header)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxCoverSize {
+		return nil, errInvalidCover
+	}
+	if _, _, err = decodeCover(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Same as saveCover, for covers we already have in memory, e.g., those
+// downloaded from Open Library.
+func writeCover(dir string, id primitive.ObjectID, data []byte) (string, error) {
+	if len(data) > maxCoverSize {
+		return "", errInvalidCover
+	}
+
+	img, format, err := decodeCover(data)
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	// Remove any previous cover, it might have been uploaded in another format
+	removeCover(dir, id)
+
+	name := id.Hex() + "." + format
+	if err = os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+		return "", err
+	}
+
+	thumb, err := os.Create(filepath.Join(dir, thumbName(id)))
+	if err != nil {
+		return "", err
+	}
+	defer thumb.Close()
+	if err = jpeg.Encode(thumb, resize(img, thumbWidth, thumbHeight), &jpeg.Options{Quality: 80}); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Removes the cover and thumbnails of a book, whatever format they have.
+func removeCover(dir string, id primitive.ObjectID) {
+	matches, _ := filepath.Glob(filepath.Join(dir, id.Hex()+".*"))
+	sized, _ := filepath.Glob(filepath.Join(dir, id.Hex()+"_thumb*.jpg"))
+	for _, m := range append(matches, sized...) {
+		os.Remove(m)
+	}
+}
+
+func thumbName(id primitive.ObjectID) string {
+	return id.Hex() + "_thumb.jpg"
+}
+
+// The thumbnail of the given width, e.g., "<id>_thumb60.jpg". The one of the
+// default width is made along with the cover, the others when first asked.
+func sizedThumbName(id primitive.ObjectID, width int) string {
+	if width == thumbWidth {
+		return thumbName(id)
+	}
+	return fmt.Sprintf("%s_thumb%d.jpg", id.Hex(), width)
+}
+
+// Returns the path of the thumbnail of the given width, and generates it from
+// the cover if it isn't there yet.
+func sizedThumb(dir string, id primitive.ObjectID, cover string, width int) (string, error) {
+	path := filepath.Join(dir, sizedThumbName(id, width))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, cover))
+	if err != nil {
+		return "", err
+	}
+	img, _, err := decodeCover(data)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, resize(img, width, width*3/2), &jpeg.Options{Quality: 80}); err != nil {
+		return "", err
+	}
+	// Written aside first, so a request at the same time never gets half of it
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// The address of the thumbnail of the book of the given width
+func thumbURL(book BookStore, width int) string {
+	return fmt.Sprintf("%s/thumb?w=%d", coverURL(book), width)
+}
+
+// Scales the image down to fit in the given box, keeping its aspect ratio.
+// Every pixel of the result is the average of the source pixels it covers,
+// which looks much better than just picking the nearest pixel.
+func resize(src image.Image, maxWidth int, maxHeight int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxWidth && h <= maxHeight {
+		return src
+	}
+	if w*maxHeight > h*maxWidth {
+		maxHeight = max(1, h*maxWidth/w)
+	} else {
+		maxWidth = max(1, w*maxHeight/h)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, maxWidth, maxHeight))
+	for y := 0; y < maxHeight; y++ {
+		y0, y1 := b.Min.Y+y*h/maxHeight, b.Min.Y+max((y+1)*h/maxHeight, y*h/maxHeight+1)
+		for x := 0; x < maxWidth; x++ {
+			x0, x1 := b.Min.X+x*w/maxWidth, b.Min.X+max((x+1)*w/maxWidth, x*w/maxWidth+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// Stores the cover sent along a multipart form, if there is one, and records
+// it on the book. Requests without a "cover" field are simply left alone.
+func storeUploadedCover(c echo.Context, coll *Repository, dir string, id primitive.ObjectID) error {
+	header, err := c.FormFile("cover")
+	if err != nil {
+		return nil
+	}
+	name, err := saveCover(dir, id, header)
+	if err != nil {
+		return err
+	}
+	_, err = coll.UpdateOne(c.Request().Context(), bson.M{"_id": id}, bson.M{"$set": bson.M{"bookcover": name}})
+	return err
+}
+
+// Downloads a cover from somewhere else, e.g., Open Library, and stores it
+// as if it had been uploaded.
+func downloadCover(ctx context.Context, client *http.Client, coll *Repository, dir string, id primitive.ObjectID, from string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, from, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cover download answered %s", resp.Status)
+	}
+	// One byte more than allowed, so writeCover can tell it is too large
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCoverSize+1))
+	if err != nil {
+		return err
+	}
+
+	return storeCover(ctx, coll, dir, id, data)
+}
+
+// Stores the cover and records it on the book.
+func storeCover(ctx context.Context, coll *Repository, dir string, id primitive.ObjectID, data []byte) error {
+	name, err := writeCover(dir, id, data)
+	if err != nil {
+		return err
+	}
+	_, err = coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"bookcover": name}})
+	return err
+}
+
+// Every book has a cover: the uploaded one, one fetched by its ISBN, or a
+// placeholder, see placeholders.go.
+func coverURL(book BookStore) string {
+	return "/covers/" + book.ID.Hex()
+}
+
+// Registers the endpoints to upload, remove and serve book covers.
+func registerCoverRoutes(e *echo.Echo, coll *Repository, fetcher *CoverFetcher, cfg Config) {
+	// The id is parsed as an ObjectID and the file name comes from the
+	// database, so nobody can sneak a "../" into the path we serve.
+	serve := func(c echo.Context, thumb bool) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		width := thumbWidth
+		if w := c.QueryParam("w"); thumb && w != "" {
+			if width, err = strconv.Atoi(w); err != nil || !slices.Contains(thumbWidths, width) {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("w must be one of %v", thumbWidths)})
+			}
+		}
+
+		var book BookStore
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&book); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "cover not found"})
+		}
+		if book.BookCover == "" {
+			fetcher.Fetch(book)
+			size := 2 * thumbWidth
+			if thumb {
+				size = width
+			}
+			var buf bytes.Buffer
+			if err = png.Encode(&buf, placeholderCover(book, size, size*3/2)); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to draw cover"})
+			}
+			return c.Blob(http.StatusOK, "image/png", buf.Bytes())
+		}
+		if thumb {
+			path, err := sizedThumb(cfg.CoversPath, id, book.BookCover, width)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to resize cover"})
+			}
+			return c.File(path)
+		}
+		return c.File(filepath.Join(cfg.CoversPath, book.BookCover))
+	}
+
+	e.GET("/covers/:id", func(c echo.Context) error {
+		return serve(c, false)
+	})
+
+	e.GET("/covers/:id/thumb", func(c echo.Context) error {
+		return serve(c, true)
+	})
+
+	e.POST("/api/books/:id/cover", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		if _, err = c.FormFile("cover"); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "cover is required"})
+		}
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Err(); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+
+		if err = storeUploadedCover(c, coll, cfg.CoversPath, id); err != nil {
+			if errors.Is(err, errInvalidCover) {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to store cover"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"cover": "/covers/" + id.Hex()})
+	})
+
+	e.DELETE("/api/books/:id/cover", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		result, err := coll.UpdateOne(c.Request().Context(), bson.M{"_id": id}, bson.M{"$unset": bson.M{"bookcover": ""}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to remove cover"})
+		}
+		removeCover(cfg.CoversPath, id)
+		return c.JSON(http.StatusOK, result)
+	})
+}
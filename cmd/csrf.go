@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// The name of the header the pages send the CSRF token in
+const csrfHeader = "X-CSRF-Token"
+
+// Protects the forms against cross-site request forgery: another website
+// making the browser of a logged in user submit one of our forms. Every
+// page gets a random token, which is also kept in a cookie, and the
+// requests changing anything must send it back. The other website can't
+// read it, so it can't send it either.
+//
+// Requests that don't come from our forms, i.e., with JSON or the headers of
+// the API tokens and keys, are left alone: browsers don't let other
+// websites send those without asking us first, and they don't rely on the
+// cookies anyway.
+func csrfProtection() echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		TokenLookup:    "header:" + csrfHeader + ",form:_csrf",
+		CookiePath:     "/",
+		CookieHTTPOnly: true,
+		CookieSameSite: http.SameSiteLaxMode,
+		Skipper: func(c echo.Context) bool {
+			header := c.Request().Header
+			if strings.HasPrefix(header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+				return true
+			}
+			for _, h := range []string{echo.HeaderAuthorization, apiKeyHeader, adminTokenHeader, tenantTokenHeader} {
+				if header.Get(h) != "" {
+					return true
+				}
+			}
+			return false
+		},
+	})
+}
+
+// Returns the CSRF token of the request, for the templates.
+func csrfToken(c echo.Context) string {
+	token, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	return token
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The ISO 4217 codes of the currencies in circulation. Prices in any other
+// currency are refused.
+var currencies = map[string]bool{
+	"AED": true, "AFN": true, "ALL": true, "AMD": true, "ANG": true, "AOA": true, "ARS": true, "AUD": true,
+	"AWG": true, "AZN": true, "BAM": true, "BBD": true, "BDT": true, "BGN": true, "BHD": true, "BIF": true,
+	"BMD": true, "BND": true, "BOB": true, "BRL": true, "BSD": true, "BTN": true, "BWP": true, "BYN": true,
+	"BZD": true, "CAD": true, "CDF": true, "CHF": true, "CLP": true, "CNY": true, "COP": true, "CRC": true,
+	"CUP": true, "CVE": true, "CZK": true, "DJF": true, "DKK": true, "DOP": true, "DZD": true, "EGP": true,
+	"ERN": true, "ETB": true, "EUR": true, "FJD": true, "FKP": true, "GBP": true, "GEL": true, "GHS": true,
+	"GIP": true, "GMD": true, "GNF": true, "GTQ": true, "GYD": true, "HKD": true, "HNL": true, "HTG": true,
+	"HUF": true, "IDR": true, "ILS": true, "INR": true, "IQD": true, "IRR": true, "ISK": true, "JMD": true,
+	"JOD": true, "JPY": true, "KES": true, "KGS": true, "KHR": true, "KMF": true, "KPW": true, "KRW": true,
+	"KWD": true, "KYD": true, "KZT": true, "LAK": true, "LBP": true, "LKR": true, "LRD": true, "LSL": true,
+	"LYD": true, "MAD": true, "MDL": true, "MGA": true, "MKD": true, "MMK": true, "MNT": true, "MOP": true,
+	"MRU": true, "MUR": true, "MVR": true, "MWK": true, "MXN": true, "MYR": true, "MZN": true, "NAD": true,
+	"NGN": true, "NIO": true, "NOK": true, "NPR": true, "NZD": true, "OMR": true, "PAB": true, "PEN": true,
+	"PGK": true, "PHP": true, "PKR": true, "PLN": true, "PYG": true, "QAR": true, "RON": true, "RSD": true,
+	"RUB": true, "RWF": true, "SAR": true, "SBD": true, "SCR": true, "SDG": true, "SEK": true, "SGD": true,
+	"SHP": true, "SLE": true, "SOS": true, "SRD": true, "SSP": true, "STN": true, "SVC": true, "SYP": true,
+	"SZL": true, "THB": true, "TJS": true, "TMT": true, "TND": true, "TOP": true, "TRY": true, "TTD": true,
+	"TWD": true, "TZS": true, "UAH": true, "UGX": true, "USD": true, "UYU": true, "UZS": true, "VES": true,
+	"VND": true, "VUV": true, "WST": true, "XAF": true, "XCD": true, "XOF": true, "XPF": true, "YER": true,
+	"ZAR": true, "ZMW": true, "ZWL": true,
+}
+
+// Validates a price and its currency. Prices are in cents (or whatever the
+// smallest unit of the currency is), and need a currency unless they are 0.
+// The currency is returned as an upper case code.
+func validatePrice(price int, currency string) (string, string) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if price < 0 {
+		return currency, "price cannot be negative"
+	}
+	if currency == "" {
+		if price > 0 {
+			return currency, "currency is required along with a price"
+		}
+		return currency, ""
+	}
+	if !currencies[currency] {
+		return currency, "currency must be an ISO 4217 code, e.g. EUR"
+	}
+	return currency, ""
+}
+
+// Adds up what the collection is worth: every copy counts with the price it
+// was acquired for, or with the price of its book when that is unknown. The
+// amounts are converted to the base currency with the configured rates;
+// those in currencies without a rate are listed apart.
+func collectionValue(books *Repository, copies *Repository, cfg Config) (map[string]interface{}, error) {
+	cursor, err := books.Find(context.TODO(), bson.M{"bookprice": bson.M{"$gt": 0}})
+	if err != nil {
+		return nil, err
+	}
+	var priced []BookStore
+	if err = cursor.All(context.TODO(), &priced); err != nil {
+		return nil, err
+	}
+	bookPrices := map[string]BookStore{}
+	for _, b := range priced {
+		bookPrices[b.ID.Hex()] = b
+	}
+
+	all, err := findCopies(copies, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0.0
+	unconverted := map[string]int{}
+	unpriced := 0
+	for _, cp := range all {
+		price, currency := cp.CopyPrice, cp.CopyCurrency
+		if price == 0 {
+			b := bookPrices[cp.BookID.Hex()]
+			price, currency = b.BookPrice, b.BookCurrency
+		}
+		switch rate, ok := cfg.ExchangeRates[currency]; {
+		case price == 0:
+			unpriced++
+		case currency == cfg.BaseCurrency:
+			total += float64(price)
+		case ok:
+			total += float64(price) * rate
+		default:
+			unconverted[currency] += price
+		}
+	}
+
+	cents := int(math.Round(total))
+	return map[string]interface{}{
+		"currency":    cfg.BaseCurrency,
+		"total":       cents,
+		"display":     formatCents(cents) + " " + cfg.BaseCurrency,
+		"unconverted": unconverted,
+		"unpriced":    unpriced,
+	}, nil
+}
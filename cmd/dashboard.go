@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How many months the growth chart of the dashboard goes back, and how many
+// books and changes its lists show
+const (
+	growthMonths   = 12
+	dashboardLimit = 10
+)
+
+// Counts the books added in every month of the last months, the current one
+// included, oldest first. The months without books are there with 0, so the
+// chart has no gaps. The share of the busiest month is there for the bars.
+func monthlyGrowth(ctx context.Context, books *Repository, months int) ([]map[string]interface{}, error) {
+	now := time.Now().UTC()
+	start := time.Date(now.Year(), now.Month()-time.Month(months-1), 1, 0, 0, 0, 0, time.UTC)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"createdat": bson.M{"$gte": start}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$dateToString", Value: bson.D{{Key: "format", Value: "%Y-%m"}, {Key: "date", Value: "$createdat"}}}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	}
+	cursor, err := books.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Month string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	most := 0
+	for _, r := range results {
+		counts[r.Month] = r.Count
+		most = max(most, r.Count)
+	}
+
+	ret := []map[string]interface{}{}
+	for m := start; !m.After(now); m = m.AddDate(0, 1, 0) {
+		month := m.Format("2006-01")
+		share := 0
+		if most > 0 {
+			share = counts[month] * 100 / most
+		}
+		ret = append(ret, map[string]interface{}{"month": month, "count": counts[month], "share": share})
+	}
+	return ret, nil
+}
+
+// The books lent most often, with how often, most loaned first. Loans of
+// books that were deleted since are left out.
+func mostLoaned(ctx context.Context, books *Repository, loans *Repository, limit int) ([]map[string]interface{}, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$bookid"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := loans.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		BookID primitive.ObjectID `bson:"_id"`
+		Count  int                `bson:"count"`
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(results))
+	for i, r := range results {
+		ids[i] = r.BookID
+	}
+
+	names := map[primitive.ObjectID]map[string]interface{}{}
+	for _, b := range findAllBooks(books, bson.M{"_id": bson.M{"$in": ids}}) {
+		id, _ := primitive.ObjectIDFromHex(b["id"].(string))
+		names[id] = b
+	}
+	ret := []map[string]interface{}{}
+	for _, r := range results {
+		if b, ok := names[r.BookID]; ok {
+			ret = append(ret, map[string]interface{}{"id": b["id"], "name": b["name"], "author": b["author"], "loans": r.Count})
+		}
+	}
+	return ret, nil
+}
+
+// The latest changes of the audit log, newest first
+func recentActivity(ctx context.Context, audit *Repository, limit int) ([]map[string]interface{}, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "audittime", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := audit.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []AuditEntry
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	ret := []map[string]interface{}{}
+	for _, a := range results {
+		book := ""
+		if !a.AuditBook.IsZero() {
+			book = a.AuditBook.Hex()
+		}
+		ret = append(ret, map[string]interface{}{
+			"collection": a.AuditCollection,
+			"action":     a.AuditAction,
+			"book":       book,
+			"actor":      a.AuditActor,
+			"time":       a.AuditTime.Format(time.DateTime),
+		})
+	}
+	return ret, nil
+}
+
+// Registers the dashboard of the admins at /admin: the totals of the
+// catalog, the books added month by month, the books lent most, and the
+// latest changes, and the routes of the server closest to their error
+// budget (see metrics.go). The page reloads its numbers from /admin/stats
+// every half a minute. The growth and the most loaned books are also at
+// /api/stats/growth and /api/stats/loaned, for other tools to chart.
+func registerDashboardRoutes(e *echo.Echo, cfg Config, books *Repository, copies *Repository, members *Repository, loans *Repository, audit *Repository) {
+	stats := func(c echo.Context) (map[string]interface{}, string, error) {
+		ctx := c.Request().Context()
+		totals, name, err := catalogTotals(ctx, books, copies, members, loans)
+		if err != nil {
+			return nil, "failed to count " + name, err
+		}
+		growth, err := monthlyGrowth(ctx, books, growthMonths)
+		if err != nil {
+			return nil, "failed to count new books", err
+		}
+		loaned, err := mostLoaned(ctx, books, loans, dashboardLimit)
+		if err != nil {
+			return nil, "failed to count loans", err
+		}
+		activity, err := recentActivity(ctx, audit, dashboardLimit)
+		if err != nil {
+			return nil, "failed to list audit log", err
+		}
+		return map[string]interface{}{
+			"totals":   totals,
+			"growth":   growth,
+			"loaned":   loaned,
+			"activity": activity,
+			"routes":   routeMetrics.Summary(cfg.SLOObjective, dashboardLimit),
+			"slo":      fmt.Sprintf("%g%%", 100*cfg.SLOObjective),
+			"updated":  time.Now().Format(time.TimeOnly),
+		}, "", nil
+	}
+
+	e.GET("/admin", func(c echo.Context) error {
+		data, msg, err := stats(c)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": msg})
+		}
+		return c.Render(http.StatusOK, "admin-dashboard", data)
+	})
+
+	e.GET("/admin/stats", func(c echo.Context) error {
+		data, msg, err := stats(c)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": msg})
+		}
+		return c.Render(http.StatusOK, "admin-stats", data)
+	})
+
+	e.GET("/api/stats/growth", func(c echo.Context) error {
+		growth, err := monthlyGrowth(c.Request().Context(), books, growthMonths)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count new books"})
+		}
+		return c.JSON(http.StatusOK, growth)
+	})
+
+	e.GET("/api/stats/loaned", func(c echo.Context) error {
+		loaned, err := mostLoaned(c.Request().Context(), books, loans, dashboardLimit)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count loans"})
+		}
+		return c.JSON(http.StatusOK, loaned)
+	})
+}
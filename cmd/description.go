@@ -0,0 +1,180 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// Longest description we accept, in characters
+const maxDescription = 10000
+
+// The tags a description may use. Anything else is dropped, keeping only
+// its text, except for the ones in droppedTags where the content goes too.
+var descriptionTags = map[string]bool{
+	"p": true, "br": true, "strong": true, "b": true, "em": true, "i": true,
+	"ul": true, "ol": true, "li": true, "blockquote": true, "code": true,
+	"pre": true, "a": true, "h3": true, "h4": true,
+}
+
+var droppedTags = map[string]bool{"script": true, "style": true, "iframe": true, "object": true, "textarea": true}
+
+var (
+	mdBold   = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	mdItalic = regexp.MustCompile(`\*(.+?)\*`)
+	mdCode   = regexp.MustCompile("`([^`]+)`")
+	mdLink   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+)
+
+// Turns the little Markdown we support into HTML: paragraphs separated by
+// blank lines, "- " lists, "> " quotes, **bold**, *italic*, `code` and
+// [links](https://...). Blocks starting with a tag are taken as HTML.
+// The result still has to go through sanitizeHTML.
+func renderMarkdown(src string) string {
+	blocks := strings.Split(strings.ReplaceAll(strings.TrimSpace(src), "\r\n", "\n"), "\n\n")
+	var out strings.Builder
+	for _, block := range blocks {
+		block = strings.TrimSpace(block)
+		if block == "" {
+			continue
+		}
+		if strings.HasPrefix(block, "<") {
+			out.WriteString(block)
+			continue
+		}
+
+		lines := strings.Split(block, "\n")
+		switch {
+		case every(lines, "- "):
+			out.WriteString("<ul>")
+			for _, l := range lines {
+				out.WriteString("<li>" + renderInline(strings.TrimPrefix(l, "- ")) + "</li>")
+			}
+			out.WriteString("</ul>")
+		case every(lines, "> "):
+			quoted := []string{}
+			for _, l := range lines {
+				quoted = append(quoted, renderInline(strings.TrimPrefix(l, "> ")))
+			}
+			out.WriteString("<blockquote>" + strings.Join(quoted, "<br>") + "</blockquote>")
+		default:
+			rendered := []string{}
+			for _, l := range lines {
+				rendered = append(rendered, renderInline(l))
+			}
+			out.WriteString("<p>" + strings.Join(rendered, "<br>") + "</p>")
+		}
+	}
+	return out.String()
+}
+
+func every(lines []string, prefix string) bool {
+	for _, l := range lines {
+		if !strings.HasPrefix(l, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func renderInline(text string) string {
+	text = mdCode.ReplaceAllString(text, "<code>$1</code>")
+	text = mdLink.ReplaceAllString(text, `<a href="$2">$1</a>`)
+	text = mdBold.ReplaceAllString(text, "<strong>$1</strong>")
+	return mdItalic.ReplaceAllString(text, "<em>$1</em>")
+}
+
+// Only plain web and mail links, so nobody can sneak in a "javascript:" one.
+func safeLink(href string) bool {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "mailto"
+}
+
+// Cleans up a piece of HTML so it only has the tags we allow, without any
+// attribute except the link of an <a>. The text is escaped again on the way
+// out, and tags left open are closed, so the result is safe to put as it is
+// into a page.
+func sanitizeHTML(src string) string {
+	var out strings.Builder
+	open := []string{}
+	dropping := 0
+
+	z := nethtml.NewTokenizer(strings.NewReader(src))
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			break
+		}
+		tok := z.Token()
+		switch tt {
+		case nethtml.TextToken:
+			if dropping == 0 {
+				out.WriteString(html.EscapeString(tok.Data))
+			}
+		case nethtml.StartTagToken, nethtml.SelfClosingTagToken:
+			if droppedTags[tok.Data] {
+				if tt == nethtml.StartTagToken {
+					dropping++
+				}
+				continue
+			}
+			if dropping > 0 || !descriptionTags[tok.Data] {
+				continue
+			}
+			if tok.Data == "br" {
+				out.WriteString("<br>")
+				continue
+			}
+			if tok.Data == "a" {
+				href := ""
+				for _, attr := range tok.Attr {
+					if attr.Key == "href" && safeLink(attr.Val) {
+						href = attr.Val
+					}
+				}
+				out.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener">`)
+			} else {
+				out.WriteString("<" + tok.Data + ">")
+			}
+			if tt == nethtml.StartTagToken {
+				open = append(open, tok.Data)
+			} else {
+				out.WriteString("</" + tok.Data + ">")
+			}
+		case nethtml.EndTagToken:
+			if droppedTags[tok.Data] {
+				dropping = max(0, dropping-1)
+				continue
+			}
+			// Close everything that was opened after the tag being closed
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == tok.Data {
+					for j := len(open) - 1; j >= i; j-- {
+						out.WriteString("</" + open[j] + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString("</" + open[i] + ">")
+	}
+	return out.String()
+}
+
+// Renders and sanitizes the description of a book, reporting false when it
+// is too long.
+func renderDescription(src string) (string, bool) {
+	if len([]rune(src)) > maxDescription {
+		return "", false
+	}
+	return sanitizeHTML(renderMarkdown(src)), true
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Books and copies remember how they came into the library, so we can tell
+// the bought ones from the donated ones.
+const (
+	ProvenancePurchase = "purchase"
+	ProvenanceDonation = "donation"
+)
+
+// Books somebody gave to the library. Unlike orders, donations are in our
+// hands already, so the books and copies are added as soon as they are
+// recorded. The items are the same as for orders, with the price being what
+// a copy is estimated to be worth.
+type Donation struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	DonationDonor string             `bson:"donationdonor"`
+	DonationEmail string             `bson:"donationemail,omitempty"`
+	DonationDate  time.Time          `bson:"donationdate"`
+	DonationNotes string             `bson:"donationnotes,omitempty"`
+	DonationItems []OrderItem        `bson:"donationitems"`
+}
+
+func donationToMap(d Donation) map[string]interface{} {
+	items := []map[string]interface{}{}
+	for _, i := range d.DonationItems {
+		items = append(items, map[string]interface{}{
+			"book":     i.Book.Hex(),
+			"title":    i.Title,
+			"author":   i.Author,
+			"isbn":     i.ISBN,
+			"quantity": i.Quantity,
+			"price":    i.Price,
+			"currency": i.Currency,
+		})
+	}
+	return map[string]interface{}{
+		"id":    d.ID.Hex(),
+		"donor": d.DonationDonor,
+		"email": d.DonationEmail,
+		"date":  d.DonationDate.Format(time.DateOnly),
+		"notes": d.DonationNotes,
+		"items": items,
+	}
+}
+
+// Reads the optional from and to query parameters (both ends included) into
+// a filter on the given field.
+func dateRangeFilter(c echo.Context, field string) (bson.M, string) {
+	query := newQuery(field)
+	if value := c.QueryParam("from"); value != "" {
+		from, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return nil, "from must look like 2024-05-01"
+		}
+		query.Where(field, "$gte", from)
+	}
+	if value := c.QueryParam("to"); value != "" {
+		to, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return nil, "to must look like 2024-05-31"
+		}
+		query.Where(field, "$lt", to.AddDate(0, 0, 1))
+	}
+	filter, err := query.Filter()
+	if err != nil {
+		return nil, err.Error()
+	}
+	return filter, ""
+}
+
+func findDonations(coll *Repository, filter bson.M) ([]Donation, error) {
+	cursor, err := coll.Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "donationdate", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	var results []Donation
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Sums up the donations per donor: how many times they gave, how many books
+// and copies, and what those are estimated to be worth per currency. Donors
+// are told apart by their email when they left one, by their name otherwise.
+func donorReport(donations []Donation) []map[string]interface{} {
+	donors := map[string]map[string]interface{}{}
+	order := []string{}
+	for _, d := range donations {
+		key := strings.ToLower(d.DonationDonor)
+		if d.DonationEmail != "" {
+			key = d.DonationEmail
+		}
+		donor, ok := donors[key]
+		if !ok {
+			donor = map[string]interface{}{
+				"donor":     d.DonationDonor,
+				"email":     d.DonationEmail,
+				"donations": 0,
+				"books":     map[string]bool{},
+				"copies":    0,
+				"value":     map[string]int{},
+				"first":     d.DonationDate,
+				"last":      d.DonationDate,
+			}
+			donors[key] = donor
+			order = append(order, key)
+		}
+		donor["donations"] = donor["donations"].(int) + 1
+		for _, i := range d.DonationItems {
+			donor["books"].(map[string]bool)[i.Book.Hex()] = true
+			donor["copies"] = donor["copies"].(int) + i.Quantity
+			if i.Price > 0 {
+				donor["value"].(map[string]int)[i.Currency] += i.Price * i.Quantity
+			}
+		}
+		if d.DonationDate.Before(donor["first"].(time.Time)) {
+			donor["first"] = d.DonationDate
+		}
+		if d.DonationDate.After(donor["last"].(time.Time)) {
+			donor["last"] = d.DonationDate
+		}
+	}
+
+	ret := []map[string]interface{}{}
+	for _, key := range order {
+		donor := donors[key]
+		donor["books"] = len(donor["books"].(map[string]bool))
+		donor["first"] = donor["first"].(time.Time).Format(time.DateOnly)
+		donor["last"] = donor["last"].(time.Time).Format(time.DateOnly)
+		ret = append(ret, donor)
+	}
+	// The most generous donors first
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i]["copies"].(int) > ret[j]["copies"].(int) })
+	return ret
+}
+
+// Registers the endpoints to record donations and the donor report.
+func registerDonationRoutes(e *echo.Echo, books *Repository, copies *Repository, coll *Repository) {
+	e.GET("/api/donations", func(c echo.Context) error {
+		filter, msg := dateRangeFilter(c, "donationdate")
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+		donations, err := findDonations(coll, filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list donations"})
+		}
+		ret := []map[string]interface{}{}
+		for _, d := range donations {
+			ret = append(ret, donationToMap(d))
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	e.GET("/api/donations/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var donation Donation
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&donation); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "donation not found"})
+		}
+		return c.JSON(http.StatusOK, donationToMap(donation))
+	})
+
+	e.POST("/api/donations", func(c echo.Context) error {
+		var req struct {
+			Donor string      `json:"donor"`
+			Email string      `json:"email"`
+			Date  string      `json:"date"`
+			Notes string      `json:"notes"`
+			Items []OrderItem `json:"items"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		donation := Donation{
+			ID:            primitive.NewObjectID(),
+			DonationDonor: strings.TrimSpace(req.Donor),
+			DonationEmail: strings.ToLower(strings.TrimSpace(req.Email)),
+			DonationDate:  time.Now().UTC().Truncate(24 * time.Hour),
+			DonationNotes: strings.TrimSpace(req.Notes),
+			DonationItems: req.Items,
+		}
+		if donation.DonationDonor == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "donor is required"})
+		}
+		if donation.DonationEmail != "" {
+			if _, err := mail.ParseAddress(donation.DonationEmail); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid email"})
+			}
+		}
+		if req.Date != "" {
+			date, err := time.Parse(time.DateOnly, req.Date)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "date must look like 2024-05-14"})
+			}
+			donation.DonationDate = date
+		}
+		if msg := validateOrderItems(books, donation.DonationItems); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		ctx := c.Request().Context()
+		if msg := acquireItems(ctx, books, copies, donation.DonationItems, ProvenanceDonation, donation.ID); msg != "" {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": msg})
+		}
+		if _, err := coll.InsertOne(ctx, donation); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert donation"})
+		}
+		return c.JSON(http.StatusOK, donationToMap(donation))
+	})
+
+	e.GET("/api/reports/donors", func(c echo.Context) error {
+		filter, msg := dateRangeFilter(c, "donationdate")
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+		donations, err := findDonations(coll, filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list donations"})
+		}
+		return c.JSON(http.StatusOK, donorReport(donations))
+	})
+}
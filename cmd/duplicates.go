@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How similar (from 0 to 1) the titles and authors of two books must be for
+// us to suspect they are the same book.
+const duplicateSimilarity = 0.85
+
+// Reduces an ISBN to its digits, converting the old 10 digit ones into their
+// 13 digit form, so "958-30-0804-4" and "9789583008041" compare equal.
+func normalizeISBN(isbn string) string {
+	digits := []rune{}
+	for _, r := range strings.ToUpper(isbn) {
+		if unicode.IsDigit(r) || r == 'X' {
+			digits = append(digits, r)
+		}
+	}
+	if len(digits) != 10 {
+		return string(digits)
+	}
+
+	isbn13 := "978" + string(digits[:9])
+	sum := 0
+	for i, r := range isbn13 {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += int(r-'0') * weight
+	}
+	return isbn13 + string(rune('0'+(10-sum%10)%10))
+}
+
+// Lowercases the text and strips the punctuation and the leading article, so
+// "The Black Cat." and "black cat" end up the same.
+func normalizeTitle(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > 1 && slices.Contains([]string{"the", "a", "an"}, words[0]) {
+		words = words[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// The edit distance between two strings: how many characters have to be
+// inserted, removed or replaced to turn one into the other.
+func levenshtein(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func similarity(a string, b string) float64 {
+	longest := max(len([]rune(a)), len([]rune(b)))
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(a, b))/float64(longest)
+}
+
+// Groups the books that are likely the same: either their ISBNs match, or
+// their titles and authors are close enough. Books are compared pairwise,
+// which is fine for the size of a library catalogue. Two books that are both
+// similar to a third one end up in the same group.
+func findDuplicates(books []BookStore) [][]BookStore {
+	group := make([]int, len(books))
+	for i := range group {
+		group[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if group[i] != i {
+			group[i] = find(group[i])
+		}
+		return group[i]
+	}
+
+	keys := make([]string, len(books))
+	for i, b := range books {
+		keys[i] = normalizeTitle(b.BookName) + " / " + normalizeTitle(b.BookAuthor)
+	}
+	for i := range books {
+		for j := i + 1; j < len(books); j++ {
+			isbn := normalizeISBN(books[i].BookISBN)
+			if (isbn != "" && isbn == normalizeISBN(books[j].BookISBN)) || similarity(keys[i], keys[j]) >= duplicateSimilarity {
+				group[find(j)] = find(i)
+			}
+		}
+	}
+
+	byGroup := map[int][]BookStore{}
+	order := []int{}
+	for i, b := range books {
+		g := find(i)
+		if _, ok := byGroup[g]; !ok {
+			order = append(order, g)
+		}
+		byGroup[g] = append(byGroup[g], b)
+	}
+	ret := [][]BookStore{}
+	for _, g := range order {
+		if len(byGroup[g]) > 1 {
+			ret = append(ret, byGroup[g])
+		}
+	}
+	return ret
+}
+
+// Registers the endpoints to find duplicated books and merge them into one.
+func registerDuplicateRoutes(e *echo.Echo, cfg Config, admin *AdminLog, coll *Repository, bookGenres *Repository, copies *Repository,
+	loans *Repository, holds *Repository, reviews *Repository, favorites *Repository, lists *Repository) {
+	e.GET("/api/books/duplicates", func(c echo.Context) error {
+		cursor, err := coll.Find(context.TODO(), bson.M{})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list books"})
+		}
+		var books []BookStore
+		if err = cursor.All(context.TODO(), &books); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list books"})
+		}
+
+		ret := [][]map[string]interface{}{}
+		for _, group := range findDuplicates(books) {
+			list := []map[string]interface{}{}
+			for _, b := range group {
+				list = append(list, map[string]interface{}{
+					"id":     b.ID.Hex(),
+					"name":   b.BookName,
+					"author": b.BookAuthor,
+					"isbn":   b.BookISBN,
+					"year":   b.BookYear,
+				})
+			}
+			ret = append(ret, list)
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	// Merges the given books into the one they are merged into: everything
+	// that pointed to them (copies, loans, holds, reviews, favorites, genres,
+	// lists) is moved over, and then they are deleted. Their history stays in
+	// the audit log, and the merged book remembers their ids to find it.
+	e.POST("/api/books/merge", func(c echo.Context) error {
+		var req struct {
+			Into  string   `json:"into" form:"into"`
+			Books []string `json:"books" form:"books"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		into, err := primitive.ObjectIDFromHex(req.Into)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		ids, ok := parseObjectIDs(req.Books)
+		if !ok || len(ids) == 0 || slices.Contains(ids, into) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "books must be a list of other book ids"})
+		}
+
+		var target BookStore
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": into}).Decode(&target); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+		cursor, err := coll.Find(context.TODO(), bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list books"})
+		}
+		var others []BookStore
+		if err = cursor.All(context.TODO(), &others); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list books"})
+		}
+		if len(others) != len(ids) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+
+		ctx := c.Request().Context()
+		failed := func() error {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to merge books"})
+		}
+
+		// The merged book keeps its own values, and takes the missing ones
+		// from the others
+		set := bson.M{}
+		tags := target.BookTags
+		for _, b := range others {
+			for _, t := range b.BookTags {
+				if !slices.Contains(tags, t) {
+					tags = append(tags, t)
+				}
+			}
+			if target.BookLanguage == "" && b.BookLanguage != "" {
+				target.BookLanguage = b.BookLanguage
+				set["booklanguage"] = b.BookLanguage
+			}
+			if target.BookSeries.IsZero() && !b.BookSeries.IsZero() {
+				target.BookSeries, target.BookVolume = b.BookSeries, b.BookVolume
+				set["bookseries"], set["bookvolume"] = b.BookSeries, b.BookVolume
+			}
+			if target.BookWork.IsZero() && !b.BookWork.IsZero() {
+				target.BookWork = b.BookWork
+				set["bookwork"] = b.BookWork
+			}
+		}
+		if len(tags) > 0 {
+			set["booktags"] = tags
+		}
+		update := bson.M{"$addToSet": bson.M{"bookmerged": bson.M{"$each": ids}}}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		if _, err = coll.UpdateOne(ctx, bson.M{"_id": into}, update); err != nil {
+			return failed()
+		}
+
+		moved := bson.M{"bookid": bson.M{"$in": ids}}
+		for _, r := range []*Repository{copies, loans, holds, reviews, favorites} {
+			if _, err = r.UpdateMany(ctx, moved, bson.M{"$set": bson.M{"bookid": into}}); err != nil {
+				return failed()
+			}
+		}
+
+		// Genres the merged book already has would end up twice
+		cursor, err = bookGenres.Find(context.TODO(), bson.M{"bookid": into})
+		if err != nil {
+			return failed()
+		}
+		var links []BookGenre
+		if err = cursor.All(context.TODO(), &links); err != nil {
+			return failed()
+		}
+		genres := []primitive.ObjectID{}
+		for _, l := range links {
+			genres = append(genres, l.GenreID)
+		}
+		if _, err = bookGenres.DeleteMany(ctx, bson.M{"bookid": bson.M{"$in": ids}, "genreid": bson.M{"$in": genres}}); err != nil {
+			return failed()
+		}
+		if _, err = bookGenres.UpdateMany(ctx, moved, bson.M{"$set": bson.M{"bookid": into}}); err != nil {
+			return failed()
+		}
+
+		// Lists holding the merged book already just lose the others,
+		// the rest get the merged book in their place
+		if _, err = lists.UpdateMany(ctx, bson.M{"listbooks": into}, bson.M{"$pull": bson.M{"listbooks": bson.M{"$in": ids}}}); err != nil {
+			return failed()
+		}
+		for _, id := range ids {
+			if _, err = lists.UpdateMany(ctx, bson.M{"listbooks": id}, bson.M{"$set": bson.M{"listbooks.$": into}}); err != nil {
+				return failed()
+			}
+			if _, err = lists.UpdateMany(ctx, bson.M{"listbooks": id}, bson.M{"$pull": bson.M{"listbooks": id}}); err != nil {
+				return failed()
+			}
+		}
+
+		if _, err = coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+			return failed()
+		}
+		for _, id := range ids {
+			removeCover(cfg.CoversPath, id)
+		}
+		admin.Record(c, AdminBooksMerge, into.Hex(), bson.M{"deleted": ids})
+		return c.JSON(http.StatusOK, map[string]interface{}{"id": into.Hex(), "merged": len(ids)})
+	})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Google Books told us to slow down. The job stops there, and can be resumed
+// later on from the same book.
+var errRateLimited = errors.New("google books rate limit reached")
+
+// Where the enrichment job is at. It is stored after every book, so a job
+// that was stopped (or crashed) picks up where it left off.
+type EnrichState struct {
+	ID        string             `bson:"_id"`
+	Last      primitive.ObjectID `bson:"last,omitempty"`
+	Processed int                `bson:"processed"`
+	Updated   int                `bson:"updated"`
+	Failed    int                `bson:"failed"`
+	Started   time.Time          `bson:"started"`
+	Finished  *time.Time         `bson:"finished,omitempty"`
+	Error     string             `bson:"error,omitempty"`
+}
+
+// Fills in what is missing from the books of the catalogue (description,
+// categories, page count and cover) with what Google Books knows about
+// their ISBN. It asks at most once per interval, so we stay within the quota.
+type Enricher struct {
+	books    *Repository
+	jobs     *Repository
+	client   *http.Client
+	baseURL  string
+	key      string
+	interval time.Duration
+	covers   string
+
+	mu      sync.Mutex
+	running bool
+}
+
+func newEnricher(books *Repository, jobs *Repository, cfg Config) *Enricher {
+	return &Enricher{
+		books:    books,
+		jobs:     jobs,
+		client:   tracedClient(time.Duration(cfg.LookupTimeout) * time.Second),
+		baseURL:  cfg.GoogleBooksURL,
+		key:      cfg.GoogleBooksKey,
+		interval: time.Duration(cfg.EnrichInterval) * time.Millisecond,
+		covers:   cfg.CoversPath,
+	}
+}
+
+// Books with an ISBN which miss at least one of the fields we can fill in.
+var enrichFilter = bson.M{
+	"bookisbn": bson.M{"$nin": bson.A{"", nil}},
+	"$or": bson.A{
+		bson.M{"bookdescription": bson.M{"$in": bson.A{"", nil}}},
+		bson.M{"booktags": bson.M{"$in": bson.A{bson.A{}, nil}}},
+		bson.M{"bookpages": bson.M{"$in": bson.A{0, nil}}},
+		bson.M{"bookcover": bson.M{"$in": bson.A{"", nil}}},
+	},
+}
+
+type volumeInfo struct {
+	Description string   `json:"description"`
+	Categories  []string `json:"categories"`
+	PageCount   int      `json:"pageCount"`
+	ImageLinks  struct {
+		Thumbnail string `json:"thumbnail"`
+	} `json:"imageLinks"`
+}
+
+// Asks Google Books about the ISBN. It reports false when the book is not
+// known there.
+func (en *Enricher) volume(ctx context.Context, isbn string) (volumeInfo, bool, error) {
+	query := url.Values{"q": {"isbn:" + normalizeISBN(isbn)}}
+	if en.key != "" {
+		query.Set("key", en.key)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, en.baseURL+"/volumes?"+query.Encode(), nil)
+	if err != nil {
+		return volumeInfo{}, false, err
+	}
+	resp, err := en.client.Do(req)
+	if err != nil {
+		return volumeInfo{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusForbidden {
+		return volumeInfo{}, false, errRateLimited
+	}
+	if resp.StatusCode != http.StatusOK {
+		return volumeInfo{}, false, fmt.Errorf("google books answered %s", resp.Status)
+	}
+
+	var body struct {
+		Items []struct {
+			VolumeInfo volumeInfo `json:"volumeInfo"`
+		} `json:"items"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return volumeInfo{}, false, err
+	}
+	if len(body.Items) == 0 {
+		return volumeInfo{}, false, nil
+	}
+	return body.Items[0].VolumeInfo, true, nil
+}
+
+// Fills in the missing fields of a single book, reporting whether anything
+// changed. Fields that are already set are never overwritten.
+func (en *Enricher) enrich(ctx context.Context, book BookStore) (bool, error) {
+	info, found, err := en.volume(ctx, book.BookISBN)
+	if err != nil || !found {
+		return false, err
+	}
+
+	set := bson.M{}
+	if book.BookDescription == "" && info.Description != "" {
+		if html, ok := renderDescription(info.Description); ok {
+			set["bookdescription"], set["bookdescriptionhtml"] = info.Description, html
+		}
+	}
+	if len(book.BookTags) == 0 && len(info.Categories) > 0 {
+		set["booktags"] = normalizeTags(info.Categories)
+	}
+	if book.BookPages == 0 && info.PageCount > 0 {
+		set["bookpages"] = info.PageCount
+	}
+	if len(set) > 0 {
+		if _, err = en.books.UpdateOne(ctx, bson.M{"_id": book.ID}, bson.M{"$set": set}); err != nil {
+			return false, err
+		}
+	}
+
+	// Google hands out plain http links, which browsers would complain about
+	if book.BookCover == "" && info.ImageLinks.Thumbnail != "" {
+		from := strings.Replace(info.ImageLinks.Thumbnail, "http://", "https://", 1)
+		if err = downloadCover(ctx, en.client, en.books, en.covers, book.ID, from); err != nil {
+			loggerFrom(ctx).Warn("failed to store cover", "book", book.ID.Hex(), "err", err)
+		} else {
+			return true, nil
+		}
+	}
+	return len(set) > 0, nil
+}
+
+// The id the state of the job is stored under. Each library enriches its
+// own books, so the other ones get their own job.
+func (en *Enricher) jobID() string {
+	if en.jobs.tenant == "" {
+		return "enrich"
+	}
+	return "enrich-" + en.jobs.tenant
+}
+
+// Returns the current state of the job, and whether it is running.
+func (en *Enricher) State() (EnrichState, bool, error) {
+	en.mu.Lock()
+	running := en.running
+	en.mu.Unlock()
+
+	var state EnrichState
+	err := en.jobs.FindOne(context.TODO(), bson.M{"_id": en.jobID()}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		err = nil
+	}
+	return state, running, err
+}
+
+// Goes through the books that miss something, one at a time and in the order
+// they were added. A finished job starts over, unless told to restart a job
+// that is stopped half-way, it resumes from the last book it handled.
+func (en *Enricher) Run(ctx context.Context, restart bool) error {
+	en.mu.Lock()
+	if en.running {
+		en.mu.Unlock()
+		return errors.New("enrichment is already running")
+	}
+	en.running = true
+	en.mu.Unlock()
+	defer func() {
+		en.mu.Lock()
+		en.running = false
+		en.mu.Unlock()
+	}()
+
+	state, _, err := en.State()
+	if err != nil {
+		return err
+	}
+	if restart || state.ID == "" || state.Finished != nil {
+		state = EnrichState{ID: en.jobID(), Started: time.Now().UTC()}
+	}
+	state.Error = ""
+	save := func() error {
+		_, err := en.jobs.ReplaceOne(context.TODO(), bson.M{"_id": state.ID}, state, options.Replace().SetUpsert(true))
+		return err
+	}
+	if err = save(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(en.interval)
+	defer ticker.Stop()
+	for {
+		filter := bson.M{"$and": bson.A{enrichFilter, bson.M{"_id": bson.M{"$gt": state.Last}}}}
+		var book BookStore
+		err = en.books.FindOne(context.TODO(), filter, options.FindOne().SetSort(bson.D{{Key: "_id", Value: 1}})).Decode(&book)
+		if err == mongo.ErrNoDocuments {
+			now := time.Now().UTC()
+			state.Finished = &now
+			return save()
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			state.Error = ctx.Err().Error()
+			save()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		updated, err := en.enrich(ctx, book)
+		if errors.Is(err, errRateLimited) {
+			state.Error = err.Error()
+			save()
+			return err
+		}
+		state.Last = book.ID
+		state.Processed++
+		if err != nil {
+			loggerFrom(ctx).Warn("failed to enrich book", "book", book.ID.Hex(), "err", err)
+			state.Failed++
+		} else if updated {
+			state.Updated++
+		}
+		if err = save(); err != nil {
+			return err
+		}
+	}
+}
+
+func enrichStateToMap(state EnrichState, running bool) map[string]interface{} {
+	finished := ""
+	if state.Finished != nil {
+		finished = state.Finished.Format(time.RFC3339)
+	}
+	return map[string]interface{}{
+		"running":   running,
+		"processed": state.Processed,
+		"updated":   state.Updated,
+		"failed":    state.Failed,
+		"started":   formatTimestamp(state.Started),
+		"finished":  finished,
+		"error":     state.Error,
+	}
+}
+
+// Registers the endpoints to start the enrichment job in the background and
+// follow its progress. It can be run from the command line too, see main.
+func registerEnrichRoutes(e *echo.Echo, en *Enricher) {
+	e.GET("/api/enrich", func(c echo.Context) error {
+		state, running, err := en.State()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read enrichment state"})
+		}
+		return c.JSON(http.StatusOK, enrichStateToMap(state, running))
+	})
+
+	e.POST("/api/enrich", func(c echo.Context) error {
+		if _, running, _ := en.State(); running {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "enrichment is already running"})
+		}
+		restart := c.QueryParam("restart") == "true"
+		// The job outlives the request, so it gets its own context
+		go func() {
+			if err := en.Run(context.Background(), restart); err != nil {
+				slog.Error("enrichment stopped", "err", err)
+			}
+		}()
+		return c.JSON(http.StatusAccepted, map[string]string{"status": "started"})
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The ID of the request (see requestid.go), for people to quote when they
+// report a problem
+func requestID(c echo.Context) string {
+	if id := c.Response().Header().Get(echo.HeaderXRequestID); id != "" {
+		return id
+	}
+	return c.Request().Header.Get(echo.HeaderXRequestID)
+}
+
+// Whether the request is from a browser showing the answer as a page, as
+// opposed to a client of the API
+func wantsPage(c echo.Context) bool {
+	req := c.Request()
+	if strings.HasPrefix(req.URL.Path, "/api/") {
+		return false
+	}
+	return req.Header.Get("HX-Request") != "" || strings.Contains(req.Header.Get(echo.HeaderAccept), echo.MIMETextHTML)
+}
+
+// Answers the errors the handlers return rather than answer themselves, the
+// routes that don't exist, and the panics (see middleware.Recover). Browsers
+// get a page saying what went wrong (see "error-page"), the API the usual
+// {"error": "..."}. What went wrong inside the server isn't shown to anybody,
+// only logged. Both are told the ID of the request, to quote when they
+// report the error (see requestid.go).
+func handleError(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	status, message := http.StatusInternalServerError, "internal server error"
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		status = he.Code
+		if status < http.StatusInternalServerError {
+			message = fmt.Sprint(he.Message)
+		}
+	}
+	if status >= http.StatusInternalServerError {
+		loggerFrom(c.Request().Context()).Error("request failed", "path", c.Request().URL.Path, "err", err)
+	}
+	// echo's own errors, e.g., of the routes that don't exist, are just the
+	// capitalized text of the status
+	if message == http.StatusText(status) {
+		message = strings.ToLower(message)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else if wantsPage(c) {
+		err = c.Render(status, "error-page", map[string]interface{}{
+			"title":   http.StatusText(status),
+			"status":  status,
+			"message": message,
+			"request": requestID(c),
+		})
+	} else {
+		err = c.JSON(status, map[string]string{"error": message, "requestId": requestID(c)})
+	}
+	if err != nil {
+		loggerFrom(c.Request().Context()).Error("failed to answer the error", "err", err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// A table to download, e.g., the books as they are shown, with the
+// filters applied. The values are strings or numbers; the numbers stay
+// numbers in the spreadsheets, so they can be added up.
+type exportTable struct {
+	name   string
+	header []string
+	rows   [][]interface{}
+}
+
+// Writes the table as CSV, with the header on the first line.
+func (t exportTable) writeCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(t.header); err != nil {
+		return err
+	}
+	for _, row := range t.rows {
+		if err := out.Write(csvRecord(row)); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func csvRecord(row []interface{}) []string {
+	record := make([]string, len(row))
+	for i, value := range row {
+		record[i] = fmt.Sprint(value)
+	}
+	return record
+}
+
+// Sends a table as CSV while its rows are still being read, for the tables
+// that may be too large to hold, i.e., the books: rows calls write with
+// every one of them.
+func streamCSV(c echo.Context, name string, header []string, rows func(write func([]interface{}) error) error) error {
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name+".csv"))
+	out := csv.NewWriter(startStream(c, exportFormats["csv"]))
+	err := out.Write(header)
+	if err == nil {
+		err = rows(func(row []interface{}) error {
+			return out.Write(csvRecord(row))
+		})
+	}
+	if err == nil {
+		out.Flush()
+		err = out.Error()
+	}
+	if err != nil {
+		loggerFrom(c.Request().Context()).Error("failed to stream export", "export", name, "err", err)
+	}
+	return nil
+}
+
+// The files every XLSX workbook with a single sheet needs next to the sheet
+// itself. An XLSX file is a zip of XML files; this is the least of them
+// Excel and LibreOffice open.
+var xlsxFiles = []struct {
+	path    string
+	content string
+}{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`},
+}
+
+// Writes the table as an XLSX workbook, with the header on the first row.
+func (t exportTable) writeXLSX(w io.Writer) error {
+	z := zip.NewWriter(w)
+	for _, f := range xlsxFiles {
+		part, err := z.Create(f.path)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(part, f.content); err != nil {
+			return err
+		}
+	}
+
+	part, err := z.Create("xl/workbook.xml")
+	if err != nil {
+		return err
+	}
+	var name strings.Builder
+	// Sheet names can't be longer than 31 characters
+	xml.EscapeText(&name, []byte(t.name[:min(len(t.name), 31)]))
+	_, err = io.WriteString(part, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="`+name.String()+`" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`)
+	if err != nil {
+		return err
+	}
+
+	part, err = z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	var sheet strings.Builder
+	sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	header := make([]interface{}, len(t.header))
+	for i, h := range t.header {
+		header[i] = h
+	}
+	for r, row := range append([][]interface{}{header}, t.rows...) {
+		fmt.Fprintf(&sheet, `<row r="%d">`, r+1)
+		for i, value := range row {
+			ref := xlsxColumn(i) + strconv.Itoa(r+1)
+			switch v := value.(type) {
+			case int, int32, int64, float64:
+				fmt.Fprintf(&sheet, `<c r="%s"><v>%v</v></c>`, ref, v)
+			default:
+				fmt.Fprintf(&sheet, `<c r="%s" t="inlineStr"><is><t>`, ref)
+				xml.EscapeText(&sheet, []byte(fmt.Sprint(v)))
+				sheet.WriteString(`</t></is></c>`)
+			}
+		}
+		sheet.WriteString(`</row>`)
+	}
+	sheet.WriteString(`</sheetData></worksheet>`)
+	if _, err = io.WriteString(part, sheet.String()); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// The letters of the column of a spreadsheet, e.g., "A" for the first one,
+// and "AA" for the 27th.
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// The formats the tables can be downloaded in, with their content types
+var exportFormats = map[string]string{
+	"csv":  "text/csv; charset=utf-8",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// Sends the table as a file to download, in the format of the query, e.g.,
+// /books/export?format=xlsx. CSV is the default.
+func sendExport(c echo.Context, t exportTable) error {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType, ok := exportFormats[format]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "format must be csv or xlsx"})
+	}
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, contentType)
+	header.Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", t.name+"."+format))
+	c.Response().WriteHeader(http.StatusOK)
+	if format == "xlsx" {
+		return t.writeXLSX(c.Response())
+	}
+	return t.writeCSV(c.Response())
+}
+
+// The links of the download buttons (see "export-buttons" in partials.html),
+// which keep the filters of the query.
+func exportLinks(path string, query url.Values) map[string]string {
+	links := map[string]string{}
+	for format := range exportFormats {
+		q := url.Values{}
+		for name, values := range query {
+			q[name] = values
+		}
+		q.Set("format", format)
+		links[format] = path + "?" + q.Encode()
+	}
+	return links
+}
+
+// Registers the downloads of the book, author and year tables. The books are
+// filtered the way the table is, by the filter of the request.
+func registerExportRoutes(e *echo.Echo, coll *Repository, authors *Repository, filter func(echo.Context) (bson.M, error)) {
+	e.GET("/books/export", func(c echo.Context) error {
+		f, err := filter(c)
+		if err != nil {
+			return filterFailed(c, err)
+		}
+		sort, ok := bookSort(preferredSort(c))
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid sort"})
+		}
+		t := exportTable{
+			name:   "books",
+			header: []string{"Name", "Author", "ISBN", "Pages", "Year", "Language", "Audience", "DDC", "LCC", "Status", "Created", "Updated"},
+		}
+		row := func(b map[string]interface{}) []interface{} {
+			return []interface{}{b["name"], b["author"], b["isbn"], b["pages"], b["year"], b["language"], b["audience"], b["ddc"], b["lcc"], b["status"], b["createdAt"], b["updatedAt"]}
+		}
+		// CSV is written as the books are read (see stream.go), the
+		// workbook needs all of them first
+		if format := c.QueryParam("format"); format == "" || format == "csv" {
+			return streamCSV(c, t.name, t.header, func(write func([]interface{}) error) error {
+				return eachBooks(c.Request().Context(), coll, f, func(books []map[string]interface{}) error {
+					for _, b := range books {
+						if err := write(row(b)); err != nil {
+							return err
+						}
+					}
+					return nil
+				}, sort)
+			})
+		}
+		for _, b := range findAllBooks(coll, f, sort) {
+			t.rows = append(t.rows, row(b))
+		}
+		return sendExport(c, t)
+	})
+
+	e.GET("/authors/export", func(c echo.Context) error {
+		list, err := listAuthors(c.Request().Context(), authors, coll)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list authors"})
+		}
+		t := exportTable{name: "authors", header: []string{"Author", "Books"}}
+		for _, a := range list {
+			t.rows = append(t.rows, []interface{}{a["author"], a["books"]})
+		}
+		return sendExport(c, t)
+	})
+
+	// The years, or the decades with ?by=decade
+	e.GET("/years/export", func(c echo.Context) error {
+		decades := c.QueryParam("by") == "decade"
+		counts, err := countByYear(c.Request().Context(), coll, 0, math.MaxInt32, decades)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count books"})
+		}
+		t := exportTable{name: "years", header: []string{"Year", "Books"}}
+		if decades {
+			t = exportTable{name: "decades", header: []string{"Decade", "Books"}}
+		}
+		for _, yc := range counts {
+			t.rows = append(t.rows, []interface{}{yc.Year, yc.Count})
+		}
+		return sendExport(c, t)
+	})
+}
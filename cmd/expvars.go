@@ -0,0 +1,57 @@
+package main
+
+import (
+	"expvar"
+	"runtime"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The numbers of the running server, for a quick look without a metrics
+// stack: expvar publishes the memory statistics ("memstats") and the command
+// line by itself, and we add the number of goroutines, the requests answered
+// by status, e.g., "requests": {"200": 1234, "404": 5}, and how often the
+// caches had what was asked for.
+var (
+	requestCounts = expvar.NewMap("requests")
+	cacheCounts   = expvar.NewMap("caches")
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+}
+
+// Counts a request, by its status
+func countRequest(status int) {
+	requestCounts.Add(strconv.Itoa(status), 1)
+}
+
+// The hits and misses of a cache, published under its name in "caches",
+// with the share of hits. All the libraries share them.
+type CacheStats struct {
+	hits   expvar.Int
+	misses expvar.Int
+}
+
+func newCacheStats(name string) *CacheStats {
+	stats := &CacheStats{}
+	cacheCounts.Set(name, expvar.Func(func() interface{} {
+		hits, misses := stats.hits.Value(), stats.misses.Value()
+		rate := 0.0
+		if hits+misses > 0 {
+			rate = float64(hits) / float64(hits+misses)
+		}
+		return map[string]interface{}{"hits": hits, "misses": misses, "hitRate": rate}
+	}))
+	return stats
+}
+
+func (s *CacheStats) Hit()  { s.hits.Add(1) }
+func (s *CacheStats) Miss() { s.misses.Add(1) }
+
+// Registers /debug/vars, where expvar shows all of them as JSON. Only the
+// admins see it (see policies.go).
+func registerExpvarRoutes(e *echo.Echo) {
+	e.GET("/debug/vars", echo.WrapHandler(expvar.Handler()))
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The filters of the catalog, and how many books each of their choices would
+// leave, for the panel next to the book table. The choices are the query
+// parameters of /books and /api/books:
+//
+//	genre=<id or name>  the books of the genre, and of its sub-genres
+//	lang=de             the books in the language
+//	from=1990&to=1999   the books that came out in these years
+//	available=1         the books with a copy on the shelf right now,
+//	                    in the branch picked in the switcher
+//
+// besides tag, audience and status, which the panel doesn't show. The counts
+// of a facet are with all the other filters applied, but not its own, so
+// they tell what picking another choice would give.
+type Facets struct {
+	books      *Repository
+	genres     *Repository
+	bookGenres *Repository
+	copies     *Repository
+}
+
+func newFacets(books *Repository, genres *Repository, bookGenres *Repository, copies *Repository) *Facets {
+	return &Facets{books: books, genres: genres, bookGenres: bookGenres, copies: copies}
+}
+
+// The years of the query, 0 when there is none or it isn't a number
+func yearParam(c echo.Context, name string) int {
+	year, err := strconv.Atoi(c.QueryParam(name))
+	if err != nil || year < 0 {
+		return 0
+	}
+	return year
+}
+
+// Builds the filter of the query, leaving out the facet named except, if
+// any, e.g., "lang" to count the books in every language.
+func (f *Facets) Filter(c echo.Context, except string) (bson.M, error) {
+	var parts []bson.M
+	if except != "genre" {
+		genre, err := genreFilter(f.genres, f.bookGenres, c.QueryParam("genre"))
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, genre)
+	}
+
+	// What the user typed goes through a Query, see query.go
+	query := newQuery("booktags", "booklanguage", "bookaudience", "bookstatus", "bookyear")
+	// A single tag matches the books having it among their tags
+	if tag := normalizeTag(c.QueryParam("tag")); tag != "" {
+		query.Eq("booktags", tag)
+	}
+	if lang, _ := normalizeLanguage(c.QueryParam("lang")); lang != "" && except != "lang" {
+		query.Eq("booklanguage", lang)
+	}
+	if audience, ok := normalizeAudience(c.QueryParam("audience")); ok && audience != "" {
+		query.Eq("bookaudience", audience)
+	}
+	statusQuery(query, c.QueryParam("status"))
+	if except != "year" {
+		if from := yearParam(c, "from"); from > 0 {
+			query.Where("bookyear", "$gte", from)
+		}
+		if to := yearParam(c, "to"); to > 0 {
+			query.Where("bookyear", "$lte", to)
+		}
+	}
+	filter, err := query.Filter()
+	if err != nil {
+		return nil, err
+	}
+	parts = append(parts, filter)
+
+	if except != "available" && c.QueryParam("available") != "" {
+		available, err := f.availableFilter(c)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, available)
+	}
+
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	and := bson.A{}
+	for _, p := range parts {
+		and = append(and, p)
+	}
+	return bson.M{"$and": and}, nil
+}
+
+// The books with at least one copy available in the branch of the request
+func (f *Facets) availableFilter(c echo.Context) (bson.M, error) {
+	scope, _ := branchFilter(c, bson.M{}, "copybranch")
+	counts, err := availabilityByBook(f.copies, scope)
+	if err != nil {
+		return nil, err
+	}
+	ids := []primitive.ObjectID{}
+	for id, count := range counts {
+		if count[1] > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return bson.M{"_id": bson.M{"$in": ids}}, nil
+}
+
+// Counts the books of every choice of the panel, for the query.
+func (f *Facets) Counts(c echo.Context) (map[string]interface{}, error) {
+	ctx := c.Request().Context()
+	genres, err := f.genreCounts(c)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := f.Filter(c, "lang")
+	if err != nil {
+		return nil, err
+	}
+	var languages []struct {
+		Code  string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err = f.group(ctx, bson.M{"$and": bson.A{filter, bson.M{"booklanguage": bson.M{"$nin": bson.A{"", nil}}}}}, "$booklanguage", &languages); err != nil {
+		return nil, err
+	}
+	languageCounts := []map[string]interface{}{}
+	for _, l := range languages {
+		languageCounts = append(languageCounts, map[string]interface{}{"code": l.Code, "count": l.Count})
+	}
+
+	if filter, err = f.Filter(c, "year"); err != nil {
+		return nil, err
+	}
+	decade := bson.D{{Key: "$subtract", Value: bson.A{"$bookyear", bson.D{{Key: "$mod", Value: bson.A{"$bookyear", 10}}}}}}
+	var decades []yearCount
+	if err = f.group(ctx, bson.M{"$and": bson.A{filter, bson.M{"bookyear": bson.M{"$gt": 0}}}}, decade, &decades); err != nil {
+		return nil, err
+	}
+	sort.Slice(decades, func(i, j int) bool { return decades[i].Year < decades[j].Year })
+	decadeCounts := yearCountsToMaps(decades)
+	for i, d := range decades {
+		decadeCounts[i]["to"] = d.Year + 9
+	}
+
+	if filter, err = f.Filter(c, "available"); err != nil {
+		return nil, err
+	}
+	available, err := f.availableFilter(c)
+	if err != nil {
+		return nil, err
+	}
+	availableCount, err := f.books.CountDocuments(ctx, bson.M{"$and": bson.A{filter, available}})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"genres":    genres,
+		"languages": languageCounts,
+		"decades":   decadeCounts,
+		"available": availableCount,
+	}, nil
+}
+
+// Counts the books by the value of the expression, e.g., "$booklanguage",
+// the most common first, into the results, with the value as "_id".
+func (f *Facets) group(ctx context.Context, filter bson.M, by interface{}, results interface{}) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: by},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+	}
+	cursor, err := f.books.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
+
+// Counts the books of every genre, with those of its sub-genres, in the
+// order of the genre select. A book filed under two sub-genres of the same
+// genre counts once for it.
+func (f *Facets) genreCounts(c echo.Context) ([]map[string]interface{}, error) {
+	genres, err := findAllGenres(f.genres)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := f.Filter(c, "genre")
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := f.books.Find(c.Request().Context(), filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var matching []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err = cursor.All(c.Request().Context(), &matching); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(matching))
+	for i, m := range matching {
+		ids[i] = m.ID
+	}
+
+	cursor, err = f.bookGenres.Find(c.Request().Context(), bson.M{"bookid": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var links []BookGenre
+	if err = cursor.All(c.Request().Context(), &links); err != nil {
+		return nil, err
+	}
+	byGenre := map[primitive.ObjectID][]primitive.ObjectID{}
+	for _, l := range links {
+		byGenre[l.GenreID] = append(byGenre[l.GenreID], l.BookID)
+	}
+
+	ret := genresToMaps(genres)
+	for i, g := range genres {
+		books := map[primitive.ObjectID]bool{}
+		for _, id := range genreWithDescendants(genres, g.ID) {
+			for _, book := range byGenre[id] {
+				books[book] = true
+			}
+		}
+		ret[i]["count"] = len(books)
+	}
+	return ret, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A book a member starred, to find it again later.
+type Favorite struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty"`
+	BookID          primitive.ObjectID `bson:"bookid"`
+	FavoriteMember  string             `bson:"favoritemember"`
+	FavoriteCreated time.Time          `bson:"favoritecreated"`
+}
+
+// Adds how many members starred each of the books we are about to return.
+func addFavoriteCounts(coll *Repository, books []map[string]interface{}) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$bookid"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	}
+	cursor, err := coll.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return err
+	}
+	var results []struct {
+		BookID primitive.ObjectID `bson:"_id"`
+		Count  int                `bson:"count"`
+	}
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.BookID.Hex()] = r.Count
+	}
+	for _, b := range books {
+		b["favorites"] = counts[b["id"].(string)]
+	}
+	return nil
+}
+
+// Returns the books the member starred, the latest first.
+func memberFavorites(books *Repository, coll *Repository, member Member) ([]map[string]interface{}, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "favoritecreated", Value: -1}})
+	cursor, err := coll.Find(context.TODO(), bson.M{"favoritemember": member.MemberMembership}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var favorites []Favorite
+	if err = cursor.All(context.TODO(), &favorites); err != nil {
+		return nil, err
+	}
+
+	ids := []primitive.ObjectID{}
+	for _, f := range favorites {
+		ids = append(ids, f.BookID)
+	}
+	byID := map[string]map[string]interface{}{}
+	for _, b := range findAllBooks(books, bson.M{"_id": bson.M{"$in": ids}}) {
+		byID[b["id"].(string)] = b
+	}
+	ret := []map[string]interface{}{}
+	for _, f := range favorites {
+		if b, ok := byID[f.BookID.Hex()]; ok {
+			ret = append(ret, b)
+		}
+	}
+	return ret, nil
+}
+
+// Registers the endpoints to star books and list the starred ones, and the
+// favorites page of a member.
+func registerFavoriteRoutes(e *echo.Echo, books *Repository, members *Repository, coll *Repository) {
+	e.GET("/members/:id/favorites", func(c echo.Context) error {
+		member, err := findMember(members, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+		favorites, err := memberFavorites(books, coll, member)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list favorites"})
+		}
+		return c.Render(200, "favorite-books", map[string]interface{}{
+			"member": memberToMap(member),
+			"books":  favorites,
+		})
+	})
+
+	e.GET("/api/members/:id/favorites", func(c echo.Context) error {
+		member, err := findMember(members, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+		favorites, err := memberFavorites(books, coll, member)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list favorites"})
+		}
+		return c.JSON(http.StatusOK, favorites)
+	})
+
+	// Stars the book for the member, or removes the star if it was there.
+	e.POST("/api/books/:id/favorite", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var req struct {
+			Member string `json:"member" form:"member"`
+		}
+		if err = c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		member, err := findMember(members, strings.TrimSpace(req.Member))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+		if err = books.FindOne(context.TODO(), bson.M{"_id": id}).Err(); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+
+		filter := bson.M{"bookid": id, "favoritemember": member.MemberMembership}
+		result, err := coll.DeleteOne(c.Request().Context(), filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update favorite"})
+		}
+		starred := result.DeletedCount == 0
+		if starred {
+			_, err = coll.InsertOne(c.Request().Context(), Favorite{
+				BookID:          id,
+				FavoriteMember:  member.MemberMembership,
+				FavoriteCreated: time.Now().UTC(),
+			})
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update favorite"})
+			}
+		}
+
+		count, err := coll.CountDocuments(context.TODO(), bson.M{"bookid": id})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count favorites"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"favorite": starred, "favorites": count})
+	})
+}
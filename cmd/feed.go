@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How many of the books added last the feed lists
+const feedBooks = 20
+
+// The address of the page on the website the request came to, e.g.,
+// https://library.example.com/books/<id>, for what is read outside of it,
+// like feeds and QR codes.
+func absoluteURL(c echo.Context, path string) string {
+	return c.Scheme() + "://" + c.Request().Host + path
+}
+
+// An Atom feed (RFC 4287), with just what feed readers need
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Link      atomLink   `xml:"link"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Author    atomAuthor `xml:"author"`
+	Summary   string     `xml:"summary,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+// Registers the feed of the books added last, at /feed.xml, for patrons to
+// follow the new books in their feed reader. Books added before the
+// repository kept the time are left out.
+func registerFeedRoutes(e *echo.Echo, coll *Repository) {
+	e.GET("/feed.xml", func(c echo.Context) error {
+		opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}}).SetLimit(feedBooks)
+		cursor, err := coll.Find(context.TODO(), bson.M{"createdat": bson.M{"$exists": true}}, opts)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list books"})
+		}
+		var books []BookStore
+		if err = cursor.All(context.TODO(), &books); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list books"})
+		}
+
+		feed := atomFeed{
+			Title: "New books",
+			ID:    absoluteURL(c, "/feed.xml"),
+			// A feed without books was never updated, which Atom can't say
+			Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "self", Type: "application/atom+xml", Href: absoluteURL(c, "/feed.xml")},
+				{Rel: "alternate", Type: "text/html", Href: absoluteURL(c, "/books?sort=-created")},
+			},
+		}
+		if len(books) > 0 {
+			feed.Updated = books[0].CreatedAt.UTC().Format(time.RFC3339)
+		}
+		for _, b := range books {
+			link := absoluteURL(c, "/books/"+b.ID.Hex())
+			feed.Entries = append(feed.Entries, atomEntry{
+				Title:     b.BookName,
+				ID:        link,
+				Link:      atomLink{Rel: "alternate", Type: "text/html", Href: link},
+				Published: b.CreatedAt.UTC().Format(time.RFC3339),
+				Updated:   b.CreatedAt.UTC().Format(time.RFC3339),
+				Author:    atomAuthor{Name: b.BookAuthor},
+				Summary:   b.BookDescription,
+			})
+		}
+
+		data, err := xml.MarshalIndent(feed, "", "  ")
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to write feed"})
+		}
+		return c.Blob(http.StatusOK, "application/atom+xml; charset=utf-8", append([]byte(xml.Header), data...))
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A fine charged to a member for returning a book late. Amounts are kept in
+// cents: floating point numbers cannot represent most decimal fractions
+// exactly, which is not something you want when dealing with money.
+type Fine struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	LoanID      primitive.ObjectID `bson:"loanid"`
+	FineMember  string             `bson:"finemember"`
+	FineDays    int                `bson:"finedays"`
+	FineAmount  int                `bson:"fineamount"`
+	FineCreated time.Time          `bson:"finecreated"`
+	FineSettled *time.Time         `bson:"finesettled,omitempty"`
+}
+
+// How much is charged per day late, and the most a single loan can cost.
+type FineRules struct {
+	PerDay int
+	Cap    int
+}
+
+// Computes the fine of a loan returned at the given time. Every started day
+// past the due date counts as a full day.
+func (r FineRules) For(loan Loan, returned time.Time) (int, int) {
+	if !returned.After(loan.LoanDue) {
+		return 0, 0
+	}
+	days := int(math.Ceil(returned.Sub(loan.LoanDue).Hours() / 24))
+	amount := days * r.PerDay
+	if r.Cap > 0 && amount > r.Cap {
+		amount = r.Cap
+	}
+	return days, amount
+}
+
+func fineToMap(f Fine) map[string]interface{} {
+	settled := ""
+	if f.FineSettled != nil {
+		settled = f.FineSettled.Format(time.RFC3339)
+	}
+	return map[string]interface{}{
+		"id":      f.ID.Hex(),
+		"loan":    f.LoanID.Hex(),
+		"member":  f.FineMember,
+		"days":    f.FineDays,
+		"amount":  f.FineAmount,
+		"display": formatCents(f.FineAmount),
+		"created": f.FineCreated.Format(time.RFC3339),
+		"settled": settled,
+	}
+}
+
+func formatCents(cents int) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// Records the fine of a loan that was just returned, if it was late.
+func chargeFine(coll *Repository, rules FineRules, loan Loan) error {
+	days, amount := rules.For(loan, *loan.LoanReturned)
+	if amount == 0 {
+		return nil
+	}
+	_, err := coll.InsertOne(context.TODO(), Fine{
+		LoanID:      loan.ID,
+		FineMember:  loan.LoanMember,
+		FineDays:    days,
+		FineAmount:  amount,
+		FineCreated: time.Now().UTC(),
+	})
+	return err
+}
+
+// Flags the open loans that went past their due date, and lets the members
+// know. Each loan is only flagged (and notified) once.
+func flagOverdueLoans(loans *Repository, notifications *Repository) error {
+	for {
+		var loan Loan
+		err := loans.FindOneAndUpdate(context.TODO(),
+			bson.M{"loanreturned": bson.M{"$exists": false}, "loanoverdue": bson.M{"$ne": true}, "loandue": bson.M{"$lt": time.Now().UTC()}},
+			bson.M{"$set": bson.M{"loanoverdue": true}},
+		).Decode(&loan)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		notify(notifications, loan.LoanMember,
+			"A book you borrowed was due on "+loan.LoanDue.Format(time.DateOnly)+", please return it.")
+	}
+}
+
+// Registers the endpoints to view and settle fines.
+func registerFineRoutes(e *echo.Echo, members *Repository, loans *Repository, rules FineRules, coll *Repository) {
+	list := func(c echo.Context, filter bson.M) error {
+		if c.QueryParam("all") != "true" {
+			filter["finesettled"] = bson.M{"$exists": false}
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "finecreated", Value: -1}})
+		cursor, err := coll.Find(context.TODO(), filter, opts)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list fines"})
+		}
+		var results []Fine
+		if err = cursor.All(context.TODO(), &results); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list fines"})
+		}
+
+		ret := []map[string]interface{}{}
+		for _, f := range results {
+			ret = append(ret, fineToMap(f))
+		}
+		return c.JSON(http.StatusOK, ret)
+	}
+
+	e.GET("/api/fines", func(c echo.Context) error {
+		return list(c, bson.M{})
+	})
+
+	e.GET("/api/members/:id/fines", func(c echo.Context) error {
+		member, err := findMember(members, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+		return list(c, bson.M{"finemember": member.MemberMembership})
+	})
+
+	// Besides the fines already charged, a member with overdue books is
+	// building up more. We show those too, so they are not a surprise.
+	e.GET("/api/members/:id/balance", func(c echo.Context) error {
+		member, err := findMember(members, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+
+		cursor, err := coll.Find(context.TODO(), bson.M{"finemember": member.MemberMembership, "finesettled": bson.M{"$exists": false}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list fines"})
+		}
+		var fines []Fine
+		if err = cursor.All(context.TODO(), &fines); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list fines"})
+		}
+		owed := 0
+		for _, f := range fines {
+			owed += f.FineAmount
+		}
+
+		cursor, err = loans.Find(context.TODO(), bson.M{"loanmember": member.MemberMembership, "loanreturned": bson.M{"$exists": false}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list loans"})
+		}
+		var open []Loan
+		if err = cursor.All(context.TODO(), &open); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list loans"})
+		}
+		accruing := 0
+		for _, l := range open {
+			_, amount := rules.For(l, time.Now().UTC())
+			accruing += amount
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"owed":     owed,
+			"accruing": accruing,
+			"display":  formatCents(owed + accruing),
+		})
+	})
+
+	e.POST("/api/fines/:id/settle", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		var fine Fine
+		err = coll.FindOneAndUpdate(c.Request().Context(),
+			bson.M{"_id": id, "finesettled": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"finesettled": time.Now().UTC()}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&fine)
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "no open fine found"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to settle fine"})
+		}
+		return c.JSON(http.StatusOK, fineToMap(fine))
+	})
+}
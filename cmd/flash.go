@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The cookie holding the message to show on the next page, e.g., "Book
+// created" after the form was sent
+const flashCookie = "flash"
+
+// Remembers the message until the next page is shown. The cookie only lives
+// for a minute, in case that page never asks for it. The message is encoded,
+// as not every character is allowed in a cookie.
+func setFlash(c echo.Context, message string) {
+	c.SetCookie(&http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(message)),
+		Path:     "/",
+		MaxAge:   60,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Returns the message, if any, and forgets it, so it is shown only once.
+func takeFlash(c echo.Context) string {
+	cookie, err := c.Cookie(flashCookie)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	c.SetCookie(&http.Cookie{Name: flashCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	message, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return ""
+	}
+	return string(message)
+}
+
+// Answers a form sent with htmx by having it load the page at the path
+// instead, which then shows the message. This way the form is not replaced
+// with whatever the endpoint returns for API clients.
+func redirectWithFlash(c echo.Context, path string, message string) error {
+	setFlash(c, message)
+	c.Response().Header().Set("HX-Location", `{"path": "`+path+`", "target": "#page-content"}`)
+	return c.NoContent(http.StatusOK)
+}
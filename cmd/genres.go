@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A genre is a managed category books can be filed under. Genres can be
+// nested by pointing to a parent, e.g., "Sci-Fi" having "Fiction" as parent.
+// The top-level genres simply have no parent.
+type Genre struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	GenreName   string             `json:"name"`
+	GenreParent primitive.ObjectID `json:"parent" bson:"genreparent,omitempty"`
+	CreatedAt   time.Time          `json:"-" bson:"createdat,omitempty"`
+	UpdatedAt   time.Time          `json:"-" bson:"updatedat,omitempty"`
+}
+
+// Associates a book with a genre. We keep this in a separate collection, the
+// same way you would have a join table in SQL, so a book can belong to many
+// genres and a genre can hold many books.
+type BookGenre struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	BookID  primitive.ObjectID `bson:"bookid"`
+	GenreID primitive.ObjectID `bson:"genreid"`
+}
+
+// The body we accept when creating or updating a genre. The parent is sent as
+// the hex representation of its id, or left empty for top-level genres.
+type genreRequest struct {
+	ID     string `json:"id" form:"id"`
+	Name   string `json:"name" form:"name"`
+	Parent string `json:"parent" form:"parent"`
+}
+
+func findAllGenres(coll *Repository) ([]Genre, error) {
+	cursor, err := coll.Find(context.TODO(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var results []Genre
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Builds the display path of a genre, e.g., "Fiction > Sci-Fi", by walking up
+// the parents. The visited set protects us from looping forever in case the
+// data got corrupted into a cycle.
+func genrePath(byID map[primitive.ObjectID]Genre, genre Genre) string {
+	parts := []string{genre.GenreName}
+	visited := map[primitive.ObjectID]bool{genre.ID: true}
+	for parent := genre.GenreParent; !parent.IsZero() && !visited[parent]; {
+		p, ok := byID[parent]
+		if !ok {
+			break
+		}
+		visited[parent] = true
+		parts = append([]string{p.GenreName}, parts...)
+		parent = p.GenreParent
+	}
+	return strings.Join(parts, " > ")
+}
+
+// Returns the given genre together with all its sub-genres (and their
+// sub-genres, and so on), so that filtering by "Fiction" also returns the
+// books filed under "Fiction > Sci-Fi".
+func genreWithDescendants(genres []Genre, root primitive.ObjectID) []primitive.ObjectID {
+	ids := []primitive.ObjectID{root}
+	seen := map[primitive.ObjectID]bool{root: true}
+	for i := 0; i < len(ids); i++ {
+		for _, g := range genres {
+			if g.GenreParent == ids[i] && !seen[g.ID] {
+				seen[g.ID] = true
+				ids = append(ids, g.ID)
+			}
+		}
+	}
+	return ids
+}
+
+func genresToMaps(genres []Genre) []map[string]interface{} {
+	byID := map[primitive.ObjectID]Genre{}
+	for _, g := range genres {
+		byID[g.ID] = g
+	}
+
+	ret := []map[string]interface{}{}
+	for _, g := range genres {
+		ret = append(ret, genreToMap(byID, g))
+	}
+	return ret
+}
+
+func genreToMap(byID map[primitive.ObjectID]Genre, g Genre) map[string]interface{} {
+	parent := ""
+	if !g.GenreParent.IsZero() {
+		parent = g.GenreParent.Hex()
+	}
+	return map[string]interface{}{
+		"id":        g.ID.Hex(),
+		"name":      g.GenreName,
+		"parent":    parent,
+		"path":      genrePath(byID, g),
+		"createdAt": formatTimestamp(g.CreatedAt),
+		"updatedAt": formatTimestamp(g.UpdatedAt),
+	}
+}
+
+// Looks up a genre either by its id or by its (case-insensitive) name, so
+// both /api/books?genre=<id> and /api/books?genre=Fiction work.
+func resolveGenre(genres []Genre, value string) (Genre, bool) {
+	if id, err := primitive.ObjectIDFromHex(value); err == nil {
+		for _, g := range genres {
+			if g.ID == id {
+				return g, true
+			}
+		}
+	}
+	for _, g := range genres {
+		if strings.EqualFold(g.GenreName, value) {
+			return g, true
+		}
+	}
+	return Genre{}, false
+}
+
+// Translates a genre query parameter into a filter over the books collection.
+// An empty value means no filtering at all.
+func genreFilter(genreColl *Repository, bookGenreColl *Repository, value string) (bson.M, error) {
+	if value == "" {
+		return bson.M{}, nil
+	}
+
+	genres, err := findAllGenres(genreColl)
+	if err != nil {
+		return nil, err
+	}
+	genre, ok := resolveGenre(genres, value)
+	if !ok {
+		// An unknown genre matches nothing rather than everything.
+		return bson.M{"_id": bson.M{"$in": []primitive.ObjectID{}}}, nil
+	}
+
+	cursor, err := bookGenreColl.Find(context.TODO(), bson.M{
+		"genreid": bson.M{"$in": genreWithDescendants(genres, genre.ID)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var links []BookGenre
+	if err = cursor.All(context.TODO(), &links); err != nil {
+		return nil, err
+	}
+
+	bookIDs := []primitive.ObjectID{}
+	for _, l := range links {
+		bookIDs = append(bookIDs, l.BookID)
+	}
+	return bson.M{"_id": bson.M{"$in": bookIDs}}, nil
+}
+
+// Validates a genre request and converts it into the model. The parent must
+// exist, and must not be the genre itself or one of its descendants,
+// otherwise we would end up with a cycle in the hierarchy.
+func parseGenreRequest(genres []Genre, req genreRequest, self primitive.ObjectID) (Genre, string) {
+	genre := Genre{ID: self, GenreName: strings.TrimSpace(req.Name)}
+	if genre.GenreName == "" {
+		return genre, "name is required"
+	}
+
+	if req.Parent != "" {
+		parent, err := primitive.ObjectIDFromHex(req.Parent)
+		if err != nil {
+			return genre, "invalid parent id"
+		}
+		if _, ok := resolveGenre(genres, req.Parent); !ok {
+			return genre, "parent genre not found"
+		}
+		if !self.IsZero() {
+			for _, id := range genreWithDescendants(genres, self) {
+				if id == parent {
+					return genre, "a genre cannot be nested under itself"
+				}
+			}
+		}
+		genre.GenreParent = parent
+	}
+
+	for _, g := range genres {
+		if g.ID != self && g.GenreParent == genre.GenreParent && strings.EqualFold(g.GenreName, genre.GenreName) {
+			return genre, "genre already exists"
+		}
+	}
+	return genre, ""
+}
+
+// Registers the endpoints to manage the genres and the association between
+// books and genres.
+func registerGenreRoutes(e *echo.Echo, books *Repository, genreColl *Repository, bookGenreColl *Repository) {
+	e.GET("/api/genres", func(c echo.Context) error {
+		genres, err := findAllGenres(genreColl)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list genres"})
+		}
+		return c.JSON(http.StatusOK, genresToMaps(genres))
+	})
+
+	e.GET("/api/genres/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		genres, err := findAllGenres(genreColl)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list genres"})
+		}
+		byID := map[primitive.ObjectID]Genre{}
+		for _, g := range genres {
+			byID[g.ID] = g
+		}
+		genre, ok := byID[id]
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "genre not found"})
+		}
+		return c.JSON(http.StatusOK, genreToMap(byID, genre))
+	})
+
+	e.POST("/api/genres", func(c echo.Context) error {
+		var req genreRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+
+		genres, err := findAllGenres(genreColl)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list genres"})
+		}
+		genre, msg := parseGenreRequest(genres, req, primitive.NilObjectID)
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		genre.ID = primitive.NewObjectID()
+		result, err := genreColl.InsertOne(c.Request().Context(), genre)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert genre"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.PUT("/api/genres", func(c echo.Context) error {
+		var req genreRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		id, err := primitive.ObjectIDFromHex(req.ID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		genres, err := findAllGenres(genreColl)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list genres"})
+		}
+		genre, msg := parseGenreRequest(genres, req, id)
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		update := bson.M{"$set": bson.M{"genrename": genre.GenreName}}
+		if genre.GenreParent.IsZero() {
+			update["$unset"] = bson.M{"genreparent": ""}
+		} else {
+			update["$set"].(bson.M)["genreparent"] = genre.GenreParent
+		}
+		result, err := genreColl.UpdateOne(c.Request().Context(), bson.M{"_id": id}, update)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update genre"})
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "genre not found"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.DELETE("/api/genres/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		children, err := genreColl.CountDocuments(context.TODO(), bson.M{"genreparent": id})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete genre"})
+		}
+		if children > 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "genre still has sub-genres"})
+		}
+
+		result, err := genreColl.DeleteOne(c.Request().Context(), bson.M{"_id": id})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete genre"})
+		}
+		if _, err = bookGenreColl.DeleteMany(c.Request().Context(), bson.M{"genreid": id}); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete genre"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.GET("/api/books/:id/genres", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		cursor, err := bookGenreColl.Find(context.TODO(), bson.M{"bookid": id})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list genres"})
+		}
+		var links []BookGenre
+		if err = cursor.All(context.TODO(), &links); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list genres"})
+		}
+
+		genres, err := findAllGenres(genreColl)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list genres"})
+		}
+		byID := map[primitive.ObjectID]Genre{}
+		for _, g := range genres {
+			byID[g.ID] = g
+		}
+
+		ret := []map[string]interface{}{}
+		for _, l := range links {
+			if g, ok := byID[l.GenreID]; ok {
+				ret = append(ret, genreToMap(byID, g))
+			}
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	e.POST("/api/books/:id/genres", func(c echo.Context) error {
+		bookID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var req struct {
+			Genre string `json:"genre" form:"genre"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+
+		if err = books.FindOne(context.TODO(), bson.M{"_id": bookID}).Err(); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+		genres, err := findAllGenres(genreColl)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list genres"})
+		}
+		genre, ok := resolveGenre(genres, req.Genre)
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "genre not found"})
+		}
+
+		count, err := bookGenreColl.CountDocuments(context.TODO(), bson.M{"bookid": bookID, "genreid": genre.ID})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to add genre"})
+		}
+		if count > 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "book already has this genre"})
+		}
+
+		result, err := bookGenreColl.InsertOne(c.Request().Context(), BookGenre{BookID: bookID, GenreID: genre.ID})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to add genre"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.DELETE("/api/books/:id/genres/:genre", func(c echo.Context) error {
+		bookID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		genreID, err := primitive.ObjectIDFromHex(c.Param("genre"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid genre id"})
+		}
+
+		result, err := bookGenreColl.DeleteOne(c.Request().Context(), bson.M{"bookid": bookID, "genreid": genreID})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to remove genre"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
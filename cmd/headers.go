@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// The Content-Security-Policy tells the browser where the page may load
+// things from, so a script somebody managed to sneak into it can't do much.
+// Ours comes with htmx from unpkg.com, which needs 'unsafe-eval' for the
+// hx-on attributes, and the fonts from Google. Covers and author pictures
+// may come from anywhere.
+const defaultCSP = "default-src 'self'; " +
+	"script-src 'self' https://unpkg.com 'unsafe-eval'; " +
+	"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com; " +
+	"font-src https://fonts.gstatic.com; " +
+	"img-src 'self' data: https:; " +
+	"frame-ancestors 'none'"
+
+// Adds the security headers to every response. A new Content-Security-Policy
+// can be tried out in report-only mode first: the browser then only
+// complains in the console about what it would block.
+// Strict-Transport-Security is only sent over HTTPS, as browsers ignore it
+// otherwise.
+func securityHeaders(cfg Config) echo.MiddlewareFunc {
+	return middleware.SecureWithConfig(middleware.SecureConfig{
+		ContentTypeNosniff:    "nosniff",
+		XFrameOptions:         cfg.FrameOptions,
+		ReferrerPolicy:        cfg.ReferrerPolicy,
+		ContentSecurityPolicy: cfg.ContentSecurityPolicy,
+		CSPReportOnly:         cfg.CSPReportOnly,
+		HSTSMaxAge:            cfg.HSTSMaxAge,
+	})
+}
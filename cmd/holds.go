@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A hold is a member waiting in line for a book whose copies are all out.
+// It starts as "waiting"; once a copy comes back it is set aside for the
+// first member in line and the hold becomes "ready" until it is picked up
+// ("fulfilled") or the pickup time runs out ("expired").
+type Hold struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	BookID      primitive.ObjectID `bson:"bookid"`
+	CopyID      primitive.ObjectID `bson:"copyid,omitempty"`
+	HoldMember  string             `bson:"holdmember"`
+	HoldPlaced  time.Time          `bson:"holdplaced"`
+	HoldStatus  string             `bson:"holdstatus"`
+	HoldExpires *time.Time         `bson:"holdexpires,omitempty"`
+}
+
+const (
+	HoldWaiting   = "waiting"
+	HoldReady     = "ready"
+	HoldFulfilled = "fulfilled"
+	HoldExpired   = "expired"
+	HoldCancelled = "cancelled"
+)
+
+// Keeps the queue of holds of every book. Copies coming back from a loan go
+// through the queue, so they end up with the next member waiting for them
+// instead of going straight back to the shelf.
+type HoldQueue struct {
+	copies        *Repository
+	holds         *Repository
+	notifications *Repository
+	pickup        time.Duration
+}
+
+func newHoldQueue(copies *Repository, holds *Repository, notifications *Repository, cfg Config) *HoldQueue {
+	return &HoldQueue{
+		copies:        copies,
+		holds:         holds,
+		notifications: notifications,
+		pickup:        time.Duration(cfg.HoldPickupDays) * 24 * time.Hour,
+	}
+}
+
+func holdToMap(h Hold) map[string]interface{} {
+	expires := ""
+	if h.HoldExpires != nil {
+		expires = h.HoldExpires.Format(time.RFC3339)
+	}
+	copyID := ""
+	if !h.CopyID.IsZero() {
+		copyID = h.CopyID.Hex()
+	}
+	return map[string]interface{}{
+		"id":      h.ID.Hex(),
+		"book":    h.BookID.Hex(),
+		"copy":    copyID,
+		"member":  h.HoldMember,
+		"placed":  h.HoldPlaced.Format(time.RFC3339),
+		"status":  h.HoldStatus,
+		"expires": expires,
+	}
+}
+
+// Hands a copy that just became free to the first member in line. If nobody
+// is waiting for the book, the copy goes back to the shelf.
+func (q *HoldQueue) Release(cp Copy) error {
+	now := time.Now().UTC()
+	expires := now.Add(q.pickup)
+
+	var hold Hold
+	err := q.holds.FindOneAndUpdate(context.TODO(),
+		bson.M{"bookid": cp.BookID, "holdstatus": HoldWaiting},
+		bson.M{"$set": bson.M{"holdstatus": HoldReady, "copyid": cp.ID, "holdexpires": expires}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "holdplaced", Value: 1}}),
+	).Decode(&hold)
+	if err == mongo.ErrNoDocuments {
+		_, err = q.copies.UpdateOne(context.TODO(), bson.M{"_id": cp.ID}, bson.M{"$set": bson.M{"copystatus": StatusAvailable}})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err = q.copies.UpdateOne(context.TODO(), bson.M{"_id": cp.ID}, bson.M{"$set": bson.M{"copystatus": StatusHeld}}); err != nil {
+		return err
+	}
+	notify(q.notifications, hold.HoldMember,
+		"A copy of the book you reserved is waiting for you until "+expires.Format(time.DateOnly)+".")
+	return nil
+}
+
+// Checks out the copy set aside for the member, if they have a ready hold
+// matching the filter (either on the book or on the copy itself).
+func (q *HoldQueue) Claim(member string, filter bson.M) (Copy, bool, error) {
+	holdFilter := bson.M{"holdmember": member, "holdstatus": HoldReady}
+	if id, ok := filter["_id"]; ok {
+		holdFilter["copyid"] = id
+	} else {
+		holdFilter["bookid"] = filter["bookid"]
+	}
+
+	var hold Hold
+	err := q.holds.FindOneAndUpdate(context.TODO(), holdFilter, bson.M{"$set": bson.M{"holdstatus": HoldFulfilled}}).Decode(&hold)
+	if err == mongo.ErrNoDocuments {
+		return Copy{}, false, nil
+	}
+	if err != nil {
+		return Copy{}, false, err
+	}
+
+	var cp Copy
+	err = q.copies.FindOneAndUpdate(context.TODO(),
+		bson.M{"_id": hold.CopyID, "copystatus": StatusHeld},
+		bson.M{"$set": bson.M{"copystatus": StatusLoaned}},
+	).Decode(&cp)
+	return cp, err == nil, err
+}
+
+// Expires the ready holds that were not picked up in time, passing their
+// copies on to the next member in line.
+func (q *HoldQueue) ExpireHolds() error {
+	for {
+		var hold Hold
+		err := q.holds.FindOneAndUpdate(context.TODO(),
+			bson.M{"holdstatus": HoldReady, "holdexpires": bson.M{"$lt": time.Now().UTC()}},
+			bson.M{"$set": bson.M{"holdstatus": HoldExpired}},
+		).Decode(&hold)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		notify(q.notifications, hold.HoldMember, "Your hold expired because the book was not picked up in time.")
+		if err = q.Release(Copy{ID: hold.CopyID, BookID: hold.BookID}); err != nil {
+			return err
+		}
+	}
+}
+
+// Returns the open holds of a book, oldest first, i.e., in queue order.
+func findHolds(coll *Repository, filter bson.M) ([]map[string]interface{}, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "holdplaced", Value: 1}})
+	cursor, err := coll.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []Hold
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	ret := []map[string]interface{}{}
+	for i, h := range results {
+		m := holdToMap(h)
+		m["position"] = i + 1
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+// Registers the endpoints to place, list and cancel holds.
+func registerHoldRoutes(e *echo.Echo, queue *HoldQueue, members *Repository) {
+	open := bson.M{"$in": bson.A{HoldWaiting, HoldReady}}
+
+	e.GET("/api/books/:id/holds", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		holds, err := findHolds(queue.holds, bson.M{"bookid": id, "holdstatus": open})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list holds"})
+		}
+		return c.JSON(http.StatusOK, holds)
+	})
+
+	e.GET("/api/members/:id/holds", func(c echo.Context) error {
+		member, err := findMember(members, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+
+		holds, err := findHolds(queue.holds, bson.M{"holdmember": member.MemberMembership, "holdstatus": open})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list holds"})
+		}
+		return c.JSON(http.StatusOK, holds)
+	})
+
+	e.POST("/api/holds", func(c echo.Context) error {
+		var req struct {
+			Book   string `json:"book" form:"book"`
+			Member string `json:"member" form:"member"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		bookID, err := primitive.ObjectIDFromHex(req.Book)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid book id"})
+		}
+		member, err := findMember(members, strings.TrimSpace(req.Member))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+
+		// Holds only make sense for books that exist on the shelves but that
+		// cannot be checked out right now.
+		total, err := queue.copies.CountDocuments(context.TODO(), bson.M{"bookid": bookID})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to place hold"})
+		}
+		if total == 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "book has no copies"})
+		}
+		available, err := queue.copies.CountDocuments(context.TODO(), bson.M{"bookid": bookID, "copystatus": StatusAvailable})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to place hold"})
+		}
+		if available > 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "a copy is available, check it out instead"})
+		}
+
+		existing, err := queue.holds.CountDocuments(context.TODO(), bson.M{"bookid": bookID, "holdmember": member.MemberMembership, "holdstatus": open})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to place hold"})
+		}
+		if existing > 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "member already has a hold on this book"})
+		}
+
+		hold := Hold{
+			ID:         primitive.NewObjectID(),
+			BookID:     bookID,
+			HoldMember: member.MemberMembership,
+			HoldPlaced: time.Now().UTC(),
+			HoldStatus: HoldWaiting,
+		}
+		if _, err = queue.holds.InsertOne(c.Request().Context(), hold); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to place hold"})
+		}
+		return c.JSON(http.StatusOK, holdToMap(hold))
+	})
+
+	e.DELETE("/api/holds/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		var hold Hold
+		err = queue.holds.FindOneAndUpdate(c.Request().Context(),
+			bson.M{"_id": id, "holdstatus": open},
+			bson.M{"$set": bson.M{"holdstatus": HoldCancelled}},
+		).Decode(&hold)
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "no open hold found"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to cancel hold"})
+		}
+
+		// The copy set aside for this hold goes to the next member in line
+		if hold.HoldStatus == HoldReady {
+			if err = queue.Release(Copy{ID: hold.CopyID, BookID: hold.BookID}); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to release copy"})
+			}
+		}
+		hold.HoldStatus = HoldCancelled
+		return c.JSON(http.StatusOK, holdToMap(hold))
+	})
+}
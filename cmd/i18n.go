@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The language the templates are written in. The others have a message
+// catalog in the locales folder, e.g., locales/de.json, mapping the English
+// text to the translation:
+//
+//	{"Books": "Bücher", "Page %d of %d": "Seite %d von %d"}
+//
+// Anything missing from a catalog is shown in English, so a translation can
+// be done bit by bit.
+const defaultLocale = "en"
+
+// The cookie holding the language picked in the switcher, which wins over
+// what the browser asks for
+const localeCookie = "lang"
+
+// The names of the languages, in the language itself, for the switcher
+var localeNames = map[string]string{
+	"en": "English",
+	"de": "Deutsch",
+	"fr": "Français",
+	"es": "Español",
+	"it": "Italiano",
+}
+
+// A message catalog of one language
+type Catalog map[string]string
+
+// Translates the message, and fills in the arguments, if any, the way
+// fmt.Sprintf does it, e.g., {{ t "Page %d of %d" .number .pages }}.
+func (cat Catalog) translate(message string, args ...interface{}) string {
+	if translated, ok := cat[message]; ok && translated != "" {
+		message = translated
+	}
+	if len(args) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
+
+// Reads every catalog in the folder, by the name of the file, e.g., "de"
+// for de.json.
+func loadCatalogs(dir string) map[string]Catalog {
+	catalogs := map[string]Catalog{}
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fatal("failed to read catalog", "path", path, "err", err)
+		}
+		var cat Catalog
+		if err = json.Unmarshal(data, &cat); err != nil {
+			fatal("invalid catalog", "path", path, "err", err)
+		}
+		catalogs[strings.TrimSuffix(filepath.Base(path), ".json")] = cat
+	}
+	return catalogs
+}
+
+// The languages there is a catalog for, English first
+func (t *Template) Locales() []string {
+	locales := []string{defaultLocale}
+	for locale := range t.locales {
+		if locale != defaultLocale {
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales[1:])
+	return locales
+}
+
+// Picks the language of the request: the one in the cookie, if there is a
+// catalog for it, or else the one the browser likes best, e.g., "de" for
+// "Accept-Language: de-DE,de;q=0.9,en;q=0.8".
+func requestLocale(c echo.Context, locales []string) string {
+	if locale, ok := c.Get("locale").(string); ok {
+		return locale
+	}
+	locale := defaultLocale
+	if cookie, err := c.Cookie(localeCookie); err == nil && slices.Contains(locales, cookie.Value) {
+		locale = cookie.Value
+	} else {
+		for _, lang := range acceptLanguages(c.Request().Header.Get("Accept-Language")) {
+			if slices.Contains(locales, lang) {
+				locale = lang
+				break
+			}
+		}
+	}
+	c.Set("locale", locale)
+	return locale
+}
+
+// Returns the languages of the Accept-Language header, the preferred ones
+// first. Regions are dropped, e.g., "de-AT" is "de", as the catalogs are by
+// language only.
+func acceptLanguages(header string) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var langs []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		lang, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if lang != "" && lang != "*" && q > 0 {
+			langs = append(langs, weighted{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	ret := make([]string, len(langs))
+	for i, l := range langs {
+		ret[i] = l.lang
+	}
+	return ret
+}
+
+// Registers the language switcher, which remembers the language in a cookie
+// and reloads the page, like the branch switcher does.
+func registerLocaleRoutes(e *echo.Echo, t *Template) {
+	e.GET("/locale/switcher", func(c echo.Context) error {
+		current := requestLocale(c, t.Locales())
+		var list []map[string]interface{}
+		for _, locale := range t.Locales() {
+			name, ok := localeNames[locale]
+			if !ok {
+				name = locale
+			}
+			list = append(list, map[string]interface{}{"code": locale, "name": name, "selected": locale == current})
+		}
+		return c.Render(http.StatusOK, "locale-switcher", list)
+	})
+
+	e.POST("/locale", func(c echo.Context) error {
+		value := c.FormValue("lang")
+		if !slices.Contains(t.Locales(), value) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "unknown language"})
+		}
+		c.SetCookie(&http.Cookie{Name: localeCookie, Value: value, Path: "/", MaxAge: 365 * 24 * 3600, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		c.Response().Header().Set("HX-Refresh", "true")
+		return c.NoContent(http.StatusOK)
+	})
+}
+
+// Makes a copy of the templates for every catalog, where "t" translates with
+// it. The templates are copied before they first run, as html/template
+// doesn't allow it afterwards.
+func localizeTemplates(base *template.Template, catalogs map[string]Catalog) map[string]*template.Template {
+	ret := map[string]*template.Template{}
+	for locale, cat := range catalogs {
+		locale := locale
+		clone := template.Must(base.Clone())
+		clone.Funcs(template.FuncMap{
+			"t":      cat.translate,
+			"locale": func() string { return locale },
+		})
+		ret[locale] = clone
+	}
+	return ret
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// How often the progress of an import is sent to the page following it
+const importProgressInterval = time.Second
+
+// A row of an imported file that was not added, and why
+type ImportError struct {
+	Row     int    `bson:"row" json:"row"`
+	Message string `bson:"message" json:"message"`
+}
+
+// Where an import is at. It is stored in the jobs collection after every
+// row, next to the state of the enrichment job, so its progress can be
+// followed from any request.
+type ImportJob struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Kind      string             `bson:"kind"`
+	File      string             `bson:"file"`
+	Total     int                `bson:"total"`
+	Processed int                `bson:"processed"`
+	Created   int                `bson:"created"`
+	Errors    []ImportError      `bson:"errors"`
+	Started   time.Time          `bson:"started"`
+	Finished  *time.Time         `bson:"finished,omitempty"`
+}
+
+func importJobToMap(job ImportJob) map[string]interface{} {
+	percent := 100
+	if job.Total > 0 {
+		percent = job.Processed * 100 / job.Total
+	}
+	return map[string]interface{}{
+		"id":        job.ID.Hex(),
+		"file":      job.File,
+		"total":     job.Total,
+		"processed": job.Processed,
+		"created":   job.Created,
+		"failed":    len(job.Errors),
+		"errors":    job.Errors,
+		"percent":   percent,
+		"started":   formatTimestamp(job.Started),
+		"finished":  job.Finished != nil,
+	}
+}
+
+// A book read from the file, with the row it was on, or why it couldn't be
+// read
+type importRow struct {
+	line int
+	book BookStore
+	err  string
+}
+
+// Reads the books of a CSV file. The first line names the columns, the way
+// the export of the book table does (see export.go), so an exported file can
+// be imported again: name, author, isbn, pages, year, language, audience,
+// ddc, lcc, price, currency, description, and tags, separated by commas.
+// Other columns are skipped.
+func readImportCSV(r io.Reader) ([]importRow, error) {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	header, err := in.Read()
+	if err != nil {
+		return nil, errors.New("the file has no header")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New("the file has no name column")
+	}
+
+	var rows []importRow
+	for line := 2; ; line++ {
+		record, err := in.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			rows = append(rows, importRow{line: line, err: "the line is not valid CSV"})
+			continue
+		}
+		value := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		// Empty numbers are 0, like in the create form
+		valid := true
+		number := func(name string) int {
+			if value(name) == "" {
+				return 0
+			}
+			n, err := strconv.Atoi(value(name))
+			valid = valid && err == nil
+			return n
+		}
+
+		row := importRow{line: line, book: BookStore{
+			BookName:        value("name"),
+			BookAuthor:      value("author"),
+			BookISBN:        value("isbn"),
+			BookLanguage:    value("language"),
+			BookAudience:    value("audience"),
+			BookDDC:         value("ddc"),
+			BookLCC:         value("lcc"),
+			BookCurrency:    value("currency"),
+			BookDescription: value("description"),
+			BookPages:       number("pages"),
+			BookYear:        number("year"),
+			BookPrice:       number("price"),
+		}}
+		if tags := value("tags"); tags != "" {
+			row.book.BookTags = strings.Split(tags, ",")
+		}
+		if !valid {
+			row.err = "pages, year and price must be whole numbers"
+		}
+		rows = append(rows, row)
+	}
+}
+
+// Reads the books of a JSON file, a list of books the way /api/books takes
+// them.
+func readImportJSON(r io.Reader) ([]importRow, error) {
+	var items []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return nil, errors.New("the file is not a JSON list")
+	}
+	rows := make([]importRow, len(items))
+	for i, item := range items {
+		rows[i].line = i + 1
+		if err := json.Unmarshal(item, &rows[i].book); err != nil {
+			rows[i].err = "the book is not valid"
+		}
+	}
+	return rows, nil
+}
+
+// Adds the books one at a time, the way the create form does, and saves the
+// job after each of them. The books that don't pass are left out and noted,
+// the others are added anyway.
+func runImport(ctx context.Context, books *Repository, jobs *Repository, job ImportJob, rows []importRow) {
+	save := func() {
+		if _, err := jobs.ReplaceOne(ctx, bson.M{"_id": job.ID}, job); err != nil {
+			loggerFrom(ctx).Error("failed to save import", "import", job.ID.Hex(), "err", err)
+		}
+	}
+	for _, row := range rows {
+		book := row.book
+		msg := row.err
+		if msg == "" {
+			book.ID = primitive.NewObjectID()
+			book.BookTags = normalizeTags(book.BookTags)
+			var problems []string
+			for _, p := range validateBook(&book) {
+				problems = append(problems, p)
+			}
+			slices.Sort(problems)
+			msg = strings.Join(problems, ", ")
+		}
+		if msg == "" {
+			if duplicate, err := hasDuplicate(books, book); err != nil || duplicate {
+				msg = "book already exists"
+			}
+		}
+		if msg == "" {
+			if _, err := books.InsertOne(ctx, book); mongo.IsDuplicateKeyError(err) {
+				msg = "book already exists"
+			} else if err != nil {
+				msg = "failed to create book"
+			}
+		}
+		if msg != "" {
+			job.Errors = append(job.Errors, ImportError{Row: row.line, Message: msg})
+		} else {
+			job.Created++
+		}
+		job.Processed++
+		save()
+	}
+	now := time.Now().UTC()
+	job.Finished = &now
+	save()
+}
+
+// Registers the import of books from a CSV or JSON file, e.g., dropped on
+// the /import page. The books are added in the background; the import can
+// be followed at /api/books/import/<id>, or as a stream of events, each with
+// its progress as HTML, at /api/books/import/<id>/events.
+func registerImportRoutes(e *echo.Echo, books *Repository, jobs *Repository) {
+	e.GET("/import", func(c echo.Context) error {
+		return c.Render(http.StatusOK, "import-page", nil)
+	})
+
+	e.POST("/api/books/import", func(c echo.Context) error {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "file is required"})
+		}
+		file, err := header.Open()
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "failed to read file"})
+		}
+		defer file.Close()
+
+		var rows []importRow
+		switch strings.ToLower(filepath.Ext(header.Filename)) {
+		case ".csv":
+			rows, err = readImportCSV(file)
+		case ".json":
+			rows, err = readImportJSON(file)
+		default:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "file must be a .csv or a .json file"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+
+		job := ImportJob{
+			ID:      primitive.NewObjectID(),
+			Kind:    "import",
+			File:    header.Filename,
+			Total:   len(rows),
+			Errors:  []ImportError{},
+			Started: time.Now().UTC(),
+		}
+		if _, err = jobs.InsertOne(c.Request().Context(), job); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start import"})
+		}
+		// The import outlives the request, but it is still done by the user
+		// who sent the file, as far as the audit log is concerned
+		go runImport(context.WithoutCancel(c.Request().Context()), books, jobs, job, rows)
+
+		if c.Request().Header.Get("HX-Request") != "" {
+			return c.Render(http.StatusAccepted, "import-job", importJobToMap(job))
+		}
+		return c.JSON(http.StatusAccepted, importJobToMap(job))
+	})
+
+	// Finds the import of the path. When there is none, the error has been
+	// answered already.
+	find := func(c echo.Context) (ImportJob, bool, error) {
+		var job ImportJob
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return job, false, c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		if err = jobs.FindOne(context.TODO(), bson.M{"_id": id, "kind": "import"}).Decode(&job); err != nil {
+			return job, false, c.JSON(http.StatusNotFound, map[string]string{"error": "import not found"})
+		}
+		return job, true, nil
+	}
+
+	e.GET("/api/books/import/:id", func(c echo.Context) error {
+		job, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		return c.JSON(http.StatusOK, importJobToMap(job))
+	})
+
+	// Server-sent events: a "progress" event whenever more rows were handled,
+	// and a "done" event at the end, each with the progress rendered as
+	// "import-status". The page puts them in place, see index.js.
+	e.GET("/api/books/import/:id/events", func(c echo.Context) error {
+		job, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set(echo.HeaderCacheControl, "no-cache")
+		res.WriteHeader(http.StatusOK)
+
+		send := func(event string) error {
+			var html bytes.Buffer
+			if err := c.Echo().Renderer.Render(&html, "import-status", importJobToMap(job), c); err != nil {
+				return err
+			}
+			fmt.Fprintf(res, "event: %s\n", event)
+			for _, line := range strings.Split(strings.TrimSpace(html.String()), "\n") {
+				fmt.Fprintf(res, "data: %s\n", line)
+			}
+			fmt.Fprint(res, "\n")
+			res.Flush()
+			return nil
+		}
+
+		ticker := time.NewTicker(importProgressInterval)
+		defer ticker.Stop()
+		sent := -1
+		for {
+			if job.Finished != nil {
+				return send("done")
+			}
+			if job.Processed != sent {
+				if err = send("progress"); err != nil {
+					return err
+				}
+				sent = job.Processed
+			}
+			select {
+			case <-c.Request().Context().Done():
+				return nil
+			case <-ticker.C:
+			}
+			if err = jobs.FindOne(context.TODO(), bson.M{"_id": job.ID}).Decode(&job); err != nil {
+				return err
+			}
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The indexes of the books the queries rely on. The libraries of all the
+// tenants share the collection, so the indexes start with the tenant, and
+// the same ISBN may be in two libraries, but not twice in one. Books without
+// an ISBN are left out of that one, so there may be any number of them.
+//
+// The authors and years pages group the books by those (see countByAuthor
+// and countByYear). The indexes on them, with the status, find the books in
+// circulation of the library without going through the whole collection,
+// but the grouping still reads the books they find: the default library
+// matches {"tenant": nil}, which also takes the books without a tenant, and
+// an index can't tell those from the ones with a null tenant, so the query
+// is never answered from the index alone.
+//
+// The text index is for searching the words of the books. Their language
+// field holds codes MongoDB doesn't all know, and it would refuse the books
+// of the others, so the index ignores it and stems everything as English.
+var bookIndexes = []mongo.IndexModel{
+	{
+		Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "bookisbnkey", Value: 1}},
+		Options: options.Index().SetName("isbn").SetUnique(true).
+			SetPartialFilterExpression(bson.M{"bookisbnkey": bson.M{"$gt": ""}}),
+	},
+	{
+		Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "bookname", Value: 1}, {Key: "bookauthor", Value: 1}},
+		Options: options.Index().SetName("name_author"),
+	},
+	{
+		Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "bookauthor", Value: 1}, {Key: "bookstatus", Value: 1}},
+		Options: options.Index().SetName("author"),
+	},
+	{
+		Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "bookyear", Value: 1}, {Key: "bookstatus", Value: 1}},
+		Options: options.Index().SetName("year"),
+	},
+	{
+		Keys: bson.D{{Key: "bookname", Value: "text"}, {Key: "bookauthor", Value: "text"}, {Key: "bookdescription", Value: "text"}},
+		Options: options.Index().SetName("search").
+			SetWeights(bson.M{"bookname": 10, "bookauthor": 5, "bookdescription": 1}).
+			SetDefaultLanguage("english").SetLanguageOverride("textlanguage"),
+	},
+}
+
+// No two libraries have the same slug, even when both are created at the
+// same time.
+var tenantIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "tenantslug", Value: 1}},
+		Options: options.Index().SetName("slug").SetUnique(true),
+	},
+}
+
+// Brings the database up to date with what this version of the server
+// expects: the books written before there was a bookisbnkey get one, and
+// the indexes are created. Doing it again changes nothing, so it runs at
+// every start, unless AUTO_MIGRATE=false, in which case "go run ./cmd
+// migrate" does it, e.g., as a step of the deployment.
+func migrate(ctx context.Context, client *mongo.Client) error {
+	// The books of all the tenants, which is why it isn't a Repository
+	books := client.Database("exercise-1").Collection(booksCollection)
+	cursor, err := books.Find(ctx, bson.M{"bookisbnkey": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"bookisbn": 1}))
+	if err != nil {
+		return err
+	}
+	var missing []struct {
+		ID   interface{} `bson:"_id"`
+		ISBN string      `bson:"bookisbn"`
+	}
+	if err = cursor.All(ctx, &missing); err != nil {
+		return err
+	}
+	for _, b := range missing {
+		if _, err = books.UpdateOne(ctx, bson.M{"_id": b.ID}, bson.M{"$set": bson.M{"bookisbnkey": normalizeISBN(b.ISBN)}}); err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		slog.Info("filled in the keys of the ISBNs", "books", len(missing))
+	}
+
+	names, err := books.Indexes().CreateMany(ctx, bookIndexes)
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("some books of a library have the same ISBN, merge them first (see GET /api/books/duplicates): %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Debug("the indexes are there", "collection", booksCollection, "indexes", names)
+
+	tenants := client.Database("exercise-1").Collection("tenants")
+	if names, err = tenants.Indexes().CreateMany(ctx, tenantIndexes); err != nil {
+		return err
+	}
+	slog.Debug("the indexes are there", "collection", "tenants", "indexes", names)
+	return nil
+}
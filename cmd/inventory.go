@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How many books a page of the printable inventory has. It's many more than
+// the table on the screen shows, as the rows are small, and printing is
+// easier with fewer pages to ask for.
+const printPageSize = 200
+
+// Registers the printable inventory, a compact table of the books to tick
+// off on the shelves when taking stock. The books are filtered the way the
+// book table is, and can be narrowed down to a room or a shelf, e.g.,
+// /books/print?room=Main&shelf=B4. With ?group=shelf they are grouped by
+// shelf, in the order they stand on it, each shelf on a page of its own.
+func registerInventoryRoutes(e *echo.Echo, coll *Repository, copies *Repository, filter func(echo.Context) (bson.M, error)) {
+	e.GET("/books/print", func(c echo.Context) error {
+		books, err := filter(c)
+		if err != nil {
+			return filterFailed(c, err)
+		}
+		location, ok := locationFilter(c, "booklocation")
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid position"})
+		}
+		combined := bson.M{"$and": bson.A{books, location}}
+
+		grouped := c.QueryParam("group") == "shelf"
+		opts := options.Find().SetSort(bson.D{{Key: "bookname", Value: 1}})
+		if grouped {
+			opts.SetSort(bson.D{
+				{Key: "booklocation.room", Value: 1},
+				{Key: "booklocation.shelf", Value: 1},
+				{Key: "booklocation.position", Value: 1},
+				{Key: "bookname", Value: 1},
+			})
+		} else if sortBy := preferredSort(c); sortBy != "" {
+			if opts, ok = bookSort(sortBy); !ok {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid sort"})
+			}
+		}
+
+		page, err := paginate(coll, combined, Page{Number: pageFrom(c).Number, Size: printPageSize})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count books"})
+		}
+		cursor, err := coll.Find(context.TODO(), combined, page.Apply(opts))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list books"})
+		}
+		var results []BookStore
+		if err = cursor.All(context.TODO(), &results); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list books"})
+		}
+
+		rows := []map[string]interface{}{}
+		for _, b := range results {
+			rows = append(rows, map[string]interface{}{
+				"id":       b.ID.Hex(),
+				"name":     b.BookName,
+				"author":   b.BookAuthor,
+				"isbn":     b.BookISBN,
+				"year":     b.BookYear,
+				"location": locationToMap(b.BookLocation),
+				"shelf":    shelfName(b.BookLocation),
+			})
+		}
+		// The copies expected on the shelves of the branch picked in the
+		// switcher
+		scope, _ := branchFilter(c, bson.M{}, "copybranch")
+		if err = addAvailability(copies, rows, scope); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count copies"})
+		}
+
+		// The books of the same shelf are next to each other, as they are
+		// sorted by shelf. Without grouping, they are all in one group.
+		var groups []map[string]interface{}
+		for _, row := range rows {
+			if len(groups) == 0 || (grouped && groups[len(groups)-1]["shelf"] != row["shelf"]) {
+				groups = append(groups, map[string]interface{}{"shelf": row["shelf"], "books": []map[string]interface{}{}})
+			}
+			last := groups[len(groups)-1]
+			last["books"] = append(last["books"].([]map[string]interface{}), row)
+		}
+
+		// The links to the pages around, and to the other grouping, keep
+		// the filters. The other grouping starts over at the first page.
+		query := bookExportQuery(c)
+		for _, name := range []string{"room", "shelf", "position", "group"} {
+			if value := c.QueryParam(name); value != "" {
+				query.Set(name, value)
+			}
+		}
+		link := func(name string, value string) string {
+			q := url.Values{}
+			for n, values := range query {
+				q[n] = values
+			}
+			q.Del(name)
+			if name != "page" {
+				q.Del("page")
+			}
+			if value != "" {
+				q.Set(name, value)
+			}
+			return "/books/print?" + q.Encode()
+		}
+		data := map[string]interface{}{
+			"groups":  groups,
+			"grouped": grouped,
+			"number":  page.Number,
+			"pages":   page.Pages(),
+			"total":   page.Total,
+			"printed": time.Now().Format(time.DateOnly),
+			"ungroup": link("group", ""),
+			"group":   link("group", "shelf"),
+		}
+		if page.Number > 1 {
+			data["prev"] = link("page", strconv.Itoa(page.Number-1))
+		}
+		if page.Number < page.Pages() {
+			data["next"] = link("page", strconv.Itoa(page.Number+1))
+		}
+		return c.Render(http.StatusOK, "book-print", data)
+	})
+}
+
+// The room and the shelf of the location, e.g., "Main / B4", or "" when the
+// book has no place yet.
+func shelfName(l Location) string {
+	if l.IsZero() {
+		return ""
+	}
+	return l.Room + " / " + l.Shelf
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Runs the job periodically, logging its failures. It is meant to be started
+// in its own goroutine, next to the server, since it never returns.
+func runEvery(interval time.Duration, name string, job func() error) {
+	for range time.Tick(interval) {
+		if err := job(); err != nil {
+			slog.Error("job failed", "job", name, "err", err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The status changes staff may make by hand. Lending, returning and holding
+// go through the loans and holds instead, so "loaned" and "held" are not a
+// target here. Withdrawn copies are gone for good.
+var copyTransitions = map[string][]string{
+	StatusAvailable: {StatusLost, StatusDamaged, StatusWithdrawn},
+	StatusLoaned:    {StatusLost},
+	StatusDamaged:   {StatusAvailable, StatusWithdrawn},
+	StatusLost:      {StatusAvailable, StatusWithdrawn},
+}
+
+// Books can be withdrawn from the catalogue too, e.g., when all the copies
+// are lost, but unlike copies they can be brought back.
+var bookTransitions = map[string][]string{
+	StatusAvailable: {StatusLost, StatusDamaged, StatusWithdrawn},
+	StatusDamaged:   {StatusAvailable, StatusWithdrawn},
+	StatusLost:      {StatusAvailable, StatusWithdrawn},
+	StatusWithdrawn: {StatusAvailable},
+}
+
+// Copies and books that are not part of the collection anymore. They are
+// left out of the catalogue and of the counts unless asked for.
+var outOfCirculation = []string{StatusLost, StatusWithdrawn}
+
+func canTransition(transitions map[string][]string, from string, to string) bool {
+	return from == to || slices.Contains(transitions[from], to)
+}
+
+// Returns the statuses from which the given one can be reached.
+func transitionSources(transitions map[string][]string, to string) []string {
+	sources := []string{}
+	for from, targets := range transitions {
+		if slices.Contains(targets, to) {
+			sources = append(sources, from)
+		}
+	}
+	return sources
+}
+
+// Books without a status were added before there were statuses, and count
+// as available.
+func bookStatus(book BookStore) string {
+	if book.BookStatus == "" {
+		return StatusAvailable
+	}
+	return book.BookStatus
+}
+
+// Narrows the books down by status. By default the lost and withdrawn ones
+// are hidden, "all" shows every book.
+func statusFilter(filter bson.M, value string) bson.M {
+	switch value {
+	case "":
+		filter["bookstatus"] = bson.M{"$nin": outOfCirculation}
+	case "all":
+	case StatusAvailable:
+		filter["bookstatus"] = bson.M{"$in": bson.A{nil, StatusAvailable}}
+	default:
+		filter["bookstatus"] = value
+	}
+	return filter
+}
+
+// Same as statusFilter, for the filters that go through a Query
+func statusQuery(q *Query, value string) *Query {
+	switch value {
+	case "":
+		return q.Where("bookstatus", "$nin", outOfCirculation)
+	case "all":
+		return q
+	case StatusAvailable:
+		return q.Where("bookstatus", "$in", bson.A{nil, StatusAvailable})
+	}
+	return q.Eq("bookstatus", value)
+}
+
+// Registers the endpoints to change the status of books and copies.
+func registerLifecycleRoutes(e *echo.Echo, books *Repository, copies *Repository) {
+	// The update only matches when the current status allows the change, so
+	// two concurrent changes cannot both go through.
+	change := func(c echo.Context, coll *Repository, field string, transitions map[string][]string, notFound string) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var req struct {
+			Status string `json:"status" form:"status"`
+		}
+		if err = c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		sources := transitionSources(transitions, req.Status)
+		if len(sources) == 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "status " + req.Status + " cannot be set by hand"})
+		}
+		filter := bson.M{"_id": id, field: bson.M{"$in": sources}}
+		if slices.Contains(sources, StatusAvailable) {
+			// Books stored before statuses existed have none
+			filter = bson.M{"_id": id, "$or": bson.A{bson.M{field: bson.M{"$in": sources}}, bson.M{field: bson.M{"$exists": false}}}}
+		}
+
+		var doc bson.M
+		err = coll.FindOneAndUpdate(c.Request().Context(),
+			filter,
+			bson.M{"$set": bson.M{field: req.Status}},
+			options.FindOneAndUpdate().SetReturnDocument(options.Before),
+		).Decode(&doc)
+		if err == mongo.ErrNoDocuments {
+			if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&doc); err != nil {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": notFound})
+			}
+			current, _ := doc[field].(string)
+			return c.JSON(http.StatusConflict, map[string]string{"error": "cannot change status from " + current + " to " + req.Status})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to change status"})
+		}
+
+		previous, _ := doc[field].(string)
+		if previous == "" {
+			previous = StatusAvailable
+		}
+		return c.JSON(http.StatusOK, map[string]string{"id": id.Hex(), "previous": previous, "status": req.Status})
+	}
+
+	e.POST("/api/books/:id/status", func(c echo.Context) error {
+		return change(c, books, "bookstatus", bookTransitions, "book not found")
+	})
+
+	e.POST("/api/copies/:id/status", func(c echo.Context) error {
+		return change(c, copies, "copystatus", copyTransitions, "copy not found")
+	})
+}
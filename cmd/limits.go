@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Limits how large the body of a request may be, so nobody can make the
+// server run out of memory by sending it gigabytes. Uploads, i.e., multipart
+// forms with files such as covers, may be larger than everything else. Too
+// large a body is answered with 413 Request Entity Too Large, before any
+// handler looks at it.
+func bodyLimit(cfg Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Body == nil || req.Body == http.NoBody {
+				return next(c)
+			}
+			limit := int64(cfg.BodyLimitKB) * 1024
+			if strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+				limit = int64(cfg.UploadLimitKB) * 1024
+			}
+
+			// Most clients say how large the body is, the others are only
+			// read up to the limit
+			if req.ContentLength > limit {
+				return tooLarge(c, limit)
+			}
+			data, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "failed to read request"})
+			}
+			if int64(len(data)) > limit {
+				return tooLarge(c, limit)
+			}
+			req.Body = io.NopCloser(bytes.NewReader(data))
+			return next(c)
+		}
+	}
+}
+
+func tooLarge(c echo.Context, limit int64) error {
+	c.Request().Close = true
+	return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "request body is larger than " + formatSize(limit)})
+}
+
+func formatSize(n int64) string {
+	if n >= 1024*1024 && n%(1024*1024) == 0 {
+		return strconv.FormatInt(n/(1024*1024), 10) + "MB"
+	}
+	return strconv.FormatInt(n/1024, 10) + "KB"
+}
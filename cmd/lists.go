@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A named list of books kept by a member, e.g., "To Read" or "Summer 2025".
+// The books are stored in the order the member arranged them. A list can be
+// shared through a secret token, which gives read-only access to it.
+type ReadingList struct {
+	ID          primitive.ObjectID   `bson:"_id,omitempty"`
+	ListName    string               `bson:"listname"`
+	ListOwner   string               `bson:"listowner"`
+	ListBooks   []primitive.ObjectID `bson:"listbooks"`
+	ListShare   string               `bson:"listshare,omitempty"`
+	ListCreated time.Time            `bson:"listcreated"`
+	UpdatedAt   time.Time            `bson:"updatedat,omitempty"`
+}
+
+func listToMap(l ReadingList) map[string]interface{} {
+	books := []string{}
+	for _, b := range l.ListBooks {
+		books = append(books, b.Hex())
+	}
+	shared := ""
+	if l.ListShare != "" {
+		shared = "/shared/lists/" + l.ListShare
+	}
+	return map[string]interface{}{
+		"id":        l.ID.Hex(),
+		"name":      l.ListName,
+		"owner":     l.ListOwner,
+		"books":     books,
+		"shared":    shared,
+		"created":   l.ListCreated.Format(time.RFC3339),
+		"updatedAt": formatTimestamp(l.UpdatedAt),
+	}
+}
+
+// Returns the books of the list in the order of the list.
+func listBooks(books *Repository, list ReadingList) []map[string]interface{} {
+	byID := map[string]map[string]interface{}{}
+	for _, b := range findAllBooks(books, bson.M{"_id": bson.M{"$in": list.ListBooks}}) {
+		byID[b["id"].(string)] = b
+	}
+
+	ret := []map[string]interface{}{}
+	for _, id := range list.ListBooks {
+		if b, ok := byID[id.Hex()]; ok {
+			ret = append(ret, b)
+		}
+	}
+	return ret
+}
+
+// Generates a random token that is practically impossible to guess, used
+// for the public links of the shared lists.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Registers the endpoints to manage the reading lists, and the public page
+// of the shared ones.
+func registerListRoutes(e *echo.Echo, books *Repository, members *Repository, coll *Repository) {
+	// Most handlers start by fetching the list from the path parameter. When
+	// that fails, the error response was already sent and ok is false.
+	find := func(c echo.Context) (list ReadingList, ok bool, err error) {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return list, false, c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&list); err != nil {
+			return list, false, c.JSON(http.StatusNotFound, map[string]string{"error": "list not found"})
+		}
+		return list, true, nil
+	}
+
+	e.GET("/shared/lists/:token", func(c echo.Context) error {
+		var list ReadingList
+		if err := coll.FindOne(context.TODO(), bson.M{"listshare": c.Param("token")}).Decode(&list); err != nil || c.Param("token") == "" {
+			return echo.NewHTTPError(http.StatusNotFound, "list not found")
+		}
+		return c.Render(200, "shared-list", map[string]interface{}{
+			"list":  listToMap(list),
+			"books": listBooks(books, list),
+		})
+	})
+
+	e.GET("/api/lists", func(c echo.Context) error {
+		query := newQuery("listowner")
+		if owner := c.QueryParam("owner"); owner != "" {
+			member, err := findMember(members, owner)
+			if err != nil {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+			}
+			query.Eq("listowner", member.MemberMembership)
+		}
+		filter, err := query.Filter()
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+
+		opts := options.Find().SetSort(bson.D{{Key: "listcreated", Value: -1}})
+		cursor, err := coll.Find(context.TODO(), filter, opts)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list lists"})
+		}
+		var results []ReadingList
+		if err = cursor.All(context.TODO(), &results); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list lists"})
+		}
+
+		ret := []map[string]interface{}{}
+		for _, l := range results {
+			ret = append(ret, listToMap(l))
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	e.GET("/api/lists/:id", func(c echo.Context) error {
+		list, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		ret := listToMap(list)
+		ret["books"] = listBooks(books, list)
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	e.POST("/api/lists", func(c echo.Context) error {
+		var req struct {
+			Name  string `json:"name" form:"name"`
+			Owner string `json:"owner" form:"owner"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if req.Name = strings.TrimSpace(req.Name); req.Name == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "name is required"})
+		}
+		member, err := findMember(members, strings.TrimSpace(req.Owner))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+
+		list := ReadingList{
+			ID:          primitive.NewObjectID(),
+			ListName:    req.Name,
+			ListOwner:   member.MemberMembership,
+			ListBooks:   []primitive.ObjectID{},
+			ListCreated: time.Now().UTC(),
+		}
+		if _, err = coll.InsertOne(c.Request().Context(), list); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert list"})
+		}
+		return c.JSON(http.StatusOK, listToMap(list))
+	})
+
+	e.PUT("/api/lists", func(c echo.Context) error {
+		var req struct {
+			ID   string `json:"id" form:"id"`
+			Name string `json:"name" form:"name"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		id, err := primitive.ObjectIDFromHex(req.ID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		if req.Name = strings.TrimSpace(req.Name); req.Name == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "name is required"})
+		}
+
+		result, err := coll.UpdateOne(c.Request().Context(), bson.M{"_id": id}, bson.M{"$set": bson.M{"listname": req.Name}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update list"})
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "list not found"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.DELETE("/api/lists/:id", func(c echo.Context) error {
+		list, ok, err := find(c)
+		if !ok {
+			return err
+		}
+
+		result, err := coll.DeleteOne(c.Request().Context(), bson.M{"_id": list.ID})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete list"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.POST("/api/lists/:id/books", func(c echo.Context) error {
+		list, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		var req struct {
+			Book string `json:"book" form:"book"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		bookID, err := primitive.ObjectIDFromHex(req.Book)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid book id"})
+		}
+		if err = books.FindOne(context.TODO(), bson.M{"_id": bookID}).Err(); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+
+		// $addToSet appends the book at the end, unless it is already there
+		if _, err = coll.UpdateOne(c.Request().Context(), bson.M{"_id": list.ID}, bson.M{"$addToSet": bson.M{"listbooks": bookID}}); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to add book"})
+		}
+		if !slices.Contains(list.ListBooks, bookID) {
+			list.ListBooks = append(list.ListBooks, bookID)
+		}
+		return c.JSON(http.StatusOK, listToMap(list))
+	})
+
+	e.DELETE("/api/lists/:id/books/:book", func(c echo.Context) error {
+		list, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		bookID, err := primitive.ObjectIDFromHex(c.Param("book"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid book id"})
+		}
+
+		if _, err = coll.UpdateOne(c.Request().Context(), bson.M{"_id": list.ID}, bson.M{"$pull": bson.M{"listbooks": bookID}}); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to remove book"})
+		}
+		list.ListBooks = slices.DeleteFunc(list.ListBooks, func(id primitive.ObjectID) bool { return id == bookID })
+		return c.JSON(http.StatusOK, listToMap(list))
+	})
+
+	// Reordering sends the complete list of books in the new order. It must
+	// contain exactly the books already in the list, just moved around.
+	e.PUT("/api/lists/:id/order", func(c echo.Context) error {
+		list, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		var req struct {
+			Books []string `json:"books" form:"books"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+
+		order := []primitive.ObjectID{}
+		for _, b := range req.Books {
+			id, err := primitive.ObjectIDFromHex(b)
+			if err != nil || !slices.Contains(list.ListBooks, id) || slices.Contains(order, id) {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "order must contain each book of the list once"})
+			}
+			order = append(order, id)
+		}
+		if len(order) != len(list.ListBooks) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "order must contain each book of the list once"})
+		}
+
+		if _, err = coll.UpdateOne(c.Request().Context(), bson.M{"_id": list.ID}, bson.M{"$set": bson.M{"listbooks": order}}); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to reorder list"})
+		}
+		list.ListBooks = order
+		return c.JSON(http.StatusOK, listToMap(list))
+	})
+
+	e.POST("/api/lists/:id/share", func(c echo.Context) error {
+		list, ok, err := find(c)
+		if !ok {
+			return err
+		}
+
+		if list.ListShare == "" {
+			if list.ListShare, err = newToken(); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to share list"})
+			}
+			if _, err = coll.UpdateOne(c.Request().Context(), bson.M{"_id": list.ID}, bson.M{"$set": bson.M{"listshare": list.ListShare}}); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to share list"})
+			}
+		}
+		return c.JSON(http.StatusOK, listToMap(list))
+	})
+
+	// Stops sharing: the old link stops working right away
+	e.DELETE("/api/lists/:id/share", func(c echo.Context) error {
+		list, ok, err := find(c)
+		if !ok {
+			return err
+		}
+
+		if _, err = coll.UpdateOne(c.Request().Context(), bson.M{"_id": list.ID}, bson.M{"$unset": bson.M{"listshare": ""}}); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to unshare list"})
+		}
+		list.ListShare = ""
+		return c.JSON(http.StatusOK, listToMap(list))
+	})
+}
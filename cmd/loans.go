@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A loan records that a copy of a book was checked out to a member, who is
+// referred to by the membership id. As long as it has no return date, the
+// loan is still open and the copy is away.
+type Loan struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty"`
+	BookID         primitive.ObjectID `bson:"bookid"`
+	CopyID         primitive.ObjectID `bson:"copyid"`
+	LoanMember     string             `bson:"loanmember"`
+	LoanCheckedOut time.Time          `bson:"loancheckedout"`
+	LoanDue        time.Time          `bson:"loandue"`
+	LoanOverdue    bool               `bson:"loanoverdue"`
+	LoanReturned   *time.Time         `bson:"loanreturned,omitempty"`
+	// The branch of the copy, where it was lent from
+	LoanBranch primitive.ObjectID `bson:"loanbranch,omitempty"`
+}
+
+// The body of a checkout. Either a specific copy is given (e.g., the barcode
+// was scanned), or just the book, and then any available copy is taken.
+type loanRequest struct {
+	Book   string `json:"book" form:"book"`
+	Copy   string `json:"copy" form:"copy"`
+	Member string `json:"member" form:"member"`
+	// When only the book is given, the copy is taken from this branch
+	Branch string `json:"branch" form:"branch"`
+}
+
+func loanToMap(l Loan) map[string]interface{} {
+	returned := ""
+	if l.LoanReturned != nil {
+		returned = l.LoanReturned.Format(time.RFC3339)
+	}
+	branch := ""
+	if !l.LoanBranch.IsZero() {
+		branch = l.LoanBranch.Hex()
+	}
+	return map[string]interface{}{
+		"id":         l.ID.Hex(),
+		"book":       l.BookID.Hex(),
+		"branch":     branch,
+		"copy":       l.CopyID.Hex(),
+		"member":     l.LoanMember,
+		"checkedOut": l.LoanCheckedOut.Format(time.RFC3339),
+		"due":        l.LoanDue.Format(time.RFC3339),
+		"overdue":    l.LoanOverdue,
+		"returned":   returned,
+		"active":     l.LoanReturned == nil,
+	}
+}
+
+func findLoans(coll *Repository, filter bson.M) ([]map[string]interface{}, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "loancheckedout", Value: -1}})
+	cursor, err := coll.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []Loan
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	ret := []map[string]interface{}{}
+	for _, l := range results {
+		ret = append(ret, loanToMap(l))
+	}
+	return ret, nil
+}
+
+// Narrows a loan filter to the open loans, unless ?all=true is requested.
+func activeLoansFilter(c echo.Context, filter bson.M) (bson.M, bool) {
+	if c.QueryParam("all") != "true" {
+		filter["loanreturned"] = bson.M{"$exists": false}
+	}
+	return branchFilter(c, filter, "loanbranch")
+}
+
+// Marks a copy as loaned, but only if it is still available. Doing the check
+// and the update in a single operation means two people cannot check out the
+// same copy at the same moment.
+func reserveCopy(copies *Repository, filter bson.M) (Copy, error) {
+	filter["copystatus"] = StatusAvailable
+	var cp Copy
+	err := copies.FindOneAndUpdate(context.TODO(), filter, bson.M{"$set": bson.M{"copystatus": StatusLoaned}}).Decode(&cp)
+	return cp, err
+}
+
+// Registers the endpoints to check books out and back in.
+func registerLoanRoutes(e *echo.Echo, cfg Config, copies *Repository, members *Repository, queue *HoldQueue, fines *Repository, coll *Repository) {
+	rules := FineRules{PerDay: cfg.FinePerDay, Cap: cfg.FineCap}
+
+	e.GET("/api/loans", func(c echo.Context) error {
+		filter, ok := activeLoansFilter(c, bson.M{})
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid branch"})
+		}
+		loans, err := findLoans(coll, filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list loans"})
+		}
+		return c.JSON(http.StatusOK, loans)
+	})
+
+	e.GET("/api/books/:id/loans", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		filter, ok := activeLoansFilter(c, bson.M{"bookid": id})
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid branch"})
+		}
+		loans, err := findLoans(coll, filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list loans"})
+		}
+		return c.JSON(http.StatusOK, loans)
+	})
+
+	e.GET("/api/members/:id/loans", func(c echo.Context) error {
+		member, err := findMember(members, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+
+		filter, ok := activeLoansFilter(c, bson.M{"loanmember": member.MemberMembership})
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid branch"})
+		}
+		loans, err := findLoans(coll, filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list loans"})
+		}
+		return c.JSON(http.StatusOK, loans)
+	})
+
+	e.POST("/api/loans", func(c echo.Context) error {
+		var req loanRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if req.Member = strings.TrimSpace(req.Member); req.Member == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "member is required"})
+		}
+		member, err := findMember(members, req.Member)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+
+		filter := bson.M{}
+		if req.Copy != "" {
+			id, err := primitive.ObjectIDFromHex(req.Copy)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid copy id"})
+			}
+			filter["_id"] = id
+		} else {
+			id, err := primitive.ObjectIDFromHex(req.Book)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid book id"})
+			}
+			filter["bookid"] = id
+			if req.Branch != "" {
+				branch, err := primitive.ObjectIDFromHex(req.Branch)
+				if err != nil {
+					return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid branch id"})
+				}
+				filter["copybranch"] = branch
+			}
+		}
+
+		// A member picking up a reserved copy goes first, otherwise we take
+		// any copy that is on the shelf.
+		cp, claimed, err := queue.Claim(member.MemberMembership, filter)
+		if err == nil && !claimed {
+			cp, err = reserveCopy(copies, filter)
+		}
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "no copy available"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to check out copy"})
+		}
+
+		now := time.Now().UTC()
+		loan := Loan{
+			ID:             primitive.NewObjectID(),
+			BookID:         cp.BookID,
+			CopyID:         cp.ID,
+			LoanMember:     member.MemberMembership,
+			LoanCheckedOut: now,
+			LoanDue:        now.AddDate(0, 0, cfg.LoanDays),
+			LoanBranch:     cp.CopyBranch,
+		}
+		if _, err = coll.InsertOne(c.Request().Context(), loan); err != nil {
+			// Put the copy back on the shelf, the loan was never recorded
+			copies.UpdateOne(c.Request().Context(), bson.M{"_id": cp.ID}, bson.M{"$set": bson.M{"copystatus": StatusAvailable}})
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to record loan"})
+		}
+		return c.JSON(http.StatusOK, loanToMap(loan))
+	})
+
+	e.POST("/api/loans/:id/return", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		var req checkInRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if req.Condition != "" && !slices.Contains(copyConditions, req.Condition) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "condition must be one of " + strings.Join(copyConditions, ", ")})
+		}
+
+		now := time.Now().UTC()
+		var loan Loan
+		err = coll.FindOneAndUpdate(c.Request().Context(),
+			bson.M{"_id": id, "loanreturned": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"loanreturned": now}},
+		).Decode(&loan)
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "no open loan found"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to return loan"})
+		}
+
+		damaged, err := checkInCopy(c.Request().Context(), copies, loan, req)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to grade copy"})
+		}
+		if !damaged {
+			if err = queue.Release(Copy{ID: loan.CopyID, BookID: loan.BookID}); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to return copy"})
+			}
+		}
+		loan.LoanReturned = &now
+		if err = chargeFine(fines, rules, loan); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to charge fine"})
+		}
+		return c.JSON(http.StatusOK, loanToMap(loan))
+	})
+}
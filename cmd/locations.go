@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Where a physical book lives: the room, the shelf in it, and the position
+// on the shelf (0 when we don't keep track of it). Books have the location
+// their copies belong to, and each copy has the location it was last put at.
+type Location struct {
+	Room     string `bson:"room"`
+	Shelf    string `bson:"shelf"`
+	Position int    `bson:"position,omitempty"`
+}
+
+// Lets the "omitempty" in the models leave out empty locations.
+func (l Location) IsZero() bool {
+	return l == Location{}
+}
+
+// Tells whether the two locations are the same shelf. The position is not
+// compared, books move a bit on the shelf as others are taken out.
+func (l Location) SameShelf(other Location) bool {
+	return strings.EqualFold(l.Room, other.Room) && strings.EqualFold(l.Shelf, other.Shelf)
+}
+
+func locationToMap(l Location) map[string]interface{} {
+	if l.IsZero() {
+		return nil
+	}
+	return map[string]interface{}{
+		"room":     l.Room,
+		"shelf":    l.Shelf,
+		"position": l.Position,
+	}
+}
+
+// The body we accept to set a location. Sending an empty one clears it.
+type locationRequest struct {
+	Room     string `json:"room" form:"room"`
+	Shelf    string `json:"shelf" form:"shelf"`
+	Position int    `json:"position" form:"position"`
+}
+
+func parseLocation(req locationRequest) (Location, string) {
+	l := Location{Room: strings.TrimSpace(req.Room), Shelf: strings.TrimSpace(req.Shelf), Position: req.Position}
+	if l.IsZero() {
+		return l, ""
+	}
+	if l.Room == "" || l.Shelf == "" {
+		return l, "room and shelf are required"
+	}
+	if l.Position < 0 {
+		return l, "position cannot be negative"
+	}
+	return l, ""
+}
+
+// Turns the room, shelf and position query parameters into a filter over the
+// given location field. Rooms and shelves are matched regardless of case.
+func locationFilter(c echo.Context, field string) (bson.M, bool) {
+	query := newQuery(field+".room", field+".shelf", field+".position")
+	for _, key := range []string{"room", "shelf"} {
+		if value := strings.TrimSpace(c.QueryParam(key)); value != "" {
+			query.Match(field+"."+key, value)
+		}
+	}
+	if value := c.QueryParam("position"); value != "" {
+		position, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, false
+		}
+		query.Eq(field+".position", position)
+	}
+	filter, err := query.Filter()
+	return filter, err == nil
+}
+
+// Registers the endpoints to place books and copies, look them up by
+// location, and find the copies that are not where they belong.
+func registerLocationRoutes(e *echo.Echo, books *Repository, copies *Repository) {
+	set := func(c echo.Context, coll *Repository, field string, notFound string) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var req locationRequest
+		if err = c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		location, msg := parseLocation(req)
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		update := bson.M{"$set": bson.M{field: location}}
+		if location.IsZero() {
+			update = bson.M{"$unset": bson.M{field: ""}}
+		}
+		result, err := coll.UpdateOne(c.Request().Context(), bson.M{"_id": id}, update)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update location"})
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": notFound})
+		}
+		return c.JSON(http.StatusOK, locationToMap(location))
+	}
+
+	e.PUT("/api/books/:id/location", func(c echo.Context) error {
+		return set(c, books, "booklocation", "book not found")
+	})
+
+	e.PUT("/api/copies/:id/location", func(c echo.Context) error {
+		return set(c, copies, "copylocation", "copy not found")
+	})
+
+	// Lists the copies at a location, e.g., /api/copies?room=Main&shelf=B4
+	// (and &branch=<id> when there are several buildings),
+	// with the name of their book so they can be recognised on the shelf.
+	e.GET("/api/copies", func(c echo.Context) error {
+		filter, ok := locationFilter(c, "copylocation")
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid position"})
+		}
+		if filter, ok = branchFilter(c, filter, "copybranch"); !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid branch"})
+		}
+		found, err := findCopies(copies, filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list copies"})
+		}
+
+		names := map[string]string{}
+		for _, b := range findAllBooks(books, bson.M{}) {
+			names[b["id"].(string)] = b["name"].(string)
+		}
+		ret := []map[string]interface{}{}
+		for _, cp := range found {
+			m := copyToMap(cp)
+			m["bookName"] = names[cp.BookID.Hex()]
+			ret = append(ret, m)
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	// The copies on the shelves that are on another shelf than the one their
+	// book belongs to. Copies that are out on loan are not on a shelf at all,
+	// so they are left out.
+	e.GET("/api/reports/misplaced", func(c echo.Context) error {
+		cursor, err := books.Find(context.TODO(), bson.M{"booklocation": bson.M{"$exists": true}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list books"})
+		}
+		var placed []BookStore
+		if err = cursor.All(context.TODO(), &placed); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list books"})
+		}
+		byID := map[primitive.ObjectID]BookStore{}
+		ids := []primitive.ObjectID{}
+		for _, b := range placed {
+			byID[b.ID] = b
+			ids = append(ids, b.ID)
+		}
+
+		found, err := findCopies(copies, bson.M{
+			"bookid":       bson.M{"$in": ids},
+			"copylocation": bson.M{"$exists": true},
+			"copystatus":   bson.M{"$ne": StatusLoaned},
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list copies"})
+		}
+
+		ret := []map[string]interface{}{}
+		for _, cp := range found {
+			book := byID[cp.BookID]
+			if cp.CopyLocation.SameShelf(book.BookLocation) {
+				continue
+			}
+			m := copyToMap(cp)
+			m["bookName"] = book.BookName
+			m["expected"] = locationToMap(book.BookLocation)
+			ret = append(ret, m)
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The failed logins of an account, or from an IP address. Each one makes
+// the next answer slower, and too many of them lock the account (or the
+// address) for a while, longer every time, so guessing passwords takes
+// forever.
+type LoginAttempts struct {
+	AttemptKey      string     `bson:"attemptkey"`
+	AttemptFailures int        `bson:"attemptfailures"`
+	AttemptLast     time.Time  `bson:"attemptlast"`
+	AttemptLocked   *time.Time `bson:"attemptlocked,omitempty"`
+}
+
+// The login events in the audit log, next to the usual writes
+const (
+	AuditLoginFailed = "login-failed"
+	AuditLockout     = "lockout"
+	loginsCollection = "logins"
+)
+
+const (
+	// Failures are forgotten after a day without any
+	loginFailureWindow = 24 * time.Hour
+	// Many people may share an address, e.g., in a school, so it takes more
+	// failures to lock it than to lock an account
+	ipFailureFactor = 4
+	maxLoginDelay   = 5 * time.Second
+	maxLockout      = 24 * time.Hour
+)
+
+type LoginGuard struct {
+	coll        *Repository
+	audit       *Repository
+	maxFailures int
+	lockout     time.Duration
+}
+
+func newLoginGuard(cfg Config, coll *Repository, audit *Repository) *LoginGuard {
+	return &LoginGuard{
+		coll:        coll,
+		audit:       audit,
+		maxFailures: cfg.LoginMaxFailures,
+		lockout:     time.Duration(cfg.LoginLockoutMinutes) * time.Minute,
+	}
+}
+
+func accountKey(email string) string { return "email:" + email }
+func addressKey(ip string) string    { return "ip:" + ip }
+
+// Returns until when logging in to the account, or from the address, is
+// locked, if it is.
+func (g *LoginGuard) Locked(email string, ip string) (time.Time, bool) {
+	cursor, err := g.coll.Find(context.TODO(), bson.M{"attemptkey": bson.M{"$in": bson.A{accountKey(email), addressKey(ip)}}})
+	if err != nil {
+		return time.Time{}, false
+	}
+	var results []LoginAttempts
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return time.Time{}, false
+	}
+
+	var until time.Time
+	for _, a := range results {
+		if a.AttemptLocked != nil && a.AttemptLocked.After(until) {
+			until = *a.AttemptLocked
+		}
+	}
+	return until, until.After(time.Now())
+}
+
+// Counts a failed login, and returns how long to wait before answering.
+func (g *LoginGuard) Fail(ctx context.Context, email string, ip string) time.Duration {
+	account := g.count(ctx, accountKey(email), g.maxFailures, email, ip)
+	address := g.count(ctx, addressKey(ip), g.maxFailures*ipFailureFactor, email, ip)
+	g.record(AuditLoginFailed, email, ip, bson.M{"failures": account})
+
+	failures := max(account, address/ipFailureFactor)
+	delay := time.Duration(math.Pow(2, float64(failures-1))) * 250 * time.Millisecond
+	return min(delay, maxLoginDelay)
+}
+
+// Adds a failure to the key, locking it once there are too many. Returns
+// the number of failures so far. The failures are added up by the database,
+// so guesses sent at the same time all count.
+func (g *LoginGuard) count(ctx context.Context, key string, limit int, email string, ip string) int {
+	now := time.Now().UTC()
+	// Failures older than the window start over
+	stale := bson.M{"attemptkey": key, "attemptlast": bson.M{"$lt": now.Add(-loginFailureWindow)}}
+	if _, err := g.coll.UpdateOne(ctx, stale, bson.M{"$set": bson.M{"attemptfailures": 0}}); err != nil {
+		loggerFrom(ctx).Error("failed to reset login attempts", "err", err)
+	}
+
+	var attempts LoginAttempts
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	update := bson.M{"$inc": bson.M{"attemptfailures": 1}, "$set": bson.M{"attemptlast": now}}
+	if err := g.coll.FindOneAndUpdate(ctx, bson.M{"attemptkey": key}, update, opts).Decode(&attempts); err != nil {
+		loggerFrom(ctx).Error("failed to count login attempt", "err", err)
+		return 1
+	}
+
+	if attempts.AttemptFailures >= limit {
+		lockout := min(g.lockout*time.Duration(math.Pow(2, float64(attempts.AttemptFailures-limit))), maxLockout)
+		until := now.Add(lockout)
+		if _, err := g.coll.UpdateOne(ctx, bson.M{"attemptkey": key}, bson.M{"$set": bson.M{"attemptlocked": until}}); err != nil {
+			loggerFrom(ctx).Error("failed to lock login", "err", err)
+		}
+		g.record(AuditLockout, email, ip, bson.M{"key": key, "failures": attempts.AttemptFailures, "until": until})
+	}
+	return attempts.AttemptFailures
+}
+
+// A successful login forgets the failures of the account. The ones of the
+// address stay, as somebody else may be guessing from there.
+func (g *LoginGuard) Succeed(ctx context.Context, email string) {
+	if _, err := g.coll.DeleteOne(ctx, bson.M{"attemptkey": accountKey(email)}); err != nil {
+		loggerFrom(ctx).Error("failed to reset login attempts", "err", err)
+	}
+}
+
+// Adds a login event to the audit log. The record is the email somebody
+// tried to log in with, and the actor the address they did it from.
+func (g *LoginGuard) record(action string, email string, ip string, details bson.M) {
+	entry := AuditEntry{
+		AuditCollection: loginsCollection,
+		AuditAction:     action,
+		AuditRecord:     email,
+		AuditActor:      ip,
+		AuditTime:       time.Now().UTC(),
+		AuditChanges:    []string{},
+		AuditAfter:      details,
+	}
+	if _, err := g.audit.InsertOne(context.TODO(), entry); err != nil {
+		slog.Error("failed to record login", "action", action, "email", email, "err", err)
+	}
+}
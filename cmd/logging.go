@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The level the logs are written from on. It starts at LOG_LEVEL, and the
+// admins may change it while the server runs (see loglevel.go).
+var logLevel = new(slog.LevelVar)
+
+// The logs are written as lines of key=value pairs, or as JSON for the
+// services collecting them (LOG_FORMAT=json), and only from the level of
+// LOG_LEVEL on: "debug", which also has every database operation, "info",
+// "warn" or "error". With LOG_DEBUG_SAMPLE above 1, only one in that many
+// debug lines of every message is written.
+func newLogger(cfg Config) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		level = slog.LevelInfo
+	}
+	logLevel.Set(level)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if strings.EqualFold(cfg.LogFormat, "json") {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	if cfg.LogDebugSample > 1 {
+		handler = &samplingHandler{Handler: handler, every: uint64(cfg.LogDebugSample), counts: &sync.Map{}}
+	}
+	return slog.New(handler)
+}
+
+// Writes only one in every so many debug lines of the same message, e.g.,
+// of the "db" lines of the database operations, which would otherwise drown the rest
+// under load. The lines written tell how many they stand for ("sample"). The
+// other levels are all written.
+type samplingHandler struct {
+	slog.Handler
+	every uint64
+	// How many lines of every message there were, shared by the loggers
+	// derived from this one with With
+	counts *sync.Map
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelInfo {
+		n, _ := h.counts.LoadOrStore(r.Message, new(atomic.Uint64))
+		if (n.(*atomic.Uint64).Add(1)-1)%h.every != 0 {
+			return nil
+		}
+		r.AddAttrs(slog.Uint64("sample", h.every))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), every: h.every, counts: h.counts}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), every: h.every, counts: h.counts}
+}
+
+// Logs what stops the program from starting, and stops it
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// Hands the logger down with the context, e.g., to the repository, so what
+// is logged during a request says which request it was
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// The logger of the context, or the default one outside of the requests
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Puts the logger in the context of every request, with the ID of the
+// request on every line (see requestid.go), and of its trace if there is
+// one (see tracing.go), and logs the request once it is answered, to the
+// access log file too if there is one (see accesslog.go), and counts it
+// (see expvars.go and metrics.go). The failed ones
+// are logged as warnings, or as errors when the server is at fault.
+func requestLogger(base *slog.Logger, access *slog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ids := []any{"request_id", requestID(c)}
+			if trace := traceIDFrom(c.Request().Context()); trace != "" {
+				ids = append(ids, "trace_id", trace)
+			}
+			logger := base.With(ids...)
+			req := c.Request().WithContext(withLogger(c.Request().Context(), logger))
+			c.SetRequest(req)
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				// Answers the error now, to log the status it gets
+				c.Error(err)
+			}
+
+			res := c.Response()
+			duration := time.Since(start)
+			countRequest(res.Status)
+			routeMetrics.Observe(req.Method, c.Path(), res.Status, duration)
+			level := slog.LevelInfo
+			if res.Status >= 500 {
+				level = slog.LevelError
+			} else if res.Status >= 400 {
+				level = slog.LevelWarn
+			}
+			attrs := []slog.Attr{
+				slog.String("method", req.Method),
+				slog.String("path", req.URL.Path),
+				slog.Int("status", res.Status),
+				slog.Duration("duration", duration),
+				slog.Int64("bytes", res.Size),
+				slog.String("ip", c.RealIP()),
+			}
+			logger.LogAttrs(req.Context(), level, "request", attrs...)
+			if access != nil {
+				attrs = append(attrs, slog.String("user_agent", req.UserAgent()), slog.String("referer", req.Referer()))
+				access.With(ids...).LogAttrs(req.Context(), level, "request", attrs...)
+			}
+			return nil
+		}
+	}
+}
+
+// Logs an operation of the repository on its collection, at the debug
+// level, with how long it took and whether it failed. The slow ones are
+// logged as warnings, with the shape of their filter (see slowqueries.go).
+// During a request, it goes to the logger of the request, otherwise to the
+// one of the library.
+func (r *Repository) logOp(ctx context.Context, op string, filter interface{}, start time.Time, err error) {
+	logger, ok := ctx.Value(loggerKey{}).(*slog.Logger)
+	if !ok {
+		logger = r.logger
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	duration := time.Since(start)
+	slow := r.slow > 0 && duration >= r.slow
+	if !slow && !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("collection", r.Name()),
+		slog.String("op", op),
+		slog.Duration("duration", duration),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("err", err))
+	}
+	if slow {
+		attrs = append(attrs, slog.Any("filter", filterShape(filter)))
+		logger.LogAttrs(ctx, slog.LevelWarn, "slow query", attrs...)
+		return
+	}
+	logger.LogAttrs(ctx, slog.LevelDebug, "db", attrs...)
+}
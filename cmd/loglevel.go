@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The level set back once the minutes of a change are up, if they were
+// given, and when
+var (
+	logLevelMu     sync.Mutex
+	logLevelBefore slog.Level
+	logLevelReset  *time.Timer
+)
+
+// Registers /api/log/level, for the admins to see the level of the logs,
+// and change it without restarting the server, e.g., to debug a problem
+// while it is happening:
+//
+//	PUT /api/log/level {"level": "debug", "minutes": 15}
+//
+// With minutes, the level goes back to what it was after that long, so it
+// isn't left at debug by mistake. The level is the one of this server
+// alone, not of the other replicas, and it is of all the libraries it
+// hosts, which is why only the main one has the route (see main). Every
+// change is in the admin log.
+func registerLogLevelRoutes(e *echo.Echo, admin *AdminLog) {
+	e.GET("/api/log/level", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]string{"level": strings.ToLower(logLevel.Level().String())})
+	})
+
+	e.PUT("/api/log/level", func(c echo.Context) error {
+		var req struct {
+			Level   string `json:"level" form:"level"`
+			Minutes int    `json:"minutes" form:"minutes"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		level := logLevel.Level()
+		if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "level must be debug, info, warn or error"})
+		}
+		if req.Minutes < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid minutes"})
+		}
+
+		logLevelMu.Lock()
+		previous := logLevel.Level()
+		restore := previous
+		if logLevelReset != nil {
+			// An earlier change is still to be undone: going back is to the
+			// level before it, not to the one it set
+			logLevelReset.Stop()
+			logLevelReset = nil
+			restore = logLevelBefore
+		}
+		logLevel.Set(level)
+		if req.Minutes > 0 {
+			logLevelBefore = restore
+			logLevelReset = time.AfterFunc(time.Duration(req.Minutes)*time.Minute, func() {
+				logLevelMu.Lock()
+				defer logLevelMu.Unlock()
+				logLevel.Set(restore)
+				logLevelReset = nil
+				slog.Info("log level set back", "level", restore)
+			})
+		}
+		logLevelMu.Unlock()
+
+		loggerFrom(c.Request().Context()).Warn("log level changed", "from", previous, "to", level, "minutes", req.Minutes)
+		admin.Record(c, AdminLogLevel, strings.ToLower(level.String()), bson.M{"from": strings.ToLower(previous.String()), "minutes": req.Minutes})
+		return c.JSON(http.StatusOK, map[string]string{"level": strings.ToLower(level.String())})
+	})
+}
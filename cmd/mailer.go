@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sends emails through an SMTP server. Without one configured, e.g., while
+// developing, the emails are written to the log instead, links and all, so
+// don't run it like that in production.
+type Mailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+}
+
+func newMailer(cfg Config) *Mailer {
+	return &Mailer{host: cfg.SMTPHost, port: cfg.SMTPPort, username: cfg.SMTPUsername, password: cfg.SMTPPassword, from: cfg.SMTPFrom}
+}
+
+func (m *Mailer) Send(to string, subject string, body string) error {
+	if m.host == "" {
+		slog.Info("no SMTP server configured, email not sent", "to", to, "subject", subject, "body", body)
+		return nil
+	}
+
+	// Line breaks in the headers would let somebody add headers of their own
+	for _, v := range []string{to, subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid header %q", v)
+		}
+	}
+	msg := "From: " + m.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+
+	// The standard library only sends the password over TLS, or to localhost
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	return smtp.SendMail(addr, auth, m.from, []string{to}, []byte(msg))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A member (or patron) of the library, i.e., somebody we can lend books to.
+// The membership id is the number printed on the library card, and it is
+// what the loans refer to.
+type Member struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty" form:"id"`
+	MemberName       string             `json:"name" form:"name"`
+	MemberEmail      string             `json:"email" form:"email"`
+	MemberMembership string             `json:"membership" form:"membership"`
+	CreatedAt        time.Time          `json:"-" form:"-" bson:"createdat,omitempty"`
+	UpdatedAt        time.Time          `json:"-" form:"-" bson:"updatedat,omitempty"`
+}
+
+func memberToMap(m Member) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         m.ID.Hex(),
+		"name":       m.MemberName,
+		"email":      m.MemberEmail,
+		"membership": m.MemberMembership,
+		"createdAt":  formatTimestamp(m.CreatedAt),
+		"updatedAt":  formatTimestamp(m.UpdatedAt),
+	}
+}
+
+func findAllMembers(coll *Repository) ([]map[string]interface{}, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "membername", Value: 1}})
+	cursor, err := coll.Find(context.TODO(), bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []Member
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	ret := []map[string]interface{}{}
+	for _, m := range results {
+		ret = append(ret, memberToMap(m))
+	}
+	return ret, nil
+}
+
+// Looks up a member either by its id or by its membership id, so the card
+// number can be typed in directly at the counter.
+func findMember(coll *Repository, value string) (Member, error) {
+	filter, err := newQuery("membermembership").Eq("membermembership", value).Filter()
+	if err != nil {
+		return Member{}, err
+	}
+	if id, err := primitive.ObjectIDFromHex(value); err == nil {
+		filter = bson.M{"$or": bson.A{bson.M{"_id": id}, filter}}
+	}
+	var member Member
+	err = coll.FindOne(context.TODO(), filter).Decode(&member)
+	return member, err
+}
+
+// Cleans up and validates a member before storing it. When no membership id
+// is given, we derive one from the document id so it is always unique.
+func validateMember(coll *Repository, m *Member) string {
+	m.MemberName = strings.TrimSpace(m.MemberName)
+	m.MemberEmail = strings.ToLower(strings.TrimSpace(m.MemberEmail))
+	m.MemberMembership = strings.TrimSpace(m.MemberMembership)
+
+	if m.MemberName == "" {
+		return "name is required"
+	}
+	if _, err := mail.ParseAddress(m.MemberEmail); err != nil {
+		return "invalid email"
+	}
+	if m.MemberMembership == "" {
+		m.MemberMembership = "M-" + strings.ToUpper(m.ID.Hex()[16:])
+	}
+
+	count, err := coll.CountDocuments(context.TODO(), bson.M{
+		"_id": bson.M{"$ne": m.ID},
+		"$or": bson.A{bson.M{"memberemail": m.MemberEmail}, bson.M{"membermembership": m.MemberMembership}},
+	})
+	if err != nil {
+		return "failed to check member"
+	}
+	if count > 0 {
+		return "member already exists"
+	}
+	return ""
+}
+
+// Splits the loans of a member into the current and past ones, adding the
+// name of the book so the page can show something more useful than ids.
+func memberLoans(books *Repository, loans *Repository, member Member) ([]map[string]interface{}, []map[string]interface{}, error) {
+	all, err := findLoans(loans, bson.M{"loanmember": member.MemberMembership})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := map[string]string{}
+	for _, b := range findAllBooks(books, bson.M{}) {
+		names[b["id"].(string)] = b["name"].(string)
+	}
+
+	current, past := []map[string]interface{}{}, []map[string]interface{}{}
+	for _, l := range all {
+		l["bookName"] = names[l["book"].(string)]
+		if l["active"].(bool) {
+			current = append(current, l)
+		} else {
+			past = append(past, l)
+		}
+	}
+	return current, past, nil
+}
+
+// Registers the endpoints and pages to manage the library members.
+func registerMemberRoutes(e *echo.Echo, books *Repository, loans *Repository, coll *Repository) {
+	e.GET("/members", func(c echo.Context) error {
+		members, err := findAllMembers(coll)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list members"})
+		}
+		return c.Render(200, "member-table", members)
+	})
+
+	e.GET("/members/:id", func(c echo.Context) error {
+		member, err := findMember(coll, c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, "member not found")
+		}
+		current, past, err := memberLoans(books, loans, member)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list loans"})
+		}
+
+		return c.Render(200, "member-detail", map[string]interface{}{
+			"member":  memberToMap(member),
+			"current": current,
+			"past":    past,
+		})
+	})
+
+	e.GET("/api/members", func(c echo.Context) error {
+		members, err := findAllMembers(coll)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list members"})
+		}
+		return c.JSON(http.StatusOK, members)
+	})
+
+	e.GET("/api/members/:id", func(c echo.Context) error {
+		member, err := findMember(coll, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+		return c.JSON(http.StatusOK, memberToMap(member))
+	})
+
+	e.POST("/api/members", func(c echo.Context) error {
+		member := new(Member)
+		if err := c.Bind(member); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+
+		member.ID = primitive.NewObjectID()
+		if msg := validateMember(coll, member); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		if _, err := coll.InsertOne(c.Request().Context(), member); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert member"})
+		}
+		return c.JSON(http.StatusOK, memberToMap(*member))
+	})
+
+	e.PUT("/api/members", func(c echo.Context) error {
+		member := new(Member)
+		if err := c.Bind(member); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+
+		var existing Member
+		if err := coll.FindOne(context.TODO(), bson.M{"_id": member.ID}).Decode(&existing); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+		// The loans point to the membership id, so it cannot change once given
+		member.MemberMembership = existing.MemberMembership
+		if msg := validateMember(coll, member); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		result, err := coll.UpdateOne(c.Request().Context(), bson.M{"_id": member.ID}, bson.M{"$set": member})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update member"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.DELETE("/api/members/:id", func(c echo.Context) error {
+		member, err := findMember(coll, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+
+		open, err := loans.CountDocuments(context.TODO(), bson.M{"loanmember": member.MemberMembership, "loanreturned": bson.M{"$exists": false}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete member"})
+		}
+		if open > 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "member still has books checked out"})
+		}
+
+		result, err := coll.DeleteOne(c.Request().Context(), bson.M{"_id": member.ID})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete member"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
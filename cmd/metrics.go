@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The upper bounds of the buckets of the latency histograms, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// The requests of a route: how many took up to each bound of the buckets
+// (the last one counting those above), how long they took altogether, and
+// how many failed on our side, with a 5xx status
+type routeStats struct {
+	method  string
+	route   string
+	buckets []int64
+	count   int64
+	errors  int64
+	sum     float64
+}
+
+// The latency and the errors of every route, since the server started. All
+// the libraries share them. They are at /metrics, for Prometheus, and the
+// routes burning their error budget the fastest are on the dashboard (see
+// dashboard.go).
+type RouteMetrics struct {
+	mu     sync.Mutex
+	routes map[string]*routeStats
+}
+
+var routeMetrics = &RouteMetrics{routes: map[string]*routeStats{}}
+
+// Counts a request. The ones that didn't match a route are counted
+// together, rather than by the path somebody made up.
+func (m *RouteMetrics) Observe(method string, route string, status int, duration time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := method + " " + route
+	stats, ok := m.routes[key]
+	if !ok {
+		stats = &routeStats{method: method, route: route, buckets: make([]int64, len(latencyBuckets)+1)}
+		m.routes[key] = stats
+	}
+	seconds := duration.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	stats.buckets[i]++
+	stats.count++
+	stats.sum += seconds
+	if status >= http.StatusInternalServerError {
+		stats.errors++
+	}
+}
+
+// The requests answered with a 5xx status, by all the routes together
+func (m *RouteMetrics) ServerErrors() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, s := range m.routes {
+		n += s.errors
+	}
+	return n
+}
+
+// Estimates the latency the share q of the requests stayed under, e.g.,
+// 0.95 for the p95, from the buckets, the way Prometheus does: within the
+// bucket it falls in, the requests are taken to be spread evenly.
+func (s *routeStats) quantile(q float64) float64 {
+	rank := q * float64(s.count)
+	var seen int64
+	for i, n := range s.buckets {
+		if float64(seen+n) < rank || n == 0 {
+			seen += n
+			continue
+		}
+		if i == len(latencyBuckets) {
+			return latencyBuckets[len(latencyBuckets)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		return lower + (latencyBuckets[i]-lower)*(rank-float64(seen))/float64(n)
+	}
+	return 0
+}
+
+// How much of the error budget of the route is left, from 1 (no errors) to
+// 0 (as many as the objective allows) and below. With an objective of
+// 99.9%, one request in a thousand may fail.
+func (s *routeStats) budgetLeft(objective float64) float64 {
+	allowed := (1 - objective) * float64(s.count)
+	if allowed <= 0 {
+		if s.errors > 0 {
+			return math.Inf(-1)
+		}
+		return 1
+	}
+	return 1 - float64(s.errors)/allowed
+}
+
+func formatLatency(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(100 * time.Microsecond).String()
+}
+
+// The routes for the dashboard, the ones with the least error budget left
+// first, then the slowest, at most limit of them
+func (m *RouteMetrics) Summary(objective float64, limit int) []map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	routes := make([]*routeStats, 0, len(m.routes))
+	for _, s := range m.routes {
+		routes = append(routes, s)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		bi, bj := routes[i].budgetLeft(objective), routes[j].budgetLeft(objective)
+		if bi != bj {
+			return bi < bj
+		}
+		return routes[i].quantile(0.95) > routes[j].quantile(0.95)
+	})
+	if len(routes) > limit {
+		routes = routes[:limit]
+	}
+
+	ret := []map[string]interface{}{}
+	for _, s := range routes {
+		budget := s.budgetLeft(objective)
+		ret = append(ret, map[string]interface{}{
+			"method":    s.method,
+			"route":     s.route,
+			"requests":  s.count,
+			"errors":    s.errors,
+			"errorRate": fmt.Sprintf("%.2f%%", 100*float64(s.errors)/float64(s.count)),
+			"p50":       formatLatency(s.quantile(0.5)),
+			"p95":       formatLatency(s.quantile(0.95)),
+			"p99":       formatLatency(s.quantile(0.99)),
+			"budget":    fmt.Sprintf("%.0f%%", 100*math.Max(budget, -9.99)),
+			"burnt":     budget <= 0,
+		})
+	}
+	return ret
+}
+
+// Escapes a value of a label of the Prometheus text format
+func promLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Writes the metrics in the text format of Prometheus (see
+// https://prometheus.io/docs/instrumenting/exposition_formats/)
+func (m *RouteMetrics) WritePrometheus(b *strings.Builder, objective float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.routes))
+	for key := range m.routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	b.WriteString("# HELP http_request_duration_seconds How long the requests took, by route.\n")
+	b.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	for _, key := range keys {
+		s := m.routes[key]
+		labels := fmt.Sprintf(`method="%s",route="%s"`, promLabel(s.method), promLabel(s.route))
+		var cumulative int64
+		for i, n := range s.buckets {
+			cumulative += n
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = fmt.Sprint(latencyBuckets[i])
+			}
+			fmt.Fprintf(b, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, le, cumulative)
+		}
+		fmt.Fprintf(b, "http_request_duration_seconds_sum{%s} %g\n", labels, s.sum)
+		fmt.Fprintf(b, "http_request_duration_seconds_count{%s} %d\n", labels, s.count)
+	}
+
+	b.WriteString("# HELP http_request_errors_total The requests answered with a 5xx status, by route.\n")
+	b.WriteString("# TYPE http_request_errors_total counter\n")
+	for _, key := range keys {
+		s := m.routes[key]
+		fmt.Fprintf(b, "http_request_errors_total{method=\"%s\",route=\"%s\"} %d\n", promLabel(s.method), promLabel(s.route), s.errors)
+	}
+
+	fmt.Fprintf(b, "# HELP http_request_error_budget_remaining The share of the error budget left by route, for an objective of %g.\n", objective)
+	b.WriteString("# TYPE http_request_error_budget_remaining gauge\n")
+	for _, key := range keys {
+		s := m.routes[key]
+		fmt.Fprintf(b, "http_request_error_budget_remaining{method=\"%s\",route=\"%s\"} %g\n", promLabel(s.method), promLabel(s.route), s.budgetLeft(objective))
+	}
+}
+
+// Registers /metrics, for Prometheus to scrape with the personal token of
+// an admin: the latency histograms and the errors of the routes, with what
+// is left of their error budget for SLO_OBJECTIVE, and the connections to
+// the database (see mongometrics.go).
+func registerMetricsRoutes(e *echo.Echo, cfg Config) {
+	e.GET("/metrics", func(c echo.Context) error {
+		var b strings.Builder
+		routeMetrics.WritePrometheus(&b, cfg.SLOObjective)
+
+		gauges := []struct {
+			name, kind, help string
+			value            interface{}
+		}{
+			{"go_goroutines", "gauge", "The goroutines running.", runtime.NumGoroutine()},
+			{"mongo_pool_max_size", "gauge", "The connections the pool may have.", mongoStats.maxPoolSize.Load()},
+			{"mongo_pool_connections", "gauge", "The connections open.", mongoStats.open.Load()},
+			{"mongo_pool_in_use", "gauge", "The connections in use.", mongoStats.inUse.Load()},
+			{"mongo_pool_checkouts_total", "counter", "The connections taken from the pool.", mongoStats.checkouts.Load()},
+			{"mongo_pool_checkout_failures_total", "counter", "The times no connection could be had.", mongoStats.checkoutFailures.Load()},
+			{"mongo_pool_checkout_wait_seconds_total", "counter", "How long the requests waited for a connection.", time.Duration(mongoStats.waitNanos.Load()).Seconds()},
+			{"mongo_commands_total", "counter", "The commands sent to the database.", mongoStats.commands.Load()},
+			{"mongo_command_failures_total", "counter", "The commands that failed.", mongoStats.commandFailures.Load()},
+		}
+		for _, g := range gauges {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", g.name, g.help, g.name, g.kind, g.name, g.value)
+		}
+		return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+	})
+}
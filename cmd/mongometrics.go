@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// What the driver tells about its connections to the database and the
+// commands it sends, published as "mongo" at /debug/vars (see expvars.go):
+// how many connections are open and how many are in use, out of how many
+// the pool may have, how long the requests waited for one, and how many
+// commands failed. A pool that is often full, with long waits, needs to be
+// bigger (maxPoolSize in MONGO_URI), or the queries faster.
+type MongoStats struct {
+	maxPoolSize      atomic.Uint64
+	open             atomic.Int64
+	inUse            atomic.Int64
+	checkouts        atomic.Int64
+	checkoutFailures atomic.Int64
+	waitNanos        atomic.Int64
+	maxWaitNanos     atomic.Int64
+	commands         atomic.Int64
+	commandFailures  atomic.Int64
+}
+
+var mongoStats = &MongoStats{}
+
+func init() {
+	expvar.Publish("mongo", expvar.Func(func() interface{} { return mongoStats.Snapshot() }))
+}
+
+func (s *MongoStats) Snapshot() map[string]interface{} {
+	avgWait := 0.0
+	if n := s.checkouts.Load(); n > 0 {
+		avgWait = float64(s.waitNanos.Load()) / float64(n) / float64(time.Millisecond)
+	}
+	return map[string]interface{}{
+		"maxPoolSize":       s.maxPoolSize.Load(),
+		"connections":       s.open.Load(),
+		"inUse":             s.inUse.Load(),
+		"checkouts":         s.checkouts.Load(),
+		"checkoutFailures":  s.checkoutFailures.Load(),
+		"checkoutWaitAvgMs": avgWait,
+		"checkoutWaitMaxMs": float64(s.maxWaitNanos.Load()) / float64(time.Millisecond),
+		"commands":          s.commands.Load(),
+		"commandFailures":   s.commandFailures.Load(),
+	}
+}
+
+// Keeps track of the connections of the pool. The events are logged at the
+// debug level, but for the checkouts and returns, which happen for every
+// command.
+func (s *MongoStats) PoolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			switch e.Type {
+			case event.PoolCreated:
+				if e.PoolOptions != nil {
+					s.maxPoolSize.Store(e.PoolOptions.MaxPoolSize)
+				}
+			case event.ConnectionCreated:
+				s.open.Add(1)
+			case event.ConnectionClosed:
+				s.open.Add(-1)
+			case event.GetSucceeded:
+				s.inUse.Add(1)
+				s.checkouts.Add(1)
+				s.wait(e.Duration)
+				return
+			case event.GetFailed:
+				s.checkoutFailures.Add(1)
+				s.wait(e.Duration)
+				slog.Warn("no connection to the database", "address", e.Address, "reason", e.Reason, "waited", e.Duration)
+				return
+			case event.ConnectionReturned:
+				s.inUse.Add(-1)
+				return
+			case event.GetStarted:
+				return
+			}
+			slog.Debug("mongo pool", "event", e.Type, "address", e.Address, "connection", e.ConnectionID, "reason", e.Reason)
+		},
+	}
+}
+
+func (s *MongoStats) wait(d time.Duration) {
+	s.waitNanos.Add(int64(d))
+	for {
+		max := s.maxWaitNanos.Load()
+		if int64(d) <= max || s.maxWaitNanos.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
+
+// Counts the commands, next to what the monitor does already (see
+// mongoTracing), and logs the failed ones at the debug level. Failures the
+// repository sees are logged by it as well, see logOp.
+func (s *MongoStats) CommandMonitor(m *event.CommandMonitor) *event.CommandMonitor {
+	succeeded, failed := m.Succeeded, m.Failed
+	m.Succeeded = func(ctx context.Context, e *event.CommandSucceededEvent) {
+		s.commands.Add(1)
+		if succeeded != nil {
+			succeeded(ctx, e)
+		}
+	}
+	m.Failed = func(ctx context.Context, e *event.CommandFailedEvent) {
+		s.commands.Add(1)
+		s.commandFailures.Add(1)
+		loggerFrom(ctx).Debug("mongo command failed", "command", e.CommandName, "database", e.DatabaseName, "duration", e.Duration, "failure", e.Failure)
+		if failed != nil {
+			failed(ctx, e)
+		}
+	}
+	return m
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A message for a member, e.g., telling them the book they were waiting for
+// is ready to be picked up.
+type Notification struct {
+	ID                  primitive.ObjectID `bson:"_id,omitempty"`
+	NotificationMember  string             `bson:"notificationmember"`
+	NotificationMessage string             `bson:"notificationmessage"`
+	NotificationCreated time.Time          `bson:"notificationcreated"`
+	NotificationRead    bool               `bson:"notificationread"`
+}
+
+// Stores a notification for the member with the given membership id. A
+// failing notification should not undo what triggered it, so we only log it.
+func notify(coll *Repository, member string, message string) {
+	_, err := coll.InsertOne(context.TODO(), Notification{
+		NotificationMember:  member,
+		NotificationMessage: message,
+		NotificationCreated: time.Now().UTC(),
+	})
+	if err != nil {
+		slog.Error("failed to notify", "member", member, "err", err)
+	}
+}
+
+// Registers the endpoints for members to read their notifications.
+func registerNotificationRoutes(e *echo.Echo, members *Repository, coll *Repository) {
+	e.GET("/api/members/:id/notifications", func(c echo.Context) error {
+		member, err := findMember(members, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+
+		filter := bson.M{"notificationmember": member.MemberMembership}
+		if c.QueryParam("all") != "true" {
+			filter["notificationread"] = false
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "notificationcreated", Value: -1}})
+		cursor, err := coll.Find(context.TODO(), filter, opts)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list notifications"})
+		}
+		var results []Notification
+		if err = cursor.All(context.TODO(), &results); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list notifications"})
+		}
+
+		ret := []map[string]interface{}{}
+		for _, n := range results {
+			ret = append(ret, map[string]interface{}{
+				"id":      n.ID.Hex(),
+				"message": n.NotificationMessage,
+				"created": n.NotificationCreated.Format(time.RFC3339),
+				"read":    n.NotificationRead,
+			})
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	e.POST("/api/notifications/:id/read", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		result, err := coll.UpdateOne(c.Request().Context(), bson.M{"_id": id}, bson.M{"$set": bson.M{"notificationread": true}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update notification"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+// Instead of a password, users may log in with their account somewhere else,
+// e.g., Google or GitHub, through OAuth2. The first time, we create a user
+// for them, or link the account to the user with the same email. Either
+// way, the account of the provider becomes one of the identities of the user.
+type Identity struct {
+	Provider string
+	Subject  string
+}
+
+// What a provider tells us about the person logging in, and whether it
+// makes them an admin, if it decides (see oidc.go)
+type providerAccount struct {
+	Subject  string
+	Name     string
+	Email    string
+	Verified bool
+	Admin    *bool
+}
+
+// The role of the user after logging in with the account: an admin when
+// the provider makes them one, and when it stops, a user again. The other
+// roles, e.g., staff, are given in the library and stay as they are.
+func providerRole(current string, account providerAccount) string {
+	switch {
+	case account.Admin == nil:
+		return current
+	case *account.Admin:
+		return RoleAdmin
+	case current == RoleAdmin:
+		return RoleUser
+	}
+	return current
+}
+
+type OAuthProvider struct {
+	Name    string
+	Title   string
+	config  oauth2.Config
+	account func(ctx context.Context, client *http.Client) (providerAccount, error)
+	// Gets the provider ready before a login, if it needs to
+	prepare func(ctx context.Context) error
+}
+
+// The cookie remembering the random state we sent to the provider, so we can
+// tell the answer comes from a login that started here
+const oauthStateCookie = "oauth_state"
+
+// Returns the providers that have a client id configured.
+func oauthProviders(cfg Config) map[string]*OAuthProvider {
+	providers := map[string]*OAuthProvider{}
+	if cfg.GoogleClientID != "" {
+		providers["google"] = &OAuthProvider{
+			Name:  "google",
+			Title: "Google",
+			config: oauth2.Config{
+				ClientID:     cfg.GoogleClientID,
+				ClientSecret: cfg.GoogleClientSecret,
+				Endpoint:     endpoints.Google,
+				Scopes:       []string{"openid", "email", "profile"},
+			},
+			account: googleAccount,
+		}
+	}
+	if cfg.GitHubClientID != "" {
+		providers["github"] = &OAuthProvider{
+			Name:  "github",
+			Title: "GitHub",
+			config: oauth2.Config{
+				ClientID:     cfg.GitHubClientID,
+				ClientSecret: cfg.GitHubClientSecret,
+				Endpoint:     endpoints.GitHub,
+				Scopes:       []string{"read:user", "user:email"},
+			},
+			account: githubAccount,
+		}
+	}
+	if cfg.OIDCIssuer != "" && cfg.OIDCClientID != "" {
+		providers["oidc"] = oidcProvider(cfg)
+	}
+	return providers
+}
+
+// Reads a JSON answer of a provider into the value.
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func googleAccount(ctx context.Context, client *http.Client) (providerAccount, error) {
+	var info struct {
+		Sub           string `json:"sub"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := getJSON(ctx, client, "https://openidconnect.googleapis.com/v1/userinfo", &info); err != nil {
+		return providerAccount{}, err
+	}
+	return providerAccount{Subject: info.Sub, Name: info.Name, Email: info.Email, Verified: info.EmailVerified}, nil
+}
+
+// GitHub only shows the public email with the user, so we look for the
+// primary one among all of them.
+func githubAccount(ctx context.Context, client *http.Client) (providerAccount, error) {
+	var info struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &info); err != nil {
+		return providerAccount{}, err
+	}
+	account := providerAccount{Subject: strconv.FormatInt(info.ID, 10), Name: info.Name}
+	if account.Name == "" {
+		account.Name = info.Login
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return providerAccount{}, err
+	}
+	for _, e := range emails {
+		if e.Primary {
+			account.Email, account.Verified = e.Email, e.Verified
+		}
+	}
+	return account, nil
+}
+
+// Finds the user of the account, linking or creating one the first time.
+// Accounts are only linked to an existing user when the provider checked
+// the email, otherwise anybody could take over a user by claiming its email.
+func oauthUser(ctx context.Context, coll *Repository, provider string, account providerAccount) (User, error) {
+	identity := Identity{Provider: provider, Subject: account.Subject}
+	var user User
+	err := coll.FindOne(context.TODO(), bson.M{"useridentities": identity}).Decode(&user)
+	if err != mongo.ErrNoDocuments {
+		return user, err
+	}
+	if !account.Verified {
+		return User{}, errors.New("the email of the account is not verified")
+	}
+
+	if user, err = findUserByEmail(coll, account.Email); err == nil {
+		_, err = coll.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$push": bson.M{"useridentities": identity}})
+		return user, err
+	}
+	if err != mongo.ErrNoDocuments {
+		return User{}, err
+	}
+
+	// Users signing up this way have no password, so they can only log in
+	// through the provider
+	user = User{UserName: account.Name, UserEmail: account.Email, UserIdentities: []Identity{identity}}
+	if user.UserName == "" {
+		user.UserName = account.Email
+	}
+	err = insertUser(ctx, coll, &user)
+	return user, err
+}
+
+// Registers the pages sending the user to the providers, and where they
+// come back to.
+func registerOAuthRoutes(e *echo.Echo, cfg Config, sessions *Sessions, admin *AdminLog, coll *Repository) {
+	providers := oauthProviders(cfg)
+
+	// The buttons on the login page
+	e.GET("/auth/providers", func(c echo.Context) error {
+		list := []map[string]string{}
+		for _, name := range []string{"google", "github", "oidc"} {
+			if p, ok := providers[name]; ok {
+				list = append(list, map[string]string{"name": p.Name, "title": p.Title})
+			}
+		}
+		return c.Render(200, "oauth-providers", list)
+	})
+
+	// The address the provider sends the user back to depends on the host,
+	// so every library (see tenants.go) gets its own
+	redirectURL := func(c echo.Context, p *OAuthProvider) *oauth2.Config {
+		config := p.config
+		config.RedirectURL = c.Scheme() + "://" + c.Request().Host + "/auth/" + p.Name + "/callback"
+		return &config
+	}
+
+	// The provider, once it is ready for a login
+	provider := func(c echo.Context) (*OAuthProvider, error) {
+		p, ok := providers[c.Param("provider")]
+		if !ok {
+			return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "provider not found"})
+		}
+		if p.prepare != nil {
+			ctx, cancel := context.WithTimeout(c.Request().Context(), time.Duration(cfg.LookupTimeout)*time.Second)
+			defer cancel()
+			if err := p.prepare(ctx); err != nil {
+				loggerFrom(ctx).Warn("failed to prepare login", "provider", p.Title, "err", err)
+				return nil, c.JSON(http.StatusBadGateway, map[string]string{"error": "failed to reach " + p.Title})
+			}
+		}
+		return p, nil
+	}
+
+	e.GET("/auth/:provider", func(c echo.Context) error {
+		p, err := provider(c)
+		if p == nil {
+			return err
+		}
+		data := make([]byte, 16)
+		if _, err := rand.Read(data); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start login"})
+		}
+		state := hex.EncodeToString(data)
+		c.SetCookie(&http.Cookie{Name: oauthStateCookie, Value: state, Path: "/auth", MaxAge: 600, HttpOnly: true, Secure: c.Scheme() == "https", SameSite: http.SameSiteLaxMode})
+		return c.Redirect(http.StatusFound, redirectURL(c, p).AuthCodeURL(state))
+	})
+
+	e.GET("/auth/:provider/callback", func(c echo.Context) error {
+		p, err := provider(c)
+		if p == nil {
+			return err
+		}
+		cookie, err := c.Cookie(oauthStateCookie)
+		if err != nil || !sameToken(cookie.Value, c.QueryParam("state")) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid state"})
+		}
+		c.SetCookie(&http.Cookie{Name: oauthStateCookie, Value: "", Path: "/auth", MaxAge: -1})
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), time.Duration(cfg.LookupTimeout)*time.Second)
+		defer cancel()
+		config := redirectURL(c, p)
+		token, err := config.Exchange(ctx, c.QueryParam("code"))
+		if err != nil {
+			return c.JSON(http.StatusBadGateway, map[string]string{"error": "failed to log in with " + p.Title})
+		}
+		account, err := p.account(ctx, config.Client(ctx, token))
+		if err != nil {
+			return c.JSON(http.StatusBadGateway, map[string]string{"error": "failed to log in with " + p.Title})
+		}
+
+		user, err := oauthUser(c.Request().Context(), coll, p.Name, account)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+		}
+		role := providerRole(user.UserRole, account)
+		if role != user.UserRole {
+			last, err := lastAdmin(c.Request().Context(), coll, user)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count admins"})
+			}
+			// The library would be left without an admin, so they stay one
+			if last {
+				loggerFrom(c.Request().Context()).Warn("the last admin stays one", "user", user.ID.Hex(), "provider", p.Name)
+				role = user.UserRole
+			}
+		}
+		if role != user.UserRole {
+			if _, err = coll.UpdateOne(c.Request().Context(), bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"userrole": role}}); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update user"})
+			}
+			admin.Record(c, AdminRoleChange, user.UserEmail, bson.M{"from": user.UserRole, "to": role, "by": p.Name})
+			user.UserRole = role
+		}
+		// The provider does not know about the second factor, so it is asked
+		// for here
+		if user.UserTOTPSecret != "" {
+			sessions.StartPending(c, user)
+			return c.Redirect(http.StatusFound, "/login/totp")
+		}
+		if err := sessions.Start(c, user); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start session"})
+		}
+		return c.Redirect(http.StatusFound, "/")
+	})
+}
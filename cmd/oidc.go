@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// Next to Google and GitHub, users may log in through any OpenID Connect
+// provider, e.g., the single sign-on of a university. All it takes is the
+// issuer, e.g., https://login.example.edu, where we discover the rest, and a
+// client registered there. The provider may also decide who is an admin:
+// with OIDC_ADMIN_VALUES set, users whose OIDC_ROLE_CLAIM (e.g., their
+// groups) holds one of these values are admins, and the others are not,
+// checked again on every login.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+func oidcProvider(cfg Config) *OAuthProvider {
+	issuer := strings.TrimSuffix(cfg.OIDCIssuer, "/")
+	p := &OAuthProvider{
+		Name:  "oidc",
+		Title: cfg.OIDCTitle,
+		config: oauth2.Config{
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			Scopes:       strings.Fields(cfg.OIDCScopes),
+		},
+	}
+
+	// The endpoints are only discovered once somebody logs in, so the
+	// server starts even when the provider is down. Until it worked, every
+	// login tries again.
+	var mu sync.Mutex
+	var userinfo string
+	p.prepare = func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if userinfo != "" {
+			return nil
+		}
+		var d oidcDiscovery
+		if err := getJSON(ctx, http.DefaultClient, issuer+"/.well-known/openid-configuration", &d); err != nil {
+			return err
+		}
+		if strings.TrimSuffix(d.Issuer, "/") != issuer || d.UserinfoEndpoint == "" {
+			return errors.New("the discovery document of " + issuer + " is not for it")
+		}
+		p.config.Endpoint = oauth2.Endpoint{AuthURL: d.AuthorizationEndpoint, TokenURL: d.TokenEndpoint}
+		userinfo = d.UserinfoEndpoint
+		return nil
+	}
+
+	// We ask the provider who logged in, with the token we just got from it,
+	// rather than reading the ID token
+	p.account = func(ctx context.Context, client *http.Client) (providerAccount, error) {
+		var claims map[string]interface{}
+		if err := getJSON(ctx, client, userinfo, &claims); err != nil {
+			return providerAccount{}, err
+		}
+		account := providerAccount{}
+		account.Subject, _ = claims["sub"].(string)
+		account.Name, _ = claims["name"].(string)
+		account.Email, _ = claims["email"].(string)
+		account.Verified, _ = claims["email_verified"].(bool)
+		if account.Subject == "" {
+			return providerAccount{}, errors.New("the provider did not say who logged in")
+		}
+		if len(cfg.OIDCAdminValues) > 0 {
+			admin := claimHasAny(claims[cfg.OIDCRoleClaim], cfg.OIDCAdminValues)
+			account.Admin = &admin
+		}
+		return account, nil
+	}
+	return p
+}
+
+// Whether the claim, a single value or a list of them, holds one of the
+// values.
+func claimHasAny(claim interface{}, values []string) bool {
+	switch v := claim.(type) {
+	case string:
+		return slices.Contains(values, strings.ToLower(v))
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && slices.Contains(values, strings.ToLower(s)) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// How long the description in the preview of a shared link may be. Longer
+// ones are cut at a word.
+const metaDescriptionLength = 200
+
+// Shortens the text to at most n characters, at the end of a word.
+func shorten(text string, n int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	cut := string([]rune(text)[:n-1])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+// What the page of a book tells those who aren't people reading it: the
+// OpenGraph tags (https://ogp.me), which the apps showing a preview of a
+// shared link read, and the schema.org Book (https://schema.org/Book) as
+// JSON-LD, which search engines read. See "meta" in layout.html. The book is
+// the one of bookDetails.
+func bookMeta(c echo.Context, book map[string]interface{}) map[string]interface{} {
+	url := absoluteURL(c, "/books/"+book["id"].(string))
+	image := absoluteURL(c, book["cover"].(string))
+	description := shorten(book["description"].(string), metaDescriptionLength)
+
+	ld := map[string]interface{}{
+		"@context": "https://schema.org",
+		"@type":    "Book",
+		"@id":      url,
+		"url":      url,
+		"name":     book["book"],
+		"author":   map[string]interface{}{"@type": "Person", "name": book["author"]},
+		"image":    image,
+	}
+	if isbn := book["isbn"].(string); isbn != "" {
+		ld["isbn"] = isbn
+	}
+	if pages := book["pages"].(int); pages > 0 {
+		ld["numberOfPages"] = pages
+	}
+	if year := book["year"].(int); year > 0 {
+		ld["datePublished"] = strconv.Itoa(year)
+	}
+	if language := book["language"].(string); language != "" {
+		ld["inLanguage"] = language
+	}
+	if description != "" {
+		ld["description"] = description
+	}
+	// The JSON escapes "<", so the script can't be ended from within
+	data, _ := json.Marshal(ld)
+
+	return map[string]interface{}{
+		"title":       book["book"],
+		"author":      book["author"],
+		"isbn":        book["isbn"],
+		"description": description,
+		"url":         url,
+		"image":       image,
+		"jsonld":      template.JS(data),
+	}
+}
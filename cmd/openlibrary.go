@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// How long we remember what Open Library told us about an ISBN. Books don't
+// change their title, so this can be long.
+const lookupCacheTTL = 24 * time.Hour
+
+// How often the cache knew the ISBN, see expvars.go
+var isbnCacheStats = newCacheStats("isbn")
+
+// What we could find out about a book somewhere else than in our catalogue.
+// Empty fields are unknown.
+type BookMetadata struct {
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	Pages  int    `json:"pages"`
+	Year   int    `json:"year"`
+	Cover  string `json:"cover"`
+}
+
+type cachedLookup struct {
+	metadata BookMetadata
+	found    bool
+	expires  time.Time
+}
+
+// Looks up ISBNs in the Open Library (https://openlibrary.org/dev/docs/api/books).
+// The answers are cached, including the ISBNs it does not know, so typing the
+// same ISBN twice only asks once. Failed requests are not cached, they may
+// well work next time.
+type OpenLibrary struct {
+	client  *http.Client
+	baseURL string
+
+	mu    sync.Mutex
+	cache map[string]cachedLookup
+}
+
+func newOpenLibrary(cfg Config) *OpenLibrary {
+	return &OpenLibrary{
+		client:  tracedClient(time.Duration(cfg.LookupTimeout) * time.Second),
+		baseURL: cfg.OpenLibraryURL,
+		cache:   map[string]cachedLookup{},
+	}
+}
+
+var yearPattern = regexp.MustCompile(`\b\d{4}\b`)
+
+// Returns what Open Library knows about the ISBN, and whether it knows the
+// book at all.
+func (ol *OpenLibrary) Lookup(ctx context.Context, isbn string) (BookMetadata, bool, error) {
+	isbn = normalizeISBN(isbn)
+	if isbn == "" {
+		return BookMetadata{}, false, nil
+	}
+
+	ol.mu.Lock()
+	cached, ok := ol.cache[isbn]
+	ol.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		isbnCacheStats.Hit()
+		return cached.metadata, cached.found, nil
+	}
+	isbnCacheStats.Miss()
+
+	key := "ISBN:" + isbn
+	query := url.Values{"bibkeys": {key}, "format": {"json"}, "jscmd": {"data"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ol.baseURL+"/api/books?"+query.Encode(), nil)
+	if err != nil {
+		return BookMetadata{}, false, err
+	}
+	resp, err := ol.client.Do(req)
+	if err != nil {
+		return BookMetadata{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return BookMetadata{}, false, fmt.Errorf("open library answered %s", resp.Status)
+	}
+
+	// The answer is keyed by what we asked for, and empty when the book is
+	// unknown
+	var body map[string]struct {
+		Title   string `json:"title"`
+		Authors []struct {
+			Name string `json:"name"`
+		} `json:"authors"`
+		Pages       int    `json:"number_of_pages"`
+		PublishDate string `json:"publish_date"`
+		Cover       struct {
+			Large  string `json:"large"`
+			Medium string `json:"medium"`
+		} `json:"cover"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return BookMetadata{}, false, err
+	}
+
+	entry, found := body[key]
+	metadata := BookMetadata{Title: entry.Title, Pages: entry.Pages, Cover: entry.Cover.Large}
+	names := []string{}
+	for _, a := range entry.Authors {
+		names = append(names, a.Name)
+	}
+	metadata.Author = strings.Join(names, ", ")
+	if years := yearPattern.FindAllString(entry.PublishDate, -1); len(years) > 0 {
+		metadata.Year, _ = strconv.Atoi(years[len(years)-1])
+	}
+	if metadata.Cover == "" {
+		metadata.Cover = entry.Cover.Medium
+	}
+
+	ol.mu.Lock()
+	ol.cache[isbn] = cachedLookup{metadata: metadata, found: found, expires: time.Now().Add(lookupCacheTTL)}
+	ol.mu.Unlock()
+	return metadata, found, nil
+}
+
+// Fills in the fields of the book that were left empty with what Open
+// Library knows about its ISBN, and returns where its cover can be found.
+// Open Library being slow or down must not keep anybody from adding books,
+// so errors are only logged, and the book is left as it was.
+func (ol *OpenLibrary) Fill(ctx context.Context, book *BookStore) string {
+	if book.BookISBN == "" {
+		return ""
+	}
+	metadata, found, err := ol.Lookup(ctx, book.BookISBN)
+	if err != nil {
+		loggerFrom(ctx).Warn("failed to look up ISBN", "isbn", book.BookISBN, "err", err)
+		return ""
+	}
+	if !found {
+		return ""
+	}
+	if book.BookName == "" {
+		book.BookName = metadata.Title
+	}
+	if book.BookAuthor == "" {
+		book.BookAuthor = metadata.Author
+	}
+	if book.BookPages == 0 {
+		book.BookPages = metadata.Pages
+	}
+	if book.BookYear == 0 {
+		book.BookYear = metadata.Year
+	}
+	return metadata.Cover
+}
+
+// Stores the cover found for a new book, unless one was uploaded along with
+// it. Like Fill, it gives up quietly.
+func (ol *OpenLibrary) StoreCover(ctx context.Context, coll *Repository, dir string, book BookStore, coverURL string) {
+	if coverURL == "" {
+		return
+	}
+	if err := downloadCover(ctx, ol.client, coll, dir, book.ID, coverURL); err != nil {
+		loggerFrom(ctx).Warn("failed to store cover", "book", book.ID.Hex(), "err", err)
+	}
+}
+
+// Registers the ISBN lookup, both as an API and as the fragment which fills
+// in the form to add a book.
+func registerLookupRoutes(e *echo.Echo, lookup *OpenLibrary) {
+	e.GET("/api/isbn/:isbn", func(c echo.Context) error {
+		metadata, found, err := lookup.Lookup(c.Request().Context(), c.Param("isbn"))
+		if err != nil {
+			return c.JSON(http.StatusBadGateway, map[string]string{"error": "ISBN lookup is not available right now"})
+		}
+		if !found {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "ISBN not found"})
+		}
+		return c.JSON(http.StatusOK, metadata)
+	})
+
+	// Whatever the outcome, the form is rendered again with what we know, so
+	// the rest can still be typed in by hand
+	e.GET("/books/lookup", func(c echo.Context) error {
+		book := BookStore{BookISBN: strings.TrimSpace(c.QueryParam("isbn"))}
+		message := ""
+		metadata, found, err := lookup.Lookup(c.Request().Context(), book.BookISBN)
+		switch {
+		case err != nil:
+			message = "The ISBN could not be looked up right now, please fill in the book by hand."
+		case !found:
+			message = "No book found for this ISBN, please fill it in by hand."
+		default:
+			book.BookName, book.BookAuthor, book.BookPages, book.BookYear = metadata.Title, metadata.Author, metadata.Pages, metadata.Year
+			if metadata.Cover != "" {
+				message = "Found it! The cover will be added too unless you upload one."
+			}
+		}
+		return c.Render(200, "create-book", map[string]interface{}{"book": book, "message": message})
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A purchase order sent to a supplier. When it arrives, every item ends up
+// in the catalogue (unless the book is there already) with as many copies as
+// were ordered.
+type PurchaseOrder struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	OrderSupplier string             `bson:"ordersupplier"`
+	OrderItems    []OrderItem        `bson:"orderitems"`
+	OrderStatus   string             `bson:"orderstatus"`
+	OrderCreated  time.Time          `bson:"ordercreated"`
+	OrderClosed   *time.Time         `bson:"orderclosed,omitempty"`
+}
+
+// A line of an order. Either it points to a book of the catalogue, for more
+// copies of it, or it describes a new one. The price is per copy, in cents.
+type OrderItem struct {
+	Book     primitive.ObjectID `json:"book" bson:"book,omitempty"`
+	Title    string             `json:"title" bson:"title"`
+	Author   string             `json:"author" bson:"author"`
+	ISBN     string             `json:"isbn" bson:"isbn"`
+	Pages    int                `json:"pages" bson:"pages"`
+	Year     int                `json:"year" bson:"year"`
+	Quantity int                `json:"quantity" bson:"quantity"`
+	Price    int                `json:"price" bson:"price"`
+	Currency string             `json:"currency" bson:"currency"`
+}
+
+const (
+	OrderOrdered   = "ordered"
+	OrderReceived  = "received"
+	OrderCancelled = "cancelled"
+)
+
+func orderToMap(o PurchaseOrder) map[string]interface{} {
+	closed := ""
+	if o.OrderClosed != nil {
+		closed = o.OrderClosed.Format(time.RFC3339)
+	}
+	items := []map[string]interface{}{}
+	for _, i := range o.OrderItems {
+		book := ""
+		if !i.Book.IsZero() {
+			book = i.Book.Hex()
+		}
+		items = append(items, map[string]interface{}{
+			"book":     book,
+			"title":    i.Title,
+			"author":   i.Author,
+			"isbn":     i.ISBN,
+			"quantity": i.Quantity,
+			"price":    i.Price,
+			"currency": i.Currency,
+		})
+	}
+	return map[string]interface{}{
+		"id":       o.ID.Hex(),
+		"supplier": o.OrderSupplier,
+		"items":    items,
+		"status":   o.OrderStatus,
+		"created":  o.OrderCreated.Format(time.RFC3339),
+		"closed":   closed,
+	}
+}
+
+// Checks the items of a new order. Items pointing to a book take its title
+// and author, so the order reads well later on.
+func validateOrderItems(books *Repository, items []OrderItem) string {
+	if len(items) == 0 {
+		return "an order needs at least one item"
+	}
+	for i := range items {
+		item := &items[i]
+		item.Title, item.Author, item.ISBN = strings.TrimSpace(item.Title), strings.TrimSpace(item.Author), strings.TrimSpace(item.ISBN)
+		if item.Quantity < 1 {
+			return "quantity must be at least 1"
+		}
+		var msg string
+		if item.Currency, msg = validatePrice(item.Price, item.Currency); msg != "" {
+			return msg
+		}
+		if !item.Book.IsZero() {
+			var book BookStore
+			if err := books.FindOne(context.TODO(), bson.M{"_id": item.Book}).Decode(&book); err != nil {
+				return "book " + item.Book.Hex() + " not found"
+			}
+			item.Title, item.Author, item.ISBN = book.BookName, book.BookAuthor, book.BookISBN
+		} else if item.Title == "" || item.Author == "" {
+			return "new books need a title and an author"
+		}
+	}
+	return ""
+}
+
+// Returns the book of the catalogue with the given ISBN, or adds a new one.
+// Books without an ISBN are always added, we cannot tell them apart.
+func catalogBook(ctx context.Context, books *Repository, book BookStore) (primitive.ObjectID, error) {
+	if book.BookISBN != "" {
+		var existing BookStore
+		err := books.FindOne(context.TODO(), bson.M{"bookisbnkey": normalizeISBN(book.BookISBN)}).Decode(&existing)
+		if err == nil {
+			return existing.ID, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return primitive.NilObjectID, err
+		}
+	}
+	book.ID = primitive.NewObjectID()
+	book.BookISBNKey = normalizeISBN(book.BookISBN)
+	_, err := books.InsertOne(ctx, book)
+	return book.ID, err
+}
+
+// Adds the items that just came in to the catalogue, as new books when they
+// are not there yet, along with their copies. The books of the items are
+// filled in, and everything is tagged with where it came from.
+func acquireItems(ctx context.Context, books *Repository, copies *Repository, items []OrderItem, provenance string, source primitive.ObjectID) string {
+	for i, item := range items {
+		if item.Book.IsZero() {
+			id, err := catalogBook(ctx, books, BookStore{
+				BookName:       item.Title,
+				BookAuthor:     item.Author,
+				BookISBN:       item.ISBN,
+				BookPages:      item.Pages,
+				BookYear:       item.Year,
+				BookPrice:      item.Price,
+				BookCurrency:   item.Currency,
+				BookProvenance: provenance,
+			})
+			if err != nil {
+				return "failed to add " + item.Title
+			}
+			items[i].Book = id
+		}
+		for n := 0; n < item.Quantity; n++ {
+			cp := newCopy(items[i].Book)
+			cp.CopyCondition = "new"
+			cp.CopyPrice, cp.CopyCurrency = item.Price, item.Currency
+			cp.CopyProvenance, cp.CopySource = provenance, source
+			if _, err := copies.InsertOne(ctx, cp); err != nil {
+				return "failed to add copies of " + item.Title
+			}
+		}
+	}
+	return ""
+}
+
+// Registers the endpoints to place purchase orders and receive or cancel
+// them.
+func registerOrderRoutes(e *echo.Echo, books *Repository, copies *Repository, coll *Repository) {
+	e.GET("/api/orders", func(c echo.Context) error {
+		query := newQuery("orderstatus")
+		if status := c.QueryParam("status"); status != "" {
+			query.Eq("orderstatus", status)
+		}
+		filter, err := query.Filter()
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		cursor, err := coll.Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "ordercreated", Value: -1}}))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list orders"})
+		}
+		var results []PurchaseOrder
+		if err = cursor.All(context.TODO(), &results); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list orders"})
+		}
+		ret := []map[string]interface{}{}
+		for _, o := range results {
+			ret = append(ret, orderToMap(o))
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	e.GET("/api/orders/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var order PurchaseOrder
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&order); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "order not found"})
+		}
+		return c.JSON(http.StatusOK, orderToMap(order))
+	})
+
+	e.POST("/api/orders", func(c echo.Context) error {
+		var req struct {
+			Supplier string      `json:"supplier"`
+			Items    []OrderItem `json:"items"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		order := PurchaseOrder{
+			ID:            primitive.NewObjectID(),
+			OrderSupplier: strings.TrimSpace(req.Supplier),
+			OrderItems:    req.Items,
+			OrderStatus:   OrderOrdered,
+			OrderCreated:  time.Now().UTC(),
+		}
+		if order.OrderSupplier == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "supplier is required"})
+		}
+		if msg := validateOrderItems(books, order.OrderItems); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		if _, err := coll.InsertOne(c.Request().Context(), order); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert order"})
+		}
+		return c.JSON(http.StatusOK, orderToMap(order))
+	})
+
+	// Only ordered orders can be closed, and only once: the status is
+	// changed atomically, so receiving an order twice cannot create the
+	// copies twice.
+	closeOrder := func(c echo.Context, status string) (PurchaseOrder, bool, error) {
+		var order PurchaseOrder
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return order, false, c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		err = coll.FindOneAndUpdate(c.Request().Context(),
+			bson.M{"_id": id, "orderstatus": OrderOrdered},
+			bson.M{"$set": bson.M{"orderstatus": status, "orderclosed": time.Now().UTC()}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&order)
+		if err == mongo.ErrNoDocuments {
+			return order, false, c.JSON(http.StatusConflict, map[string]string{"error": "order not found or not open anymore"})
+		}
+		if err != nil {
+			return order, false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update order"})
+		}
+		return order, true, nil
+	}
+
+	e.POST("/api/orders/:id/cancel", func(c echo.Context) error {
+		order, ok, err := closeOrder(c, OrderCancelled)
+		if !ok {
+			return err
+		}
+		return c.JSON(http.StatusOK, orderToMap(order))
+	})
+
+	e.POST("/api/orders/:id/receive", func(c echo.Context) error {
+		order, ok, err := closeOrder(c, OrderReceived)
+		if !ok {
+			return err
+		}
+
+		ctx := c.Request().Context()
+		if msg := acquireItems(ctx, books, copies, order.OrderItems, ProvenancePurchase, order.ID); msg != "" {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": msg})
+		}
+
+		// Remember which books the items ended up as
+		if _, err = coll.UpdateOne(ctx, bson.M{"_id": order.ID}, bson.M{"$set": bson.M{"orderitems": order.OrderItems}}); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update order"})
+		}
+		return c.JSON(http.StatusOK, orderToMap(order))
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The page sizes users can pick from, the first one being the default
+var pageSizes = []int{25, 10, 50, 100}
+
+// A page of the results of a query, e.g., the second page of 25 books is
+// books 26 to 50. Total is how many there are on all the pages together.
+type Page struct {
+	Number int
+	Size   int
+	Total  int64
+}
+
+// Reads the page from the query string, e.g., /books?page=2&size=50.
+// Anything that doesn't make sense is the first page of the size in the
+// preferences (see preferences.go).
+func pageFrom(c echo.Context) Page {
+	page := Page{Number: 1, Size: preferredPageSize(c)}
+	if n, err := strconv.Atoi(c.QueryParam("page")); err == nil && n > 0 {
+		page.Number = n
+	}
+	if n, err := strconv.Atoi(c.QueryParam("size")); err == nil && slices.Contains(pageSizes, n) {
+		page.Size = n
+	}
+	return page
+}
+
+// Counts the records matching the filter, and moves the page to the last one
+// if it is past the end, e.g., after a filter narrowed the results down.
+func paginate(coll *Repository, filter bson.M, page Page) (Page, error) {
+	total, err := coll.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		return page, err
+	}
+	page.Total = total
+	if last := page.Pages(); page.Number > last {
+		page.Number = last
+	}
+	return page, nil
+}
+
+// How many pages there are. An empty result still has one, empty, page.
+func (p Page) Pages() int {
+	pages := int((p.Total + int64(p.Size) - 1) / int64(p.Size))
+	return max(pages, 1)
+}
+
+// Adds skipping to the page and limiting to its size to the options of the
+// query.
+func (p Page) Apply(opts *options.FindOptions) *options.FindOptions {
+	return opts.SetSkip(int64((p.Number - 1) * p.Size)).SetLimit(int64(p.Size))
+}
+
+// What the template needs to show the controls (see "pagination" in
+// partials.html): where we are, and the pages before and after, 0 when there
+// is none. The buttons ask the path for the page, with the fields of the
+// form matching include, e.g., "#book-filters".
+func (p Page) toMap(path string, include string) map[string]interface{} {
+	prev, next := p.Number-1, p.Number+1
+	if next > p.Pages() {
+		next = 0
+	}
+	return map[string]interface{}{
+		"number":  p.Number,
+		"size":    p.Size,
+		"sizes":   pageSizes,
+		"total":   p.Total,
+		"pages":   p.Pages(),
+		"prev":    prev,
+		"next":    next,
+		"path":    path,
+		"include": include,
+	}
+}
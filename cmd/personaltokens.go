@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A token users create for themselves on their account page, e.g., for a
+// script of their own, and send as the "Authorization: Bearer <token>"
+// header. Unlike the tokens of a login, it does not expire, and unlike the
+// API keys, it acts as the user who created it. It works until the user
+// revokes it, and like with the API keys we only store its hash.
+type PersonalToken struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	TokenName     string             `json:"name" form:"name"`
+	TokenPrefix   string             `json:"-" form:"-"`
+	TokenHash     string             `json:"-" form:"-"`
+	TokenUser     primitive.ObjectID `json:"-" form:"-"`
+	TokenUses     int64              `json:"-" form:"-"`
+	TokenLastUsed *time.Time         `json:"-" form:"-" bson:",omitempty"`
+	CreatedAt     time.Time          `json:"-" form:"-" bson:"createdat,omitempty"`
+	UpdatedAt     time.Time          `json:"-" form:"-" bson:"updatedat,omitempty"`
+}
+
+// Every personal token starts like this, so they can be told apart from the
+// tokens of a login
+const personalTokenStart = "pat_"
+
+func personalTokenToMap(t PersonalToken) map[string]interface{} {
+	ret := map[string]interface{}{
+		"id":        t.ID.Hex(),
+		"name":      t.TokenName,
+		"prefix":    t.TokenPrefix,
+		"uses":      t.TokenUses,
+		"lastUsed":  "",
+		"createdAt": formatTimestamp(t.CreatedAt),
+	}
+	if t.TokenLastUsed != nil {
+		ret["lastUsed"] = t.TokenLastUsed.Format(time.RFC3339)
+	}
+	return ret
+}
+
+func newPersonalToken() (string, error) {
+	data := make([]byte, 24)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return personalTokenStart + hex.EncodeToString(data), nil
+}
+
+// Middleware letting the requests with a personal token through as its
+// user. Every use is counted.
+func personalTokenAuth(coll *Repository, users *Repository) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			value, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if !ok || !strings.HasPrefix(strings.TrimSpace(value), personalTokenStart) {
+				return next(c)
+			}
+
+			var token PersonalToken
+			if err := coll.FindOne(context.TODO(), bson.M{"tokenhash": hashToken(strings.TrimSpace(value))}).Decode(&token); err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+			}
+			user, err := findUserByID(users, token.TokenUser)
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+			}
+			update := bson.M{"$inc": bson.M{"tokenuses": 1}, "$set": bson.M{"tokenlastused": time.Now().UTC()}}
+			if _, err = coll.UpdateOne(context.TODO(), bson.M{"_id": token.ID}, update); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to check token"})
+			}
+
+			setUser(c, user)
+			return next(c)
+		}
+	}
+}
+
+// Answers with the tokens of the user: htmx gets the account page, with the
+// new token if one was just created, and other clients the list as JSON.
+func personalTokensPage(c echo.Context, coll *Repository, user User, created string, message string) error {
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}})
+	cursor, err := coll.Find(context.TODO(), bson.M{"tokenuser": user.ID}, opts)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list tokens"})
+	}
+	var results []PersonalToken
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list tokens"})
+	}
+
+	tokens := []map[string]interface{}{}
+	for _, t := range results {
+		tokens = append(tokens, personalTokenToMap(t))
+	}
+	if c.Request().Header.Get("HX-Request") == "" {
+		if message != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": message})
+		}
+		if created != "" {
+			return c.JSON(http.StatusOK, map[string]interface{}{"token": created, "tokens": tokens})
+		}
+		return c.JSON(http.StatusOK, tokens)
+	}
+	return c.Render(200, "personal-tokens", map[string]interface{}{"tokens": tokens, "created": created, "message": message})
+}
+
+// Registers the account page where users manage their personal tokens.
+func registerPersonalTokenRoutes(e *echo.Echo, coll *Repository) {
+	e.GET("/account/tokens", func(c echo.Context) error {
+		user, _ := currentUser(c)
+		return personalTokensPage(c, coll, user, "", "")
+	})
+
+	// The new token is in the response, which is the only time it is shown
+	e.POST("/account/tokens", func(c echo.Context) error {
+		user, _ := currentUser(c)
+		token := new(PersonalToken)
+		if err := c.Bind(token); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		token.TokenName = strings.TrimSpace(token.TokenName)
+		if token.TokenName == "" {
+			return personalTokensPage(c, coll, user, "", "name is required")
+		}
+
+		value, err := newPersonalToken()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create token"})
+		}
+		token.ID = primitive.NewObjectID()
+		token.TokenPrefix = value[:len(personalTokenStart)+6]
+		token.TokenHash = hashToken(value)
+		token.TokenUser = user.ID
+		if _, err = coll.InsertOne(c.Request().Context(), token); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert token"})
+		}
+		return personalTokensPage(c, coll, user, value, "")
+	})
+
+	// Users can only revoke their own tokens
+	e.DELETE("/account/tokens/:id", func(c echo.Context) error {
+		user, _ := currentUser(c)
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		result, err := coll.DeleteOne(c.Request().Context(), bson.M{"_id": id, "tokenuser": user.ID})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to revoke token"})
+		}
+		if result.DeletedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "token not found"})
+		}
+		return personalTokensPage(c, coll, user, "", "")
+	})
+}
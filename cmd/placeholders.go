@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// How long we wait before asking the provider again for a cover it did not
+// have.
+const coverRetry = 24 * time.Hour
+
+// Fetches covers for the books that have none, by ISBN, from the configured
+// provider. They are stored like uploaded ones, so each is only fetched
+// once. The books the provider has no cover for are remembered for a while,
+// so we don't ask for them on every page view.
+type CoverFetcher struct {
+	books    *Repository
+	client   *http.Client
+	provider string
+	dir      string
+
+	mu       sync.Mutex
+	misses   map[primitive.ObjectID]time.Time
+	fetching map[primitive.ObjectID]bool
+}
+
+func newCoverFetcher(books *Repository, cfg Config) *CoverFetcher {
+	return &CoverFetcher{
+		books:    books,
+		client:   &http.Client{Timeout: time.Duration(cfg.LookupTimeout) * time.Second},
+		provider: cfg.CoverProvider,
+		dir:      cfg.CoversPath,
+		misses:   map[primitive.ObjectID]time.Time{},
+		fetching: map[primitive.ObjectID]bool{},
+	}
+}
+
+// Starts fetching the cover of the book in the background, unless it is
+// already being fetched or the provider didn't have it lately. Meanwhile, the
+// book shows its placeholder, and the cover once it is stored.
+func (f *CoverFetcher) Fetch(book BookStore) {
+	isbn := normalizeISBN(book.BookISBN)
+	if f.provider == "" || isbn == "" {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if missed, ok := f.misses[book.ID]; (ok && time.Since(missed) < coverRetry) || f.fetching[book.ID] {
+		return
+	}
+	f.fetching[book.ID] = true
+
+	go func() {
+		// The cover is stored on behalf of the library, not of whoever
+		// happened to look at the book first
+		from := strings.ReplaceAll(f.provider, "{isbn}", isbn)
+		err := downloadCover(context.Background(), f.client, f.books, f.dir, book.ID, from)
+		if err != nil {
+			slog.Warn("failed to fetch cover", "book", book.ID.Hex(), "err", err)
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.fetching, book.ID)
+		if err != nil {
+			f.misses[book.ID] = time.Now()
+		}
+	}()
+}
+
+// Draws a plain cover with the title and author of the book on it, for the
+// books we have no picture of. The background color is derived from the
+// title, so the same book always looks the same.
+func placeholderCover(book BookStore, width int, height int) image.Image {
+	h := fnv.New32a()
+	h.Write([]byte(book.BookName))
+	sum := h.Sum32()
+	background := color.RGBA{uint8(40 + sum%120), uint8(40 + (sum>>8)%120), uint8(40 + (sum>>16)%120), 255}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+
+	face := basicfont.Face7x13
+	columns := max(1, (width-16)/7)
+	d := &font.Drawer{Dst: img, Src: image.White, Face: face}
+	y := 24
+	write := func(text string) {
+		for _, line := range wrapText(text, columns) {
+			if y > height-8 {
+				return
+			}
+			d.Dot = fixed.P(8, y)
+			d.DrawString(line)
+			y += 15
+		}
+	}
+	write(strings.ToUpper(book.BookName))
+	y += 15
+	write(book.BookAuthor)
+	return img
+}
+
+// Splits the text into lines of at most the given number of characters,
+// breaking between words when possible.
+func wrapText(text string, columns int) []string {
+	lines := []string{}
+	line := ""
+	for _, word := range strings.Fields(text) {
+		for len([]rune(word)) > columns {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			lines = append(lines, string([]rune(word)[:columns]))
+			word = string([]rune(word)[columns:])
+		}
+		switch {
+		case line == "":
+			line = word
+		case len([]rune(line))+1+len([]rune(word)) <= columns:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
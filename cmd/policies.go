@@ -0,0 +1,247 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// What a user may do. Every route takes one permission (see routePolicies),
+// and the roles grant them (see rolePermissions), so giving some users more
+// or less to do only takes a new role, not changes to the handlers.
+type Permission string
+
+const (
+	// Anybody, logged in or not
+	PermPublic Permission = "public"
+	// Anybody logged in, e.g., to review books
+	PermLogin         Permission = "login"
+	PermBooksWrite    Permission = "books:write"
+	PermLoansManage   Permission = "loans:manage"
+	PermMembersManage Permission = "members:manage"
+	PermModerate      Permission = "reviews:moderate"
+	PermUsersManage   Permission = "users:manage"
+	PermKeysManage    Permission = "keys:manage"
+	PermAdminLogRead  Permission = "admin-log:read"
+	PermMetricsRead   Permission = "metrics:read"
+	// The covers and other files, which may be private (see signedurls.go)
+	PermFilesRead Permission = "files:read"
+)
+
+// The admins may do everything, the staff everything but managing the
+// users, the keys and reading the admin log and the metrics, and the other
+// users, e.g., everybody signing up, only what readers do.
+var rolePermissions = map[string][]Permission{
+	RoleAdmin: {PermLogin, PermFilesRead, PermBooksWrite, PermLoansManage, PermMembersManage, PermModerate, PermUsersManage, PermKeysManage, PermAdminLogRead, PermMetricsRead},
+	RoleStaff: {PermLogin, PermFilesRead, PermBooksWrite, PermLoansManage, PermMembersManage, PermModerate},
+	RoleUser:  {PermLogin, PermFilesRead},
+}
+
+// Whether the user may do what the permission allows.
+func can(user User, p Permission) bool {
+	return p == PermPublic || slices.Contains(rolePermissions[user.UserRole], p)
+}
+
+// The permission a route takes. The method is either the method of the
+// request, "*" for all of them, or "write" for all but GET, HEAD and
+// OPTIONS. The path is the route as registered, or ends with "*" for all
+// the routes below it.
+type routePolicy struct {
+	method string
+	path   string
+	perm   Permission
+}
+
+// The first policy matching the request applies. Without one, the request
+// takes a login, so a new route is never open to everybody by mistake.
+var routePolicies = []routePolicy{
+	// Logging in at all, and the requests that have tokens of their own
+	{"POST", "/login", PermPublic},
+	{"POST", "/login/totp", PermPublic},
+	{"POST", "/signup", PermPublic},
+	{"POST", "/logout", PermPublic},
+	{"POST", "/password/forgot", PermPublic},
+	{"POST", "/password/reset", PermPublic},
+	{"POST", "/branch", PermPublic},
+	{"POST", "/locale", PermPublic},
+	{"POST", "/preferences", PermPublic},
+	{"POST", "/api/token/refresh", PermPublic},
+	{"*", "/api/tenants", PermPublic},
+	{"*", "/api/tenant*", PermPublic},
+	{"GET", "/login*", PermPublic},
+	{"GET", "/signup", PermPublic},
+	{"GET", "/password/*", PermPublic},
+	{"GET", "/auth/*", PermPublic},
+	{"GET", "/account/status", PermPublic},
+	{"GET", "/locale/switcher", PermPublic},
+	{"GET", "/branches/switcher", PermPublic},
+	{"GET", "/preferences", PermPublic},
+	{"GET", "/css*", PermPublic},
+	{"GET", "/js*", PermPublic},
+
+	// The pages with the forms to change things need a login just like the
+	// changes themselves
+	{"GET", "/create", PermBooksWrite},
+	{"GET", "/edit/:id", PermBooksWrite},
+	{"GET", "/books/lookup", PermBooksWrite},
+	{"GET", "/import", PermBooksWrite},
+	{"GET", "/api/books/import*", PermBooksWrite},
+	{"GET", "/account/2fa", PermLogin},
+	{"GET", "/account/tokens", PermLogin},
+	{"GET", "/api/sessions", PermLogin},
+
+	// What users do with the books for themselves
+	{"POST", "/api/books/:id/reviews", PermLogin},
+
+	{"GET", "/covers*", PermFilesRead},
+
+	// The patrons, their loans and what they owe are for the staff only
+	{"GET", "/api/books/:id/loans", PermLoansManage},
+	{"GET", "/api/books/:id/holds", PermLoansManage},
+	{"GET", "/api/members/:id/loans", PermLoansManage},
+	{"GET", "/api/members/:id/fines", PermLoansManage},
+	{"GET", "/api/members/:id/balance", PermLoansManage},
+	{"GET", "/api/members/:id/holds", PermLoansManage},
+	{"GET", "/api/members/:id/notifications", PermLoansManage},
+	{"*", "/api/members*", PermMembersManage},
+	{"GET", "/members*", PermMembersManage},
+	{"*", "/api/loans*", PermLoansManage},
+	{"*", "/api/holds*", PermLoansManage},
+	{"*", "/api/fines*", PermLoansManage},
+	{"GET", "/api/reviews", PermModerate},
+	// The lists, favorites and suggestions name the member they are for,
+	// and users aren't members, so the staff keeps them for the members
+	{"POST", "/api/books/:id/favorite", PermMembersManage},
+	{"*", "/api/lists*", PermMembersManage},
+	{"POST", "/api/suggestions/:id/moderate", PermModerate},
+	{"POST", "/api/suggestions/:id/acquire", PermBooksWrite},
+	{"*", "/api/suggestions*", PermMembersManage},
+	{"*", "/api/notifications*", PermLoansManage},
+
+	// What the staff reads to run the library
+	{"GET", "/api/books/duplicates", PermBooksWrite},
+	{"GET", "/api/books/:id/revisions", PermBooksWrite},
+	{"*", "/api/copies*", PermBooksWrite},
+	{"*", "/api/orders*", PermBooksWrite},
+	{"*", "/api/donations*", PermBooksWrite},
+	{"*", "/api/enrich", PermBooksWrite},
+	{"GET", "/api/isbn/:isbn", PermBooksWrite},
+	{"GET", "/api/reports/*", PermBooksWrite},
+	{"GET", "/api/stats", PermUsersManage},
+	{"GET", "/api/stats/*", PermUsersManage},
+	// A signed URL opens a private file to anybody who has it
+	{"POST", "/api/signed-urls", PermBooksWrite},
+
+	// The catalog, which anybody may browse
+	{"GET", "/", PermPublic},
+	{"GET", "/search", PermPublic},
+	{"GET", "/books*", PermPublic},
+	{"GET", "/authors*", PermPublic},
+	{"GET", "/years*", PermPublic},
+	{"GET", "/decades/*", PermPublic},
+	{"GET", "/series*", PermPublic},
+	{"GET", "/works*", PermPublic},
+	{"GET", "/classification", PermPublic},
+	{"GET", "/shared/lists/:token", PermPublic},
+	{"GET", "/feed.xml", PermPublic},
+	{"GET", "/sitemap.xml", PermPublic},
+	{"GET", "/robots.txt", PermPublic},
+	{"GET", "/api/books", PermPublic},
+	{"GET", "/api/books/:id", PermPublic},
+	{"GET", "/api/books/:id/copies", PermPublic},
+	{"GET", "/api/books/:id/genres", PermPublic},
+	{"GET", "/api/books/:id/related", PermPublic},
+	{"GET", "/api/books/:id/reviews", PermPublic},
+	{"GET", "/api/authors*", PermPublic},
+	{"GET", "/api/branches*", PermPublic},
+	{"GET", "/api/genres*", PermPublic},
+	{"GET", "/api/tags", PermPublic},
+	{"GET", "/api/series*", PermPublic},
+	{"GET", "/api/works*", PermPublic},
+	{"GET", "/api/classification", PermPublic},
+	{"GET", "/api/version", PermPublic},
+
+	{"write", "/api/books*", PermBooksWrite},
+	{"write", "/api/branches*", PermBooksWrite},
+	{"write", "/api/genres*", PermBooksWrite},
+	{"write", "/api/tags*", PermBooksWrite},
+	{"write", "/api/series*", PermBooksWrite},
+	{"write", "/api/works*", PermBooksWrite},
+	{"write", "/api/authors*", PermBooksWrite},
+	{"POST", "/api/reviews/:id/moderate", PermModerate},
+	{"DELETE", "/api/reviews/:id", PermModerate},
+
+	{"*", "/api/users*", PermUsersManage},
+	{"*", "/api/keys*", PermKeysManage},
+	{"*", "/api/admin/*", PermAdminLogRead},
+	{"GET", "/api/audit*", PermAdminLogRead},
+	{"*", "/api/log/level", PermUsersManage},
+	{"GET", "/admin*", PermUsersManage},
+	{"*", "/debug/*", PermUsersManage},
+	{"GET", "/metrics", PermMetricsRead},
+}
+
+func reading(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func (p routePolicy) matches(method string, path string) bool {
+	switch p.method {
+	case "*":
+	case "write":
+		if reading(method) {
+			return false
+		}
+	default:
+		if p.method != method {
+			return false
+		}
+	}
+	if prefix, ok := strings.CutSuffix(p.path, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return p.path == path
+}
+
+// Returns the permission the request takes, given the route it matched.
+func routePermission(method string, path string) Permission {
+	for _, p := range routePolicies {
+		if p.matches(method, path) {
+			return p.perm
+		}
+	}
+	return PermLogin
+}
+
+// Middleware enforcing the policies. Echo already found the route when it
+// runs, which is how the policy of the request is known. The files are open
+// to everybody, unless they are private and the URL is not signed.
+func authorize(signer *URLSigner) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			perm := routePermission(c.Request().Method, c.Path())
+			if perm == PermPublic || (perm == PermFilesRead && signer.Allowed(c)) {
+				return next(c)
+			}
+			return requirePermission(c, next, perm)
+		}
+	}
+}
+
+// Lets the request through if the user has the permission.
+func requirePermission(c echo.Context, next echo.HandlerFunc, perm Permission) error {
+	user, ok := currentUser(c)
+	if !ok {
+		// htmx shows the login form instead, other clients get an error
+		if c.Request().Header.Get("HX-Request") != "" {
+			c.Response().Header().Set("HX-Location", `{"path": "/login", "target": "#page-content"}`)
+		}
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "login required"})
+	}
+	if !can(user, perm) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "missing permission " + string(perm)})
+	}
+	return next(c)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Registers the profiles of Go's net/http/pprof under /debug/pprof, to find
+// out where the memory or the CPU goes on a running server, e.g., with
+// "go tool pprof https://<host>/debug/pprof/heap". They are only there with
+// PPROF=true, and only for the admins (see policies.go), since they tell a
+// lot about the server and taking them slows it down.
+func registerPprofRoutes(e *echo.Echo, cfg Config) {
+	if !cfg.Pprof {
+		return
+	}
+	// The index also serves the profiles by name, e.g., /debug/pprof/heap
+	e.GET("/debug/pprof/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+	e.GET("/debug/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	e.GET("/debug/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	e.GET("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	e.GET("/debug/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+}
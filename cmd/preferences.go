@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The cookie holding the preferences of visitors who are not logged in. The
+// users who are logged in have theirs saved with their account, so they
+// follow them from one computer to the next.
+const preferencesCookie = "prefs"
+
+// The themes of the website. No theme is the light one.
+var themes = []string{"light", "dark"}
+
+// The orders the book table can start with, for the preferences form. The
+// table can still be sorted by any column afterwards.
+var sortChoices = []struct {
+	value string
+	label string
+}{
+	{"", "As added"},
+	{"name", "Book Name"},
+	{"author", "Author"},
+	{"-year", "Newest first"},
+	{"year", "Oldest first"},
+	{"-created", "Recently added"},
+}
+
+// How somebody likes the pages to look: the theme, and the size and the order
+// of the book table when they don't ask for others in the query string.
+type Preferences struct {
+	Theme    string `json:"theme" form:"theme" bson:"theme,omitempty"`
+	PageSize int    `json:"size" form:"size" bson:"pagesize,omitempty"`
+	Sort     string `json:"sort" form:"sort" bson:"sort,omitempty"`
+}
+
+// Checks the preferences, and returns what is wrong, if anything. Empty
+// values mean the defaults.
+func (p Preferences) validate() string {
+	if p.Theme != "" && !slices.Contains(themes, p.Theme) {
+		return "unknown theme"
+	}
+	if p.PageSize != 0 && !slices.Contains(pageSizes, p.PageSize) {
+		return "unknown page size"
+	}
+	if _, ok := bookSort(p.Sort); !ok {
+		return "invalid sort"
+	}
+	return ""
+}
+
+// Returns the preferences of the request: the ones of the user, if they
+// saved any, or else the ones in the cookie. Preferences that don't pass,
+// e.g., a page size that was removed since, are ignored.
+func preferencesOf(c echo.Context) Preferences {
+	if prefs, ok := c.Get("preferences").(Preferences); ok {
+		return prefs
+	}
+	var prefs Preferences
+	if user, ok := currentUser(c); ok && user.UserPreferences != (Preferences{}) {
+		prefs = user.UserPreferences
+	} else if cookie, err := c.Cookie(preferencesCookie); err == nil {
+		if data, err := base64.RawURLEncoding.DecodeString(cookie.Value); err == nil {
+			_ = json.Unmarshal(data, &prefs)
+		}
+	}
+	if prefs.validate() != "" {
+		prefs = Preferences{}
+	}
+	c.Set("preferences", prefs)
+	return prefs
+}
+
+// Registers the preferences form, which saves them with the account of the
+// user, if they are logged in, and in a cookie anyway, and reloads the page
+// to apply them.
+func registerPreferenceRoutes(e *echo.Echo, users *Repository) {
+	e.GET("/preferences", func(c echo.Context) error {
+		prefs := preferencesOf(c)
+		var sorts []map[string]interface{}
+		for _, s := range sortChoices {
+			sorts = append(sorts, map[string]interface{}{"value": s.value, "label": s.label, "selected": s.value == prefs.Sort})
+		}
+		var sizes []map[string]interface{}
+		for _, size := range pageSizes {
+			sizes = append(sizes, map[string]interface{}{"value": size, "selected": size == prefs.PageSize})
+		}
+		return c.Render(http.StatusOK, "preferences", map[string]interface{}{
+			"theme":  prefs.Theme,
+			"themes": themes,
+			"sorts":  sorts,
+			"sizes":  sizes,
+		})
+	})
+
+	e.POST("/preferences", func(c echo.Context) error {
+		var prefs Preferences
+		if err := c.Bind(&prefs); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if msg := prefs.validate(); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		if user, ok := currentUser(c); ok {
+			update := bson.M{"$set": bson.M{"userpreferences": prefs}}
+			if _, err := users.UpdateOne(c.Request().Context(), bson.M{"_id": user.ID}, update); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to save preferences"})
+			}
+		}
+		data, _ := json.Marshal(prefs)
+		c.SetCookie(&http.Cookie{
+			Name:     preferencesCookie,
+			Value:    base64.RawURLEncoding.EncodeToString(data),
+			Path:     "/",
+			MaxAge:   365 * 24 * 3600,
+			HttpOnly: true,
+			Secure:   c.Scheme() == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+		if c.Request().Header.Get("HX-Request") != "" {
+			c.Response().Header().Set("HX-Refresh", "true")
+			return c.NoContent(http.StatusOK)
+		}
+		return c.JSON(http.StatusOK, prefs)
+	})
+}
+
+// The page size of the preferences, or else the default one
+func preferredPageSize(c echo.Context) int {
+	if size := preferencesOf(c).PageSize; size != 0 {
+		return size
+	}
+	return pageSizes[0]
+}
+
+// The order the book table starts with, when the query doesn't pick one
+func preferredSort(c echo.Context) string {
+	if sort := c.QueryParam("sort"); sort != "" {
+		return sort
+	}
+	return preferencesOf(c).Sort
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Filters built from what users send go through a Query, so nobody can
+// sneak operators into them. Say somebody sends {"status": {"$ne": ""}}
+// where we expect a string: put into a filter as it is, it would match every
+// document. A Query only takes the fields it was made for, the comparison
+// operators below, and values of plain types, i.e., strings, numbers, dates,
+// ids and lists of them. A value is always compared with an explicit $eq,
+// so even a string such as "$where" is only ever a string.
+type Query struct {
+	fields []string
+	filter bson.M
+	err    error
+}
+
+var queryOperators = []string{"$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$in", "$nin"}
+
+var errInvalidQuery = errors.New("invalid query")
+
+// Starts a query over the given fields. Only these can be filtered on.
+func newQuery(fields ...string) *Query {
+	return &Query{fields: fields, filter: bson.M{}}
+}
+
+// Adds a condition on a field, e.g., q.Where("bookyear", "$gte", 1990).
+// Conditions on the same field add up.
+func (q *Query) Where(field string, op string, value interface{}) *Query {
+	if q.err != nil {
+		return q
+	}
+	if !slices.Contains(q.fields, field) || !slices.Contains(queryOperators, op) {
+		q.err = errInvalidQuery
+		return q
+	}
+	list := op == "$in" || op == "$nin"
+	if !queryValue(value, list) {
+		q.err = errInvalidQuery
+		return q
+	}
+	cond, ok := q.filter[field].(bson.M)
+	if !ok {
+		cond = bson.M{}
+		q.filter[field] = cond
+	}
+	cond[op] = value
+	return q
+}
+
+func (q *Query) Eq(field string, value interface{}) *Query {
+	return q.Where(field, "$eq", value)
+}
+
+// Matches the whole value of the field with the text, regardless of case.
+// The text is quoted, so it can't be a regular expression of its own.
+func (q *Query) Match(field string, text string) *Query {
+	if q.err != nil {
+		return q
+	}
+	if !slices.Contains(q.fields, field) {
+		q.err = errInvalidQuery
+		return q
+	}
+	q.filter[field] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(text) + "$", Options: "i"}
+	return q
+}
+
+// Matches the documents where one of the fields contains the text,
+// regardless of case, e.g., q.Contains("frank", "bookname", "bookauthor")
+// for Frankenstein. The text is quoted like with Match, and the conditions
+// of several calls all have to hold.
+func (q *Query) Contains(text string, fields ...string) *Query {
+	if q.err != nil {
+		return q
+	}
+	if len(fields) == 0 {
+		q.err = errInvalidQuery
+		return q
+	}
+	pattern := primitive.Regex{Pattern: regexp.QuoteMeta(text), Options: "i"}
+	either := bson.A{}
+	for _, field := range fields {
+		if !slices.Contains(q.fields, field) {
+			q.err = errInvalidQuery
+			return q
+		}
+		either = append(either, bson.M{field: pattern})
+	}
+	all, _ := q.filter["$and"].(bson.A)
+	q.filter["$and"] = append(all, bson.M{"$or": either})
+	return q
+}
+
+// Looks for the words of the text with the text index of the collection,
+// e.g., q.Search("tolkien hobbit"). The text is only ever the $search
+// string of $text, so it can't add conditions of its own.
+func (q *Query) Search(text string) *Query {
+	if q.err == nil {
+		q.filter["$text"] = bson.M{"$search": text}
+	}
+	return q
+}
+
+// Returns the filter, or the error of the first condition that was not
+// allowed.
+func (q *Query) Filter() (bson.M, error) {
+	return q.filter, q.err
+}
+
+// Answers a request whose filter could not be built: with 400 when the query
+// was not allowed, see above, and 500 otherwise.
+func filterFailed(c echo.Context, err error) error {
+	if errors.Is(err, errInvalidQuery) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to filter books"})
+}
+
+// Whether the value is of a plain type, or a list of them for $in and $nin.
+func queryValue(value interface{}, list bool) bool {
+	if list {
+		switch v := value.(type) {
+		case []string, []int, []primitive.ObjectID:
+			return true
+		case bson.A:
+			for _, item := range v {
+				if !queryValue(item, false) {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	}
+	switch value.(type) {
+	case nil, string, bool, int, int32, int64, float64, time.Time, primitive.ObjectID:
+		return true
+	}
+	return false
+}
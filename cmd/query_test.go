@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// What people send in place of a plain value to get around a filter
+var injections = []interface{}{
+	bson.M{"$gt": ""},
+	bson.M{"$ne": nil},
+	bson.M{"$where": "sleep(1000)"},
+	bson.D{{Key: "$gt", Value: ""}},
+	map[string]interface{}{"$regex": ".*"},
+	map[string]string{"$ne": ""},
+	[]interface{}{bson.M{"$gt": ""}},
+	primitive.Regex{Pattern: ".*"},
+	primitive.JavaScript("sleep(1000)"),
+}
+
+func TestQueryRejectsOperatorValues(t *testing.T) {
+	for _, value := range injections {
+		if _, err := newQuery("bookname").Eq("bookname", value).Filter(); !errors.Is(err, errInvalidQuery) {
+			t.Errorf("Eq(%#v): got %v, want errInvalidQuery", value, err)
+		}
+		if _, err := newQuery("bookyear").Where("bookyear", "$gte", value).Filter(); !errors.Is(err, errInvalidQuery) {
+			t.Errorf("Where($gte, %#v): got %v, want errInvalidQuery", value, err)
+		}
+		if _, err := newQuery("booktags").Where("booktags", "$in", bson.A{value}).Filter(); !errors.Is(err, errInvalidQuery) {
+			t.Errorf("Where($in, [%#v]): got %v, want errInvalidQuery", value, err)
+		}
+	}
+}
+
+func TestQueryRejectsOperatorsAndFields(t *testing.T) {
+	for _, op := range []string{"$where", "$regex", "$expr", "$exists", "$or", "gt", ""} {
+		if _, err := newQuery("bookname").Where("bookname", op, "x").Filter(); !errors.Is(err, errInvalidQuery) {
+			t.Errorf("Where(%q): got %v, want errInvalidQuery", op, err)
+		}
+	}
+	for _, field := range []string{"$where", "$or", "bookname.$", "password"} {
+		if _, err := newQuery("bookname").Eq(field, "x").Filter(); !errors.Is(err, errInvalidQuery) {
+			t.Errorf("Eq on %q: got %v, want errInvalidQuery", field, err)
+		}
+		if _, err := newQuery("bookname").Match(field, "x").Filter(); !errors.Is(err, errInvalidQuery) {
+			t.Errorf("Match on %q: got %v, want errInvalidQuery", field, err)
+		}
+		if _, err := newQuery("bookname").Contains("x", "bookname", field).Filter(); !errors.Is(err, errInvalidQuery) {
+			t.Errorf("Contains on %q: got %v, want errInvalidQuery", field, err)
+		}
+	}
+}
+
+func TestQueryKeepsTheFirstError(t *testing.T) {
+	filter, err := newQuery("bookname").Eq("bookname", bson.M{"$gt": ""}).Eq("bookname", "x").Filter()
+	if !errors.Is(err, errInvalidQuery) {
+		t.Fatalf("got %v, want errInvalidQuery", err)
+	}
+	if len(filter) != 0 {
+		t.Errorf("got filter %v, want it empty", filter)
+	}
+}
+
+func TestQueryQuotesStrings(t *testing.T) {
+	filter, err := newQuery("bookname").Eq("bookname", "$where").Filter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{"bookname": bson.M{"$eq": "$where"}}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("Eq: got %v, want %v", filter, want)
+	}
+
+	filter, err = newQuery("bookname").Match("bookname", `.*|$where`).Filter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = bson.M{"bookname": primitive.Regex{Pattern: `^\.\*\|\$where$`, Options: "i"}}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("Match: got %v, want %v", filter, want)
+	}
+
+	filter, err = newQuery("bookname", "bookauthor").Contains(`.*|$where`, "bookname", "bookauthor").Contains("frank", "bookname").Filter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	quoted := primitive.Regex{Pattern: `\.\*\|\$where`, Options: "i"}
+	want = bson.M{"$and": bson.A{
+		bson.M{"$or": bson.A{bson.M{"bookname": quoted}, bson.M{"bookauthor": quoted}}},
+		bson.M{"$or": bson.A{bson.M{"bookname": primitive.Regex{Pattern: "frank", Options: "i"}}}},
+	}}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("Contains: got %v, want %v", filter, want)
+	}
+
+	filter, err = newQuery().Search(`"$where" {"$gt": ""}`).Filter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = bson.M{"$text": bson.M{"$search": `"$where" {"$gt": ""}`}}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("Search: got %v, want %v", filter, want)
+	}
+}
+
+func TestQueryAllowsPlainValues(t *testing.T) {
+	id := primitive.NewObjectID()
+	filter, err := newQuery("bookyear", "bookstatus", "_id").
+		Where("bookyear", "$gte", 1990).
+		Where("bookyear", "$lte", 1999).
+		Where("bookstatus", "$in", bson.A{nil, StatusAvailable}).
+		Eq("_id", id).
+		Filter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{
+		"bookyear":   bson.M{"$gte": 1990, "$lte": 1999},
+		"bookstatus": bson.M{"$in": bson.A{nil, StatusAvailable}},
+		"_id":        bson.M{"$eq": id},
+	}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("got %v, want %v", filter, want)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How much each thing two books have in common counts towards them being
+// related. Genres are a strong hint, a shared tag a weaker one, and every
+// reading list holding both or member who borrowed both adds a little more.
+const (
+	relatedAuthor = 3
+	relatedGenre  = 2
+	relatedTag    = 1
+	relatedList   = 1
+	relatedLoan   = 1
+)
+
+// Scores the other books by what they have in common with the given one,
+// e.g., the scores of "Frankenstein" might end up as {<Dracula>: 5}. The
+// reasons say where the score comes from, to show it to the readers.
+func relatedScores(books []BookStore, book BookStore, bookGenres *Repository, lists *Repository, loans *Repository) (map[primitive.ObjectID]int, map[primitive.ObjectID][]string, error) {
+	scores := map[primitive.ObjectID]int{}
+	reasons := map[primitive.ObjectID][]string{}
+	add := func(id primitive.ObjectID, points int, reason string) {
+		if id == book.ID {
+			return
+		}
+		scores[id] += points
+		if !slices.Contains(reasons[id], reason) {
+			reasons[id] = append(reasons[id], reason)
+		}
+	}
+
+	for _, b := range books {
+		if book.BookAuthor != "" && strings.EqualFold(b.BookAuthor, book.BookAuthor) {
+			add(b.ID, relatedAuthor, "same author")
+		}
+		for _, t := range b.BookTags {
+			if slices.Contains(book.BookTags, t) {
+				add(b.ID, relatedTag, "tag "+t)
+			}
+		}
+	}
+
+	cursor, err := bookGenres.Find(context.TODO(), bson.M{"bookid": book.ID})
+	if err != nil {
+		return nil, nil, err
+	}
+	var own []BookGenre
+	if err = cursor.All(context.TODO(), &own); err != nil {
+		return nil, nil, err
+	}
+	genres := []primitive.ObjectID{}
+	for _, l := range own {
+		genres = append(genres, l.GenreID)
+	}
+	cursor, err = bookGenres.Find(context.TODO(), bson.M{"genreid": bson.M{"$in": genres}})
+	if err != nil {
+		return nil, nil, err
+	}
+	var shared []BookGenre
+	if err = cursor.All(context.TODO(), &shared); err != nil {
+		return nil, nil, err
+	}
+	for _, l := range shared {
+		add(l.BookID, relatedGenre, "same genre")
+	}
+
+	cursor, err = lists.Find(context.TODO(), bson.M{"listbooks": book.ID})
+	if err != nil {
+		return nil, nil, err
+	}
+	var withBook []ReadingList
+	if err = cursor.All(context.TODO(), &withBook); err != nil {
+		return nil, nil, err
+	}
+	for _, l := range withBook {
+		for _, id := range l.ListBooks {
+			add(id, relatedList, "in the same reading lists")
+		}
+	}
+
+	// Readers who borrowed this book, and what else they borrowed. A member
+	// borrowing the same book twice still counts once.
+	readers, err := loans.Distinct(context.TODO(), "loanmember", bson.M{"bookid": book.ID})
+	if err != nil {
+		return nil, nil, err
+	}
+	cursor, err = loans.Find(context.TODO(), bson.M{"loanmember": bson.M{"$in": readers}, "bookid": bson.M{"$ne": book.ID}})
+	if err != nil {
+		return nil, nil, err
+	}
+	var borrowed []Loan
+	if err = cursor.All(context.TODO(), &borrowed); err != nil {
+		return nil, nil, err
+	}
+	seen := map[string]bool{}
+	for _, l := range borrowed {
+		if key := l.LoanMember + "/" + l.BookID.Hex(); !seen[key] {
+			seen[key] = true
+			add(l.BookID, relatedLoan, "readers also borrowed")
+		}
+	}
+	return scores, reasons, nil
+}
+
+// Returns the books most related to the given one, best first. Only books
+// still in the catalogue are suggested.
+func relatedBooks(coll *Repository, bookGenres *Repository, lists *Repository, loans *Repository, book BookStore, limit int) ([]map[string]interface{}, error) {
+	cursor, err := coll.Find(context.TODO(), statusFilter(bson.M{}, ""))
+	if err != nil {
+		return nil, err
+	}
+	var books []BookStore
+	if err = cursor.All(context.TODO(), &books); err != nil {
+		return nil, err
+	}
+
+	scores, reasons, err := relatedScores(books, book, bookGenres, lists, loans)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []BookStore{}
+	for _, b := range books {
+		if scores[b.ID] > 0 {
+			candidates = append(candidates, b)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i].ID] > scores[candidates[j].ID]
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	ret := []map[string]interface{}{}
+	for _, b := range candidates {
+		ret = append(ret, map[string]interface{}{
+			"id":      b.ID.Hex(),
+			"name":    b.BookName,
+			"author":  b.BookAuthor,
+			"cover":   coverURL(b),
+			"score":   scores[b.ID],
+			"reasons": reasons[b.ID],
+		})
+	}
+	return ret, nil
+}
+
+// Registers the endpoint suggesting related books, and the fragment showing
+// them on the page of a book.
+func registerRelatedRoutes(e *echo.Echo, coll *Repository, bookGenres *Repository, lists *Repository, loans *Repository) {
+	related := func(c echo.Context) ([]map[string]interface{}, bool, error) {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return nil, false, c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		limit := 5
+		if value := c.QueryParam("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+				return nil, false, c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+			}
+		}
+
+		var book BookStore
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&book); err != nil {
+			return nil, false, c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+		books, err := relatedBooks(coll, bookGenres, lists, loans, book, limit)
+		if err != nil {
+			return nil, false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to find related books"})
+		}
+		return books, true, nil
+	}
+
+	e.GET("/books/:id/related", func(c echo.Context) error {
+		books, ok, err := related(c)
+		if !ok {
+			return err
+		}
+		return c.Render(200, "related-books", books)
+	})
+
+	e.GET("/api/books/:id/related", func(c echo.Context) error {
+		books, ok, err := related(c)
+		if !ok {
+			return err
+		}
+		return c.JSON(http.StatusOK, books)
+	})
+}
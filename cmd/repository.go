@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The repository is the layer between the handlers and the database. It
+// embeds the collection, so reading works exactly like before, but it
+// overrides the insert and update methods to keep the "createdat" and
+// "updatedat" timestamps of every record up to date. This way no handler
+// has to remember doing it. For the same reason, the repository is also
+// where the writes get recorded in the audit log (see audit.go), and where
+// the records are kept apart from the ones of other libraries (see
+// tenants.go): the reads only see the records of the tenant, and the
+// inserts put its id on them. Every operation is logged at the debug level
+// (see logging.go), and the ones slower than slow as warnings. The writes
+// also empty the cache of the library (see cache.go).
+type Repository struct {
+	*mongo.Collection
+	audit  *Repository
+	tenant string
+	logger *slog.Logger
+	slow   time.Duration
+	cache  Cache
+}
+
+// Matches the records of the tenant of the repository. The default library
+// has no tenant, and neither do its records.
+func (r *Repository) tenantFilter() bson.M {
+	if r.tenant == "" {
+		return bson.M{"tenant": nil}
+	}
+	return bson.M{"tenant": r.tenant}
+}
+
+// Forgets the cached answers, which the write may have changed.
+func (r *Repository) invalidate(ctx context.Context) {
+	if r.cache != nil {
+		r.cache.Clear(ctx)
+	}
+}
+
+// Narrows down a filter to the records of the tenant.
+func (r *Repository) scope(filter interface{}) interface{} {
+	return bson.M{"$and": bson.A{filter, r.tenantFilter()}}
+}
+
+func (r *Repository) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	filter = r.scope(filter)
+	start := time.Now()
+	cursor, err := r.Collection.Find(ctx, filter, opts...)
+	r.logOp(ctx, "find", filter, start, err)
+	return cursor, err
+}
+
+func (r *Repository) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	filter = r.scope(filter)
+	start := time.Now()
+	result := r.Collection.FindOne(ctx, filter, opts...)
+	r.logOp(ctx, "findOne", filter, start, result.Err())
+	return result
+}
+
+func (r *Repository) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	filter = r.scope(filter)
+	start := time.Now()
+	count, err := r.Collection.CountDocuments(ctx, filter, opts...)
+	r.logOp(ctx, "count", filter, start, err)
+	return count, err
+}
+
+func (r *Repository) Distinct(ctx context.Context, fieldName string, filter interface{}, opts ...*options.DistinctOptions) ([]interface{}, error) {
+	filter = r.scope(filter)
+	start := time.Now()
+	values, err := r.Collection.Distinct(ctx, fieldName, filter, opts...)
+	r.logOp(ctx, "distinct", filter, start, err)
+	return values, err
+}
+
+// The pipeline starts with the records of the tenant. The stages joining
+// other collections do so by id, so they stay within the tenant as well.
+func (r *Repository) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	stages, ok := pipeline.(mongo.Pipeline)
+	if !ok {
+		return nil, errors.New("the pipeline must be a mongo.Pipeline")
+	}
+	scoped := append(mongo.Pipeline{{{Key: "$match", Value: r.tenantFilter()}}}, stages...)
+	start := time.Now()
+	cursor, err := r.Collection.Aggregate(ctx, scoped, opts...)
+	r.logOp(ctx, "aggregate", scoped, start, err)
+	return cursor, err
+}
+
+// Converts any document (a struct, a bson.M...) into a bson.M, so we can add
+// fields to it regardless of its type.
+func toBsonM(doc interface{}) (bson.M, error) {
+	if m, ok := doc.(bson.M); ok {
+		return m, nil
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	return m, err
+}
+
+// Adds the timestamps of a new record, keeping the ones it might already have.
+func stampNew(doc interface{}) (bson.M, error) {
+	m, err := toBsonM(doc)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if _, ok := m["createdat"]; !ok {
+		m["createdat"] = now
+	}
+	m["updatedat"] = now
+	return m, nil
+}
+
+// Adds the "updatedat" timestamp to an update, next to whatever it already
+// sets. In case the update creates the record (an upsert), "createdat" is
+// filled in as well.
+func stampUpdate(update interface{}) (interface{}, error) {
+	m, ok := update.(bson.M)
+	if !ok {
+		return update, nil
+	}
+	now := time.Now().UTC()
+
+	set := bson.M{}
+	if current, ok := m["$set"]; ok {
+		var err error
+		if set, err = toBsonM(current); err != nil {
+			return nil, err
+		}
+	}
+	set["updatedat"] = now
+	// Setting a field that is also being set on insert is a conflict
+	delete(set, "createdat")
+
+	stamped := bson.M{}
+	for k, v := range m {
+		stamped[k] = v
+	}
+	stamped["$set"] = set
+	stamped["$setOnInsert"] = bson.M{"createdat": now}
+	return stamped, nil
+}
+
+func (r *Repository) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	doc, err := stampNew(document)
+	if err != nil {
+		return nil, err
+	}
+	if r.tenant != "" {
+		doc["tenant"] = r.tenant
+	}
+	start := time.Now()
+	result, err := r.Collection.InsertOne(ctx, doc, opts...)
+	r.logOp(ctx, "insertOne", nil, start, err)
+	if err == nil {
+		r.invalidate(ctx)
+		r.record(ctx, AuditCreate, nil, r.findByID(ctx, result.InsertedID))
+	}
+	return result, err
+}
+
+func (r *Repository) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	stamped, err := stampUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+	filter = r.scope(filter)
+	before := r.snapshot(ctx, filter, true)
+	start := time.Now()
+	result, err := r.Collection.UpdateOne(ctx, filter, stamped, opts...)
+	r.logOp(ctx, "updateOne", filter, start, err)
+	if err == nil {
+		r.invalidate(ctx)
+		r.recordUpdate(ctx, before, result)
+	}
+	return result, err
+}
+
+func (r *Repository) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	stamped, err := stampUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+	filter = r.scope(filter)
+	before := r.snapshot(ctx, filter, false)
+	start := time.Now()
+	result, err := r.Collection.UpdateMany(ctx, filter, stamped, opts...)
+	r.logOp(ctx, "updateMany", filter, start, err)
+	if err == nil {
+		r.invalidate(ctx)
+		r.recordUpdate(ctx, before, result)
+	}
+	return result, err
+}
+
+// Replacing keeps the "createdat" of the document if it has one, as it is
+// usually a record we read before and then changed.
+func (r *Repository) ReplaceOne(ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	doc, err := toBsonM(replacement)
+	if err != nil {
+		return nil, err
+	}
+	doc["updatedat"] = time.Now().UTC()
+	if r.tenant != "" {
+		doc["tenant"] = r.tenant
+	}
+	filter = r.scope(filter)
+	before := r.snapshot(ctx, filter, true)
+	start := time.Now()
+	result, err := r.Collection.ReplaceOne(ctx, filter, doc, opts...)
+	r.logOp(ctx, "replaceOne", filter, start, err)
+	if err == nil {
+		r.invalidate(ctx)
+		r.recordUpdate(ctx, before, result)
+	}
+	return result, err
+}
+
+// FindOneAndUpdate returns a SingleResult rather than an error, so a failure
+// to stamp the update is reported through it, just like the driver does.
+// We always ask the database for the document as it was before the update,
+// for the audit log, and read it again afterwards if the caller wanted the
+// updated one.
+func (r *Repository) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	stamped, err := stampUpdate(update)
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	filter = r.scope(filter)
+	start := time.Now()
+	if r.audit == nil {
+		result := r.Collection.FindOneAndUpdate(ctx, filter, stamped, opts...)
+		r.logOp(ctx, "findOneAndUpdate", filter, start, result.Err())
+		if result.Err() == nil {
+			r.invalidate(ctx)
+		}
+		return result
+	}
+	merged := options.MergeFindOneAndUpdateOptions(opts...)
+	wantAfter := merged.ReturnDocument != nil && *merged.ReturnDocument == options.After
+	merged.SetReturnDocument(options.Before)
+
+	var before bson.M
+	err = r.Collection.FindOneAndUpdate(ctx, filter, stamped, merged).Decode(&before)
+	r.logOp(ctx, "findOneAndUpdate", filter, start, err)
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	r.invalidate(ctx)
+	after := r.findByID(ctx, before["_id"])
+	r.record(ctx, AuditUpdate, before, after)
+	if wantAfter {
+		return mongo.NewSingleResultFromDocument(after, nil, nil)
+	}
+	return mongo.NewSingleResultFromDocument(before, nil, nil)
+}
+
+func (r *Repository) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	filter = r.scope(filter)
+	before := r.snapshot(ctx, filter, true)
+	start := time.Now()
+	result, err := r.Collection.DeleteOne(ctx, filter, opts...)
+	r.logOp(ctx, "deleteOne", filter, start, err)
+	if err == nil && result.DeletedCount > 0 {
+		r.invalidate(ctx)
+		r.recordAll(ctx, AuditDelete, before)
+	}
+	return result, err
+}
+
+func (r *Repository) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	filter = r.scope(filter)
+	before := r.snapshot(ctx, filter, false)
+	start := time.Now()
+	result, err := r.Collection.DeleteMany(ctx, filter, opts...)
+	r.logOp(ctx, "deleteMany", filter, start, err)
+	if err == nil && result.DeletedCount > 0 {
+		r.invalidate(ctx)
+		r.recordAll(ctx, AuditDelete, before)
+	}
+	return result, err
+}
+
+// Records an update, or the creation of a document in case of an upsert.
+func (r *Repository) recordUpdate(ctx context.Context, before []bson.M, result *mongo.UpdateResult) {
+	if result.UpsertedID != nil {
+		r.record(ctx, AuditCreate, nil, r.findByID(ctx, result.UpsertedID))
+		return
+	}
+	if result.ModifiedCount > 0 {
+		r.recordAll(ctx, AuditUpdate, before)
+	}
+}
+
+// Formats a timestamp for the API responses. Records written before the
+// timestamps existed don't have them, and get an empty string instead.
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The request IDs we take from the clients, or the proxy in front of us.
+// Anything else could mess up the logs, so it gets a new one instead.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Gives every request an ID, the one of the X-Request-ID header when the
+// client or the proxy already sent one, and sends it back in the same
+// header. The logs of the request carry it (see requestLogger), and so do
+// the errors (see handleError), so a problem somebody reports can be found
+// in the logs. It must come before requestLogger.
+func requestIDs(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(echo.HeaderXRequestID)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+			c.Request().Header.Set(echo.HeaderXRequestID, id)
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+		return next(c)
+	}
+}
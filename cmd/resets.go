@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A request to set a new password, for somebody who forgot theirs. We email
+// a link with a random token, which works once and only for a while. Like
+// the other tokens, only its hash is stored.
+type PasswordReset struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	ResetUser    primitive.ObjectID `bson:"resetuser"`
+	ResetToken   string             `bson:"resettoken"`
+	ResetExpires time.Time          `bson:"resetexpires"`
+	ResetUsed    *time.Time         `bson:"resetused,omitempty"`
+}
+
+// Renders the page to set a new password. It is a page of its own, rather
+// than a part of the index page, as people land on it from their email.
+func resetPage(c echo.Context, status int, token string, message string, done bool) error {
+	return c.Render(status, "reset-password", map[string]interface{}{
+		"token":   token,
+		"message": message,
+		"done":    done,
+		"csrf":    csrfToken(c),
+	})
+}
+
+// Registers the pages to ask for a reset link and to set the new password.
+func registerResetRoutes(e *echo.Echo, cfg Config, mailer *Mailer, sessions *Sessions, guard *LoginGuard, users *Repository, coll *Repository) {
+	e.GET("/password/forgot", func(c echo.Context) error {
+		return c.Render(200, "forgot-password", nil)
+	})
+
+	// The answer is the same whether there is a user with the email or not,
+	// so nobody can find out who has an account this way
+	e.POST("/password/forgot", func(c echo.Context) error {
+		sent := func() error {
+			return c.Render(200, "forgot-password", map[string]string{"message": "If the email is registered, a link to set a new password is on its way."})
+		}
+		user, err := findUserByEmail(users, c.FormValue("email"))
+		if err != nil {
+			return sent()
+		}
+
+		token, hash, err := newSecretToken()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create token"})
+		}
+		reset := PasswordReset{
+			ID:           primitive.NewObjectID(),
+			ResetUser:    user.ID,
+			ResetToken:   hash,
+			ResetExpires: time.Now().UTC().Add(time.Duration(cfg.ResetTokenMinutes) * time.Minute),
+		}
+		if _, err = coll.InsertOne(c.Request().Context(), reset); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create token"})
+		}
+
+		link := c.Scheme() + "://" + c.Request().Host + "/password/reset?token=" + token
+		body := fmt.Sprintf("Hello %s,\n\nsomebody, hopefully you, asked to set a new password for your account. "+
+			"To do so, open this link within %d minutes:\n\n%s\n\nIf it wasn't you, just ignore this email.\n",
+			user.UserName, cfg.ResetTokenMinutes, link)
+		if err = mailer.Send(user.UserEmail, "Set a new password", body); err != nil {
+			loggerFrom(c.Request().Context()).Error("failed to send reset link", "email", user.UserEmail, "err", err)
+		}
+		return sent()
+	})
+
+	e.GET("/password/reset", func(c echo.Context) error {
+		return resetPage(c, 200, c.QueryParam("token"), "", false)
+	})
+
+	e.POST("/password/reset", func(c echo.Context) error {
+		token := c.FormValue("token")
+		hash, msg := hashPassword(c.FormValue("password"))
+		if msg != "" {
+			return resetPage(c, http.StatusBadRequest, token, msg, false)
+		}
+
+		// Using the token and checking it is still good happens in one go, so
+		// it can't be used twice at the same time
+		now := time.Now().UTC()
+		var reset PasswordReset
+		filter := bson.M{"resettoken": hashToken(token), "resetused": bson.M{"$exists": false}, "resetexpires": bson.M{"$gt": now}}
+		err := coll.FindOneAndUpdate(c.Request().Context(), filter, bson.M{"$set": bson.M{"resetused": now}}).Decode(&reset)
+		if err != nil {
+			return resetPage(c, http.StatusBadRequest, "", "The link is invalid or expired, please ask for a new one.", false)
+		}
+
+		var user User
+		if err = users.FindOne(context.TODO(), bson.M{"_id": reset.ResetUser}).Decode(&user); err != nil {
+			return resetPage(c, http.StatusBadRequest, "", "The link is invalid or expired, please ask for a new one.", false)
+		}
+		if _, err = users.UpdateOne(c.Request().Context(), bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"userpassword": hash}, "$inc": bson.M{"usertokenversion": 1}}); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update user"})
+		}
+		// Whoever forgot the password may well have locked the account trying,
+		// and whoever knew the old one is logged out, their API tokens
+		// revoked along with the password
+		guard.Succeed(c.Request().Context(), user.UserEmail)
+		if err = sessions.store.DeleteUser(c.Request().Context(), user.ID); err != nil {
+			loggerFrom(c.Request().Context()).Error("failed to end sessions", "email", user.UserEmail, "err", err)
+		}
+		return resetPage(c, 200, "", "Your password was changed, you can log in with it now.", true)
+	})
+}
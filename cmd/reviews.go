@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A review of a book with a star rating from 1 to 5. New reviews wait for a
+// moderator to approve them before they are shown or counted.
+type Review struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty"`
+	BookID         primitive.ObjectID `bson:"bookid"`
+	ReviewRating   int                `json:"rating" form:"rating"`
+	ReviewText     string             `json:"text" form:"text"`
+	ReviewReviewer string             `json:"reviewer" form:"reviewer"`
+	ReviewStatus   string             `json:"-" form:"-"`
+	ReviewCreated  time.Time          `json:"-" form:"-"`
+}
+
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+func reviewToMap(r Review) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       r.ID.Hex(),
+		"book":     r.BookID.Hex(),
+		"rating":   r.ReviewRating,
+		"text":     r.ReviewText,
+		"reviewer": r.ReviewReviewer,
+		"status":   r.ReviewStatus,
+		"created":  r.ReviewCreated.Format(time.RFC3339),
+	}
+}
+
+func findReviews(coll *Repository, filter bson.M) ([]map[string]interface{}, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "reviewcreated", Value: -1}})
+	cursor, err := coll.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []Review
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	ret := []map[string]interface{}{}
+	for _, r := range results {
+		ret = append(ret, reviewToMap(r))
+	}
+	return ret, nil
+}
+
+// The average rating (rounded to one decimal) and the number of reviews of
+// a book. Only approved reviews count.
+type bookRating struct {
+	average float64
+	count   int
+}
+
+// The ratings of the reviewed books, by the hex of their id
+func ratingsByBook(coll *Repository) (map[string]bookRating, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "reviewstatus", Value: ReviewApproved}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$bookid"},
+			{Key: "average", Value: bson.D{{Key: "$avg", Value: "$reviewrating"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	}
+	cursor, err := coll.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		BookID  primitive.ObjectID `bson:"_id"`
+		Average float64            `bson:"average"`
+		Count   int                `bson:"count"`
+	}
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	ratings := map[string]bookRating{}
+	for _, r := range results {
+		ratings[r.BookID.Hex()] = bookRating{average: math.Round(r.Average*10) / 10, count: r.Count}
+	}
+	return ratings, nil
+}
+
+// Adds the average rating (rounded to one decimal) and the number of reviews
+// to the books we are about to return. Only approved reviews count.
+func addRatings(coll *Repository, books []map[string]interface{}) error {
+	ratings, err := ratingsByBook(coll)
+	if err != nil {
+		return err
+	}
+	fillRatings(books, ratings)
+	return nil
+}
+
+// Adds the ratings of ratingsByBook to the books, e.g., to one batch after
+// the other when streaming them (see stream.go).
+func fillRatings(books []map[string]interface{}, ratings map[string]bookRating) {
+	for _, b := range books {
+		r := ratings[b["id"].(string)]
+		b["rating"] = r.average
+		b["reviews"] = r.count
+	}
+}
+
+// Registers the endpoints to write, list and moderate reviews, and the
+// fragment showing the reviews of a book.
+func registerReviewRoutes(e *echo.Echo, books *Repository, coll *Repository) {
+	e.GET("/books/:id/reviews", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		reviews, err := findReviews(coll, bson.M{"bookid": id, "reviewstatus": ReviewApproved})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list reviews"})
+		}
+		summary := []map[string]interface{}{{"id": id.Hex()}}
+		if err = addRatings(coll, summary); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list reviews"})
+		}
+
+		return c.Render(200, "book-reviews", map[string]interface{}{
+			"id":      id.Hex(),
+			"rating":  summary[0]["rating"],
+			"count":   summary[0]["reviews"],
+			"reviews": reviews,
+		})
+	})
+
+	e.GET("/api/books/:id/reviews", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		reviews, err := findReviews(coll, bson.M{"bookid": id, "reviewstatus": ReviewApproved})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list reviews"})
+		}
+		return c.JSON(http.StatusOK, reviews)
+	})
+
+	e.POST("/api/books/:id/reviews", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		review := new(Review)
+		if err := c.Bind(review); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if err = books.FindOne(context.TODO(), bson.M{"_id": id}).Err(); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+
+		review.ReviewText = strings.TrimSpace(review.ReviewText)
+		review.ReviewReviewer = strings.TrimSpace(review.ReviewReviewer)
+		if review.ReviewRating < 1 || review.ReviewRating > 5 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "rating must be between 1 and 5"})
+		}
+		if review.ReviewReviewer == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "reviewer is required"})
+		}
+
+		review.ID = primitive.NewObjectID()
+		review.BookID = id
+		review.ReviewStatus = ReviewPending
+		review.ReviewCreated = time.Now().UTC()
+		if _, err = coll.InsertOne(c.Request().Context(), review); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert review"})
+		}
+		return c.JSON(http.StatusOK, reviewToMap(*review))
+	})
+
+	// The moderation queue: by default the reviews waiting for approval
+	e.GET("/api/reviews", func(c echo.Context) error {
+		status := c.QueryParam("status")
+		if status == "" {
+			status = ReviewPending
+		}
+
+		filter, err := newQuery("reviewstatus").Eq("reviewstatus", status).Filter()
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		reviews, err := findReviews(coll, filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list reviews"})
+		}
+		return c.JSON(http.StatusOK, reviews)
+	})
+
+	e.POST("/api/reviews/:id/moderate", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var req struct {
+			Status string `json:"status" form:"status"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if req.Status != ReviewApproved && req.Status != ReviewRejected {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "status must be approved or rejected"})
+		}
+
+		result, err := coll.UpdateOne(c.Request().Context(), bson.M{"_id": id}, bson.M{"$set": bson.M{"reviewstatus": req.Status}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to moderate review"})
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "review not found"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.DELETE("/api/reviews/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		result, err := coll.DeleteOne(c.Request().Context(), bson.M{"_id": id})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete review"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
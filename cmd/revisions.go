@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The revisions of a book are simply the versions the audit log recorded
+// after each write, oldest first. Revision 1 is the book as it was created,
+// and every edit since added one more.
+func bookRevisions(audit *Repository, id primitive.ObjectID) ([]AuditEntry, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "audittime", Value: 1}})
+	cursor, err := audit.Find(context.TODO(), bson.M{
+		"auditcollection": booksCollection,
+		"auditrecord":     id,
+		"auditafter":      bson.M{"$exists": true},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []AuditEntry
+	err = cursor.All(context.TODO(), &results)
+	return results, err
+}
+
+func revisionToMap(rev int, a AuditEntry) map[string]interface{} {
+	var book BookStore
+	if data, err := bson.Marshal(a.AuditAfter); err == nil {
+		bson.Unmarshal(data, &book)
+	}
+	return map[string]interface{}{
+		"rev":     rev,
+		"time":    a.AuditTime.Format(time.RFC3339),
+		"actor":   a.AuditActor,
+		"action":  a.AuditAction,
+		"changes": a.AuditChanges,
+		"book": map[string]interface{}{
+			"name":     book.BookName,
+			"author":   book.BookAuthor,
+			"isbn":     book.BookISBN,
+			"pages":    book.BookPages,
+			"year":     book.BookYear,
+			"tags":     book.BookTags,
+			"language": book.BookLanguage,
+		},
+	}
+}
+
+// Registers the endpoints to review the revisions of a book and roll back to
+// one of them.
+func registerRevisionRoutes(e *echo.Echo, coll *Repository, audit *Repository, cfg Config) {
+	e.GET("/api/books/:id/revisions", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		revisions, err := bookRevisions(audit, id)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list revisions"})
+		}
+		ret := []map[string]interface{}{}
+		for i, a := range revisions {
+			ret = append(ret, revisionToMap(i+1, a))
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	// Restoring works for deleted books too: they are simply created again.
+	// Restoring is a write like any other, so it adds a revision itself and
+	// can be undone the same way.
+	e.POST("/api/books/:id/revisions/:rev/restore", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		rev, err := strconv.Atoi(c.Param("rev"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid revision"})
+		}
+
+		revisions, err := bookRevisions(audit, id)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list revisions"})
+		}
+		if rev < 1 || rev > len(revisions) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "revision not found"})
+		}
+
+		doc := revisions[rev-1].AuditAfter
+		delete(doc, "updatedat")
+		// The cover file is removed along with the book, so it might be gone
+		if cover, ok := doc["bookcover"].(string); ok {
+			if _, err = os.Stat(filepath.Join(cfg.CoversPath, cover)); err != nil {
+				delete(doc, "bookcover")
+			}
+		}
+
+		_, err = coll.ReplaceOne(c.Request().Context(), bson.M{"_id": id}, doc, options.Replace().SetUpsert(true))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to restore revision"})
+		}
+		return c.JSON(http.StatusOK, revisionToMap(rev, revisions[rev-1]))
+	})
+}
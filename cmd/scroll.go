@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Where the rows of the book table stopped: the value of the sort field of
+// the last row, and its id, for the rows of the same value. The next rows
+// are the ones after it, so rows added or removed meanwhile don't shift the
+// next batch the way skipping a number of rows would.
+type scrollCursor struct {
+	Value interface{}        `bson:"v"`
+	ID    primitive.ObjectID `bson:"id"`
+}
+
+// The cursor travels in the query string. It's encoded as BSON, so the value
+// keeps its type, e.g., a date stays a date.
+func (cur scrollCursor) encode() string {
+	data, _ := bson.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (scrollCursor, bool) {
+	var cur scrollCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || bson.Unmarshal(data, &cur) != nil || cur.ID.IsZero() {
+		return cur, false
+	}
+	return cur, true
+}
+
+// The books after the cursor, in the order of the field. Books without the
+// field come first in ascending order and last in descending order, the way
+// MongoDB sorts them, and comparing with them needs a condition of its own.
+func afterCursor(field string, order int, cur scrollCursor) bson.M {
+	op := "$gt"
+	if order < 0 {
+		op = "$lt"
+	}
+	if field == "_id" {
+		return bson.M{"_id": bson.M{op: cur.ID}}
+	}
+	if cur.Value == nil {
+		same := bson.M{field: nil, "_id": bson.M{op: cur.ID}}
+		if order < 0 {
+			return same
+		}
+		return bson.M{"$or": bson.A{same, bson.M{field: bson.M{"$ne": nil}}}}
+	}
+	after := bson.A{
+		bson.M{field: bson.M{op: cur.Value}},
+		bson.M{field: cur.Value, "_id": bson.M{op: cur.ID}},
+	}
+	if order < 0 {
+		after = append(after, bson.M{field: nil})
+	}
+	return bson.M{"$or": after}
+}
+
+// The address of the rows after the book, with the filters and the sort of
+// the query, or "" when it was the last one.
+func nextRowsURL(c echo.Context, coll *Repository, filter bson.M, field string, order int, last string) (string, error) {
+	id, err := primitive.ObjectIDFromHex(last)
+	if err != nil {
+		return "", err
+	}
+	var doc bson.M
+	if err = coll.FindOne(context.TODO(), bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{field: 1})).Decode(&doc); err != nil {
+		return "", err
+	}
+	cur := scrollCursor{Value: doc[field], ID: id}
+	more, err := coll.CountDocuments(context.TODO(), bson.M{"$and": bson.A{filter, afterCursor(field, order, cur)}}, options.Count().SetLimit(1))
+	if err != nil || more == 0 {
+		return "", err
+	}
+
+	query := bookExportQuery(c)
+	if size := c.QueryParam("size"); size != "" {
+		query.Set("size", size)
+	}
+	query.Set("cursor", cur.encode())
+	return "/books/rows?" + query.Encode(), nil
+}
+
+// The field and the order of the rows: the sort of the query or of the
+// preferences, or the order the books were added.
+func scrollOrder(c echo.Context) (string, int, bool) {
+	sortBy := preferredSort(c)
+	if sortBy == "" {
+		return "_id", 1, true
+	}
+	return bookSortKey(sortBy)
+}
+
+// Registers the endpoint returning the next rows of the book table, e.g.,
+// /books/rows?cursor=<cursor>&genre=<id>, for the table to add as it
+// scrolls down. The last row asks for the ones after it as soon as it shows.
+func registerScrollRoutes(e *echo.Echo, coll *Repository, copies *Repository, filter func(echo.Context) (bson.M, error)) {
+	e.GET("/books/rows", func(c echo.Context) error {
+		cur, ok := decodeCursor(c.QueryParam("cursor"))
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid cursor"})
+		}
+		field, order, ok := scrollOrder(c)
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid sort"})
+		}
+		books, err := filter(c)
+		if err != nil {
+			return filterFailed(c, err)
+		}
+
+		opts := options.Find().SetLimit(int64(pageFrom(c).Size))
+		if field == "_id" {
+			opts.SetSort(bson.D{{Key: "_id", Value: order}})
+		} else {
+			opts.SetSort(bson.D{{Key: field, Value: order}, {Key: "_id", Value: order}})
+		}
+		rows := findAllBooks(coll, bson.M{"$and": bson.A{books, afterCursor(field, order, cur)}}, opts)
+		scope, _ := branchFilter(c, bson.M{}, "copybranch")
+		if err = addAvailability(copies, rows, scope); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count copies"})
+		}
+
+		next := ""
+		if len(rows) > 0 {
+			if next, err = nextRowsURL(c, coll, books, field, order, rows[len(rows)-1]["id"].(string)); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to find the next books"})
+			}
+		}
+		return c.Render(http.StatusOK, "book-rows", map[string]interface{}{
+			"books": rows,
+			"next":  next,
+		})
+	})
+}
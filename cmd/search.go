@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How many books the search shows at most, so typing a single letter does
+// not send the whole catalogue.
+const searchLimit = 50
+
+// Splits what was typed into words, e.g., "tolkien  hobbit" into "tolkien"
+// and "hobbit". Quotes and leading dashes are left out, as $text would make
+// phrases of the words between quotes and leave out the books having the
+// words after a dash. Parts of ISBNs, e.g., "978-0-261", are kept to their
+// digits, which is how the books have them (see normalizeISBN).
+func searchTerms(q string) []string {
+	var terms []string
+	for _, term := range strings.Fields(strings.ReplaceAll(q, `"`, " ")) {
+		if isbnLike(term) {
+			term = strings.ReplaceAll(term, "-", "")
+		}
+		if term = strings.TrimLeft(term, "-"); term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// Whether the text could be an ISBN, or a part of one
+func isbnLike(text string) bool {
+	return strings.ContainsAny(text, "0123456789") && strings.Trim(strings.ToUpper(text), "0123456789-X") == ""
+}
+
+// The filters the search tries, one after the other, until one of them
+// finds books:
+//
+//   - An ISBN, of 10 or 13 digits, with or without its dashes, finds its
+//     book.
+//   - The words are looked up with the text index (see indexes.go), which
+//     holds the words of the name, the author and the description of the
+//     books, regardless of case and of their ending, so "tolkien hobbits"
+//     finds The Hobbit by J. R. R. Tolkien. The books having most of the
+//     words come first, see searchSort.
+//   - The index only knows whole words, so while a word is still being typed,
+//     e.g., "frank", the books whose name or author contain every word, or
+//     whose ISBN contains the digits typed, are found instead.
+func searchFilters(terms []string) ([]bson.M, error) {
+	var filters []bson.M
+	typed := strings.Join(terms, "")
+	if key := normalizeISBN(typed); len(key) == 13 && isbnLike(typed) {
+		filter, err := newQuery("bookisbnkey").Eq("bookisbnkey", key).Filter()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+
+	filter, err := newQuery().Search(strings.Join(terms, " ")).Filter()
+	if err != nil {
+		return nil, err
+	}
+	filters = append(filters, filter)
+
+	query := newQuery("bookname", "bookauthor", "bookisbnkey")
+	for _, term := range terms {
+		if isbnLike(term) {
+			query.Contains(strings.ToUpper(term), "bookname", "bookauthor", "bookisbnkey")
+		} else {
+			query.Contains(term, "bookname", "bookauthor")
+		}
+	}
+	if filter, err = query.Filter(); err != nil {
+		return nil, err
+	}
+	return append(filters, filter), nil
+}
+
+// The best matches of the words first, see searchFilters, then by name
+func searchSort(filter bson.M) bson.D {
+	if _, ok := filter["$text"]; ok {
+		return bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "bookname", Value: 1}}
+	}
+	return bson.D{{Key: "bookname", Value: 1}}
+}
+
+// Wraps the words found in the text in <mark>, for the template, e.g.,
+// {{ highlight .name $.terms }}. The rest of the text is escaped, as the
+// template would do it.
+func highlight(text string, terms []string) template.HTML {
+	if len(terms) == 0 {
+		return template.HTML(template.HTMLEscapeString(text))
+	}
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	re := regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringIndex(text, -1) {
+		b.WriteString(template.HTMLEscapeString(text[last:m[0]]))
+		b.WriteString("<mark>" + template.HTMLEscapeString(text[m[0]:m[1]]) + "</mark>")
+		last = m[1]
+	}
+	b.WriteString(template.HTMLEscapeString(text[last:]))
+	return template.HTML(b.String())
+}
+
+// Registers the endpoint behind the search bar. It answers with the rows of
+// the matching books only, which htmx puts below the bar while typing. The
+// rows are cached until a write, as the same words are often looked for
+// (see cache.go).
+func registerSearchRoutes(e *echo.Echo, coll *Repository, cache Cache, templates *Template) {
+	e.GET("/search", func(c echo.Context) error {
+		return c.Render(http.StatusOK, "search-bar", nil)
+	})
+
+	e.GET("/books/search", func(c echo.Context) error {
+		key := bookCacheKey(c, "search", requestLocale(c, templates.Locales()))
+		if cache != nil {
+			if body, ok := cache.Get(c.Request().Context(), key); ok {
+				return c.HTMLBlob(http.StatusOK, body)
+			}
+		}
+
+		terms := searchTerms(c.QueryParam("q"))
+		var books []map[string]interface{}
+		if len(terms) > 0 {
+			filters, err := searchFilters(terms)
+			if err != nil {
+				return filterFailed(c, err)
+			}
+			for _, filter := range filters {
+				opts := options.Find().SetLimit(searchLimit).SetSort(searchSort(filter))
+				if books = findAllBooks(coll, filter, opts); len(books) > 0 {
+					break
+				}
+			}
+		}
+		data := map[string]interface{}{
+			"books": books,
+			"terms": terms,
+			"limit": searchLimit,
+		}
+		if cache == nil {
+			return c.Render(http.StatusOK, "search-results", data)
+		}
+		var body bytes.Buffer
+		if err := c.Echo().Renderer.Render(&body, "search-results", data, c); err != nil {
+			return err
+		}
+		cache.Set(c.Request().Context(), key, body.Bytes())
+		return c.HTMLBlob(http.StatusOK, body.Bytes())
+	})
+}
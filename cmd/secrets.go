@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Passwords, keys and the like should not live in the code, nor necessarily
+// in plain environment variables. Each secret setting, e.g., MONGO_URI, can
+// come from:
+//   - the environment variable itself,
+//   - a file named by the variable with _FILE appended, e.g.,
+//     MONGO_URI_FILE=/run/secrets/mongo_uri, which is how Docker and
+//     Kubernetes mount their secrets,
+//   - HashiCorp Vault, a key with the same name in the secret at
+//     VAULT_SECRET_PATH (a KV version 2 path such as secret/data/library),
+//     when VAULT_ADDR and VAULT_TOKEN are set.
+//
+// in that order.
+type Secrets struct {
+	vault map[string]string
+}
+
+// Reads the secrets from Vault, if there is one. A Vault we can't read from
+// stops the server, as it would not work without its secrets anyway.
+func loadSecrets() Secrets {
+	addr, token := os.Getenv("VAULT_ADDR"), readSecretFile("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return Secrets{}
+	}
+	vault, err := readVault(strings.TrimSuffix(addr, "/"), token, getEnv("VAULT_SECRET_PATH", "secret/data/library"))
+	if err != nil {
+		fatal("failed to read the secrets from vault", "err", err)
+	}
+	return Secrets{vault: vault}
+}
+
+// Returns the value of the environment variable, or the content of the file
+// the _FILE variable points to.
+func readSecretFile(key string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fatal("failed to read secret file", "variable", key+"_FILE", "err", err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func readVault(addr string, token string, path string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault answered %s", resp.Status)
+	}
+
+	var body struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Data.Data, nil
+}
+
+// Returns the secret, or the fallback when it is set nowhere.
+func (s Secrets) get(key string, fallback string) string {
+	if value := readSecretFile(key); value != "" {
+		return value
+	}
+	if value := s.vault[key]; value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Puts the password, when given separately, into the URI of the database.
+func mongoURI(uri string, password string) string {
+	if password == "" {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.User == nil {
+		return uri
+	}
+	u.User = url.UserPassword(u.User.Username(), password)
+	return u.String()
+}
+
+// Hides the password of the URI, so it can be logged.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "(invalid uri)"
+	}
+	return u.Redacted()
+}
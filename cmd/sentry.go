@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The headers and the parameters of the query that may hold secrets or
+// personal data, which are never sent to Sentry
+var (
+	sentryScrubbedHeaders = []string{"Authorization", "Cookie", "Referer", "X-Api-Key", "X-Csrf-Token", "X-Forwarded-For", "X-Real-Ip"}
+	sentryScrubbedParams  = []string{"token", "password", "code", "key", "secret", "email", "state"}
+)
+
+// Reports the panics and the answers with a 5xx status to Sentry, or to a
+// service speaking its protocol, like GlitchTip. The events are sent in the
+// background, with at most sentryQueue of them waiting, and only a share
+// of them (SENTRY_SAMPLE_RATE) to keep to a quota. They tell the request and
+// the id of the user, but none of the cookies, tokens, emails or IP
+// addresses.
+type Sentry struct {
+	endpoint    string
+	key         string
+	dsn         string
+	environment string
+	release     string
+	sampleRate  float64
+	client      *http.Client
+	events      chan map[string]interface{}
+}
+
+const sentryQueue = 100
+
+var (
+	sentryOnce   sync.Once
+	sentryShared *Sentry
+	sentryErr    error
+)
+
+// The reporter of the deployment, shared by the libraries of all tenants,
+// or nil without SENTRY_DSN. The DSN reads like
+// https://<key>@<host>/<project>, as Sentry shows it in the settings of the
+// project.
+func sentryFor(cfg Config) (*Sentry, error) {
+	sentryOnce.Do(func() {
+		if cfg.SentryDSN == "" {
+			return
+		}
+		dsn, err := url.Parse(cfg.SentryDSN)
+		if err != nil || dsn.User == nil || dsn.Host == "" {
+			sentryErr = errors.New("SENTRY_DSN is not a valid DSN")
+			return
+		}
+		// Sentry may be served under a path, which comes before the project
+		prefix, project := "", strings.Trim(dsn.Path, "/")
+		if i := strings.LastIndex(project, "/"); i >= 0 {
+			prefix, project = "/"+project[:i], project[i+1:]
+		}
+		if project == "" {
+			sentryErr = errors.New("SENTRY_DSN has no project")
+			return
+		}
+		sentryShared = &Sentry{
+			endpoint:    dsn.Scheme + "://" + dsn.Host + prefix + "/api/" + project + "/envelope/",
+			key:         dsn.User.Username(),
+			dsn:         cfg.SentryDSN,
+			environment: cfg.SentryEnvironment,
+			release:     cfg.SentryRelease,
+			sampleRate:  cfg.SentrySampleRate,
+			client:      &http.Client{Timeout: 10 * time.Second},
+			events:      make(chan map[string]interface{}, sentryQueue),
+		}
+		go sentryShared.send()
+	})
+	return sentryShared, sentryErr
+}
+
+// Reports the panics of the handlers, and the requests answered with a 5xx
+// status. It must come after middleware.Recover, which answers the panics
+// once they are reported.
+func (s *Sentry) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		defer func() {
+			if r := recover(); r != nil {
+				// Called while panicking, so the stack goes down to the panic
+				pcs := make([]uintptr, 64)
+				n := runtime.Callers(3, pcs)
+				s.capture(c, "panic", fmt.Sprint(r), pcs[:n])
+				panic(r)
+			}
+		}()
+		err := next(c)
+		if err != nil {
+			// Answers the error now, to know the status it gets
+			c.Error(err)
+		}
+		if status := c.Response().Status; status >= http.StatusInternalServerError {
+			message := fmt.Sprintf("%s %s answered %d", c.Request().Method, c.Path(), status)
+			kind := "error"
+			if err != nil {
+				message, kind = err.Error(), fmt.Sprintf("%T", err)
+			}
+			s.capture(c, kind, message, nil)
+		}
+		return nil
+	}
+}
+
+// Whether an event is sent, at the sample rate
+func (s *Sentry) sampled() bool {
+	if s.sampleRate >= 1 {
+		return true
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	return err == nil && float64(n.Int64()) < s.sampleRate*1_000_000
+}
+
+// The frames of the stack, the innermost last, as Sentry wants them
+func sentryFrames(pcs []uintptr) []map[string]interface{} {
+	var frames []map[string]interface{}
+	it := runtime.CallersFrames(pcs)
+	for {
+		frame, more := it.Next()
+		module, function := "", frame.Function
+		if i := strings.LastIndex(function, "/"); i >= 0 {
+			if j := strings.Index(function[i:], "."); j >= 0 {
+				module, function = function[:i+j], function[i+j+1:]
+			}
+		} else if j := strings.Index(function, "."); j >= 0 {
+			module, function = function[:j], function[j+1:]
+		}
+		frames = append([]map[string]interface{}{{
+			"function": function,
+			"module":   module,
+			"abs_path": frame.File,
+			"filename": frame.File,
+			"lineno":   frame.Line,
+			"in_app":   module == "main",
+		}}, frames...)
+		if !more {
+			return frames
+		}
+	}
+}
+
+// The request, without what may be secret or personal
+func sentryRequest(c echo.Context) map[string]interface{} {
+	req := c.Request()
+	headers := map[string]string{}
+	for name := range req.Header {
+		headers[name] = req.Header.Get(name)
+	}
+	for _, name := range sentryScrubbedHeaders {
+		if _, ok := headers[http.CanonicalHeaderKey(name)]; ok {
+			headers[http.CanonicalHeaderKey(name)] = "[Filtered]"
+		}
+	}
+	query := req.URL.Query()
+	for name := range query {
+		for _, scrubbed := range sentryScrubbedParams {
+			if strings.Contains(strings.ToLower(name), scrubbed) {
+				query.Set(name, "[Filtered]")
+			}
+		}
+	}
+	return map[string]interface{}{
+		"method":       req.Method,
+		"url":          absoluteURL(c, req.URL.Path),
+		"query_string": query.Encode(),
+		"headers":      headers,
+	}
+}
+
+func (s *Sentry) capture(c echo.Context, kind string, message string, pcs []uintptr) {
+	if !s.sampled() {
+		return
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	exception := map[string]interface{}{"type": kind, "value": message}
+	if len(pcs) > 0 {
+		exception["stacktrace"] = map[string]interface{}{"frames": sentryFrames(pcs)}
+		exception["mechanism"] = map[string]interface{}{"type": "echo", "handled": false}
+	}
+	hostname, _ := os.Hostname()
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339Nano),
+		"platform":    "go",
+		"level":       "error",
+		"server_name": hostname,
+		"transaction": c.Request().Method + " " + c.Path(),
+		"exception":   map[string]interface{}{"values": []interface{}{exception}},
+		"request":     sentryRequest(c),
+		"tags":        map[string]string{"request_id": requestID(c), "host": c.Request().Host},
+	}
+	if s.environment != "" {
+		event["environment"] = s.environment
+	}
+	if s.release != "" {
+		event["release"] = s.release
+	}
+	// Just the id, which tells nothing about the user outside of the library
+	if user, ok := currentUser(c); ok {
+		event["user"] = map[string]string{"id": user.ID.Hex()}
+	}
+	if trace := traceIDFrom(c.Request().Context()); trace != "" {
+		event["contexts"] = map[string]interface{}{"trace": map[string]string{"trace_id": trace}}
+	}
+
+	select {
+	case s.events <- event:
+	default:
+		slog.Warn("dropped error report, too many waiting", "event", event["event_id"])
+	}
+}
+
+// Sends the events one at a time, as envelopes (see
+// https://develop.sentry.dev/sdk/envelopes/)
+func (s *Sentry) send() {
+	auth := "Sentry sentry_version=7, sentry_client=library/1.0, sentry_key=" + s.key
+	for event := range s.events {
+		var body bytes.Buffer
+		enc := json.NewEncoder(&body)
+		enc.Encode(map[string]string{"event_id": event["event_id"].(string), "dsn": s.dsn})
+		enc.Encode(map[string]string{"type": "event"})
+		enc.Encode(event)
+
+		req, err := http.NewRequest(http.MethodPost, s.endpoint, &body)
+		if err != nil {
+			slog.Warn("failed to report error", "err", err)
+			continue
+		}
+		req.Header.Set(echo.HeaderContentType, "application/x-sentry-envelope")
+		req.Header.Set("X-Sentry-Auth", auth)
+		res, err := s.client.Do(req)
+		if err != nil {
+			slog.Warn("failed to report error", "err", err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			slog.Warn("failed to report error", "status", res.StatusCode)
+		}
+	}
+}
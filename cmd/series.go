@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A series of books, e.g., "The Lord of the Rings". The books themselves
+// point to the series they belong to, together with their volume number, so
+// "The Two Towers" is volume 2 of the series.
+type Series struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	SeriesName string             `bson:"seriesname"`
+	CreatedAt  time.Time          `bson:"createdat,omitempty"`
+	UpdatedAt  time.Time          `bson:"updatedat,omitempty"`
+}
+
+// Returns the books of a series ordered by their volume number.
+func seriesVolumes(books *Repository, id primitive.ObjectID) ([]BookStore, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "bookvolume", Value: 1}})
+	cursor, err := books.Find(context.TODO(), bson.M{"bookseries": id}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []BookStore
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func volumeToMap(b BookStore) map[string]interface{} {
+	return map[string]interface{}{
+		"id":     b.ID.Hex(),
+		"name":   b.BookName,
+		"author": b.BookAuthor,
+		"volume": b.BookVolume,
+	}
+}
+
+func seriesToMap(books *Repository, s Series) (map[string]interface{}, error) {
+	volumes, err := seriesVolumes(books, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	list := []map[string]interface{}{}
+	for _, v := range volumes {
+		list = append(list, volumeToMap(v))
+	}
+	return map[string]interface{}{
+		"id":        s.ID.Hex(),
+		"name":      s.SeriesName,
+		"volumes":   list,
+		"createdAt": formatTimestamp(s.CreatedAt),
+		"updatedAt": formatTimestamp(s.UpdatedAt),
+	}, nil
+}
+
+// Describes the place of a book in its series, with links to the books that
+// come right before and after it. Books outside a series get nil.
+func bookSeriesInfo(books *Repository, seriesColl *Repository, book BookStore) (map[string]interface{}, error) {
+	if book.BookSeries.IsZero() {
+		return nil, nil
+	}
+	var s Series
+	if err := seriesColl.FindOne(context.TODO(), bson.M{"_id": book.BookSeries}).Decode(&s); err != nil {
+		return nil, err
+	}
+	volumes, err := seriesVolumes(books, s.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	info := map[string]interface{}{
+		"id":       s.ID.Hex(),
+		"name":     s.SeriesName,
+		"volume":   book.BookVolume,
+		"previous": nil,
+		"next":     nil,
+	}
+	for i, v := range volumes {
+		if v.ID != book.ID {
+			continue
+		}
+		if i > 0 {
+			info["previous"] = volumeToMap(volumes[i-1])
+		}
+		if i < len(volumes)-1 {
+			info["next"] = volumeToMap(volumes[i+1])
+		}
+	}
+	return info, nil
+}
+
+func findAllSeries(books *Repository, coll *Repository) ([]map[string]interface{}, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "seriesname", Value: 1}})
+	cursor, err := coll.Find(context.TODO(), bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []Series
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	ret := []map[string]interface{}{}
+	for _, s := range results {
+		m, err := seriesToMap(books, s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+// Registers the endpoints and pages of the book series.
+func registerSeriesRoutes(e *echo.Echo, books *Repository, coll *Repository) {
+	// Fetches the series from the path parameter. When that fails, the error
+	// response was already sent and ok is false.
+	find := func(c echo.Context) (series map[string]interface{}, ok bool, err error) {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return nil, false, echo.NewHTTPError(http.StatusBadRequest, "invalid id")
+		}
+		var s Series
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&s); err != nil {
+			return nil, false, echo.NewHTTPError(http.StatusNotFound, "series not found")
+		}
+		if series, err = seriesToMap(books, s); err != nil {
+			return nil, false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list volumes"})
+		}
+		return series, true, nil
+	}
+
+	e.GET("/series", func(c echo.Context) error {
+		series, err := findAllSeries(books, coll)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list series"})
+		}
+		return c.Render(200, "series-table", series)
+	})
+
+	e.GET("/series/:id", func(c echo.Context) error {
+		series, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		return c.Render(200, "series-detail", series)
+	})
+
+	e.GET("/api/series", func(c echo.Context) error {
+		series, err := findAllSeries(books, coll)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list series"})
+		}
+		return c.JSON(http.StatusOK, series)
+	})
+
+	e.GET("/api/series/:id", func(c echo.Context) error {
+		series, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		return c.JSON(http.StatusOK, series)
+	})
+
+	e.POST("/api/series", func(c echo.Context) error {
+		var req struct {
+			Name string `json:"name" form:"name"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if req.Name = strings.TrimSpace(req.Name); req.Name == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "name is required"})
+		}
+
+		s := Series{ID: primitive.NewObjectID(), SeriesName: req.Name}
+		if _, err := coll.InsertOne(c.Request().Context(), s); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert series"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"id": s.ID.Hex(), "name": s.SeriesName, "volumes": []interface{}{}})
+	})
+
+	e.PUT("/api/series", func(c echo.Context) error {
+		var req struct {
+			ID   string `json:"id" form:"id"`
+			Name string `json:"name" form:"name"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		id, err := primitive.ObjectIDFromHex(req.ID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		if req.Name = strings.TrimSpace(req.Name); req.Name == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "name is required"})
+		}
+
+		result, err := coll.UpdateOne(c.Request().Context(), bson.M{"_id": id}, bson.M{"$set": bson.M{"seriesname": req.Name}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update series"})
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "series not found"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.DELETE("/api/series/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		result, err := coll.DeleteOne(c.Request().Context(), bson.M{"_id": id})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete series"})
+		}
+		// The books stay in the catalog, they just no longer belong to a series
+		if _, err = books.UpdateMany(c.Request().Context(), bson.M{"bookseries": id}, bson.M{"$unset": bson.M{"bookseries": "", "bookvolume": ""}}); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to detach volumes"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	// Adds a book to the series as the given volume, or moves it there if it
+	// already belonged to this or another series.
+	e.POST("/api/series/:id/volumes", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var req struct {
+			Book   string `json:"book" form:"book"`
+			Volume int    `json:"volume" form:"volume"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		bookID, err := primitive.ObjectIDFromHex(req.Book)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid book id"})
+		}
+		if req.Volume < 1 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "volume must be a positive number"})
+		}
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Err(); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "series not found"})
+		}
+
+		taken, err := books.CountDocuments(context.TODO(), bson.M{"bookseries": id, "bookvolume": req.Volume, "_id": bson.M{"$ne": bookID}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to add volume"})
+		}
+		if taken > 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "volume number already taken"})
+		}
+
+		result, err := books.UpdateOne(c.Request().Context(), bson.M{"_id": bookID}, bson.M{"$set": bson.M{"bookseries": id, "bookvolume": req.Volume}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to add volume"})
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.DELETE("/api/series/:id/volumes/:book", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		bookID, err := primitive.ObjectIDFromHex(c.Param("book"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid book id"})
+		}
+
+		result, err := books.UpdateOne(c.Request().Context(), bson.M{"_id": bookID, "bookseries": id}, bson.M{"$unset": bson.M{"bookseries": "", "bookvolume": ""}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to remove volume"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
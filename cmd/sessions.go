@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The names of the cookies holding the session of the logged in user, and
+// of somebody half-way through logging in, who still has to enter the code
+// of their second factor (see totp.go)
+const (
+	sessionCookie = "session"
+	pendingCookie = "login_pending"
+)
+
+// How long somebody has to enter the code of their second factor
+const pendingMaxAge = 5 * time.Minute
+
+// The session cookie holds a random token, and the store the session it
+// stands for (see sessionstore.go), so a session can be ended from
+// anywhere, e.g., when the password changed. The cookie of somebody half-way
+// through logging in is short-lived, and holds the id of the user and when it
+// expires instead, signed with a secret so nobody can make one up or change
+// it.
+type Sessions struct {
+	secret []byte
+	maxAge time.Duration
+	idle   time.Duration
+	store  SessionStore
+}
+
+// Without a configured secret we make one up, which means whoever is
+// half-way through logging in has to start over after a restart.
+func newSessions(cfg Config, store SessionStore) *Sessions {
+	secret := []byte(cfg.SessionSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			fatal("failed to make up a secret", "err", err)
+		}
+		slog.Warn("SESSION_SECRET is not set, two-factor logins will not survive a restart")
+	}
+	return &Sessions{
+		secret: secret,
+		maxAge: time.Duration(cfg.SessionDays) * 24 * time.Hour,
+		idle:   time.Duration(cfg.SessionIdleMinutes) * time.Minute,
+		store:  store,
+	}
+}
+
+// The name of the cookie is signed as well, so one kind of cookie can't be
+// passed off as another.
+func (s *Sessions) sign(name string, value string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(name + "|" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Hands out a cookie with the id of the user. It can't be read by scripts,
+// and is only sent back over HTTPS if it came that way.
+func (s *Sessions) set(c echo.Context, name string, user User, maxAge time.Duration) {
+	expires := time.Now().Add(maxAge)
+	value := user.ID.Hex() + "." + strconv.FormatInt(expires.Unix(), 10)
+	c.SetCookie(&http.Cookie{
+		Name:     name,
+		Value:    value + "." + s.sign(name, value),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *Sessions) clear(c echo.Context, name string) {
+	c.SetCookie(&http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+}
+
+// Starts a session for the user, i.e., stores it and hands out the cookie.
+func (s *Sessions) Start(c echo.Context, user User) error {
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	session := Session{
+		ID:             hash,
+		SessionUser:    user.ID,
+		SessionCreated: now,
+		SessionSeen:    now,
+		SessionExpires: now.Add(s.maxAge),
+		SessionIP:      c.RealIP(),
+		SessionAgent:   c.Request().UserAgent(),
+	}
+	if err = s.store.Create(c.Request().Context(), session); err != nil {
+		return err
+	}
+
+	s.clear(c, pendingCookie)
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.SessionExpires,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (s *Sessions) End(c echo.Context) {
+	if session, ok := s.current(c); ok {
+		if err := s.store.Delete(c.Request().Context(), session); err != nil {
+			loggerFrom(c.Request().Context()).Error("failed to end session", "err", err)
+		}
+	}
+	s.clear(c, sessionCookie)
+}
+
+// Remembers the user got the password right, and only has to enter the code
+// of the second factor.
+func (s *Sessions) StartPending(c echo.Context, user User) {
+	s.set(c, pendingCookie, user, pendingMaxAge)
+}
+
+func (s *Sessions) pendingUserID(c echo.Context) (primitive.ObjectID, bool) {
+	return s.read(c, pendingCookie)
+}
+
+// Returns the session of the cookie, if it is still valid. So the store is
+// not written on every request, we only record the session was used once a
+// minute.
+func (s *Sessions) current(c echo.Context) (Session, bool) {
+	cookie, err := c.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return Session{}, false
+	}
+	ctx := c.Request().Context()
+	session, err := s.store.Get(ctx, hashToken(cookie.Value))
+	if err != nil {
+		return Session{}, false
+	}
+	now := time.Now()
+	if now.After(session.SessionExpires) || now.Sub(session.SessionSeen) > s.idle {
+		s.store.Delete(ctx, session)
+		return Session{}, false
+	}
+	if now.Sub(session.SessionSeen) > time.Minute {
+		if err = s.store.Touch(ctx, session, now.UTC()); err != nil {
+			loggerFrom(ctx).Error("failed to update session", "err", err)
+		}
+	}
+	return session, true
+}
+
+func (s *Sessions) read(c echo.Context, name string) (primitive.ObjectID, bool) {
+	cookie, err := c.Cookie(name)
+	if err != nil {
+		return primitive.NilObjectID, false
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return primitive.NilObjectID, false
+	}
+	value := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(s.sign(name, value))) {
+		return primitive.NilObjectID, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return primitive.NilObjectID, false
+	}
+	id, err := primitive.ObjectIDFromHex(parts[0])
+	return id, err == nil
+}
+
+// Middleware looking up the user of the session, if any, so the handlers
+// find it with currentUser. From then on, the audit log shows the email of
+// the user rather than the IP address the request came from.
+func (s *Sessions) Authenticate(users *Repository) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			session, ok := s.current(c)
+			if !ok {
+				return next(c)
+			}
+			if user, err := findUserByID(users, session.SessionUser); err == nil {
+				c.Set("session", session.ID)
+				setUser(c, user)
+			}
+			return next(c)
+		}
+	}
+}
+
+// Remembers who the request is from, for the handlers and the audit log.
+func setUser(c echo.Context, user User) {
+	c.Set("user", user)
+	ctx := context.WithValue(c.Request().Context(), actorKey{}, user.UserEmail)
+	c.SetRequest(c.Request().WithContext(ctx))
+}
+
+// Returns the logged in user, and whether there is one.
+func currentUser(c echo.Context) (User, bool) {
+	user, ok := c.Get("user").(User)
+	return user, ok
+}
+
+// Registers the endpoints to list the sessions of the user, e.g., to spot a
+// login on a computer they don't know, and to end them. The admins can end
+// all the sessions of somebody else.
+func registerSessionRoutes(e *echo.Echo, sessions *Sessions, admin *AdminLog, users *Repository) {
+	e.GET("/api/sessions", func(c echo.Context) error {
+		user, ok := currentUser(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "login required"})
+		}
+		results, err := sessions.store.List(c.Request().Context(), user.ID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list sessions"})
+		}
+
+		current, _ := c.Get("session").(string)
+		ret := []map[string]interface{}{}
+		for _, s := range results {
+			ret = append(ret, sessionToMap(s, current))
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	e.DELETE("/api/sessions/:id", func(c echo.Context) error {
+		user, _ := currentUser(c)
+		session, err := sessions.store.Get(c.Request().Context(), c.Param("id"))
+		if err != nil || session.SessionUser != user.ID {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "session not found"})
+		}
+		if err = sessions.store.Delete(c.Request().Context(), session); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to end session"})
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	e.DELETE("/api/users/:id/sessions", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		user, err := findUserByID(users, id)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "user not found"})
+		}
+		if err = sessions.store.DeleteUser(c.Request().Context(), id); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to end sessions"})
+		}
+		if err = revokeTokens(c.Request().Context(), users, id); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to revoke tokens"})
+		}
+		admin.Record(c, AdminSessionsRevoke, user.UserEmail, nil)
+		return c.NoContent(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A login, as the server remembers it. The cookie holds a random token, and
+// the store only its hash, which is also the id of the session. A session
+// ends when it was not used for a while (idle), or at the latest when it
+// expires, however much it is used.
+type Session struct {
+	ID             string             `json:"id" bson:"_id"`
+	SessionUser    primitive.ObjectID `json:"user"`
+	SessionCreated time.Time          `json:"created"`
+	SessionSeen    time.Time          `json:"seen"`
+	SessionExpires time.Time          `json:"expires"`
+	SessionIP      string             `json:"ip"`
+	SessionAgent   string             `json:"agent"`
+}
+
+// Where the sessions are kept: in MongoDB, along with everything else, or
+// in Redis. Either way they survive a restart, and all the replicas of the
+// server see the same ones.
+type SessionStore interface {
+	Create(ctx context.Context, s Session) error
+	Get(ctx context.Context, id string) (Session, error)
+	// Records the session was just used
+	Touch(ctx context.Context, s Session, seen time.Time) error
+	Delete(ctx context.Context, s Session) error
+	// The sessions of a user, and ending them all, e.g., when the password
+	// changed
+	List(ctx context.Context, user primitive.ObjectID) ([]Session, error)
+	DeleteUser(ctx context.Context, user primitive.ObjectID) error
+}
+
+var errNoSession = errors.New("session not found")
+
+func sessionToMap(s Session, current string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        s.ID,
+		"createdAt": formatTimestamp(s.SessionCreated),
+		"lastSeen":  formatTimestamp(s.SessionSeen),
+		"expiresAt": formatTimestamp(s.SessionExpires),
+		"ip":        s.SessionIP,
+		"userAgent": s.SessionAgent,
+		"current":   s.ID == current,
+	}
+}
+
+// Picks the store with SESSION_STORE: "mongo", the default, or "redis".
+func newSessionStore(cfg Config, coll *Repository, tenant string) (SessionStore, error) {
+	switch cfg.SessionStore {
+	case "", "mongo":
+		return newMongoSessions(coll), nil
+	case "redis":
+		client, err := redisClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &RedisSessions{client: client, prefix: "library:" + tenant + ":", idle: time.Duration(cfg.SessionIdleMinutes) * time.Minute}, nil
+	}
+	return nil, errors.New("SESSION_STORE must be mongo or redis")
+}
+
+type MongoSessions struct {
+	coll *Repository
+}
+
+// MongoDB removes the expired sessions by itself, thanks to a TTL index on
+// when they expire.
+func newMongoSessions(coll *Repository) *MongoSessions {
+	index := mongo.IndexModel{Keys: bson.D{{Key: "sessionexpires", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)}
+	if _, err := coll.Indexes().CreateOne(context.TODO(), index); err != nil {
+		slog.Error("failed to create the index expiring the sessions", "err", err)
+	}
+	return &MongoSessions{coll: coll}
+}
+
+func (m *MongoSessions) Create(ctx context.Context, s Session) error {
+	_, err := m.coll.InsertOne(ctx, s)
+	return err
+}
+
+func (m *MongoSessions) Get(ctx context.Context, id string) (Session, error) {
+	var s Session
+	err := m.coll.FindOne(ctx, bson.M{"_id": id}).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		return s, errNoSession
+	}
+	return s, err
+}
+
+func (m *MongoSessions) Touch(ctx context.Context, s Session, seen time.Time) error {
+	_, err := m.coll.UpdateOne(ctx, bson.M{"_id": s.ID}, bson.M{"$set": bson.M{"sessionseen": seen}})
+	return err
+}
+
+func (m *MongoSessions) Delete(ctx context.Context, s Session) error {
+	_, err := m.coll.DeleteOne(ctx, bson.M{"_id": s.ID})
+	return err
+}
+
+func (m *MongoSessions) List(ctx context.Context, user primitive.ObjectID) ([]Session, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "sessionseen", Value: -1}})
+	cursor, err := m.coll.Find(ctx, bson.M{"sessionuser": user}, opts)
+	if err != nil {
+		return nil, err
+	}
+	results := []Session{}
+	err = cursor.All(ctx, &results)
+	return results, err
+}
+
+func (m *MongoSessions) DeleteUser(ctx context.Context, user primitive.ObjectID) error {
+	_, err := m.coll.DeleteMany(ctx, bson.M{"sessionuser": user})
+	return err
+}
+
+// In Redis, every session is a key of its own, which Redis drops once the
+// session is idle for too long or expires. A set per user lists the ids of
+// their sessions. The keys start with the tenant, as the libraries share
+// the Redis server.
+type RedisSessions struct {
+	client *redis.Client
+	prefix string
+	idle   time.Duration
+}
+
+func (r *RedisSessions) key(id string) string {
+	return r.prefix + "session:" + id
+}
+
+func (r *RedisSessions) userKey(user primitive.ObjectID) string {
+	return r.prefix + "user-sessions:" + user.Hex()
+}
+
+// Stores the session for as long as it may still be used
+func (r *RedisSessions) set(ctx context.Context, s Session) error {
+	ttl := min(time.Until(s.SessionExpires), time.Until(s.SessionSeen.Add(r.idle)))
+	if ttl <= 0 {
+		return r.Delete(ctx, s)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, r.key(s.ID), data, ttl).Err()
+}
+
+func (r *RedisSessions) Create(ctx context.Context, s Session) error {
+	if err := r.set(ctx, s); err != nil {
+		return err
+	}
+	pipe := r.client.TxPipeline()
+	pipe.SAdd(ctx, r.userKey(s.SessionUser), s.ID)
+	pipe.ExpireGT(ctx, r.userKey(s.SessionUser), time.Until(s.SessionExpires))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *RedisSessions) Get(ctx context.Context, id string) (Session, error) {
+	var s Session
+	data, err := r.client.Get(ctx, r.key(id)).Bytes()
+	if err == redis.Nil {
+		return s, errNoSession
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+func (r *RedisSessions) Touch(ctx context.Context, s Session, seen time.Time) error {
+	s.SessionSeen = seen
+	return r.set(ctx, s)
+}
+
+func (r *RedisSessions) Delete(ctx context.Context, s Session) error {
+	pipe := r.client.TxPipeline()
+	pipe.Del(ctx, r.key(s.ID))
+	pipe.SRem(ctx, r.userKey(s.SessionUser), s.ID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// The ids of sessions Redis already dropped are cleaned up on the way.
+func (r *RedisSessions) List(ctx context.Context, user primitive.ObjectID) ([]Session, error) {
+	ids, err := r.client.SMembers(ctx, r.userKey(user)).Result()
+	if err != nil {
+		return nil, err
+	}
+	results := []Session{}
+	for _, id := range ids {
+		s, err := r.Get(ctx, id)
+		if err == errNoSession {
+			r.client.SRem(ctx, r.userKey(user), id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, s)
+	}
+	return results, nil
+}
+
+func (r *RedisSessions) DeleteUser(ctx context.Context, user primitive.ObjectID) error {
+	ids, err := r.client.SMembers(ctx, r.userKey(user)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{r.userKey(user)}
+	for _, id := range ids {
+		keys = append(keys, r.key(id))
+	}
+	return r.client.Del(ctx, keys...).Err()
+}
+
+// All the libraries share a single connection pool to Redis, opened the
+// first time it is needed.
+var (
+	redisOnce   sync.Once
+	redisShared *redis.Client
+	redisErr    error
+)
+
+func redisClient(cfg Config) (*redis.Client, error) {
+	redisOnce.Do(func() {
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			redisErr = err
+			return
+		}
+		redisShared = redis.NewClient(opts)
+		redisErr = redisShared.Ping(context.TODO()).Err()
+	})
+	return redisShared, redisErr
+}
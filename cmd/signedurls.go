@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// With PRIVATE_FILES=true, the covers (and the other files below) are only
+// served to users who are logged in. To share one anyway, e.g., to embed a
+// cover on the website of a school, users get a signed URL: the address of
+// the file, when it stops working, and a signature of both with a secret,
+// so nobody can change either.
+type URLSigner struct {
+	secret  []byte
+	private bool
+	// How many minutes a URL works by default, and at most
+	minutes    int
+	maxMinutes int
+}
+
+// The paths that can be signed
+var signablePaths = []string{"/covers/"}
+
+// Without a configured secret we make one up, which means the URLs stop
+// working after a restart.
+func newURLSigner(cfg Config) *URLSigner {
+	secret := []byte(cfg.URLSigningSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			fatal("failed to make up a secret", "err", err)
+		}
+		if cfg.PrivateFiles {
+			slog.Warn("URL_SIGNING_SECRET is not set, signed URLs will not survive a restart")
+		}
+	}
+	return &URLSigner{secret: secret, private: cfg.PrivateFiles, minutes: cfg.SignedURLMinutes, maxMinutes: cfg.SignedURLMaxMinutes}
+}
+
+func (s *URLSigner) signature(path string, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(path + "|" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the path with the expiry and the signature in its query.
+func (s *URLSigner) Sign(path string, expires time.Time) string {
+	value := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", value)
+	query.Set("signature", s.signature(path, value))
+	return path + "?" + query.Encode()
+}
+
+// Whether the request came with a valid signature that did not expire yet.
+func (s *URLSigner) Valid(c echo.Context) bool {
+	value := c.QueryParam("expires")
+	expires, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := s.signature(c.Request().URL.Path, value)
+	return hmac.Equal([]byte(expected), []byte(c.QueryParam("signature")))
+}
+
+// Whether the request may read the file: anybody may unless the files are
+// private, and then only with a valid signature, or a login.
+func (s *URLSigner) Allowed(c echo.Context) bool {
+	return !s.private || s.Valid(c)
+}
+
+// Registers the endpoint signing URLs, e.g., POST /api/signed-urls with
+// {"path": "/covers/<id>", "minutes": 60}.
+func registerSignedURLRoutes(e *echo.Echo, signer *URLSigner) {
+	e.POST("/api/signed-urls", func(c echo.Context) error {
+		var req struct {
+			Path    string `json:"path" form:"path"`
+			Minutes int    `json:"minutes" form:"minutes"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		signable := false
+		for _, prefix := range signablePaths {
+			signable = signable || strings.HasPrefix(req.Path, prefix)
+		}
+		if !signable || strings.ContainsAny(req.Path, "?#") || strings.Contains(req.Path, "..") {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "path can't be signed"})
+		}
+		if req.Minutes == 0 {
+			req.Minutes = signer.minutes
+		}
+		if req.Minutes < 1 || req.Minutes > signer.maxMinutes {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "minutes must be between 1 and " + strconv.Itoa(signer.maxMinutes)})
+		}
+
+		expires := time.Now().Add(time.Duration(req.Minutes) * time.Minute)
+		path := signer.Sign(req.Path, expires)
+		return c.JSON(http.StatusOK, map[string]string{
+			"url":       c.Scheme() + "://" + c.Request().Host + path,
+			"expiresAt": expires.UTC().Format(time.RFC3339),
+		})
+	})
+}
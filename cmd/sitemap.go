@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A sitemap holds 50,000 addresses at most. The pages after them are left
+// out; search engines still find them through the links of the others.
+const sitemapLimit = 50000
+
+// The pages search engines have no business with, when the catalog is
+// public: the API, the forms to change things, and the pages of the users.
+var robotsDisallowed = []string{
+	"/api/",
+	"/admin",
+	"/account",
+	"/create",
+	"/edit/",
+	"/import",
+	"/login",
+	"/signup",
+	"/password/",
+	"/preferences",
+	"/books/export",
+	"/books/print",
+	"/books/rows",
+	"/debug/",
+}
+
+// A sitemap (see https://www.sitemaps.org/protocol.html)
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// When a page was last changed, for the sitemap. Documents from before the
+// repository kept the times have none.
+func lastModified(created time.Time, updated time.Time) string {
+	if updated.IsZero() {
+		updated = created
+	}
+	if updated.IsZero() {
+		return ""
+	}
+	return updated.UTC().Format(time.DateOnly)
+}
+
+// The ids and times of the documents of the collection, for the sitemap,
+// in the order they were added.
+type sitemapDocument struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Share     string             `bson:"listshare"`
+	CreatedAt time.Time          `bson:"createdat"`
+	UpdatedAt time.Time          `bson:"updatedat"`
+}
+
+// The pages of a collection in the sitemap: the documents of the filter,
+// at the path of each
+type sitemapPages struct {
+	coll   *Repository
+	filter bson.M
+	path   func(sitemapDocument) string
+}
+
+func sitemapDocuments(coll *Repository, filter bson.M, limit int) ([]sitemapDocument, error) {
+	opts := options.Find().
+		SetProjection(bson.M{"_id": 1, "listshare": 1, "createdat": 1, "updatedat": 1}).
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(limit))
+	cursor, err := coll.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []sitemapDocument
+	err = cursor.All(context.TODO(), &docs)
+	return docs, err
+}
+
+// Registers /robots.txt and /sitemap.xml. Unless the catalog is public, the
+// robots are asked to stay away, and there is no sitemap. Public catalogs
+// list their books and authors in it, and the shared reading lists if they
+// are meant to be found too; their addresses are all anybody needs to see
+// them, so they are only in it when asked for.
+func registerSitemapRoutes(e *echo.Echo, cfg Config, books *Repository, authors *Repository, lists *Repository) {
+	e.GET("/robots.txt", func(c echo.Context) error {
+		if cfg.RobotsFile != "" {
+			return c.File(cfg.RobotsFile)
+		}
+		if !cfg.PublicCatalog {
+			return c.String(http.StatusOK, "User-agent: *\nDisallow: /\n")
+		}
+		var b strings.Builder
+		b.WriteString("User-agent: *\n")
+		for _, path := range robotsDisallowed {
+			b.WriteString("Disallow: " + path + "\n")
+		}
+		b.WriteString("\nSitemap: " + absoluteURL(c, "/sitemap.xml") + "\n")
+		return c.String(http.StatusOK, b.String())
+	})
+
+	e.GET("/sitemap.xml", func(c echo.Context) error {
+		if !cfg.PublicCatalog {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "the catalog is not public"})
+		}
+		set := sitemapURLSet{}
+		for _, path := range []string{"/", "/books", "/authors", "/years"} {
+			set.URLs = append(set.URLs, sitemapURL{Loc: absoluteURL(c, path)})
+		}
+
+		pages := []sitemapPages{
+			{books, bson.M{}, func(d sitemapDocument) string { return "/books/" + d.ID.Hex() }},
+			{authors, bson.M{}, func(d sitemapDocument) string { return "/authors/" + d.ID.Hex() }},
+		}
+		if cfg.SitemapLists {
+			shared := bson.M{"listshare": bson.M{"$nin": bson.A{"", nil}}}
+			pages = append(pages, sitemapPages{lists, shared, func(d sitemapDocument) string { return "/shared/lists/" + d.Share }})
+		}
+		for _, p := range pages {
+			if len(set.URLs) >= sitemapLimit {
+				break
+			}
+			docs, err := sitemapDocuments(p.coll, p.filter, sitemapLimit-len(set.URLs))
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list pages"})
+			}
+			for _, d := range docs {
+				set.URLs = append(set.URLs, sitemapURL{Loc: absoluteURL(c, p.path(d)), LastMod: lastModified(d.CreatedAt, d.UpdatedAt)})
+			}
+		}
+
+		data, err := xml.MarshalIndent(set, "", "  ")
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to write sitemap"})
+		}
+		return c.Blob(http.StatusOK, "application/xml; charset=utf-8", append([]byte(xml.Header), data...))
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The database operations taking longer than SLOW_QUERY_MS are logged as
+// warnings (see logOp), with the shape of their filter, or of the stages of
+// their pipeline: which fields they look at, and with which operators, but
+// none of the values, which may be emails or passwords, e.g.,
+// {"$and": [{"bookisbn": "?"}, {"tenant": "?"}]}. A slow query usually means
+// an index is missing for the fields of its filter.
+func filterShape(filter interface{}) interface{} {
+	switch f := filter.(type) {
+	case nil:
+		return nil
+	case mongo.Pipeline:
+		stages := make([]interface{}, len(f))
+		for i, stage := range f {
+			stages[i] = shapeOf(stage)
+		}
+		return stages
+	case bson.M, bson.D, bson.A:
+		return shapeOf(f)
+	}
+	// Structs, e.g., a BookStore, filter by their fields
+	if m, err := toBsonM(filter); err == nil {
+		return shapeOf(m)
+	}
+	return "?"
+}
+
+// Keeps the keys of the documents, and the lists, and replaces everything
+// else by "?"
+func shapeOf(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.M:
+		shape := bson.M{}
+		for key, x := range v {
+			shape[key] = shapeOf(x)
+		}
+		return shape
+	case bson.D:
+		shape := bson.M{}
+		for _, e := range v {
+			shape[e.Key] = shapeOf(e.Value)
+		}
+		return shape
+	case bson.A:
+		// A list of values, e.g., of an $in, is just one "?"
+		shape := bson.A{}
+		for _, x := range v {
+			if s := shapeOf(x); s != "?" {
+				shape = append(shape, s)
+			}
+		}
+		if len(shape) == 0 {
+			return "?"
+		}
+		return shape
+	}
+	return "?"
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Counts the books per language, most common first. Books without a language
+// are grouped under an empty code.
+func languageBreakdown(coll *Repository) ([]map[string]interface{}, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$booklanguage", ""}}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+	}
+	cursor, err := coll.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Language string `bson:"_id"`
+		Count    int    `bson:"count"`
+	}
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	ret := []map[string]interface{}{}
+	for _, r := range results {
+		name := languages[r.Language]
+		if r.Language == "" {
+			name = "Unknown"
+		}
+		ret = append(ret, map[string]interface{}{"language": r.Language, "name": name, "count": r.Count})
+	}
+	return ret, nil
+}
+
+// Counts the books, the copies, the members and the loans still open. When a
+// count fails, its name is returned with the error.
+func catalogTotals(ctx context.Context, books *Repository, copies *Repository, members *Repository, loans *Repository) (map[string]int64, string, error) {
+	totals := map[string]int64{}
+	counts := map[string]struct {
+		coll   *Repository
+		filter bson.M
+	}{
+		"books":   {books, bson.M{}},
+		"copies":  {copies, bson.M{}},
+		"members": {members, bson.M{}},
+		"loans":   {loans, bson.M{"loanreturned": bson.M{"$exists": false}}},
+	}
+	for name, q := range counts {
+		count, err := q.coll.CountDocuments(ctx, q.filter)
+		if err != nil {
+			return nil, name, err
+		}
+		totals[name] = count
+	}
+	return totals, "", nil
+}
+
+// Registers the endpoint returning statistics about the whole catalog.
+func registerStatsRoutes(e *echo.Echo, cfg Config, books *Repository, copies *Repository, members *Repository, loans *Repository) {
+	e.GET("/api/stats", func(c echo.Context) error {
+		stats := map[string]interface{}{}
+		totals, name, err := catalogTotals(context.TODO(), books, copies, members, loans)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count " + name})
+		}
+		for name, count := range totals {
+			stats[name] = count
+		}
+
+		langs, err := languageBreakdown(books)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count languages"})
+		}
+		stats["languages"] = langs
+
+		if stats["value"], err = collectionValue(books, copies, cfg); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to compute collection value"})
+		}
+		return c.JSON(http.StatusOK, stats)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How many books are read from the cursor before they are handed over
+const streamBatchSize = 100
+
+// Same as findAllBooks, but hands the books over to each a batch at a time,
+// as they come from the cursor, rather than all of them at once, so the
+// whole catalogue never has to fit in memory. It stops at the first error.
+func eachBooks(ctx context.Context, coll *Repository, filter bson.M, each func([]map[string]interface{}) error, opts ...*options.FindOptions) error {
+	opts = append(opts, options.Find().SetBatchSize(streamBatchSize))
+	cursor, err := coll.Find(ctx, filter, opts...)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	batch := make([]map[string]interface{}, 0, streamBatchSize)
+	for cursor.Next(ctx) {
+		var book BookStore
+		if err = cursor.Decode(&book); err != nil {
+			return err
+		}
+		if batch = append(batch, bookToMap(book)); len(batch) == streamBatchSize {
+			if err = each(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return each(batch)
+	}
+	return nil
+}
+
+// Writes the values as the elements of a JSON array, one after the other,
+// e.g., the books of eachBooks. Close ends the array.
+type jsonArrayWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (a *jsonArrayWriter) Write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sep := ","
+	if !a.written {
+		sep, a.written = "[", true
+	}
+	if _, err = io.WriteString(a.w, sep); err != nil {
+		return err
+	}
+	_, err = a.w.Write(data)
+	return err
+}
+
+func (a *jsonArrayWriter) Close() error {
+	end := "]\n"
+	if !a.written {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(a.w, end)
+	return err
+}
+
+// Starts a response of the given type, e.g., the JSON array of the books,
+// whose body is written as it comes. Once started, a failure can't change
+// the status anymore; the body is just cut short.
+func startStream(c echo.Context, contentType string) *echo.Response {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, contentType)
+	res.WriteHeader(http.StatusOK)
+	return res
+}
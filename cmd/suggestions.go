@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A book a member would like the library to acquire. Other members vote for
+// the suggestions they like, and the staff approves or rejects them. Once an
+// approved book is bought, the suggestion is turned into a catalogue record.
+type Suggestion struct {
+	ID                primitive.ObjectID `bson:"_id,omitempty"`
+	SuggestionTitle   string             `bson:"suggestiontitle"`
+	SuggestionAuthor  string             `bson:"suggestionauthor"`
+	SuggestionISBN    string             `bson:"suggestionisbn"`
+	SuggestionReason  string             `bson:"suggestionreason"`
+	SuggestionMember  string             `bson:"suggestionmember"`
+	SuggestionVotes   []string           `bson:"suggestionvotes"`
+	SuggestionStatus  string             `bson:"suggestionstatus"`
+	SuggestionBook    primitive.ObjectID `bson:"suggestionbook,omitempty"`
+	SuggestionCreated time.Time          `bson:"suggestioncreated"`
+}
+
+const (
+	SuggestionPending  = "pending"
+	SuggestionApproved = "approved"
+	SuggestionRejected = "rejected"
+	// The book was bought and added to the catalogue
+	SuggestionAcquired = "acquired"
+)
+
+func suggestionToMap(s Suggestion) map[string]interface{} {
+	book := ""
+	if !s.SuggestionBook.IsZero() {
+		book = s.SuggestionBook.Hex()
+	}
+	return map[string]interface{}{
+		"id":      s.ID.Hex(),
+		"title":   s.SuggestionTitle,
+		"author":  s.SuggestionAuthor,
+		"isbn":    s.SuggestionISBN,
+		"reason":  s.SuggestionReason,
+		"member":  s.SuggestionMember,
+		"votes":   len(s.SuggestionVotes),
+		"status":  s.SuggestionStatus,
+		"book":    book,
+		"created": s.SuggestionCreated.Format(time.RFC3339),
+	}
+}
+
+// Registers the endpoints to suggest books, vote for them, and for the staff
+// to go through the suggestions.
+func registerSuggestionRoutes(e *echo.Echo, books *Repository, members *Repository, coll *Repository) {
+	find := func(c echo.Context) (Suggestion, bool, error) {
+		var s Suggestion
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return s, false, c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&s); err != nil {
+			return s, false, c.JSON(http.StatusNotFound, map[string]string{"error": "suggestion not found"})
+		}
+		return s, true, nil
+	}
+
+	// The most wanted first. By default the ones still open are listed.
+	e.GET("/api/suggestions", func(c echo.Context) error {
+		filter := bson.M{"suggestionstatus": bson.M{"$in": bson.A{SuggestionPending, SuggestionApproved}}}
+		if status := c.QueryParam("status"); status == "all" {
+			filter = bson.M{}
+		} else if status != "" {
+			var err error
+			if filter, err = newQuery("suggestionstatus").Eq("suggestionstatus", status).Filter(); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			}
+		}
+		cursor, err := coll.Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "suggestioncreated", Value: 1}}))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list suggestions"})
+		}
+		var results []Suggestion
+		if err = cursor.All(context.TODO(), &results); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list suggestions"})
+		}
+		slices.SortStableFunc(results, func(a, b Suggestion) int {
+			return len(b.SuggestionVotes) - len(a.SuggestionVotes)
+		})
+
+		ret := []map[string]interface{}{}
+		for _, s := range results {
+			ret = append(ret, suggestionToMap(s))
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	e.POST("/api/suggestions", func(c echo.Context) error {
+		var req struct {
+			Member string `json:"member" form:"member"`
+			Title  string `json:"title" form:"title"`
+			Author string `json:"author" form:"author"`
+			ISBN   string `json:"isbn" form:"isbn"`
+			Reason string `json:"reason" form:"reason"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		member, err := findMember(members, strings.TrimSpace(req.Member))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+		s := Suggestion{
+			ID:                primitive.NewObjectID(),
+			SuggestionTitle:   strings.TrimSpace(req.Title),
+			SuggestionAuthor:  strings.TrimSpace(req.Author),
+			SuggestionISBN:    strings.TrimSpace(req.ISBN),
+			SuggestionReason:  strings.TrimSpace(req.Reason),
+			SuggestionMember:  member.MemberMembership,
+			SuggestionVotes:   []string{member.MemberMembership},
+			SuggestionStatus:  SuggestionPending,
+			SuggestionCreated: time.Now().UTC(),
+		}
+		if s.SuggestionTitle == "" || s.SuggestionAuthor == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "title and author are required"})
+		}
+
+		// Somebody else might have had the same idea already
+		if isbn := normalizeISBN(s.SuggestionISBN); isbn != "" {
+			var open []Suggestion
+			cursor, err := coll.Find(context.TODO(), bson.M{"suggestionstatus": bson.M{"$in": bson.A{SuggestionPending, SuggestionApproved}}})
+			if err == nil {
+				err = cursor.All(context.TODO(), &open)
+			}
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to check suggestions"})
+			}
+			for _, o := range open {
+				if normalizeISBN(o.SuggestionISBN) == isbn {
+					return c.JSON(http.StatusConflict, map[string]string{"error": "this book was suggested already, vote for it instead", "id": o.ID.Hex()})
+				}
+			}
+		}
+
+		if _, err = coll.InsertOne(c.Request().Context(), s); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert suggestion"})
+		}
+		return c.JSON(http.StatusOK, suggestionToMap(s))
+	})
+
+	// Votes for the suggestion, or takes the vote back if it was there.
+	e.POST("/api/suggestions/:id/vote", func(c echo.Context) error {
+		s, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		var req struct {
+			Member string `json:"member" form:"member"`
+		}
+		if err = c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		member, err := findMember(members, strings.TrimSpace(req.Member))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "member not found"})
+		}
+
+		update := bson.M{"$addToSet": bson.M{"suggestionvotes": member.MemberMembership}}
+		if slices.Contains(s.SuggestionVotes, member.MemberMembership) {
+			update = bson.M{"$pull": bson.M{"suggestionvotes": member.MemberMembership}}
+		}
+		err = coll.FindOneAndUpdate(c.Request().Context(), bson.M{"_id": s.ID}, update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&s)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to vote"})
+		}
+		return c.JSON(http.StatusOK, suggestionToMap(s))
+	})
+
+	e.POST("/api/suggestions/:id/moderate", func(c echo.Context) error {
+		s, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		var req struct {
+			Status string `json:"status" form:"status"`
+		}
+		if err = c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if req.Status != SuggestionApproved && req.Status != SuggestionRejected {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "status must be approved or rejected"})
+		}
+
+		err = coll.FindOneAndUpdate(c.Request().Context(),
+			bson.M{"_id": s.ID, "suggestionstatus": bson.M{"$ne": SuggestionAcquired}},
+			bson.M{"$set": bson.M{"suggestionstatus": req.Status}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&s)
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "the book was acquired already"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to moderate suggestion"})
+		}
+		return c.JSON(http.StatusOK, suggestionToMap(s))
+	})
+
+	// Adds the approved suggestion to the catalogue. The pages and year are
+	// only known once the book is at hand, so they are sent along.
+	e.POST("/api/suggestions/:id/acquire", func(c echo.Context) error {
+		s, ok, err := find(c)
+		if !ok {
+			return err
+		}
+		var req struct {
+			Pages    int    `json:"pages" form:"pages"`
+			Year     int    `json:"year" form:"year"`
+			Language string `json:"language" form:"language"`
+		}
+		if err = c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if s.SuggestionStatus != SuggestionApproved {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "only approved suggestions can be acquired"})
+		}
+
+		book := BookStore{
+			ID:          primitive.NewObjectID(),
+			BookName:    s.SuggestionTitle,
+			BookAuthor:  s.SuggestionAuthor,
+			BookISBN:    s.SuggestionISBN,
+			BookISBNKey: normalizeISBN(s.SuggestionISBN),
+			BookPages:   req.Pages,
+			BookYear:    req.Year,
+		}
+		if book.BookLanguage, ok = normalizeLanguage(req.Language); !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "language must be an ISO 639-1 code"})
+		}
+
+		// Mark it first, so two clicks don't add the book twice
+		result, err := coll.UpdateOne(c.Request().Context(),
+			bson.M{"_id": s.ID, "suggestionstatus": SuggestionApproved},
+			bson.M{"$set": bson.M{"suggestionstatus": SuggestionAcquired, "suggestionbook": book.ID}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to acquire suggestion"})
+		}
+		if result.ModifiedCount == 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "only approved suggestions can be acquired"})
+		}
+		if _, err = books.InsertOne(c.Request().Context(), book); err != nil {
+			coll.UpdateOne(c.Request().Context(), bson.M{"_id": s.ID},
+				bson.M{"$set": bson.M{"suggestionstatus": SuggestionApproved}, "$unset": bson.M{"suggestionbook": ""}})
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert book"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"book": book.ID.Hex()})
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Tags are free-form labels, so we normalize them to avoid ending up with
+// "Classic", "classic" and " classic " as three different tags.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+// Normalizes a list of tags, dropping the empty and repeated ones.
+func normalizeTags(tags []string) []string {
+	var ret []string
+	for _, t := range tags {
+		t = normalizeTag(t)
+		if t != "" && !slices.Contains(ret, t) {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+// Counts how many books carry each tag, most used first. In the aggregation
+// pipeline, $unwind creates one document per tag, $group counts them and
+// $sort orders the result.
+func popularTags(coll *Repository, limit int) ([]map[string]interface{}, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$unwind", Value: "$booktags"}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$booktags"}, {Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := coll.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Tag   string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	ret := []map[string]interface{}{}
+	for _, r := range results {
+		ret = append(ret, map[string]interface{}{"tag": r.Tag, "count": r.Count})
+	}
+	return ret, nil
+}
+
+// Replaces the given tags with "into" on every book. Renaming is just merging
+// a single tag: books that already had the target keep one copy of it.
+func mergeTags(ctx context.Context, coll *Repository, tags []string, into string) (int64, error) {
+	filter := bson.M{"booktags": bson.M{"$in": tags}}
+	result, err := coll.UpdateMany(ctx, filter, bson.M{"$addToSet": bson.M{"booktags": into}})
+	if err != nil {
+		return 0, err
+	}
+
+	var others []string
+	for _, t := range tags {
+		if t != into {
+			others = append(others, t)
+		}
+	}
+	if len(others) > 0 {
+		_, err = coll.UpdateMany(ctx, bson.M{}, bson.M{"$pull": bson.M{"booktags": bson.M{"$in": others}}})
+	}
+	return result.MatchedCount, err
+}
+
+// Registers the endpoints to label books with tags and manage the tags
+// across the whole collection.
+func registerTagRoutes(e *echo.Echo, coll *Repository) {
+	e.GET("/api/tags", func(c echo.Context) error {
+		limit := 20
+		if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 {
+			limit = l
+		}
+
+		tags, err := popularTags(coll, limit)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list tags"})
+		}
+		return c.JSON(http.StatusOK, tags)
+	})
+
+	e.POST("/api/books/:id/tags", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var req struct {
+			Tag string `json:"tag" form:"tag"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		tag := normalizeTag(req.Tag)
+		if tag == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "tag is required"})
+		}
+
+		result, err := coll.UpdateOne(c.Request().Context(), bson.M{"_id": id}, bson.M{"$addToSet": bson.M{"booktags": tag}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to add tag"})
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.DELETE("/api/books/:id/tags/:tag", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		result, err := coll.UpdateOne(c.Request().Context(), bson.M{"_id": id}, bson.M{"$pull": bson.M{"booktags": normalizeTag(c.Param("tag"))}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to remove tag"})
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.PUT("/api/tags/:tag", func(c echo.Context) error {
+		var req struct {
+			Name string `json:"name" form:"name"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		into := normalizeTag(req.Name)
+		if into == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "name is required"})
+		}
+
+		updated, err := mergeTags(c.Request().Context(), coll, []string{normalizeTag(c.Param("tag"))}, into)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to rename tag"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"tag": into, "books": updated})
+	})
+
+	e.POST("/api/tags/merge", func(c echo.Context) error {
+		var req struct {
+			Tags []string `json:"tags"`
+			Into string   `json:"into"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		tags := normalizeTags(req.Tags)
+		into := normalizeTag(req.Into)
+		if len(tags) == 0 || into == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "tags and into are required"})
+		}
+
+		updated, err := mergeTags(c.Request().Context(), coll, tags, into)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to merge tags"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"tag": into, "books": updated})
+	})
+}
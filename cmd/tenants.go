@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Next to the default library, a deployment can host other, independent
+// ones, e.g., one per classroom. Each tenant has its own subdomain:
+// with TENANT_DOMAIN=library.example.com, the library "math" lives at
+// math.library.example.com, while library.example.com itself is the
+// default library. All the libraries share the collections, but every record
+// carries the id of its tenant (its slug), and the repositories only see the
+// records of their own tenant (see repository.go).
+type Tenant struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	TenantSlug  string             `json:"slug" form:"slug"`
+	TenantName  string             `json:"name" form:"name"`
+	TenantAdmin string             `json:"admin" form:"admin"`
+	// The hash of the token of the admin of the library. The token itself is
+	// only shown once, when it is created.
+	TenantToken string    `json:"-" form:"-"`
+	CreatedAt   time.Time `json:"-" form:"-" bson:"createdat,omitempty"`
+	UpdatedAt   time.Time `json:"-" form:"-" bson:"updatedat,omitempty"`
+}
+
+// The headers with the token of the admin of the deployment, and of a library
+const (
+	adminTokenHeader  = "X-Admin-Token"
+	tenantTokenHeader = "X-Tenant-Token"
+)
+
+// Slugs end up in host names, so they are lowercase letters, digits and
+// dashes. Some of them are kept for the deployment itself.
+var (
+	tenantSlug     = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,30}[a-z0-9]$`)
+	reservedSlugs  = []string{"www", "api", "admin"}
+	tenantSlugHelp = "slug must be 2 to 32 lowercase letters, digits or dashes"
+)
+
+func tenantToMap(t Tenant) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        t.ID.Hex(),
+		"slug":      t.TenantSlug,
+		"name":      t.TenantName,
+		"admin":     t.TenantAdmin,
+		"createdAt": formatTimestamp(t.CreatedAt),
+		"updatedAt": formatTimestamp(t.UpdatedAt),
+	}
+}
+
+// Creates a new random token, and the hash we store in its place.
+func newSecretToken() (string, string, error) {
+	data := make([]byte, 24)
+	if _, err := rand.Read(data); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(data)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Compares the strings in constant time, so the time it takes does not tell
+// how much of a token was right.
+func sameToken(a string, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Returns the tenant a request is for, given the host it was sent to. Hosts
+// that are not a subdomain of the domain are for the default library.
+func tenantFromHost(host string, domain string) string {
+	if domain == "" {
+		return ""
+	}
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	slug, ok := strings.CutSuffix(host, "."+strings.ToLower(domain))
+	if !ok || strings.Contains(slug, ".") || slices.Contains(reservedSlugs, slug) {
+		return ""
+	}
+	return slug
+}
+
+// Cleans up and validates a tenant before storing it.
+func validateTenant(t *Tenant) string {
+	t.TenantSlug = strings.ToLower(strings.TrimSpace(t.TenantSlug))
+	t.TenantName = strings.TrimSpace(t.TenantName)
+	t.TenantAdmin = strings.ToLower(strings.TrimSpace(t.TenantAdmin))
+
+	if !tenantSlug.MatchString(t.TenantSlug) {
+		return tenantSlugHelp
+	}
+	if slices.Contains(reservedSlugs, t.TenantSlug) {
+		return "slug is reserved"
+	}
+	if t.TenantName == "" {
+		return "name is required"
+	}
+	if _, err := mail.ParseAddress(t.TenantAdmin); err != nil {
+		return "invalid admin email"
+	}
+	return ""
+}
+
+// The libraries of the tenants, built the first time somebody visits them.
+// Building one takes a while, so the lock is only held to look them up; the
+// requests for a library being built wait for it, the others don't.
+type Tenants struct {
+	client    *mongo.Client
+	cfg       Config
+	coll      *Repository
+	mu        sync.Mutex
+	libraries map[string]*Library
+	// Closed once the library is built, or failed to be
+	opening map[string]chan struct{}
+}
+
+func newTenants(client *mongo.Client, cfg Config, coll *Repository) *Tenants {
+	return &Tenants{client: client, cfg: cfg, coll: coll, libraries: map[string]*Library{}, opening: map[string]chan struct{}{}}
+}
+
+func findTenant(coll *Repository, slug string) (Tenant, error) {
+	var tenant Tenant
+	err := coll.FindOne(context.TODO(), bson.M{"tenantslug": slug}).Decode(&tenant)
+	return tenant, err
+}
+
+// The email of the admin of the library the users belong to, as its tenant
+// has it, or "" for the default library.
+func libraryAdmin(users *Repository) (string, error) {
+	if users.tenant == "" {
+		return "", nil
+	}
+	// The tenants themselves belong to the default library
+	tenant, err := findTenant(&Repository{Collection: users.Database().Collection("tenants")}, users.tenant)
+	return tenant.TenantAdmin, err
+}
+
+// Returns the library of the tenant, and whether there is such a tenant.
+func (t *Tenants) library(slug string) (*Library, bool, error) {
+	t.mu.Lock()
+	for {
+		if lib, ok := t.libraries[slug]; ok {
+			t.mu.Unlock()
+			return lib, true, nil
+		}
+		done, ok := t.opening[slug]
+		if !ok {
+			break
+		}
+		t.mu.Unlock()
+		<-done
+		t.mu.Lock()
+	}
+	done := make(chan struct{})
+	t.opening[slug] = done
+	t.mu.Unlock()
+
+	lib, ok, err := t.open(slug)
+
+	t.mu.Lock()
+	delete(t.opening, slug)
+	if ok && err == nil {
+		t.libraries[slug] = lib
+	}
+	t.mu.Unlock()
+	close(done)
+	return lib, ok, err
+}
+
+// Builds the library of the tenant, if there is one.
+func (t *Tenants) open(slug string) (*Library, bool, error) {
+	if _, err := findTenant(t.coll, slug); err == mongo.ErrNoDocuments {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	lib, err := newLibrary(t.client, t.cfg, slug)
+	if err != nil {
+		return nil, false, err
+	}
+	registerTenantAdminRoutes(lib.Echo, slug, lib.admin, t.coll)
+	lib.startJobs()
+	return lib, true, nil
+}
+
+// Middleware handing the requests for a tenant over to its library, before
+// the default library even looks at them.
+func (t *Tenants) Route(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		slug := tenantFromHost(c.Request().Host, t.cfg.TenantDomain)
+		if slug == "" {
+			return next(c)
+		}
+		lib, ok, err := t.library(slug)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to open library"})
+		}
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "library not found"})
+		}
+		lib.ServeHTTP(c.Response(), c.Request())
+		return nil
+	}
+}
+
+// Only lets through the requests with the token of the admin of the
+// deployment, who is the one creating the libraries.
+func deploymentAdmin(cfg Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if cfg.TenantDomain == "" {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "multi-tenant mode is disabled"})
+			}
+			if !sameToken(cfg.AdminToken, c.Request().Header.Get(adminTokenHeader)) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "invalid admin token"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// Registers the endpoints of the default library to create and list the
+// other libraries.
+func registerTenantRoutes(e *echo.Echo, cfg Config, adminLog *AdminLog, tenants *Tenants) {
+	admin := deploymentAdmin(cfg)
+	coll := tenants.coll
+
+	e.GET("/api/tenants", func(c echo.Context) error {
+		opts := options.Find().SetSort(bson.D{{Key: "tenantslug", Value: 1}})
+		cursor, err := coll.Find(context.TODO(), bson.D{}, opts)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list tenants"})
+		}
+		var results []Tenant
+		if err = cursor.All(context.TODO(), &results); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list tenants"})
+		}
+
+		ret := []map[string]interface{}{}
+		for _, t := range results {
+			ret = append(ret, tenantToMap(t))
+		}
+		return c.JSON(http.StatusOK, ret)
+	}, admin)
+
+	// The response holds the token of the admin of the new library, which is
+	// the only time it is shown
+	e.POST("/api/tenants", func(c echo.Context) error {
+		tenant := new(Tenant)
+		if err := c.Bind(tenant); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if msg := validateTenant(tenant); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+		if _, err := findTenant(coll, tenant.TenantSlug); err == nil {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "slug is already taken"})
+		}
+
+		token, hash, err := newSecretToken()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create token"})
+		}
+		tenant.ID = primitive.NewObjectID()
+		tenant.TenantToken = hash
+		// Somebody might have taken the slug since we looked, see tenantIndexes
+		_, err = coll.InsertOne(c.Request().Context(), tenant)
+		if mongo.IsDuplicateKeyError(err) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "slug is already taken"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert tenant"})
+		}
+
+		adminLog.Record(c, AdminTenantCreate, tenant.TenantSlug, bson.M{"name": tenant.TenantName, "admin": tenant.TenantAdmin})
+		ret := tenantToMap(*tenant)
+		ret["token"] = token
+		return c.JSON(http.StatusOK, ret)
+	}, admin)
+}
+
+// Only lets through the requests with the token of the admin of the library.
+func tenantAdmin(slug string, coll *Repository) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			tenant, err := findTenant(coll, slug)
+			if err != nil {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "library not found"})
+			}
+			if !sameToken(tenant.TenantToken, hashToken(c.Request().Header.Get(tenantTokenHeader))) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "invalid tenant token"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// Registers the endpoints of a library for its admin, who may see it,
+// rename it, hand it over to somebody else, or replace a token that leaked.
+// They go by the token, not by a login, hence their public policy.
+func registerTenantAdminRoutes(e *echo.Echo, slug string, adminLog *AdminLog, coll *Repository) {
+	admin := tenantAdmin(slug, coll)
+
+	e.GET("/api/tenant", func(c echo.Context) error {
+		tenant, err := findTenant(coll, slug)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "library not found"})
+		}
+		return c.JSON(http.StatusOK, tenantToMap(tenant))
+	}, admin)
+
+	e.PUT("/api/tenant", func(c echo.Context) error {
+		tenant, err := findTenant(coll, slug)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "library not found"})
+		}
+		var req struct {
+			Name  string `json:"name" form:"name"`
+			Admin string `json:"admin" form:"admin"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if req.Name != "" {
+			tenant.TenantName = req.Name
+		}
+		if req.Admin != "" {
+			tenant.TenantAdmin = req.Admin
+		}
+		if msg := validateTenant(&tenant); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		update := bson.M{"$set": bson.M{"tenantname": tenant.TenantName, "tenantadmin": tenant.TenantAdmin}}
+		if _, err = coll.UpdateOne(c.Request().Context(), bson.M{"_id": tenant.ID}, update); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update tenant"})
+		}
+		adminLog.Record(c, AdminTenantUpdate, slug, bson.M{"name": tenant.TenantName, "admin": tenant.TenantAdmin})
+		return c.JSON(http.StatusOK, tenantToMap(tenant))
+	}, admin)
+
+	e.POST("/api/tenant/token", func(c echo.Context) error {
+		token, hash, err := newSecretToken()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create token"})
+		}
+		update := bson.M{"$set": bson.M{"tenanttoken": hash}}
+		if _, err = coll.UpdateOne(c.Request().Context(), bson.M{"tenantslug": slug}, update); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update tenant"})
+		}
+		adminLog.Record(c, AdminTenantToken, slug, nil)
+		return c.JSON(http.StatusOK, map[string]string{"token": token})
+	}, admin)
+}
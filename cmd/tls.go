@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Without a reverse proxy in front of it, the server can serve HTTPS itself,
+// with a certificate of its own (TLS_CERT_FILE and TLS_KEY_FILE) or one it
+// gets from Let's Encrypt for the domains in TLS_DOMAINS. Either way, plain
+// HTTP only redirects to HTTPS.
+func serve(lib *Library, cfg Config, tenants *Tenants) error {
+	switch {
+	case cfg.TLSCertFile != "" && cfg.TLSKeyFile != "":
+		go redirectToHTTPS(cfg, http.HandlerFunc(httpsRedirect(cfg)))
+		return lib.StartTLS(cfg.HTTPSAddr, cfg.TLSCertFile, cfg.TLSKeyFile)
+	case len(cfg.TLSDomains) > 0:
+		lib.AutoTLSManager.HostPolicy = hostPolicy(cfg, tenants)
+		lib.AutoTLSManager.Cache = autocert.DirCache(cfg.TLSCacheDir)
+		// Let's Encrypt checks we own the domains over plain HTTP, which is
+		// why it must be reachable on port 80
+		go redirectToHTTPS(cfg, lib.AutoTLSManager.HTTPHandler(httpsRedirect(cfg)))
+		return lib.StartAutoTLS(cfg.HTTPSAddr)
+	}
+	return lib.Start(cfg.HTTPAddr)
+}
+
+func redirectToHTTPS(cfg Config, handler http.Handler) {
+	slog.Info("redirecting http to https", "http", cfg.HTTPAddr, "https", cfg.HTTPSAddr)
+	if err := http.ListenAndServe(cfg.HTTPAddr, handler); err != nil {
+		fatal("the http server stopped", "err", err)
+	}
+}
+
+// Sends the browser to the same address over HTTPS, on the port we serve it
+// on unless it is the usual one.
+func httpsRedirect(cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if _, port, err := net.SplitHostPort(cfg.HTTPSAddr); err == nil && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
+
+// Only asks Let's Encrypt for certificates of our own domains, and of the
+// libraries of the tenants that exist, so nobody can make us request
+// certificates for made up host names.
+func hostPolicy(cfg Config, tenants *Tenants) autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		host = strings.ToLower(host)
+		if slices.Contains(cfg.TLSDomains, host) {
+			return nil
+		}
+		if slug := tenantFromHost(host, cfg.TenantDomain); slug != "" {
+			if _, err := findTenant(tenants.coll, slug); err == nil {
+				return nil
+			}
+		}
+		return errors.New("unknown host " + host)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Programs using the API can't keep cookies as easily as a browser, so they
+// get tokens when logging in instead, which they send along in the
+// "Authorization: Bearer <token>" header. These are JWTs (https://jwt.io),
+// signed with a secret, holding the id of the user and when they expire,
+// and the token version of the user: resetting the password or ending all
+// the sessions of the user bumps it, which revokes the tokens issued before.
+// The access tokens are short-lived; once expired, the refresh token gets
+// a new pair without having to log in again.
+type Tokens struct {
+	secret        []byte
+	accessMaxAge  time.Duration
+	refreshMaxAge time.Duration
+}
+
+// The kinds of tokens, so a refresh token can't be used as an access token
+const (
+	AccessToken  = "access"
+	RefreshToken = "refresh"
+)
+
+type tokenClaims struct {
+	Kind    string `json:"kind"`
+	Version int    `json:"ver,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Without a configured secret we make one up, which means the tokens stop
+// working after a restart.
+func newTokens(cfg Config) *Tokens {
+	secret := []byte(cfg.JWTSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			fatal("failed to make up a secret", "err", err)
+		}
+		slog.Warn("JWT_SECRET is not set, tokens will not survive a restart")
+	}
+	return &Tokens{
+		secret:        secret,
+		accessMaxAge:  time.Duration(cfg.AccessTokenMinutes) * time.Minute,
+		refreshMaxAge: time.Duration(cfg.RefreshTokenDays) * 24 * time.Hour,
+	}
+}
+
+func (t *Tokens) issue(user User, kind string, maxAge time.Duration) (string, error) {
+	now := time.Now()
+	claims := tokenClaims{
+		Kind:    kind,
+		Version: user.UserTokenVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.ID.Hex(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(maxAge)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(t.secret)
+}
+
+// Issues a new access and refresh token for the user.
+func (t *Tokens) Issue(user User) (map[string]interface{}, error) {
+	access, err := t.issue(user, AccessToken, t.accessMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := t.issue(user, RefreshToken, t.refreshMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"accessToken":  access,
+		"refreshToken": refresh,
+		"expiresIn":    int(t.accessMaxAge.Seconds()),
+	}, nil
+}
+
+// Checks the signature, the expiry and the kind of the token, and returns
+// its user, unless the token was revoked since it was issued.
+func (t *Tokens) Parse(users *Repository, value string, kind string) (User, error) {
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(value, &claims, func(*jwt.Token) (interface{}, error) {
+		return t.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return User{}, err
+	}
+	if claims.Kind != kind {
+		return User{}, errors.New("wrong kind of token")
+	}
+	id, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return User{}, err
+	}
+	user, err := findUserByID(users, id)
+	if err != nil {
+		return User{}, err
+	}
+	if claims.Version != user.UserTokenVersion {
+		return User{}, errors.New("revoked token")
+	}
+	return user, nil
+}
+
+// Revokes the tokens issued to the user so far.
+func revokeTokens(ctx context.Context, users *Repository, id primitive.ObjectID) error {
+	_, err := users.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"usertokenversion": 1}})
+	return err
+}
+
+// Middleware looking up the user of the access token, if the request has
+// one. Unlike a missing token, a wrong or expired one is an error, so the
+// client knows it has to refresh it.
+func (t *Tokens) Authenticate(users *Repository) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			value, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			// Personal tokens are checked by personalTokenAuth
+			if !ok || strings.HasPrefix(strings.TrimSpace(value), personalTokenStart) {
+				return next(c)
+			}
+			user, err := t.Parse(users, strings.TrimSpace(value), AccessToken)
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid or expired token"})
+			}
+			setUser(c, user)
+			return next(c)
+		}
+	}
+}
+
+// Registers the endpoint trading a refresh token for new tokens.
+func registerTokenRoutes(e *echo.Echo, tokens *Tokens, users *Repository) {
+	e.POST("/api/token/refresh", func(c echo.Context) error {
+		var req struct {
+			RefreshToken string `json:"refreshToken" form:"refreshToken"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		user, err := tokens.Parse(users, req.RefreshToken, RefreshToken)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid or expired token"})
+		}
+
+		ret, err := tokens.Issue(user)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to issue token"})
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+}
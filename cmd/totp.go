@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Two-factor authentication: besides the password, users may require a code
+// from an authenticator app on their phone to log in. The codes are TOTPs
+// (RFC 6238): the app and the server share a secret, and both compute a
+// code of six digits from it and the current time, a new one every 30
+// seconds. The secret is stored encrypted with ENCRYPTION_KEY, so a copy of
+// the database is not enough to compute the codes. For when the phone is
+// lost, users get a few backup codes that work once each, or an admin can
+// turn it off for them.
+type TwoFactor struct {
+	key    []byte
+	issuer string
+}
+
+const (
+	totpStep        = 30
+	totpDigits      = 6
+	backupCodeCount = 10
+)
+
+func newTwoFactor(cfg Config) *TwoFactor {
+	tf := &TwoFactor{issuer: cfg.TOTPIssuer}
+	if cfg.EncryptionKey != "" {
+		sum := sha256.Sum256([]byte(cfg.EncryptionKey))
+		tf.key = sum[:]
+	}
+	return tf
+}
+
+var errNoEncryptionKey = errors.New("two-factor authentication needs ENCRYPTION_KEY to be set")
+
+func (tf *TwoFactor) seal(secret []byte) (string, error) {
+	if tf.key == nil {
+		return "", errNoEncryptionKey
+	}
+	block, err := aes.NewCipher(tf.key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func (tf *TwoFactor) open(sealed string) ([]byte, error) {
+	if tf.key == nil {
+		return nil, errNoEncryptionKey
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(tf.key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("invalid secret")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// The code for one time step, as in RFC 4226: the HMAC of the step, cut down
+// to a number of six digits.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// Returns the time step the code belongs to, accepting the steps right
+// before and after the current one, as the clock of a phone is never quite
+// right. Steps up to the last one used are refused, so a code can't be used
+// twice.
+func totpStepOf(secret []byte, code string, last int64) (int64, bool) {
+	now := time.Now().Unix() / totpStep
+	for step := now - 1; step <= now+1; step++ {
+		if step > last && hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// The address the authenticator apps read from the QR code
+func (tf *TwoFactor) provisioningURI(user User, secret []byte) string {
+	label := url.PathEscape(tf.issuer + ":" + user.UserEmail)
+	query := url.Values{}
+	query.Set("secret", strings.TrimRight(base32.StdEncoding.EncodeToString(secret), "="))
+	query.Set("issuer", tf.issuer)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Draws the QR code as a PNG, inlined in the page as a data: URL.
+func qrCodeDataURL(content string) (string, error) {
+	code, err := qr.Encode(content, qr.M, qr.Auto)
+	if err != nil {
+		return "", err
+	}
+	if code, err = barcode.Scale(code, 200, 200); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, code); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Creates the backup codes, and the hashes we store in their place.
+func newBackupCodes() ([]string, []string, error) {
+	codes, hashes := []string{}, []string{}
+	for i := 0; i < backupCodeCount; i++ {
+		data := make([]byte, 5)
+		if _, err := rand.Read(data); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(data)
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// Checks the code of the second factor of the user: a code of the app, or
+// one of the backup codes, which then stops working.
+func (tf *TwoFactor) Check(ctx context.Context, users *Repository, user User, code string) bool {
+	code = strings.ToLower(strings.ReplaceAll(code, " ", ""))
+	if secret, err := tf.open(user.UserTOTPSecret); err == nil {
+		if step, ok := totpStepOf(secret, code, user.UserTOTPLast); ok {
+			_, err = users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"usertotplast": step}})
+			return err == nil
+		}
+	}
+
+	filter := bson.M{"_id": user.ID, "userbackupcodes": hashToken(code)}
+	result, err := users.UpdateOne(ctx, filter, bson.M{"$pull": bson.M{"userbackupcodes": hashToken(code)}})
+	return err == nil && result.ModifiedCount > 0
+}
+
+// The setup page: either the QR code to enroll, or how many backup codes
+// are left.
+func (tf *TwoFactor) setupPage(c echo.Context, users *Repository, user User, message string) error {
+	data := map[string]interface{}{"enabled": user.UserTOTPSecret != "", "backupCodes": len(user.UserBackupCodes), "message": message}
+	if user.UserTOTPSecret != "" {
+		return c.Render(200, "totp-setup", data)
+	}
+
+	// Every visit makes a new secret, which only counts once the user
+	// entered a code computed from it
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create secret"})
+	}
+	sealed, err := tf.seal(secret)
+	if err != nil {
+		data["message"] = err.Error()
+		return c.Render(200, "totp-setup", data)
+	}
+	if _, err = users.UpdateOne(c.Request().Context(), bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"usertotppending": sealed}}); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update user"})
+	}
+	uri := tf.provisioningURI(user, secret)
+	if data["qr"], err = qrCodeDataURL(uri); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to draw qr code"})
+	}
+	data["secret"] = strings.TrimRight(base32.StdEncoding.EncodeToString(secret), "=")
+	return c.Render(200, "totp-setup", data)
+}
+
+// Answers the second step of logging in with the form again. Who comes from
+// another provider (see oauth.go) was not sent by htmx, and gets a page of
+// its own.
+func totpLoginPage(c echo.Context, status int, message string) error {
+	data := map[string]interface{}{"message": message, "csrf": csrfToken(c)}
+	if c.Request().Header.Get("HX-Request") != "" {
+		if status != http.StatusOK {
+			status = http.StatusUnprocessableEntity
+		}
+		return c.Render(status, "login-totp", data)
+	}
+	return c.Render(status, "login-totp-page", data)
+}
+
+// Registers the pages to turn two-factor authentication on and off, the
+// second step of logging in, and the endpoint for the admins to turn it off
+// for somebody who lost their phone.
+func registerTOTPRoutes(e *echo.Echo, sessions *Sessions, tf *TwoFactor, guard *LoginGuard, admin *AdminLog, users *Repository) {
+	e.GET("/account/2fa", func(c echo.Context) error {
+		user, _ := currentUser(c)
+		return tf.setupPage(c, users, user, "")
+	})
+
+	e.POST("/account/2fa/enable", func(c echo.Context) error {
+		user, _ := currentUser(c)
+		if user.UserTOTPSecret != "" || user.UserTOTPPending == "" {
+			return tf.setupPage(c, users, user, "")
+		}
+		secret, err := tf.open(user.UserTOTPPending)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read secret"})
+		}
+		step, ok := totpStepOf(secret, strings.TrimSpace(c.FormValue("code")), 0)
+		if !ok {
+			return tf.setupPage(c, users, user, "The code is not right, please try again with this new QR code.")
+		}
+
+		codes, hashes, err := newBackupCodes()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to create backup codes"})
+		}
+		update := bson.M{
+			"$set":   bson.M{"usertotpsecret": user.UserTOTPPending, "usertotplast": step, "userbackupcodes": hashes},
+			"$unset": bson.M{"usertotppending": ""},
+		}
+		if _, err = users.UpdateOne(c.Request().Context(), bson.M{"_id": user.ID}, update); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update user"})
+		}
+		return c.Render(200, "totp-backup-codes", codes)
+	})
+
+	e.POST("/account/2fa/disable", func(c echo.Context) error {
+		user, _ := currentUser(c)
+		if !tf.Check(c.Request().Context(), users, user, c.FormValue("code")) {
+			return tf.setupPage(c, users, user, "The code is not right.")
+		}
+		update := bson.M{"$unset": bson.M{"usertotpsecret": "", "usertotplast": "", "userbackupcodes": ""}}
+		if _, err := users.UpdateOne(c.Request().Context(), bson.M{"_id": user.ID}, update); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update user"})
+		}
+		user.UserTOTPSecret = ""
+		return tf.setupPage(c, users, user, "Two-factor authentication is off.")
+	})
+
+	e.GET("/login/totp", func(c echo.Context) error {
+		return totpLoginPage(c, http.StatusOK, "")
+	})
+
+	e.POST("/login/totp", func(c echo.Context) error {
+		id, ok := sessions.pendingUserID(c)
+		if !ok {
+			return totpLoginPage(c, http.StatusUnauthorized, "Please log in again, it took too long.")
+		}
+		user, err := findUserByID(users, id)
+		if err != nil {
+			return totpLoginPage(c, http.StatusUnauthorized, "Please log in again.")
+		}
+		if _, locked := guard.Locked(user.UserEmail, c.RealIP()); locked {
+			return totpLoginPage(c, http.StatusTooManyRequests, "Too many failed logins, try again later.")
+		}
+		if !tf.Check(c.Request().Context(), users, user, c.FormValue("code")) {
+			time.Sleep(guard.Fail(c.Request().Context(), user.UserEmail, c.RealIP()))
+			return totpLoginPage(c, http.StatusUnauthorized, "The code is not right.")
+		}
+
+		guard.Succeed(c.Request().Context(), user.UserEmail)
+		if err := sessions.Start(c, user); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start session"})
+		}
+		if c.Request().Header.Get("HX-Request") == "" {
+			return c.Redirect(http.StatusSeeOther, "/")
+		}
+		c.Response().Header().Set("HX-Redirect", "/")
+		return c.NoContent(http.StatusOK)
+	})
+
+	e.POST("/api/users/:id/2fa/reset", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		update := bson.M{"$unset": bson.M{"usertotpsecret": "", "usertotppending": "", "usertotplast": "", "userbackupcodes": ""}}
+		result, err := users.UpdateOne(c.Request().Context(), bson.M{"_id": id}, update)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update user"})
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "user not found"})
+		}
+		admin.Record(c, AdminTOTPReset, id.Hex(), nil)
+		return c.JSON(http.StatusOK, result)
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The spans of our own, e.g., of the rendering of the templates
+var tracer = otel.Tracer("github.com/CAPS-Cloud/exercises/cmd")
+
+// The traces show what a request went through: the handler, the rendering
+// of the templates, the database operations and the requests to the Open
+// Library, Wikidata and Google Books, each as a span with how long it took.
+// They are made with OpenTelemetry and sent in batches, over OTLP/HTTP, to
+// the collector at OTEL_EXPORTER_OTLP_ENDPOINT, e.g., http://localhost:4318,
+// which passes them on to Jaeger, Tempo... Without one, nothing is traced.
+//
+// Only OTEL_TRACES_SAMPLER_ARG of the requests, e.g., 0.1 for one in ten,
+// start a trace. A request with a traceparent header (see
+// https://www.w3.org/TR/trace-context/) continues the trace of the caller
+// instead, and is traced when the caller's was, as its sampled flag says.
+//
+// The tracer is the one of the deployment, shared by the libraries of all
+// tenants. The returned function sends the spans left before we stop.
+func setupTracing(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(strings.TrimSuffix(cfg.OTLPEndpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Traces every request, in a span named after its route, e.g.,
+// "/books/:id", or nil without a collector. It must come before
+// requestLogger, which writes the ID of the trace next to the one of the
+// request.
+func tracingMiddleware(cfg Config) echo.MiddlewareFunc {
+	if cfg.OTLPEndpoint == "" {
+		return nil
+	}
+	return otelecho.Middleware(cfg.ServiceName)
+}
+
+// The ID of the trace of the context, if it is part of one that is sent to
+// the collector
+func traceIDFrom(ctx context.Context) string {
+	if span := trace.SpanContextFromContext(ctx); span.IsSampled() {
+		return span.TraceID().String()
+	}
+	return ""
+}
+
+// Traces the commands the driver sends to the database, within the span of
+// the request that caused them. The commands of the background jobs, which
+// aren't part of a trace, aren't traced.
+func mongoTracing() *event.CommandMonitor {
+	monitor := otelmongo.NewMonitor()
+	started := monitor.Started
+	monitor.Started = func(ctx context.Context, e *event.CommandStartedEvent) {
+		if trace.SpanContextFromContext(ctx).IsValid() {
+			started(ctx, e)
+		}
+	}
+	return monitor
+}
+
+// An HTTP client for the services we look books and authors up with. Its
+// requests are spans of the trace of their context, and pass the trace on
+// to the service in a traceparent header.
+func tracedClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: otelhttp.NewTransport(http.DefaultTransport)}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Somebody who can log in to change the library. Unlike the members, who
+// borrow the books, users are the people running it. We never store the
+// password itself, only its bcrypt hash.
+type User struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	UserName     string             `json:"name"`
+	UserEmail    string             `json:"email"`
+	UserPassword string             `json:"-"`
+	UserRole     string             `json:"role"`
+	// The accounts somewhere else the user logs in with, see oauth.go
+	UserIdentities []Identity `json:"-" bson:",omitempty"`
+	// The encrypted secret of the authenticator app, the one waiting to be
+	// confirmed, the last time step a code was used for, and the hashes of
+	// the backup codes left (see totp.go)
+	UserTOTPSecret  string   `json:"-" bson:",omitempty"`
+	UserTOTPPending string   `json:"-" bson:",omitempty"`
+	UserTOTPLast    int64    `json:"-" bson:",omitempty"`
+	UserBackupCodes []string `json:"-" bson:",omitempty"`
+	// Goes up to revoke the API tokens issued so far, see tokens.go
+	UserTokenVersion int       `json:"-" bson:",omitempty"`
+	CreatedAt        time.Time `json:"-" bson:"createdat,omitempty"`
+	UpdatedAt        time.Time `json:"-" bson:"updatedat,omitempty"`
+	// How the user likes the pages to look, see preferences.go
+	UserPreferences Preferences `json:"-"`
+}
+
+// The first user to sign up in the default library is its admin, and in
+// the library of a tenant the one with its admin's email. The admins make
+// the librarians staff; everybody else is a reader.
+const (
+	RoleAdmin = "admin"
+	RoleStaff = "staff"
+	RoleUser  = "user"
+)
+
+// Anything shorter is too easy to guess
+const minPasswordLength = 8
+
+// What is sent to sign up (all of it but the code) or log in (without the
+// name, and the code of the second factor if the user has one). The password
+// is not a field of the user, so it can never be stored by accident.
+type credentials struct {
+	Name     string `json:"name" form:"name"`
+	Email    string `json:"email" form:"email"`
+	Password string `json:"password" form:"password"`
+	Code     string `json:"code" form:"code"`
+}
+
+var unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+
+func userToMap(u User) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        u.ID.Hex(),
+		"name":      u.UserName,
+		"email":     u.UserEmail,
+		"role":      u.UserRole,
+		"twoFactor": u.UserTOTPSecret != "",
+		"createdAt": formatTimestamp(u.CreatedAt),
+		"updatedAt": formatTimestamp(u.UpdatedAt),
+	}
+}
+
+func findUserByEmail(coll *Repository, email string) (User, error) {
+	var user User
+	err := coll.FindOne(context.TODO(), bson.M{"useremail": strings.ToLower(strings.TrimSpace(email))}).Decode(&user)
+	return user, err
+}
+
+// Whether the user is the only admin left, who can't stop being one, or the
+// library would have nobody to manage the users.
+func lastAdmin(ctx context.Context, coll *Repository, user User) (bool, error) {
+	if user.UserRole != RoleAdmin {
+		return false, nil
+	}
+	admins, err := coll.CountDocuments(ctx, bson.M{"userrole": RoleAdmin})
+	return admins <= 1, err
+}
+
+func findUserByID(coll *Repository, id primitive.ObjectID) (User, error) {
+	var user User
+	err := coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&user)
+	return user, err
+}
+
+// Cleans up and validates a new user, and hashes the password.
+func validateUser(coll *Repository, u *User, password string) string {
+	u.UserName = strings.TrimSpace(u.UserName)
+	u.UserEmail = strings.ToLower(strings.TrimSpace(u.UserEmail))
+
+	if u.UserName == "" {
+		return "name is required"
+	}
+	if _, err := mail.ParseAddress(u.UserEmail); err != nil {
+		return "invalid email"
+	}
+	if _, err := findUserByEmail(coll, u.UserEmail); err == nil {
+		return "email is already registered"
+	}
+
+	hash, msg := hashPassword(password)
+	u.UserPassword = hash
+	return msg
+}
+
+// Checks the password is good enough, and returns its hash.
+func hashPassword(password string) (string, string) {
+	if len(password) < minPasswordLength {
+		return "", "password must be at least 8 characters long"
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "failed to hash password"
+	}
+	return string(hash), ""
+}
+
+// Stores a new user. In the library of a tenant, the one with the email of
+// its admin (see tenants.go) is the admin; in the default library, the
+// first one to sign up.
+func insertUser(ctx context.Context, coll *Repository, u *User) error {
+	u.UserRole = RoleUser
+	if coll.tenant != "" {
+		admin, err := libraryAdmin(coll)
+		if err != nil {
+			return err
+		}
+		if admin != "" && strings.EqualFold(u.UserEmail, admin) {
+			u.UserRole = RoleAdmin
+		}
+	} else {
+		count, err := coll.CountDocuments(context.TODO(), bson.M{})
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			u.UserRole = RoleAdmin
+		}
+	}
+	u.ID = primitive.NewObjectID()
+	_, err := coll.InsertOne(ctx, u)
+	return err
+}
+
+// Answers a form of the pages to sign up and log in: htmx gets the form
+// again, with the error, and other clients just the error, with the status.
+func authFormError(c echo.Context, status int, block string, email string, msg string) error {
+	if c.Request().Header.Get("HX-Request") != "" {
+		return c.Render(http.StatusUnprocessableEntity, block, map[string]string{"email": email, "message": msg})
+	}
+	return c.JSON(status, map[string]string{"error": msg})
+}
+
+// Answers a successful login: htmx reloads the whole page, so it shows the
+// user everywhere, and other clients get the user and the tokens to use the
+// API with (see tokens.go).
+func loggedIn(c echo.Context, tokens *Tokens, user User) error {
+	if c.Request().Header.Get("HX-Request") != "" {
+		c.Response().Header().Set("HX-Redirect", "/")
+		return c.NoContent(http.StatusOK)
+	}
+	ret, err := tokens.Issue(user)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to issue token"})
+	}
+	ret["user"] = userToMap(user)
+	return c.JSON(http.StatusOK, ret)
+}
+
+// Registers the pages and endpoints to sign up, log in and out.
+func registerUserRoutes(e *echo.Echo, sessions *Sessions, tokens *Tokens, tf *TwoFactor, guard *LoginGuard, admin *AdminLog, coll *Repository) {
+	e.GET("/signup", func(c echo.Context) error {
+		return c.Render(200, "signup", nil)
+	})
+
+	e.GET("/login", func(c echo.Context) error {
+		return c.Render(200, "login", nil)
+	})
+
+	// Who is logged in, shown in the header of every page
+	e.GET("/account/status", func(c echo.Context) error {
+		user, ok := currentUser(c)
+		if !ok {
+			return c.Render(200, "account-status", nil)
+		}
+		return c.Render(200, "account-status", userToMap(user))
+	})
+
+	e.GET("/api/me", func(c echo.Context) error {
+		user, ok := currentUser(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "login required"})
+		}
+		return c.JSON(http.StatusOK, userToMap(user))
+	})
+
+	// All the users, for the admins
+	e.GET("/api/users", func(c echo.Context) error {
+		opts := options.Find().SetSort(bson.D{{Key: "useremail", Value: 1}})
+		cursor, err := coll.Find(context.TODO(), bson.D{}, opts)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list users"})
+		}
+		var results []User
+		if err = cursor.All(context.TODO(), &results); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list users"})
+		}
+
+		ret := []map[string]interface{}{}
+		for _, u := range results {
+			ret = append(ret, userToMap(u))
+		}
+		return c.JSON(http.StatusOK, ret)
+	})
+
+	// Makes a user an admin, or not anymore. There is always at least one
+	// admin left, or nobody could make anybody an admin again.
+	e.PUT("/api/users/:id/role", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var req struct {
+			Role string `json:"role" form:"role"`
+		}
+		if err = c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		if _, ok := rolePermissions[req.Role]; !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "role must be admin, staff or user"})
+		}
+		user, err := findUserByID(coll, id)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "user not found"})
+		}
+		if user.UserRole == req.Role {
+			return c.JSON(http.StatusOK, userToMap(user))
+		}
+		last, err := lastAdmin(c.Request().Context(), coll, user)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count admins"})
+		}
+		if last {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "the last admin can't stop being one"})
+		}
+
+		if _, err = coll.UpdateOne(c.Request().Context(), bson.M{"_id": id}, bson.M{"$set": bson.M{"userrole": req.Role}}); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update user"})
+		}
+		admin.Record(c, AdminRoleChange, user.UserEmail, bson.M{"from": user.UserRole, "to": req.Role})
+		user.UserRole = req.Role
+		return c.JSON(http.StatusOK, userToMap(user))
+	})
+
+	e.POST("/signup", func(c echo.Context) error {
+		var req credentials
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		user := &User{UserName: req.Name, UserEmail: req.Email}
+		if msg := validateUser(coll, user, req.Password); msg != "" {
+			return authFormError(c, http.StatusBadRequest, "signup", user.UserEmail, msg)
+		}
+
+		if err := insertUser(c.Request().Context(), coll, user); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to insert user"})
+		}
+
+		if err := sessions.Start(c, *user); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start session"})
+		}
+		return loggedIn(c, tokens, *user)
+	})
+
+	e.POST("/login", func(c echo.Context) error {
+		var req credentials
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		email := strings.ToLower(strings.TrimSpace(req.Email))
+		if until, locked := guard.Locked(email, c.RealIP()); locked {
+			wait := int(math.Ceil(time.Until(until).Minutes()))
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+			return authFormError(c, http.StatusTooManyRequests, "login", req.Email, fmt.Sprintf("too many failed logins, try again in %d minutes", wait))
+		}
+
+		user, err := findUserByEmail(coll, email)
+		// For an unknown email we still compare the password, against a
+		// hash of nothing, so it takes as long as a wrong password and does
+		// not tell which one it was
+		hash := []byte(user.UserPassword)
+		if err != nil {
+			hash = unknownUserHash
+		}
+		if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil || err != nil {
+			time.Sleep(guard.Fail(c.Request().Context(), email, c.RealIP()))
+			return authFormError(c, http.StatusUnauthorized, "login", req.Email, "invalid email or password")
+		}
+
+		// With a second factor, the password is not enough: either the code
+		// came along, or htmx asks for it in a second step
+		if user.UserTOTPSecret != "" {
+			switch {
+			case req.Code != "":
+				if !tf.Check(c.Request().Context(), coll, user, req.Code) {
+					time.Sleep(guard.Fail(c.Request().Context(), email, c.RealIP()))
+					return authFormError(c, http.StatusUnauthorized, "login", req.Email, "invalid code")
+				}
+			case c.Request().Header.Get("HX-Request") != "":
+				sessions.StartPending(c, user)
+				return totpLoginPage(c, http.StatusOK, "")
+			default:
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "code required"})
+			}
+		}
+		guard.Succeed(c.Request().Context(), email)
+
+		if err := sessions.Start(c, user); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to start session"})
+		}
+		return loggedIn(c, tokens, user)
+	})
+
+	e.POST("/logout", func(c echo.Context) error {
+		sessions.End(c)
+		c.Response().Header().Set("HX-Redirect", "/")
+		return c.NoContent(http.StatusOK)
+	})
+}
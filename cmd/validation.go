@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// What is wrong with a form, by the name of the field, e.g., "language" for
+// a language that isn't an ISO 639-1 code. Problems with the form as a whole,
+// such as a duplicate book, are under "form".
+type fieldErrors map[string]string
+
+// The fields of the book forms, in the order they are checked
+var bookFormFields = []string{"form", "isbn", "name", "author", "pages", "year", "language", "audience", "ddc", "lcc", "price", "currency", "description"}
+
+// The first problem, in the order of the form, for the API clients that get
+// one message only.
+func (e fieldErrors) first() string {
+	for _, field := range bookFormFields {
+		if msg, ok := e[field]; ok {
+			return msg
+		}
+	}
+	return ""
+}
+
+// Checks the book and normalizes what it can, e.g., "EN" to "en". It finds
+// all the problems at once, so the form can show them next to their fields.
+func validateBook(book *BookStore) fieldErrors {
+	errs := fieldErrors{}
+	if strings.TrimSpace(book.BookName) == "" {
+		errs["name"] = "name is required"
+	}
+	if strings.TrimSpace(book.BookAuthor) == "" {
+		errs["author"] = "author is required"
+	}
+
+	var ok bool
+	if book.BookLanguage, ok = normalizeLanguage(book.BookLanguage); !ok {
+		errs["language"] = "language must be an ISO 639-1 code"
+	}
+	if book.BookAudience, ok = normalizeAudience(book.BookAudience); !ok {
+		errs["audience"] = "audience must be one of " + strings.Join(audiences, ", ")
+	}
+	if book.BookDescriptionHTML, ok = renderDescription(book.BookDescription); !ok {
+		errs["description"] = "description is too long"
+	}
+	// These messages start with the name of the field they are about
+	var msg string
+	if book.BookCurrency, msg = validatePrice(book.BookPrice, book.BookCurrency); msg != "" {
+		errs[strings.Fields(msg)[0]] = msg
+	}
+	if msg = validateClassification(book); msg != "" {
+		errs[strings.Fields(msg)[0]] = msg
+	}
+	book.BookISBNKey = normalizeISBN(book.BookISBN)
+	return errs
+}
+
+// Answers a form that didn't pass. htmx gets the form again, with what was
+// typed in and the problems next to the fields; the 422 tells it to swap
+// the form anyway (see index.js). API clients get the first problem.
+func bookFormError(c echo.Context, status int, name string, data map[string]interface{}, errs fieldErrors) error {
+	if c.Request().Header.Get("HX-Request") == "" {
+		return c.JSON(status, map[string]string{"error": errs.first()})
+	}
+	data["errors"] = errs
+	return c.Render(http.StatusUnprocessableEntity, name, data)
+}
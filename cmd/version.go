@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The commit the server was built from and when, set when building it:
+//
+//	go build -ldflags "-X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)" ./cmd
+var (
+	commit    = ""
+	buildDate = ""
+)
+
+// The commit and the build date, from the flags of the build, or else from
+// what Go records of the repository it was built in, if anything
+func buildInfo() (string, string) {
+	rev, date := commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && rev == "":
+				rev = s.Value
+			case s.Key == "vcs.time" && date == "":
+				date = s.Value
+			}
+		}
+	}
+	if rev == "" {
+		rev = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return rev, date
+}
+
+// Registers /api/version, which tells what is running where, to debug a
+// deployed server: the commit it was built from, when, and with which Go,
+// the profile of its configuration (APP_PROFILE) and where it keeps its
+// data.
+func registerVersionRoutes(e *echo.Echo, cfg Config) {
+	e.GET("/api/version", func(c echo.Context) error {
+		rev, date := buildInfo()
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"commit":    rev,
+			"buildDate": date,
+			"goVersion": runtime.Version(),
+			"profile":   cfg.Profile,
+			"storage": map[string]string{
+				"database": "mongodb",
+				"sessions": cfg.SessionStore,
+			},
+		})
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A work is the book as the author wrote it, while every BookStore record is
+// one edition of it: a different ISBN, year, translation or page count. The
+// editions point to the work they belong to.
+type Work struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	WorkTitle  string             `bson:"worktitle"`
+	WorkAuthor string             `bson:"workauthor"`
+	CreatedAt  time.Time          `bson:"createdat,omitempty"`
+	UpdatedAt  time.Time          `bson:"updatedat,omitempty"`
+}
+
+func workEditions(books *Repository, id primitive.ObjectID) ([]BookStore, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "bookyear", Value: 1}})
+	cursor, err := books.Find(context.TODO(), bson.M{"bookwork": id}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []BookStore
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Builds the response of a work, aggregating the information spread across
+// its editions: from the first to the latest year, all the ISBNs and the
+// languages it was published in.
+func workToMap(books *Repository, w Work) (map[string]interface{}, error) {
+	editions, err := workEditions(books, w.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []map[string]interface{}{}
+	isbns := []string{}
+	langs := []string{}
+	first, latest := 0, 0
+	for _, b := range editions {
+		list = append(list, map[string]interface{}{
+			"id":       b.ID.Hex(),
+			"name":     b.BookName,
+			"isbn":     b.BookISBN,
+			"pages":    b.BookPages,
+			"year":     b.BookYear,
+			"language": b.BookLanguage,
+		})
+		if b.BookLanguage != "" && !slices.Contains(langs, b.BookLanguage) {
+			langs = append(langs, b.BookLanguage)
+		}
+		if b.BookISBN != "" {
+			isbns = append(isbns, b.BookISBN)
+		}
+		if first == 0 || b.BookYear < first {
+			first = b.BookYear
+		}
+		latest = max(latest, b.BookYear)
+	}
+
+	return map[string]interface{}{
+		"id":        w.ID.Hex(),
+		"title":     w.WorkTitle,
+		"author":    w.WorkAuthor,
+		"editions":  list,
+		"isbns":     isbns,
+		"languages": langs,
+		"firstYear": first,
+		"lastYear":  latest,
+		"createdAt": formatTimestamp(w.CreatedAt),
+		"updatedAt": formatTimestamp(w.UpdatedAt),
+	}, nil
+}
+
+func findAllWorks(books *Repository, coll *Repository) ([]map[string]interface{}, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "worktitle", Value: 1}})
+	cursor, err := coll.Find(context.TODO(), bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []Work
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	ret := []map[string]interface{}{}
+	for _, w := range results {
+		m, err := workToMap(books, w)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+// Groups the given books as editions of a single work. If some of them
+// already belonged to works, those works are merged into the first one, so
+// merging is also the way to combine two works that turned out to be the same.
+func mergeEditions(ctx context.Context, books *Repository, coll *Repository, ids []primitive.ObjectID, title string) (Work, error) {
+	cursor, err := books.Find(context.TODO(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return Work{}, err
+	}
+	var editions []BookStore
+	if err = cursor.All(context.TODO(), &editions); err != nil {
+		return Work{}, err
+	}
+	if len(editions) != len(ids) {
+		return Work{}, mongo.ErrNoDocuments
+	}
+
+	var work Work
+	var others []primitive.ObjectID
+	for _, b := range editions {
+		if b.BookWork.IsZero() {
+			continue
+		}
+		if work.ID.IsZero() {
+			if err = coll.FindOne(context.TODO(), bson.M{"_id": b.BookWork}).Decode(&work); err != nil {
+				return Work{}, err
+			}
+		} else if b.BookWork != work.ID {
+			others = append(others, b.BookWork)
+		}
+	}
+	if work.ID.IsZero() {
+		work = Work{ID: primitive.NewObjectID(), WorkTitle: editions[0].BookName, WorkAuthor: editions[0].BookAuthor}
+		if _, err = coll.InsertOne(ctx, work); err != nil {
+			return Work{}, err
+		}
+	}
+	if title != "" && title != work.WorkTitle {
+		work.WorkTitle = title
+		if _, err = coll.UpdateOne(ctx, bson.M{"_id": work.ID}, bson.M{"$set": bson.M{"worktitle": title}}); err != nil {
+			return Work{}, err
+		}
+	}
+
+	// Move the editions of the other works over, then drop the empty works
+	filter := bson.M{"$or": bson.A{bson.M{"_id": bson.M{"$in": ids}}, bson.M{"bookwork": bson.M{"$in": others}}}}
+	if _, err = books.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"bookwork": work.ID}}); err != nil {
+		return Work{}, err
+	}
+	if len(others) > 0 {
+		if _, err = coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": others}}); err != nil {
+			return Work{}, err
+		}
+	}
+	return work, nil
+}
+
+// Parses a list of hex ids, as sent by the forms and API clients.
+func parseObjectIDs(values []string) ([]primitive.ObjectID, bool) {
+	ids := []primitive.ObjectID{}
+	for _, v := range values {
+		id, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+// Registers the endpoints and page to group editions into works.
+func registerWorkRoutes(e *echo.Echo, books *Repository, coll *Repository) {
+	e.GET("/works", func(c echo.Context) error {
+		works, err := findAllWorks(books, coll)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list works"})
+		}
+		// Books outside of any work can be selected to be merged
+		standalone := findAllBooks(books, bson.M{"bookwork": bson.M{"$exists": false}})
+		return c.Render(200, "work-table", map[string]interface{}{
+			"works":      works,
+			"standalone": standalone,
+		})
+	})
+
+	e.GET("/api/works", func(c echo.Context) error {
+		works, err := findAllWorks(books, coll)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list works"})
+		}
+		return c.JSON(http.StatusOK, works)
+	})
+
+	e.GET("/api/works/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		var w Work
+		if err = coll.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&w); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "work not found"})
+		}
+		work, err := workToMap(books, w)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list editions"})
+		}
+		return c.JSON(http.StatusOK, work)
+	})
+
+	e.POST("/api/works/merge", func(c echo.Context) error {
+		var req struct {
+			Books []string `json:"books" form:"books"`
+			Title string   `json:"title" form:"title"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		ids, ok := parseObjectIDs(req.Books)
+		if !ok || len(ids) == 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "books must be a list of book ids"})
+		}
+
+		w, err := mergeEditions(c.Request().Context(), books, coll, ids, strings.TrimSpace(req.Title))
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "book not found"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to merge editions"})
+		}
+		work, err := workToMap(books, w)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list editions"})
+		}
+		return c.JSON(http.StatusOK, work)
+	})
+
+	// Takes the given editions out of the work. A work left without editions
+	// has nothing to group anymore, so it is removed.
+	e.POST("/api/works/:id/split", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+		var req struct {
+			Books []string `json:"books" form:"books"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		ids, ok := parseObjectIDs(req.Books)
+		if !ok || len(ids) == 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "books must be a list of book ids"})
+		}
+
+		result, err := books.UpdateMany(c.Request().Context(), bson.M{"_id": bson.M{"$in": ids}, "bookwork": id}, bson.M{"$unset": bson.M{"bookwork": ""}})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to split editions"})
+		}
+		left, err := books.CountDocuments(context.TODO(), bson.M{"bookwork": id})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to split editions"})
+		}
+		if left == 0 {
+			if _, err = coll.DeleteOne(c.Request().Context(), bson.M{"_id": id}); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete work"})
+			}
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.DELETE("/api/works/:id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		}
+
+		result, err := coll.DeleteOne(c.Request().Context(), bson.M{"_id": id})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to delete work"})
+		}
+		if _, err = books.UpdateMany(c.Request().Context(), bson.M{"bookwork": id}, bson.M{"$unset": bson.M{"bookwork": ""}}); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to detach editions"})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How many books came out in a year, or in a decade
+type yearCount struct {
+	Year  int `bson:"_id"`
+	Count int `bson:"count"`
+}
+
+// Counts the books in circulation by the year they came out, or by decade
+// with decades set, e.g., 1990 for the books of 1990 to 1999. Only the
+// years between from and to (not included) are counted; books of unknown
+// year (0) never are. The database finds them with the "year" index (see
+// indexes.go).
+func countByYear(ctx context.Context, coll *Repository, from int, to int, decades bool) ([]yearCount, error) {
+	group := interface{}("$bookyear")
+	if decades {
+		// The year, less what is left over when dividing by 10
+		group = bson.D{{Key: "$subtract", Value: bson.A{"$bookyear", bson.D{{Key: "$mod", Value: bson.A{"$bookyear", 10}}}}}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: statusFilter(bson.M{"bookyear": bson.M{"$gt": 0, "$gte": from, "$lt": to}}, "")}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: group},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []yearCount
+	err = cursor.All(ctx, &results)
+	return results, err
+}
+
+// Finds the closest years with books before from and from to on, so the
+// pages can link to them. 0 means there is none.
+func adjacentYears(ctx context.Context, coll *Repository, from int, to int) (int, int, error) {
+	before := bson.D{{Key: "$cond", Value: bson.A{bson.D{{Key: "$lt", Value: bson.A{"$bookyear", from}}}, "$bookyear", nil}}}
+	after := bson.D{{Key: "$cond", Value: bson.A{bson.D{{Key: "$gte", Value: bson.A{"$bookyear", to}}}, "$bookyear", nil}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: statusFilter(bson.M{"bookyear": bson.M{"$gt": 0}}, "")}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "prev", Value: bson.D{{Key: "$max", Value: before}}},
+			{Key: "next", Value: bson.D{{Key: "$min", Value: after}}},
+		}}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, 0, err
+	}
+	var results []struct {
+		Prev int `bson:"prev"`
+		Next int `bson:"next"`
+	}
+	if err = cursor.All(ctx, &results); err != nil || len(results) == 0 {
+		return 0, 0, err
+	}
+	return results[0].Prev, results[0].Next, nil
+}
+
+func yearCountsToMaps(counts []yearCount) []map[string]interface{} {
+	ret := []map[string]interface{}{}
+	for _, yc := range counts {
+		ret = append(ret, map[string]interface{}{"year": yc.Year, "count": yc.Count})
+	}
+	return ret
+}
+
+// Registers the pages to browse the books by the year, or the decade, they
+// came out.
+func registerYearRoutes(e *echo.Echo, coll *Repository) {
+	e.GET("/years", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		years, err := countByYear(ctx, coll, 0, math.MaxInt32, false)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count books"})
+		}
+		decades, err := countByYear(ctx, coll, 0, math.MaxInt32, true)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count books"})
+		}
+		return c.Render(http.StatusOK, "year-table", map[string]interface{}{
+			"years":         yearCountsToMaps(years),
+			"decades":       yearCountsToMaps(decades),
+			"exports":       exportLinks("/years/export", nil),
+			"decadeExports": exportLinks("/years/export", url.Values{"by": {"decade"}}),
+		})
+	})
+
+	// Shows the books of the years from to to (not included)
+	period := func(c echo.Context, from int, to int, decade bool) error {
+		ctx := c.Request().Context()
+		prev, next, err := adjacentYears(ctx, coll, from, to)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to find the years around"})
+		}
+		counts, err := countByYear(ctx, coll, from, to, false)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to count books"})
+		}
+		if decade {
+			// Links to the decades rather than the years around
+			prev, next = prev-prev%10, next-next%10
+		}
+
+		opts := options.Find().SetSort(bson.D{{Key: "bookyear", Value: 1}, {Key: "bookname", Value: 1}})
+		books := findAllBooks(coll, statusFilter(bson.M{"bookyear": bson.M{"$gte": from, "$lt": to}}, ""), opts)
+		title := strconv.Itoa(from)
+		if decade {
+			title += "s"
+		}
+		total := 0
+		for _, yc := range counts {
+			total += yc.Count
+		}
+		return c.Render(http.StatusOK, "year-page", map[string]interface{}{
+			"from":   from,
+			"decade": decade,
+			"books":  books,
+			"total":  total,
+			"counts": yearCountsToMaps(counts),
+			"prev":   prev,
+			"next":   next,
+			"title":  title,
+		})
+	}
+
+	e.GET("/years/:year", func(c echo.Context) error {
+		year, err := strconv.Atoi(c.Param("year"))
+		if err != nil || year <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid year"})
+		}
+		return period(c, year, year+1, false)
+	})
+
+	// E.g., /decades/1990, or /decades/1990s
+	e.GET("/decades/:decade", func(c echo.Context) error {
+		decade, err := strconv.Atoi(strings.TrimSuffix(c.Param("decade"), "s"))
+		if err != nil || decade <= 0 || decade%10 != 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid decade, e.g. 1990"})
+		}
+		return period(c, decade, decade+10, true)
+	})
+}
@@ -0,0 +1,91 @@
+// Kept out of the page, so the Content-Security-Policy does not have to allow
+// inline scripts
+document.addEventListener("DOMContentLoaded", (event) => {
+  document.body.addEventListener('htmx:beforeSwap', function (evt) {
+    if (evt.detail.xhr.status === 422) {
+      // allow 422 responses to swap as we are using this as a signal that
+      // a form was submitted with bad data and want to rerender with the
+      // errors
+      //
+      // set isError to false to avoid error logging in console
+      evt.detail.shouldSwap = true;
+      evt.detail.isError = false;
+    } else if (evt.detail.xhr.status >= 400 && (evt.detail.xhr.getResponseHeader('Content-Type') || '').startsWith('text/html')) {
+      // the error pages (see errors.go) show where the page asked for would
+      // have gone
+      evt.detail.shouldSwap = true;
+    }
+  });
+
+  // The buttons printing the page, e.g., on the printable inventory
+  document.querySelectorAll('[data-print]').forEach(function (button) {
+    button.addEventListener('click', function () { window.print(); });
+  });
+
+  // The box ticking all the books of the table for the bulk edit bar. The
+  // table is swapped in later, so the listener is on the body.
+  document.body.addEventListener('change', function (evt) {
+    var form = evt.target.dataset && evt.target.dataset.selectAll;
+    if (!form) {
+      return;
+    }
+    document.querySelectorAll('input[form="' + form + '"][name="ids"]').forEach(function (box) {
+      box.checked = evt.target.checked;
+    });
+  });
+
+  // Dropping a file on the zone of a form picks it, and sends the form
+  document.body.addEventListener('dragover', function (evt) {
+    var form = evt.target.closest && evt.target.closest('[data-drop-zone]');
+    if (form) {
+      evt.preventDefault();
+      form.classList.add('dragging');
+    }
+  });
+  document.body.addEventListener('dragleave', function (evt) {
+    var form = evt.target.closest && evt.target.closest('[data-drop-zone]');
+    if (form) {
+      form.classList.remove('dragging');
+    }
+  });
+  document.body.addEventListener('drop', function (evt) {
+    var form = evt.target.closest && evt.target.closest('[data-drop-zone]');
+    if (!form) {
+      return;
+    }
+    evt.preventDefault();
+    form.classList.remove('dragging');
+    form.querySelector('input[type="file"]').files = evt.dataTransfer.files;
+    htmx.trigger(form, 'submit');
+  });
+
+  // Elements following the events of the server, e.g., the progress of an
+  // import. Every event holds the HTML to show in their place; the last one
+  // is called "done".
+  htmx.onLoad(function (content) {
+    var elements = content.querySelectorAll('[data-events]');
+    if (content.matches && content.matches('[data-events]')) {
+      elements = [content];
+    }
+    elements.forEach(function (element) {
+      var source = new EventSource(element.dataset.events);
+      source.addEventListener('progress', function (evt) {
+        element.innerHTML = evt.data;
+        htmx.process(element);
+      });
+      source.addEventListener('done', function (evt) {
+        source.close();
+        element.innerHTML = evt.data;
+        htmx.process(element);
+      });
+    });
+  });
+
+  // Forms whose buttons send them each somewhere else, e.g., the bulk edit
+  // bar, aren't sent by pressing Enter in one of their fields
+  document.body.addEventListener('submit', function (evt) {
+    if ('buttonsOnly' in evt.target.dataset) {
+      evt.preventDefault();
+    }
+  });
+})